@@ -0,0 +1,590 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"subscription-service/data"
+	"time"
+)
+
+// AdminUsers lists every user, or those whose name or email contains the search term q
+func (app *Config) AdminUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := app.Models.User.GetAll()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, "unable to get users", http.StatusInternalServerError)
+		return
+	}
+
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q != "" {
+		users = searchUsers(users, q)
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["users"] = users
+	dataMap["q"] = q
+	app.render(w, r, "admin-users.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+// searchUsers returns the users whose name or email contains q, ignoring case
+func searchUsers(users []*data.User, q string) []*data.User {
+	q = strings.ToLower(q)
+
+	var found []*data.User
+	for _, u := range users {
+		name := strings.ToLower(fmt.Sprintf("%s %s", u.FirstName, u.LastName))
+		if strings.Contains(name, q) || strings.Contains(strings.ToLower(u.Email), q) {
+			found = append(found, u)
+		}
+	}
+	return found
+}
+
+// AdminUser shows one user with their current subscription, subscription history and
+// invoices
+func (app *Config) AdminUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	current, err := app.Models.Subscription.GetCurrentByUser(user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.ErrorLog.Println(err)
+	}
+
+	subs, err := app.Models.Subscription.GetAllByUser(user.ID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	invoices, err := app.Models.Invoice.GetAllByUser(user.ID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	plans, err := app.Models.Plan.GetAll()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	// an archived plan is only offered to a user already on it
+	var available []*data.Plan
+	for _, plan := range plans {
+		if !plan.Archived || (current != nil && current.PlanID == plan.ID) {
+			available = append(available, plan)
+		}
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["user"] = user
+	dataMap["subscription"] = current
+	dataMap["subscriptions"] = subs
+	dataMap["invoices"] = invoices
+	dataMap["plans"] = available
+	app.render(w, r, "admin-user.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+// AdminActivateUser lets a user log in again
+func (app *Config) AdminActivateUser(w http.ResponseWriter, r *http.Request) {
+	app.setUserActive(w, r, 1)
+}
+
+// AdminDeactivateUser stops a user from logging in and logs them out. Their subscription
+// is left alone.
+func (app *Config) AdminDeactivateUser(w http.ResponseWriter, r *http.Request) {
+	app.setUserActive(w, r, 0)
+}
+
+// setUserActive activates or deactivates the user in the URL. Administrators cannot
+// deactivate themselves.
+func (app *Config) setUserActive(w http.ResponseWriter, r *http.Request, active int) {
+	user, ok := app.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	back := fmt.Sprintf("/admin/users/%d", user.ID)
+
+	if active == 0 && user.ID == app.Session.GetInt(r.Context(), "userId") {
+		app.Session.Put(r.Context(), "error", app.T(r, "You cannot deactivate your own account"))
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	user.Active = active
+	err := app.Models.User.Update(*user)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to update user"))
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	// a deactivated user is logged out everywhere
+	if active == 0 {
+		err = app.destroyUserSessions(r.Context(), user.ID)
+		if err != nil {
+			app.ErrorLog.Println(err)
+			app.Session.Put(r.Context(), "error", app.T(r, "Unable to log the user out"))
+			http.Redirect(w, r, back, http.StatusSeeOther)
+			return
+		}
+	}
+
+	if active == 1 {
+		app.Session.Put(r.Context(), "flash", app.T(r, "User activated"))
+	} else {
+		app.Session.Put(r.Context(), "flash", app.T(r, "User deactivated"))
+	}
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// AdminVerifyTaxID records that the tax ID of the user in the URL has been checked, e.g.
+// in the EU's VIES service, so that tax is reverse charged on it
+func (app *Config) AdminVerifyTaxID(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	back := fmt.Sprintf("/admin/users/%d", user.ID)
+
+	if user.TaxID == "" {
+		app.Session.Put(r.Context(), "error", app.T(r, "The user has no tax ID"))
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	user.TaxIDVerified = true
+	err := app.Models.User.UpdateBillingDetails(*user)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to update user"))
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", app.T(r, "Tax ID verified"))
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// AdminChangePlan moves the user in the URL to another plan straight away, or subscribes
+// them if they have no subscription. Changes made by support are not invoiced, but the
+// usage on the old plan up to the change is.
+func (app *Config) AdminChangePlan(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, ok := app.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	back := fmt.Sprintf("/admin/users/%d", user.ID)
+
+	planID, _ := strconv.Atoi(r.Form.Get("plan_id"))
+	plan, err := app.Models.Plan.GetOne(planID)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to find plan"))
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	current, err := app.Models.Subscription.GetCurrentByUser(user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to change plan"))
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	if plan.Archived && (current == nil || current.PlanID != plan.ID) {
+		app.Session.Put(r.Context(), "error", app.T(r, "That plan is no longer available"))
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	switch {
+	case current == nil:
+		_, err = app.Models.Subscription.Subscribe(*user, *plan.InCurrency(user.Currency))
+	case current.PlanID == plan.ID:
+		app.Session.Put(r.Context(), "warning", app.T(r, "The user is already on the %s", plan.PlanName))
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	default:
+		_, err = app.Models.Subscription.ChangePlan(*current, *plan.InCurrency(current.Currency), data.ChangeImmediately)
+	}
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to change plan"))
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	if current != nil {
+		err = app.invoiceFinalUsage(current, time.Now())
+		if err != nil {
+			app.ErrorLog.Println(err)
+		}
+	}
+
+	app.Session.Put(r.Context(), "flash", app.T(r, "Plan changed to %s", plan.PlanName))
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// AdminDeleteUser deletes the user in the URL, together with their subscriptions. A user
+// who has been invoiced cannot be deleted, as the invoices are kept; they can be
+// deactivated instead. Administrators cannot delete themselves.
+func (app *Config) AdminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.ID == app.Session.GetInt(r.Context(), "userId") {
+		app.Session.Put(r.Context(), "error", app.T(r, "You cannot delete your own account"))
+		http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusSeeOther)
+		return
+	}
+
+	err := app.Models.User.DeleteByID(user.ID)
+	if errors.Is(err, data.ErrUserHasInvoices) {
+		app.Session.Put(r.Context(), "error", app.T(r, "%s has invoices, which are kept, so they cannot be deleted. Deactivate them instead.", user.Email))
+		http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to delete user"))
+		http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", app.T(r, "User %s deleted", user.Email))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// adminTargetUser loads the user whose id is in the URL. If there is no such user it
+// answers with a not found page and returns false.
+func (app *Config) adminTargetUser(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return nil, false
+	}
+
+	user, err := app.Models.User.GetOne(id)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			app.ErrorLog.Println(err)
+		}
+		http.NotFound(w, r)
+		return nil, false
+	}
+
+	return user, true
+}
+
+// AdminPlans lists every plan, archived ones included
+func (app *Config) AdminPlans(w http.ResponseWriter, r *http.Request) {
+	plans, err := app.Models.Plan.GetAll()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, "unable to get plans", http.StatusInternalServerError)
+		return
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["plans"] = plans
+	app.render(w, r, "admin-plans.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+// AdminNewPlan shows an empty plan form
+func (app *Config) AdminNewPlan(w http.ResponseWriter, r *http.Request) {
+	app.renderPlanForm(w, r, &data.Plan{
+		Currency:      data.DefaultCurrency,
+		Interval:      data.IntervalMonth,
+		IntervalCount: 1,
+	})
+}
+
+// AdminCreatePlan adds a plan to the catalogue
+func (app *Config) AdminCreatePlan(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	plan, msg := planFromForm(r.Form, app.locale(r))
+	if msg != "" {
+		app.Session.Put(r.Context(), "error", msg)
+		http.Redirect(w, r, "/admin/plans/new", http.StatusSeeOther)
+		return
+	}
+
+	id, err := app.Models.Plan.Insert(plan)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to create plan"))
+		http.Redirect(w, r, "/admin/plans/new", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", app.T(r, "%s created", plan.PlanName))
+	http.Redirect(w, r, fmt.Sprintf("/admin/plans/%d", id), http.StatusSeeOther)
+}
+
+// AdminPlan shows the form to edit the plan in the URL
+func (app *Config) AdminPlan(w http.ResponseWriter, r *http.Request) {
+	plan, ok := app.adminTargetPlan(w, r)
+	if !ok {
+		return
+	}
+
+	app.renderPlanForm(w, r, plan)
+}
+
+// AdminUpdatePlan saves the plan in the URL. Members already on it are charged the new
+// price from their next renewal.
+func (app *Config) AdminUpdatePlan(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	current, ok := app.adminTargetPlan(w, r)
+	if !ok {
+		return
+	}
+
+	back := fmt.Sprintf("/admin/plans/%d", current.ID)
+
+	plan, msg := planFromForm(r.Form, app.locale(r))
+	if msg != "" {
+		app.Session.Put(r.Context(), "error", msg)
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+	plan.ID = current.ID
+
+	err = app.Models.Plan.Update(plan)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to update plan"))
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", app.T(r, "%s updated", plan.PlanName))
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// AdminArchivePlan retires the plan in the URL. Members on it keep it, but nobody can
+// choose it any more.
+func (app *Config) AdminArchivePlan(w http.ResponseWriter, r *http.Request) {
+	plan, ok := app.adminTargetPlan(w, r)
+	if !ok {
+		return
+	}
+
+	if plan.Archived {
+		app.Session.Put(r.Context(), "warning", app.T(r, "The %s is already archived", plan.PlanName))
+		http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+		return
+	}
+
+	err := app.Models.Plan.Archive(plan.ID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to archive plan"))
+		http.Redirect(w, r, fmt.Sprintf("/admin/plans/%d", plan.ID), http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", app.T(r, "%s archived", plan.PlanName))
+	http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+}
+
+// renderPlanForm shows the form to create or edit plan, with its prices written out in
+// major units
+func (app *Config) renderPlanForm(w http.ResponseWriter, r *http.Request, plan *data.Plan) {
+	prices := make(map[string]string)
+	for _, price := range plan.Prices {
+		prices[price.Currency] = data.GetCurrency(price.Currency).Number(price.Amount)
+	}
+
+	amount := ""
+	if plan.ID != 0 {
+		amount = data.GetCurrency(plan.Currency).Number(plan.PlanAmount)
+	}
+
+	var features []string
+	for _, f := range plan.Features {
+		value := "true"
+		if f.Limit != nil {
+			value = strconv.Itoa(*f.Limit)
+		}
+		features = append(features, fmt.Sprintf("%s: %s", f.Feature, value))
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["plan"] = plan
+	dataMap["amount"] = amount
+	dataMap["features"] = strings.Join(features, "\n")
+	dataMap["prices"] = prices
+	dataMap["currencies"] = data.SupportedCurrencies()
+	dataMap["intervals"] = data.Intervals
+	app.render(w, r, "admin-plan.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+// planFromForm reads a plan from the plan form. A price in another currency is only set
+// when it is filled in. If the form is not valid it returns a message saying why, in
+// locale.
+func planFromForm(form url.Values, locale string) (data.Plan, string) {
+	plan := data.Plan{
+		PlanName: strings.TrimSpace(form.Get("plan_name")),
+		Currency: form.Get("currency"),
+		Interval: form.Get("interval"),
+		PerSeat:  form.Get("per_seat") != "",
+	}
+
+	if plan.PlanName == "" {
+		return plan, translate(locale, "Enter a name for the plan")
+	}
+
+	if !data.IsSupportedCurrency(plan.Currency) {
+		return plan, translate(locale, "Unsupported currency")
+	}
+
+	if !slices.Contains(data.Intervals, plan.Interval) {
+		return plan, translate(locale, "Choose how often the plan is billed")
+	}
+
+	var err error
+	plan.IntervalCount, err = strconv.Atoi(form.Get("interval_count"))
+	if err != nil || plan.IntervalCount < 1 {
+		return plan, translate(locale, "Enter how many intervals there are between payments, at least 1")
+	}
+
+	plan.TrialDays, err = strconv.Atoi(form.Get("trial_days"))
+	if err != nil || plan.TrialDays < 0 {
+		return plan, translate(locale, "Enter the number of free trial days, or 0 for none")
+	}
+
+	plan.PlanAmount, err = data.GetCurrency(plan.Currency).ParseAmount(form.Get("amount"))
+	if err != nil {
+		return plan, translate(locale, "Enter a valid price in %s", plan.Currency)
+	}
+
+	for _, code := range data.SupportedCurrencies() {
+		value := strings.TrimSpace(form.Get("price_" + code))
+		if code == plan.Currency || value == "" {
+			continue
+		}
+
+		amount, err := data.GetCurrency(code).ParseAmount(value)
+		if err != nil {
+			return plan, translate(locale, "Enter a valid price in %s", code)
+		}
+		plan.Prices = append(plan.Prices, &data.PlanPrice{Currency: code, Amount: amount})
+	}
+
+	var msg string
+	plan.Features, msg = parseFeatures(form.Get("features"), locale)
+	if msg != "" {
+		return plan, msg
+	}
+
+	return plan, ""
+}
+
+// featurePattern matches the name of a plan feature, e.g. "api_calls"
+var featurePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,49}$`)
+
+// parseFeatures reads the features of a plan written one per line as "name: value",
+// e.g. "api_calls: 10000". A value of "true" or "unlimited" includes the feature without
+// a limit. If the text is not valid it returns a message saying why, in locale.
+func parseFeatures(text, locale string) ([]*data.PlanFeature, string) {
+	var features []*data.PlanFeature
+	seen := make(map[string]bool)
+
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		name, value, _ := strings.Cut(line, ":")
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.ToLower(strings.TrimSpace(value))
+
+		if !featurePattern.MatchString(name) {
+			return nil, translate(locale, "%q is not a valid feature name; use lowercase letters, digits and underscores", name)
+		}
+		if seen[name] {
+			return nil, translate(locale, "The feature %s is listed twice", name)
+		}
+		seen[name] = true
+
+		feature := &data.PlanFeature{Feature: name}
+		switch value {
+		case "true", "unlimited":
+		default:
+			limit, err := strconv.Atoi(value)
+			if err != nil || limit < 0 {
+				return nil, translate(locale, "Enter a limit, true or unlimited for the feature %s", name)
+			}
+			feature.Limit = &limit
+		}
+		features = append(features, feature)
+	}
+
+	return features, ""
+}
+
+// adminTargetPlan loads the plan whose id is in the URL. If there is no such plan it
+// answers with a not found page and returns false.
+func (app *Config) adminTargetPlan(w http.ResponseWriter, r *http.Request) (*data.Plan, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return nil, false
+	}
+
+	plan, err := app.Models.Plan.GetOne(id)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			app.ErrorLog.Println(err)
+		}
+		http.NotFound(w, r)
+		return nil, false
+	}
+
+	return plan, true
+}
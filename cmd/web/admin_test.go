@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"subscription-service/data"
+	"testing"
+)
+
+func TestConfig_Admin(t *testing.T) {
+	tests := []struct {
+		name             string
+		userID           int
+		expectedCode     int
+		expectedLocation string
+	}{
+		{"admin", 1, http.StatusOK, ""},
+		{"member", 2, http.StatusSeeOther, "/"},
+		{"logged out", 0, http.StatusSeeOther, "/login"},
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, e := range tests {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/admin/users", nil)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		if e.userID != 0 {
+			testApp.Session.Put(ctx, "userId", e.userID)
+		}
+
+		testApp.Admin(next).ServeHTTP(rw, req)
+
+		if rw.Code != e.expectedCode {
+			t.Errorf("%s: expected status code %d but got %d", e.name, e.expectedCode, rw.Code)
+		}
+
+		if location := rw.Header().Get("Location"); location != e.expectedLocation {
+			t.Errorf("%s: expected redirect to %q but got %q", e.name, e.expectedLocation, location)
+		}
+	}
+}
+
+func Test_searchUsers(t *testing.T) {
+	users := []*data.User{
+		{ID: 1, FirstName: "Jane", LastName: "Doe", Email: "jane@example.com"},
+		{ID: 2, FirstName: "John", LastName: "Smith", Email: "js@example.org"},
+	}
+
+	tests := []struct {
+		q           string
+		expectedIDs []int
+	}{
+		{"jane", []int{1}},
+		{"JOHN SMITH", []int{2}},
+		{"example.org", []int{2}},
+		{"example", []int{1, 2}},
+		{"nobody", nil},
+	}
+
+	for _, e := range tests {
+		found := searchUsers(users, e.q)
+		if len(found) != len(e.expectedIDs) {
+			t.Errorf("%q: expected %d users but got %d", e.q, len(e.expectedIDs), len(found))
+			continue
+		}
+		for i, u := range found {
+			if u.ID != e.expectedIDs[i] {
+				t.Errorf("%q: expected user %d but got %d", e.q, e.expectedIDs[i], u.ID)
+			}
+		}
+	}
+}
+
+var adminTests = []struct {
+	name             string
+	method           string
+	url              string
+	id               string
+	form             url.Values
+	handler          http.HandlerFunc
+	expectedCode     int
+	expectedHTML     string
+	expectedKey      string
+	expectedMessage  string
+	expectedLocation string
+}{
+	{"users", "GET", "/admin/users?q=admin", "", nil, testApp.AdminUsers, http.StatusOK, `<td>admin@example.com</td>`, "", "", ""},
+	{"user", "GET", "/admin/users/2", "2", nil, testApp.AdminUser, http.StatusOK, `<dd class="col-sm-9">member@example.com</dd>`, "", "", ""},
+	{"unknown user", "GET", "/admin/users/x", "x", nil, testApp.AdminUser, http.StatusNotFound, "", "", "", ""},
+	{"deactivate", "POST", "/admin/users/2/deactivate", "2", nil, testApp.AdminDeactivateUser, http.StatusSeeOther, "", "flash", "User deactivated", "/admin/users/2"},
+	{"deactivate self", "POST", "/admin/users/1/deactivate", "1", nil, testApp.AdminDeactivateUser, http.StatusSeeOther, "", "error", "You cannot deactivate your own account", "/admin/users/1"},
+	{"activate", "POST", "/admin/users/2/activate", "2", nil, testApp.AdminActivateUser, http.StatusSeeOther, "", "flash", "User activated", "/admin/users/2"},
+	{"verify tax id", "POST", "/admin/users/8/tax-id/verify", "8", nil, testApp.AdminVerifyTaxID, http.StatusSeeOther, "", "flash", "Tax ID verified", "/admin/users/8"},
+	{"verify missing tax id", "POST", "/admin/users/2/tax-id/verify", "2", nil, testApp.AdminVerifyTaxID, http.StatusSeeOther, "", "error", "The user has no tax ID", "/admin/users/2"},
+	{"change plan", "POST", "/admin/users/8/plan", "8", url.Values{"plan_id": {"2"}}, testApp.AdminChangePlan, http.StatusSeeOther, "", "flash", "Plan changed to Silver Plan", "/admin/users/8"},
+	{"same plan", "POST", "/admin/users/8/plan", "8", url.Values{"plan_id": {"1"}}, testApp.AdminChangePlan, http.StatusSeeOther, "", "warning", "The user is already on the Bronze Plan", "/admin/users/8"},
+	{"delete", "POST", "/admin/users/2/delete", "2", nil, testApp.AdminDeleteUser, http.StatusSeeOther, "", "flash", "User member@example.com deleted", "/admin/users"},
+	{"delete invoiced user", "POST", "/admin/users/5/delete", "5", nil, testApp.AdminDeleteUser, http.StatusSeeOther, "", "error", "member@example.com has invoices, which are kept, so they cannot be deleted. Deactivate them instead.", "/admin/users/5"},
+	{"delete self", "POST", "/admin/users/1/delete", "1", nil, testApp.AdminDeleteUser, http.StatusSeeOther, "", "error", "You cannot delete your own account", "/admin/users/1"},
+	{"change to archived plan", "POST", "/admin/users/2/plan", "2", url.Values{"plan_id": {"9"}}, testApp.AdminChangePlan, http.StatusSeeOther, "", "error", "That plan is no longer available", "/admin/users/2"},
+	{"plans", "GET", "/admin/plans", "", nil, testApp.AdminPlans, http.StatusOK, `<td class="text-center">Archived</td>`, "", "", ""},
+	{"new plan", "GET", "/admin/plans/new", "", nil, testApp.AdminNewPlan, http.StatusOK, `<h1 class="mt-5">New Plan</h1>`, "", "", ""},
+	{"plan", "GET", "/admin/plans/2", "2", nil, testApp.AdminPlan, http.StatusOK, `value="20.00"`, "", "", ""},
+	{"plan features", "GET", "/admin/plans/2", "2", nil, testApp.AdminPlan, http.StatusOK, "api_calls: 10000\npriority_support: true\nseats: 5</textarea>", "", "", ""},
+	{"unknown plan", "GET", "/admin/plans/x", "x", nil, testApp.AdminPlan, http.StatusNotFound, "", "", "", ""},
+	{"create plan", "POST", "/admin/plans", "", planForm("Gold Plan", "30"), testApp.AdminCreatePlan, http.StatusSeeOther, "", "flash", "Gold Plan created", "/admin/plans/4"},
+	{"create invalid plan", "POST", "/admin/plans", "", planForm("", "30"), testApp.AdminCreatePlan, http.StatusSeeOther, "", "error", "Enter a name for the plan", "/admin/plans/new"},
+	{"update plan", "POST", "/admin/plans/2", "2", planForm("Silver Plan", "25.00"), testApp.AdminUpdatePlan, http.StatusSeeOther, "", "flash", "Silver Plan updated", "/admin/plans/2"},
+	{"update invalid plan", "POST", "/admin/plans/2", "2", planForm("Silver Plan", "25.001"), testApp.AdminUpdatePlan, http.StatusSeeOther, "", "error", "Enter a valid price in USD", "/admin/plans/2"},
+	{"archive plan", "POST", "/admin/plans/2/archive", "2", nil, testApp.AdminArchivePlan, http.StatusSeeOther, "", "flash", "Silver Plan archived", "/admin/plans"},
+	{"archive archived plan", "POST", "/admin/plans/9/archive", "9", nil, testApp.AdminArchivePlan, http.StatusSeeOther, "", "warning", "The Legacy Plan is already archived", "/admin/plans"},
+}
+
+func TestConfig_adminHandlers(t *testing.T) {
+	templatesPath = "./templates"
+
+	for _, e := range adminTests {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest(e.method, e.url, strings.NewReader(e.form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		chiCtx := chi.NewRouteContext()
+		chiCtx.URLParams.Add("id", e.id)
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		testApp.Session.Put(ctx, "userId", 1)
+		testApp.Session.Put(ctx, "user", data.User{ID: 1, IsAdmin: 1})
+
+		e.handler.ServeHTTP(rw, req)
+
+		if rw.Code != e.expectedCode {
+			t.Errorf("%s: expected status code %d but got %d", e.name, e.expectedCode, rw.Code)
+		}
+
+		if e.expectedHTML != "" && !strings.Contains(rw.Body.String(), e.expectedHTML) {
+			t.Errorf("%s: did not find %s", e.name, e.expectedHTML)
+		}
+
+		if e.expectedKey != "" {
+			if msg := testApp.Session.PopString(ctx, e.expectedKey); msg != e.expectedMessage {
+				t.Errorf("%s: expected %s %q but got %q", e.name, e.expectedKey, e.expectedMessage, msg)
+			}
+		}
+
+		if location := rw.Header().Get("Location"); location != e.expectedLocation {
+			t.Errorf("%s: expected redirect to %q but got %q", e.name, e.expectedLocation, location)
+		}
+	}
+}
+
+// planForm returns a valid plan form for a monthly plan in USD
+func planForm(name, amount string) url.Values {
+	return url.Values{
+		"plan_name":      {name},
+		"amount":         {amount},
+		"currency":       {"USD"},
+		"interval":       {"month"},
+		"interval_count": {"1"},
+		"trial_days":     {"0"},
+	}
+}
+
+func Test_planFromForm(t *testing.T) {
+	tests := []struct {
+		name            string
+		change          map[string]string
+		expectedAmount  int
+		expectedPrices  map[string]int
+		expectedMessage string
+	}{
+		{"valid", nil, 1250, map[string]int{}, ""},
+		{"whole amount", map[string]string{"amount": "12"}, 1200, map[string]int{}, ""},
+		{"other prices", map[string]string{"price_EUR": "11.5", "price_JPY": "1800"}, 1250, map[string]int{"EUR": 1150, "JPY": 1800}, ""},
+		{"base currency price ignored", map[string]string{"price_USD": "99"}, 1250, map[string]int{}, ""},
+		{"no name", map[string]string{"plan_name": " "}, 0, nil, "Enter a name for the plan"},
+		{"bad currency", map[string]string{"currency": "XXX"}, 0, nil, "Unsupported currency"},
+		{"bad interval", map[string]string{"interval": "fortnight"}, 0, nil, "Choose how often the plan is billed"},
+		{"no interval count", map[string]string{"interval_count": "0"}, 0, nil, "Enter how many intervals there are between payments, at least 1"},
+		{"negative trial", map[string]string{"trial_days": "-1"}, 0, nil, "Enter the number of free trial days, or 0 for none"},
+		{"negative amount", map[string]string{"amount": "-5"}, 0, nil, "Enter a valid price in USD"},
+		{"too many decimals", map[string]string{"amount": "1.234"}, 0, nil, "Enter a valid price in USD"},
+		{"decimals in yen", map[string]string{"price_JPY": "1800.5"}, 0, nil, "Enter a valid price in JPY"},
+		{"bad feature", map[string]string{"features": "seats: many"}, 0, nil, "Enter a limit, true or unlimited for the feature seats"},
+	}
+
+	for _, e := range tests {
+		form := planForm("Gold Plan", "12.50")
+		for k, v := range e.change {
+			form.Set(k, v)
+		}
+
+		plan, msg := planFromForm(form, DefaultLocale)
+		if msg != e.expectedMessage {
+			t.Errorf("%s: expected message %q but got %q", e.name, e.expectedMessage, msg)
+			continue
+		}
+		if msg != "" {
+			continue
+		}
+
+		if plan.PlanAmount != e.expectedAmount {
+			t.Errorf("%s: expected amount %d but got %d", e.name, e.expectedAmount, plan.PlanAmount)
+		}
+
+		if len(plan.Prices) != len(e.expectedPrices) {
+			t.Errorf("%s: expected %d prices but got %d", e.name, len(e.expectedPrices), len(plan.Prices))
+		}
+		for _, price := range plan.Prices {
+			if price.Amount != e.expectedPrices[price.Currency] {
+				t.Errorf("%s: expected %s price %d but got %d", e.name, price.Currency, e.expectedPrices[price.Currency], price.Amount)
+			}
+		}
+	}
+
+	// the message is in the administrator's language
+	if _, msg := planFromForm(planForm("", "30"), "de"); msg != "Geben Sie einen Namen für den Tarif ein" {
+		t.Errorf("expected the message in German but got %q", msg)
+	}
+}
+
+func Test_parseFeatures(t *testing.T) {
+	tests := []struct {
+		name            string
+		text            string
+		expected        map[string]int
+		expectedMessage string
+	}{
+		{"none", "", map[string]int{}, ""},
+		{"limits", "api_calls: 10000\r\n\r\nSeats: 5\n", map[string]int{"api_calls": 10000, "seats": 5}, ""},
+		{"switched on", "priority_support: true\napi_calls: unlimited", map[string]int{"priority_support": data.Unlimited, "api_calls": data.Unlimited}, ""},
+		{"zero", "seats: 0", map[string]int{"seats": 0}, ""},
+		{"bad name", "api calls: 5", nil, `"api calls" is not a valid feature name; use lowercase letters, digits and underscores`},
+		{"twice", "seats: 1\nseats: 2", nil, "The feature seats is listed twice"},
+		{"no value", "seats", nil, "Enter a limit, true or unlimited for the feature seats"},
+		{"negative", "seats: -1", nil, "Enter a limit, true or unlimited for the feature seats"},
+	}
+
+	for _, e := range tests {
+		features, msg := parseFeatures(e.text, DefaultLocale)
+		if msg != e.expectedMessage {
+			t.Errorf("%s: expected message %q but got %q", e.name, e.expectedMessage, msg)
+			continue
+		}
+
+		if len(features) != len(e.expected) {
+			t.Errorf("%s: expected %d features but got %d", e.name, len(e.expected), len(features))
+		}
+		for _, f := range features {
+			limit := data.Unlimited
+			if f.Limit != nil {
+				limit = *f.Limit
+			}
+			expected, ok := e.expected[f.Feature]
+			if !ok || limit != expected {
+				t.Errorf("%s: did not expect %s with limit %d", e.name, f.Feature, limit)
+			}
+		}
+	}
+}
+
+func TestConfig_AdminDeactivateUser_logsOut(t *testing.T) {
+	member, _ := testApp.Session.Load(context.Background(), "")
+	testApp.Session.Put(member, "userId", 2)
+	token, _, err := testApp.Session.Commit(member)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/admin/users/2/deactivate", nil)
+	chiCtx := chi.NewRouteContext()
+	chiCtx.URLParams.Add("id", "2")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	testApp.Session.Put(ctx, "userId", 1)
+
+	testApp.AdminDeactivateUser(rw, req)
+
+	if _, found, _ := testApp.Session.Store.Find(token); found {
+		t.Error("expected the session of the deactivated user to be destroyed")
+	}
+}
+
+func TestConfig_AdminChangePlan_usage(t *testing.T) {
+	sentMail()
+
+	form := url.Values{"plan_id": {"2"}}
+	req, _ := http.NewRequest("POST", "/admin/users/1/plan", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	chiCtx := chi.NewRouteContext()
+	chiCtx.URLParams.Add("id", "1")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	testApp.Session.Put(ctx, "userId", 1)
+
+	testApp.AdminChangePlan(httptest.NewRecorder(), req)
+
+	// the change itself is free, but the usage on the old plan is not
+	sent := sentMail()
+	if len(sent) != 1 || sent[0].Subject != "Your Invoice Data" {
+		t.Errorf("expected the usage up to the change to be invoiced but got %d emails", len(sent))
+	}
+}
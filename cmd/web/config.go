@@ -16,6 +16,9 @@ type Config struct {
 	Wait          *sync.WaitGroup
 	Models        data.Models
 	Mailer        Mail
+	Payments      PaymentProvider
+	Tax           TaxCalculator
 	ErrorChan     chan error
 	ErrorChanDone chan bool
+	RenewalDone   chan bool
 }
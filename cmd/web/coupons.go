@@ -0,0 +1,117 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"subscription-service/data"
+	"time"
+)
+
+// couponMessages tell the member why the promotion code they entered was not accepted
+var couponMessages = map[error]string{
+	data.ErrCouponNotFound:  "That promotion code is not valid",
+	data.ErrCouponExpired:   "That promotion code has expired",
+	data.ErrCouponExhausted: "That promotion code is no longer available",
+	data.ErrCouponPlan:      "That promotion code does not apply to this plan",
+	data.ErrCouponCurrency:  "That promotion code does not apply to payments in this currency",
+	data.ErrCouponRedeemed:  "You have already used that promotion code",
+}
+
+// couponMessage returns the message for a coupon that cannot be redeemed, and whether
+// err is such a reason at all
+func couponMessage(err error) (string, bool) {
+	for reason, msg := range couponMessages {
+		if errors.Is(err, reason) {
+			return msg, true
+		}
+	}
+	return "", false
+}
+
+// findCoupon looks up the coupon with the given code and checks that user can redeem it
+// on a subscription to plan
+func (app *Config) findCoupon(code string, user data.User, plan *data.Plan) (*data.Coupon, error) {
+	coupon, err := app.Models.Coupon.GetByCode(code)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, data.ErrCouponNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = coupon.Check(plan.ID, plan.Currency, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	redeemed, err := app.Models.Coupon.HasRedeemed(coupon.ID, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if redeemed {
+		return nil, data.ErrCouponRedeemed
+	}
+
+	return coupon, nil
+}
+
+// activeRedemption returns the coupon redemption that still discounts the invoices of
+// a user, if there is one and its coupon applies to planID
+func (app *Config) activeRedemption(userID, planID int) (*data.CouponRedemption, error) {
+	redemption, err := app.Models.Coupon.GetActiveRedemption(userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !redemption.Coupon.Continues(redemption.PeriodsApplied) || !redemption.Coupon.AppliesTo(planID) {
+		return nil, nil
+	}
+
+	return redemption, nil
+}
+
+// discountInvoice adds a line taking the coupon's discount off the invoice, written in
+// locale. An amount off in another currency than the invoice's is not applied.
+func discountInvoice(invoice *data.Invoice, coupon *data.Coupon, locale string) {
+	if coupon.AmountOff > 0 && coupon.Currency != invoice.Currency {
+		return
+	}
+
+	discount := coupon.Discount(invoice.Subtotal)
+	if discount == 0 {
+		return
+	}
+
+	off := formatMoney(locale, coupon.AmountOff, coupon.Currency)
+	if coupon.PercentOff > 0 {
+		off = strconv.Itoa(coupon.PercentOff) + "%"
+	}
+	invoice.AddLine(data.LineDiscount, translate(locale, "Discount %s (%s off)", coupon.Code, off), 1, -discount)
+}
+
+// redeemCoupon records that user redeemed coupon for a period that is not billed yet,
+// such as a free trial, so that it discounts the invoice when it is. It returns the id of
+// the redemption, to be released if the subscription cannot be changed after all.
+func (app *Config) redeemCoupon(coupon *data.Coupon, user data.User) (int, error) {
+	return app.Models.Coupon.Redeem(data.CouponRedemption{
+		CouponID: coupon.ID,
+		UserID:   user.ID,
+	})
+}
+
+// releaseRedemption gives back a redemption whose invoice was never paid. An id of 0
+// means no coupon was redeemed.
+func (app *Config) releaseRedemption(id int) {
+	if id == 0 {
+		return
+	}
+
+	err := app.Models.Coupon.ReleaseRedemption(id)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"subscription-service/data"
+	"testing"
+)
+
+func Test_discountInvoice(t *testing.T) {
+	tests := []struct {
+		name             string
+		coupon           data.Coupon
+		currency         string
+		expectedDiscount int
+	}{
+		{"percent off", data.Coupon{Code: "WELCOME20", PercentOff: 20}, "USD", 400},
+		{"amount off", data.Coupon{Code: "SAVE5", AmountOff: 500, Currency: "USD"}, "USD", 500},
+		{"amount off more than the total", data.Coupon{Code: "BIG", AmountOff: 5000, Currency: "USD"}, "USD", 2000},
+		{"amount off in another currency", data.Coupon{Code: "SAVE5", AmountOff: 500, Currency: "USD"}, "EUR", 0},
+	}
+
+	for _, e := range tests {
+		invoice := data.Invoice{Currency: e.currency}
+		invoice.AddLine(data.LineItem, "Silver Plan", 1, 2000)
+
+		discountInvoice(&invoice, &e.coupon, DefaultLocale)
+
+		if discount := 2000 - invoice.Total; discount != e.expectedDiscount {
+			t.Errorf("%s: expected a discount of %d but got %d", e.name, e.expectedDiscount, discount)
+		}
+
+		if e.expectedDiscount > 0 && invoice.Lines[len(invoice.Lines)-1].Kind != data.LineDiscount {
+			t.Errorf("%s: expected a discount line", e.name)
+		}
+	}
+}
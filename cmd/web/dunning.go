@@ -0,0 +1,229 @@
+package main
+
+import (
+	"subscription-service/data"
+	"time"
+)
+
+// dunningRetryDays are the days, counted from the first failed renewal charge, on which a
+// past due subscription is charged again
+var dunningRetryDays = []int{1, 3, 7}
+
+// dunningDowngradePlanID is the plan a subscription moves to once its last retry has
+// failed. The move is not invoiced, since the member's payment method has just failed
+// every retry, so it is only made to a plan that is free in the subscription's currency.
+// With 0, or a plan that is not free, the subscription is canceled instead.
+var dunningDowngradePlanID = 0
+
+// pastDueWarning is shown on every page to a member whose subscription is past due
+const pastDueWarning = "Your last payment failed. Please update your payment method to keep your subscription."
+
+// retryPastDuePayments charges every past due subscription whose next attempt is due
+func (app *Config) retryPastDuePayments() {
+	app.Wait.Add(1)
+	defer app.Wait.Done()
+
+	subs, err := app.Models.Subscription.GetDueForPaymentRetry(time.Now())
+	if err != nil {
+		app.ErrorChan <- err
+		return
+	}
+
+	for _, sub := range subs {
+		if err := app.retryPayment(sub); err != nil {
+			app.ErrorChan <- err
+		}
+	}
+}
+
+// retryPayment charges the open invoice of a past due subscription again, and moves
+// on to the next step of the dunning schedule if that fails too
+func (app *Config) retryPayment(sub *data.Subscription) error {
+	user, err := app.Models.User.GetOne(sub.UserID)
+	if err != nil {
+		return err
+	}
+
+	invoice, err := app.Models.Invoice.GetOpenBySubscription(sub.ID)
+	if err != nil {
+		return err
+	}
+
+	err = app.collectPastDue(*user, sub, invoice)
+	if !isPaymentError(err) {
+		return err
+	}
+
+	sub.PaymentAttempts++
+	return app.dunningFailed(*user, sub, invoice)
+}
+
+// startDunning puts sub past due after the charge for invoice failed, schedules the
+// first retry and tells the member
+func (app *Config) startDunning(user data.User, sub *data.Subscription, invoice *data.Invoice) error {
+	now := time.Now()
+	sub.Status = data.SubscriptionPastDue
+	sub.PastDueSince = &now
+	sub.PaymentAttempts = 1
+	return app.dunningFailed(user, sub, invoice)
+}
+
+// dunningFailed schedules the next retry of a past due subscription and emails the
+// member, more urgently as retries run out. When none are left it gives up.
+func (app *Config) dunningFailed(user data.User, sub *data.Subscription, invoice *data.Invoice) error {
+	retry := sub.PaymentAttempts - 1
+	if retry >= len(dunningRetryDays) {
+		return app.endDunning(user, sub, invoice)
+	}
+
+	if sub.PastDueSince == nil {
+		now := time.Now()
+		sub.PastDueSince = &now
+	}
+	next := sub.PastDueSince.AddDate(0, 0, dunningRetryDays[retry])
+	sub.NextPaymentAttemptAt = &next
+
+	err := app.Models.Subscription.Update(*sub)
+	if err != nil {
+		return err
+	}
+
+	plan, err := app.subscriptionPlan(sub)
+	if err != nil {
+		return err
+	}
+
+	template := "payment-failed"
+	subject := translate(user.Locale, "We Could Not Process Your Payment")
+	if sub.PaymentAttempts > 1 {
+		template = "payment-retry-failed"
+		subject = translate(user.Locale, "Your Payment Failed Again")
+	}
+
+	msg := Message{
+		Subject:  subject,
+		Template: template,
+		Data: PaymentFailedEmail{
+			Plan:         plan,
+			Subscription: sub,
+			Invoice:      invoice,
+			NextAttempt:  next,
+			AttemptsLeft: len(dunningRetryDays) - retry,
+			LastAttempt:  retry == len(dunningRetryDays)-1,
+			Downgrade:    dunningDowngradePlanID != 0,
+		},
+	}
+	app.sendBillingEmail(user, msg)
+
+	return nil
+}
+
+// endDunning voids the unpaid invoice of a subscription whose last retry failed, then
+// downgrades the subscription to the free dunningDowngradePlanID or cancels it, bills the
+// usage the voided invoice left unpaid, and tells the member
+func (app *Config) endDunning(user data.User, sub *data.Subscription, invoice *data.Invoice) error {
+	plan, err := app.subscriptionPlan(sub)
+	if err != nil {
+		return err
+	}
+
+	err = app.Models.Invoice.UpdateStatus(invoice.ID, data.InvoiceVoid)
+	if err != nil {
+		return err
+	}
+
+	var downgradePlan *data.Plan
+	if dunningDowngradePlanID != 0 && dunningDowngradePlanID != sub.PlanID {
+		downgradePlan, err = app.Models.Plan.GetOne(dunningDowngradePlanID)
+		if err != nil {
+			return err
+		}
+		downgradePlan = downgradePlan.InCurrency(sub.Currency)
+		if downgradePlan.PlanAmount > 0 {
+			app.ErrorLog.Printf("canceling subscription %d instead of downgrading it to plan %d, which is not free",
+				sub.ID, downgradePlan.ID)
+			downgradePlan = nil
+		}
+	}
+
+	// the voided invoice forgives the period it was for, but not the usage on it: that
+	// is billed up to the start of the free plan, or up to now if the subscription ends
+	if downgradePlan != nil {
+		_, err = app.Models.Subscription.Renew(*sub, *downgradePlan)
+		if err != nil {
+			return err
+		}
+		err = app.invoiceFinalUsage(sub, sub.CurrentPeriodEnd)
+	} else {
+		now := time.Now()
+		sub.Status = data.SubscriptionCanceled
+		sub.CanceledAt = &now
+		sub.EndedAt = &now
+		sub.NextPaymentAttemptAt = nil
+		err = app.Models.Subscription.Update(*sub)
+		if err != nil {
+			return err
+		}
+		err = app.invoiceFinalUsage(sub, now)
+	}
+	if err != nil {
+		return err
+	}
+
+	msg := Message{
+		Subject:  translate(user.Locale, "Your Subscription Has Ended"),
+		Template: "subscription-unpaid",
+		Data: SubscriptionUnpaidEmail{
+			Plan:          plan,
+			Subscription:  sub,
+			Invoice:       invoice,
+			DowngradePlan: downgradePlan,
+		},
+	}
+	app.sendBillingEmail(user, msg)
+
+	return nil
+}
+
+// collectPastDue charges the open invoice of a past due subscription and, once it is
+// paid, brings the subscription back to active
+func (app *Config) collectPastDue(user data.User, sub *data.Subscription, invoice *data.Invoice) error {
+	_, err := app.chargeInvoice(user, invoice)
+	if err != nil {
+		return err
+	}
+
+	return app.recoverSubscription(user, sub, invoice)
+}
+
+// recoverSubscription makes a past due subscription active again now that invoice is
+// paid. If the invoice was for the renewal of sub, the next period starts.
+func (app *Config) recoverSubscription(user data.User, sub *data.Subscription, invoice *data.Invoice) error {
+	if !sub.CurrentPeriodEnd.After(time.Now()) {
+		plan, err := app.renewalPlan(sub)
+		if err != nil {
+			return err
+		}
+		return app.completeRenewal(user, sub, plan, invoice)
+	}
+
+	sub.Status = data.SubscriptionActive
+	sub.PastDueSince = nil
+	sub.PaymentAttempts = 0
+	sub.NextPaymentAttemptAt = nil
+	return app.Models.Subscription.Update(*sub)
+}
+
+// subscriptionPlan returns the plan of sub, priced in its currency
+func (app *Config) subscriptionPlan(sub *data.Subscription) (*data.Plan, error) {
+	if sub.Plan != nil {
+		return sub.Plan, nil
+	}
+
+	plan, err := app.Models.Plan.GetOne(sub.PlanID)
+	if err != nil {
+		return nil, err
+	}
+
+	return plan.InCurrency(sub.Currency), nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"strings"
+	"subscription-service/data"
+	"testing"
+	"time"
+)
+
+func TestConfig_retryPastDuePayments(t *testing.T) {
+	sentMail()
+
+	// the retry of the subscription due is paid, which starts its next period
+	testApp.retryPastDuePayments()
+	testApp.Wait.Wait()
+
+	sent := sentMail()
+	if len(sent) != 1 || sent[0].Subject != "Your Subscription Has Been Renewed" {
+		t.Fatalf("expected the renewal email but got %d emails", len(sent))
+	}
+	if sent[0].To[0] != "admin@example.com" {
+		t.Errorf("expected the renewal email to go to admin@example.com but it went to %v", sent[0].To)
+	}
+
+	// a declined retry schedules the next one and tells the member
+	testPayments.SetMode(FakeDecline)
+	defer testPayments.SetMode(FakeSucceed)
+
+	testApp.retryPastDuePayments()
+	testApp.Wait.Wait()
+
+	sent = sentMail()
+	if len(sent) != 1 || sent[0].Subject != "Your Payment Failed Again" {
+		t.Fatalf("expected the payment failed email but got %d emails", len(sent))
+	}
+}
+
+func TestConfig_retryPayment(t *testing.T) {
+	testPayments.SetMode(FakeDecline)
+	defer testPayments.SetMode(FakeSucceed)
+
+	since := time.Now().AddDate(0, 0, -1)
+	sub := &data.Subscription{
+		ID:                 1,
+		UserID:             1,
+		PlanID:             1,
+		Status:             data.SubscriptionPastDue,
+		Currency:           data.DefaultCurrency,
+		CurrentPeriodStart: since.AddDate(0, -1, 0),
+		CurrentPeriodEnd:   since,
+		PastDueSince:       &since,
+		PaymentAttempts:    1,
+	}
+
+	// every failed retry schedules the next one, until the schedule runs out
+	for i := 1; i < len(dunningRetryDays); i++ {
+		err := testApp.retryPayment(sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := since.AddDate(0, 0, dunningRetryDays[i])
+		if sub.Status != data.SubscriptionPastDue || sub.NextPaymentAttemptAt == nil || !sub.NextPaymentAttemptAt.Equal(expected) {
+			t.Errorf("retry %d: expected next attempt on %s but got %v", i, expected, sub.NextPaymentAttemptAt)
+		}
+	}
+
+	err := testApp.retryPayment(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Status != data.SubscriptionCanceled || sub.EndedAt == nil {
+		t.Errorf("expected the subscription to be canceled after the last retry but got status %s", sub.Status)
+	}
+	testApp.Wait.Wait()
+}
+
+func TestConfig_retryPayment_succeeded(t *testing.T) {
+	since := time.Now().AddDate(0, 0, -1)
+	sub := &data.Subscription{
+		ID:                 1,
+		UserID:             1,
+		PlanID:             1,
+		Status:             data.SubscriptionPastDue,
+		Currency:           data.DefaultCurrency,
+		CurrentPeriodStart: since.AddDate(0, -1, 0),
+		CurrentPeriodEnd:   since,
+		PastDueSince:       &since,
+		PaymentAttempts:    1,
+	}
+
+	err := testApp.retryPayment(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testApp.Wait.Wait()
+}
+
+func TestConfig_endDunning_downgrade(t *testing.T) {
+	defer func() { dunningDowngradePlanID = 0 }()
+
+	tests := []struct {
+		name     string
+		planID   int
+		canceled bool
+		message  string
+	}{
+		{"free plan", 10, false, "Your subscription has been moved to the Free Plan."},
+		{"paid plan", 2, true, "Your subscription has been canceled."},
+	}
+
+	for _, e := range tests {
+		dunningDowngradePlanID = e.planID
+		sentMail()
+
+		sub, _ := testApp.Models.Subscription.GetOne(1)
+		sub.Status = data.SubscriptionPastDue
+		invoice, _ := testApp.Models.Invoice.GetOne(1)
+
+		err := testApp.endDunning(data.User{ID: 1, Email: "admin@example.com"}, sub, invoice)
+		if err != nil {
+			t.Errorf("%s: %s", e.name, err)
+		}
+		if canceled := sub.Status == data.SubscriptionCanceled; canceled != e.canceled {
+			t.Errorf("%s: expected canceled to be %t but got status %s", e.name, e.canceled, sub.Status)
+		}
+
+		subjects := make(map[string]data.Email)
+		for _, email := range sentMail() {
+			subjects[email.Subject] = email
+		}
+		if email, ok := subjects["Your Subscription Has Ended"]; !ok || !strings.Contains(email.PlainBody, e.message) {
+			t.Errorf("%s: expected an email saying %q", e.name, e.message)
+		}
+		// the usage the voided invoice was for is billed on an invoice of its own
+		if _, ok := subjects["Your Invoice Data"]; !ok {
+			t.Errorf("%s: expected the usage to be invoiced", e.name)
+		}
+	}
+}
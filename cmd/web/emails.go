@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"reflect"
+	"sort"
+	"strings"
+	"subscription-service/data"
+	texttemplate "text/template"
+	"time"
+)
+
+// templateFS holds the templates built into the binary
+//
+//go:embed templates/*.gohtml
+var templateFS embed.FS
+
+// The data each email template is rendered with; see emailContracts
+
+// MessageEmail is a plain message, sent with the default "mail" template
+type MessageEmail struct {
+	Message string
+}
+
+// ActivationEmail carries the link to activate a new account
+type ActivationEmail struct {
+	Link htmltemplate.URL
+}
+
+// InvoiceEmail carries an invoice, which is also attached as a PDF
+type InvoiceEmail struct {
+	Invoice *data.Invoice
+}
+
+// SubscriptionEmail tells a member about a change to their subscription
+type SubscriptionEmail struct {
+	Plan         *data.Plan
+	Subscription *data.Subscription
+}
+
+// CancellationEmail confirms a subscription was canceled, now or at the end of the
+// period
+type CancellationEmail struct {
+	Plan         *data.Plan
+	Subscription *data.Subscription
+	Immediate    bool
+}
+
+// RenewalEmail carries the invoice of a renewed subscription
+type RenewalEmail struct {
+	Plan         *data.Plan
+	Subscription *data.Subscription
+	Invoice      *data.Invoice
+}
+
+// PaymentFailedEmail tells a member a payment failed and when it is tried again
+type PaymentFailedEmail struct {
+	Plan         *data.Plan
+	Subscription *data.Subscription
+	Invoice      *data.Invoice
+	NextAttempt  time.Time
+	AttemptsLeft int
+	LastAttempt  bool
+	Downgrade    bool
+}
+
+// SubscriptionUnpaidEmail tells a member their subscription ended because it was not
+// paid, and the plan they were moved to, if any
+type SubscriptionUnpaidEmail struct {
+	Plan          *data.Plan
+	Subscription  *data.Subscription
+	Invoice       *data.Invoice
+	DowngradePlan *data.Plan
+}
+
+// PasswordResetEmail carries the link to reset a password, valid for Minutes
+type PasswordResetEmail struct {
+	User    *data.User
+	Link    htmltemplate.URL
+	Minutes int
+}
+
+// PasswordChangedEmail tells a user their password was changed
+type PasswordChangedEmail struct {
+	User *data.User
+}
+
+// InvitationEmail invites someone to join an organization
+type InvitationEmail struct {
+	Inviter      data.User
+	Organization *data.Organization
+	Link         htmltemplate.URL
+}
+
+// emailContracts lists every email template with the type of the data it is rendered
+// with. A template must be listed here to be loaded, and is only rendered with its type.
+var emailContracts = map[string]any{
+	"mail":                     MessageEmail{},
+	"confirmation-email":       ActivationEmail{},
+	"invoice":                  InvoiceEmail{},
+	"renewal":                  RenewalEmail{},
+	"trial-ending":             SubscriptionEmail{},
+	"subscription-canceled":    CancellationEmail{},
+	"subscription-paused":      SubscriptionEmail{},
+	"subscription-reactivated": SubscriptionEmail{},
+	"payment-failed":           PaymentFailedEmail{},
+	"payment-retry-failed":     PaymentFailedEmail{},
+	"subscription-unpaid":      SubscriptionUnpaidEmail{},
+	"password-reset":           PasswordResetEmail{},
+	"password-changed":         PasswordChangedEmail{},
+	"organization-invitation":  InvitationEmail{},
+}
+
+// EmailTemplates holds every email template, parsed once with the shared layouts and
+// partials. Each template <name> has an html variant, <name>.html.gohtml, rendered in
+// email.layout.gohtml with the email-*.partial.gohtml partials, and a plain variant,
+// <name>.plain.gohtml, rendered in email-plain.layout.gohtml. Both define "content",
+// and have the functions of localeFuncs.
+type EmailTemplates struct {
+	html      map[string]*htmltemplate.Template
+	plain     map[string]*texttemplate.Template
+	contracts map[string]reflect.Type
+}
+
+// LoadEmailTemplates parses the templates in contracts from fsys. It fails, listing
+// every problem, if a template is missing a variant or does not parse, or if fsys has a
+// template which is not in contracts.
+func LoadEmailTemplates(fsys fs.FS, contracts map[string]any) (*EmailTemplates, error) {
+	t := &EmailTemplates{
+		html:      make(map[string]*htmltemplate.Template),
+		plain:     make(map[string]*texttemplate.Template),
+		contracts: make(map[string]reflect.Type),
+	}
+
+	var problems []error
+
+	found, err := emailTemplateNames(fsys)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range found {
+		if _, ok := contracts[name]; !ok {
+			problems = append(problems, fmt.Errorf("email template %q has no data type in the contracts", name))
+		}
+	}
+
+	for name, contract := range contracts {
+		t.contracts[name] = reflect.TypeOf(contract)
+
+		html, err := htmltemplate.New(name).Funcs(localeFuncs(DefaultLocale)).ParseFS(fsys,
+			"email.layout.gohtml", "email-*.partial.gohtml", name+".html.gohtml")
+		if err == nil && html.Lookup("content") == nil {
+			err = errors.New(`does not define "content"`)
+		}
+		if err != nil {
+			problems = append(problems, fmt.Errorf("html variant of email template %q: %w", name, err))
+		}
+		t.html[name] = html
+
+		plain, err := texttemplate.New(name).Funcs(localeFuncs(DefaultLocale)).ParseFS(fsys,
+			"email-plain.layout.gohtml", name+".plain.gohtml")
+		if err == nil && plain.Lookup("content") == nil {
+			err = errors.New(`does not define "content"`)
+		}
+		if err != nil {
+			problems = append(problems, fmt.Errorf("plain variant of email template %q: %w", name, err))
+		}
+		t.plain[name] = plain
+	}
+
+	if len(problems) > 0 {
+		sort.Slice(problems, func(i, j int) bool { return problems[i].Error() < problems[j].Error() })
+		return nil, errors.Join(problems...)
+	}
+
+	return t, nil
+}
+
+// Render renders both variants of the template name in locale with data, which must be
+// of the template's type
+func (t *EmailTemplates) Render(name, locale string, data any) (string, string, error) {
+	contract, ok := t.contracts[name]
+	if !ok {
+		return "", "", fmt.Errorf("no email template %q", name)
+	}
+	if reflect.TypeOf(data) != contract {
+		return "", "", fmt.Errorf("email template %q is rendered with %s, not %T", name, contract, data)
+	}
+
+	// the parsed templates are shared, so each render binds the locale to a copy
+	htmlTmpl, err := t.html[name].Clone()
+	if err != nil {
+		return "", "", err
+	}
+
+	var html bytes.Buffer
+	if err := htmlTmpl.Funcs(localeFuncs(locale)).ExecuteTemplate(&html, "body", data); err != nil {
+		return "", "", err
+	}
+
+	plainTmpl, err := t.plain[name].Clone()
+	if err != nil {
+		return "", "", err
+	}
+
+	var plain bytes.Buffer
+	if err := plainTmpl.Funcs(localeFuncs(locale)).ExecuteTemplate(&plain, "body", data); err != nil {
+		return "", "", err
+	}
+
+	return html.String(), plain.String(), nil
+}
+
+// emailTemplateNames returns the name of every template with a variant in fsys
+func emailTemplateNames(fsys fs.FS) ([]string, error) {
+	var names []string
+	seen := make(map[string]bool)
+
+	for _, suffix := range []string{".html.gohtml", ".plain.gohtml"} {
+		files, err := fs.Glob(fsys, "*"+suffix)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			name := strings.TrimSuffix(file, suffix)
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+
+	return names, nil
+}
+
+// embeddedEmailTemplates returns the templates built into the binary
+func embeddedEmailTemplates() fs.FS {
+	templates, err := fs.Sub(templateFS, "templates")
+	if err != nil {
+		// templates is a directory built into the binary, so this cannot happen
+		panic(err)
+	}
+	return templates
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"subscription-service/data"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadEmailTemplates(t *testing.T) {
+	// the templates we ship must all load, from disk and from the binary
+	if _, err := LoadEmailTemplates(os.DirFS(templatesPath), emailContracts); err != nil {
+		t.Errorf("templates on disk: %s", err)
+	}
+	if _, err := LoadEmailTemplates(embeddedEmailTemplates(), emailContracts); err != nil {
+		t.Errorf("embedded templates: %s", err)
+	}
+
+	layouts := fstest.MapFS{
+		"email.layout.gohtml":         {Data: []byte(`{{define "body"}}<html>{{template "email-footer" .}}{{template "content" .}}</html>{{end}}`)},
+		"email-plain.layout.gohtml":   {Data: []byte(`{{define "body"}}{{template "content" .}}{{end}}`)},
+		"email-footer.partial.gohtml": {Data: []byte(`{{define "email-footer"}}<p>{{year}}</p>{{end}}`)},
+	}
+	with := func(files map[string]string) fstest.MapFS {
+		fsys := fstest.MapFS{}
+		for name, file := range layouts {
+			fsys[name] = file
+		}
+		for name, content := range files {
+			fsys[name] = &fstest.MapFile{Data: []byte(content)}
+		}
+		return fsys
+	}
+
+	tests := []struct {
+		name     string
+		fsys     fstest.MapFS
+		expected string
+	}{
+		{"complete", with(map[string]string{
+			"mail.html.gohtml":  `{{define "content"}}<p>{{.Message}}</p>{{end}}`,
+			"mail.plain.gohtml": `{{define "content"}}{{.Message}}{{end}}`,
+		}), ""},
+		{"missing plain variant", with(map[string]string{
+			"mail.html.gohtml": `{{define "content"}}<p>{{.Message}}</p>{{end}}`,
+		}), `plain variant of email template "mail"`},
+		{"missing html variant", with(map[string]string{
+			"mail.plain.gohtml": `{{define "content"}}{{.Message}}{{end}}`,
+		}), `html variant of email template "mail"`},
+		{"no content", with(map[string]string{
+			"mail.html.gohtml":  `{{define "main"}}<p>{{.Message}}</p>{{end}}`,
+			"mail.plain.gohtml": `{{define "content"}}{{.Message}}{{end}}`,
+		}), `does not define "content"`},
+		{"broken", with(map[string]string{
+			"mail.html.gohtml":  `{{define "content"}}<p>{{.Message</p>{{end}}`,
+			"mail.plain.gohtml": `{{define "content"}}{{.Message}}{{end}}`,
+		}), `html variant of email template "mail"`},
+		{"untyped", with(map[string]string{
+			"mail.html.gohtml":   `{{define "content"}}<p>{{.Message}}</p>{{end}}`,
+			"mail.plain.gohtml":  `{{define "content"}}{{.Message}}{{end}}`,
+			"promo.html.gohtml":  `{{define "content"}}<p>Sale!</p>{{end}}`,
+			"promo.plain.gohtml": `{{define "content"}}Sale!{{end}}`,
+		}), `email template "promo" has no data type`},
+	}
+
+	for _, e := range tests {
+		_, err := LoadEmailTemplates(e.fsys, map[string]any{"mail": MessageEmail{}})
+		switch {
+		case e.expected == "" && err != nil:
+			t.Errorf("%s: unexpected error %s", e.name, err)
+		case e.expected != "" && (err == nil || !strings.Contains(err.Error(), e.expected)):
+			t.Errorf("%s: expected an error containing %q but got %v", e.name, e.expected, err)
+		}
+	}
+}
+
+func TestEmailTemplates_Render(t *testing.T) {
+	templates := testApp.Mailer.Templates
+
+	html, plain, err := templates.Render("password-changed", DefaultLocale, PasswordChangedEmail{User: &data.User{FirstName: "Jane"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{html, plain} {
+		if !strings.Contains(body, "Jane") {
+			t.Errorf("did not find the name of the user in %q", body)
+		}
+		if !strings.Contains(body, "GoCode.ca") {
+			t.Errorf("did not find the footer in %q", body)
+		}
+	}
+	if !strings.Contains(html, "<!doctype html>") {
+		t.Error("expected the html variant to be rendered in the layout")
+	}
+
+	// plain variants are not escaped as html
+	_, plain, _ = templates.Render("mail", DefaultLocale, MessageEmail{Message: "Tom & Jerry's"})
+	if !strings.Contains(plain, "Tom & Jerry's") {
+		t.Errorf("expected the plain variant to be left unescaped but got %q", plain)
+	}
+
+	// each render is written in the language it is asked for
+	html, plain, _ = templates.Render("password-changed", "de", PasswordChangedEmail{User: &data.User{FirstName: "Jane"}})
+	for _, body := range []string{html, plain} {
+		if !strings.Contains(body, "Hallo Jane,") {
+			t.Errorf("expected a German greeting in %q", body)
+		}
+	}
+	if html, _, _ = templates.Render("password-changed", DefaultLocale, PasswordChangedEmail{User: &data.User{FirstName: "Jane"}}); !strings.Contains(html, "Hello Jane,") {
+		t.Error("expected a later render in the default locale to be in English")
+	}
+
+	if _, _, err := templates.Render("password-changed", DefaultLocale, MessageEmail{}); err == nil {
+		t.Error("expected an error for data of the wrong type")
+	}
+}
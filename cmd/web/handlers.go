@@ -1,12 +1,17 @@
 package main
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
+	"github.com/go-chi/chi/v5"
 	"github.com/phpdave11/gofpdf"
 	"github.com/phpdave11/gofpdf/contrib/gofpdi"
 	"html/template"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"subscription-service/data"
 	"time"
 )
@@ -14,6 +19,12 @@ import (
 var manualPath = "./pdf"
 var tmpPath = "./tmp"
 
+// invoiceDueDays is the number of days a member has to pay an invoice
+const invoiceDueDays = 14
+
+// companyName is printed at the top of every PDF invoice
+const companyName = "GoCode.ca"
+
 func (app *Config) HomePage(w http.ResponseWriter, r *http.Request) {
 	app.render(w, r, "home.page.gohtml", nil)
 }
@@ -37,7 +48,7 @@ func (app *Config) Login(w http.ResponseWriter, r *http.Request) {
 
 	user, err := app.Models.User.GetByEmail(email)
 	if err != nil {
-		app.Session.Put(r.Context(), "error", "invalid credentials")
+		app.Session.Put(r.Context(), "error", app.T(r, "invalid credentials"))
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
@@ -46,19 +57,26 @@ func (app *Config) Login(w http.ResponseWriter, r *http.Request) {
 		if !isValid {
 			msg := Message{
 				To:      []string{email},
-				Subject: "Failed to Log In",
-				Data:    "Invalid login attempt",
+				Subject: translate(user.Locale, "Failed to Log In"),
+				Data:    MessageEmail{Message: translate(user.Locale, "Invalid login attempt")},
+				Locale:  user.Locale,
 			}
 			app.sendEmail(msg)
 		}
-		app.Session.Put(r.Context(), "error", "invalid credentials")
+		app.Session.Put(r.Context(), "error", app.T(r, "invalid credentials"))
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if user.Active != 1 {
+		app.Session.Put(r.Context(), "error", app.T(r, "Your account is not active"))
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
 	app.Session.Put(r.Context(), "userId", user.ID)
 	app.Session.Put(r.Context(), "user", user)
-	app.Session.Put(r.Context(), "flash", "Successful login")
+	app.Session.Put(r.Context(), "flash", app.T(r, "Successful login"))
 
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
@@ -69,7 +87,7 @@ func (app *Config) Logout(w http.ResponseWriter, r *http.Request) {
 
 	app.Session.Remove(r.Context(), "userId")
 	app.Session.Remove(r.Context(), "user")
-	app.Session.Put(r.Context(), "flash", "Successful logout")
+	app.Session.Put(r.Context(), "flash", app.T(r, "Successful logout"))
 
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
@@ -95,44 +113,59 @@ func (app *Config) Register(w http.ResponseWriter, r *http.Request) {
 		Password:  r.Form.Get("password"),
 		Active:    0,
 		IsAdmin:   0,
+		// emails sent outside of a request, such as renewals, use the language the
+		// user signed up in until they choose another
+		Locale: app.locale(r),
 	}
 
-	_, err = app.Models.User.Insert(u)
+	id, err := app.Models.User.Insert(u)
 	if err != nil {
-		app.Session.Put(r.Context(), "error", "Unable to create User.")
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to create User."))
 		http.Redirect(w, r, "/register", http.StatusSeeOther)
 		return
 	}
 
-	url := fmt.Sprintf("http://localhost:3000/activate-acc?email=%s", u.Email)
-	signedUrl := GenerateTokenFromString(url)
-	app.InfoLog.Println(signedUrl)
+	signedUrl, err := app.issueLink("/activate-acc", data.Token{
+		Purpose: data.TokenActivation,
+		UserID:  &id,
+		Email:   u.Email,
+	}, activationExpiry)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to create User."))
+		http.Redirect(w, r, "/register", http.StatusSeeOther)
+		return
+	}
 
 	msg := Message{
 		To:       []string{u.Email},
-		Subject:  "Activate Your Account",
+		Subject:  app.T(r, "Activate Your Account"),
 		Template: "confirmation-email",
-		Data:     template.HTML(signedUrl),
+		Data:     ActivationEmail{Link: template.URL(signedUrl)},
+		Locale:   app.locale(r),
 	}
 	app.sendEmail(msg)
 
-	app.Session.Put(r.Context(), "flash", "Confirmation email sent. Check your inbox.")
+	app.Session.Put(r.Context(), "flash", app.T(r, "Confirmation email sent. Check your inbox."))
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
 }
 
+// ActivateAccount activates the account an activation link was sent for. Each link only
+// works once, until it expires.
 func (app *Config) ActivateAccount(w http.ResponseWriter, r *http.Request) {
-	url := r.RequestURI
-	testUrl := fmt.Sprintf("http://localhost:3000%s", url)
-	fmt.Println(testUrl)
-	if ok := VerifyToken(testUrl); !ok {
-		app.Session.Put(r.Context(), "error", "Invalid Token")
+	token, err := app.consumeLink(r, data.TokenActivation)
+	if err == nil && token.UserID == nil {
+		err = data.ErrTokenInvalid
+	}
+	if err != nil {
+		app.Session.Put(r.Context(), "error", app.linkMessage(r, err))
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
 
-	u, err := app.Models.User.GetByEmail(r.URL.Query().Get("email"))
+	u, err := app.Models.User.GetOne(*token.UserID)
 	if err != nil {
-		app.Session.Put(r.Context(), "error", "No User Found")
+		app.Session.Put(r.Context(), "error", app.T(r, "No User Found"))
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
@@ -140,92 +173,466 @@ func (app *Config) ActivateAccount(w http.ResponseWriter, r *http.Request) {
 	u.Active = 1
 	err = app.Models.User.Update(*u)
 	if err != nil {
-		app.Session.Put(r.Context(), "error", "Unable to update User")
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to update User"))
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
 
-	app.Session.Put(r.Context(), "flash", "Account Activated. You can now login.")
+	app.Session.Put(r.Context(), "flash", app.T(r, "Account Activated. You can now login."))
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
 }
 
 func (app *Config) SubscribeToPlan(w http.ResponseWriter, r *http.Request) {
-	id := r.URL.Query().Get("id")
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id := r.Form.Get("id")
 	planId, _ := strconv.Atoi(id)
 
+	mode := r.Form.Get("change")
+	if mode != data.ChangeAtPeriodEnd {
+		mode = data.ChangeImmediately
+	}
+
 	plan, err := app.Models.Plan.GetOne(planId)
 	if err != nil {
-		app.Session.Put(r.Context(), "error", "Unable to find plan")
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to find plan"))
 		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
 		return
 	}
 
 	user, ok := app.Session.Get(r.Context(), "user").(data.User)
 	if !ok {
-		app.Session.Put(r.Context(), "error", "Log In First!")
+		app.Session.Put(r.Context(), "error", app.T(r, "Log In First!"))
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
-	app.Wait.Add(1)
-	go func() {
-		defer app.Wait.Done()
+	// members of an organization share the subscription of its owner
+	org, err := app.userOrganization(user)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to subscribe to plan"))
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+	if org != nil && org.OwnerID != user.ID {
+		app.Session.Put(r.Context(), "error", app.T(r, "Your plan is managed by %s", org.Name))
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+
+	current, err := app.Models.Subscription.GetCurrentByUser(user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to subscribe to plan"))
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+
+	if current != nil && current.IsPaused() {
+		app.Session.Put(r.Context(), "error", app.T(r, "Your subscription is paused. Reactivate it before changing plan."))
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+
+	// the open invoice of a past due subscription is settled by dunning, which a plan
+	// change would cut short
+	if current != nil && current.Status == data.SubscriptionPastDue {
+		app.Session.Put(r.Context(), "error", app.T(r, "Your last payment failed. Update your payment method before changing plan."))
+		http.Redirect(w, r, "/members/payment-method", http.StatusSeeOther)
+		return
+	}
+
+	if plan.Archived && (current == nil || current.PlanID != plan.ID) {
+		app.Session.Put(r.Context(), "error", app.T(r, "That plan is no longer available"))
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+
+	isChange := current != nil && current.PlanID != plan.ID
+
+	// new subscriptions are billed in the member's currency; a plan change stays in
+	// the currency of the subscription being changed
+	if current != nil {
+		plan = plan.InCurrency(current.Currency)
+	} else {
+		plan = plan.InCurrency(user.Currency)
+	}
+
+	var coupon *data.Coupon
+	code := strings.TrimSpace(r.Form.Get("coupon"))
+	if code != "" {
+		coupon, err = app.findCoupon(code, user, plan)
+		if err != nil {
+			msg, ok := couponMessage(err)
+			if !ok {
+				app.ErrorLog.Println(err)
+				msg = "Unable to subscribe to plan"
+			}
+			app.Session.Put(r.Context(), "error", app.T(r, msg))
+			http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+			return
+		}
+	}
+
+	if isChange && mode == data.ChangeAtPeriodEnd {
+		// the coupon starts discounting when the new plan is first billed
+		var redemptionID int
+		if coupon != nil {
+			redemptionID, err = app.redeemCoupon(coupon, user)
+			if err != nil {
+				msg, ok := couponMessage(err)
+				if !ok {
+					app.ErrorLog.Println(err)
+					msg = "Unable to change plan"
+				}
+				app.Session.Put(r.Context(), "error", app.T(r, msg))
+				http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+				return
+			}
+		}
+
+		_, err = app.Models.Subscription.ChangePlan(*current, *plan, mode)
+		if err != nil {
+			app.ErrorLog.Println(err)
+			app.releaseRedemption(redemptionID)
+			app.Session.Put(r.Context(), "error", app.T(r, "Unable to change plan"))
+			http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+			return
+		}
+
+		app.Session.Put(r.Context(), "flash", app.T(r, "Your plan will change to %s on %s",
+			plan.PlanName, formatDate(app.locale(r), current.CurrentPeriodEnd)))
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+
+	// a new trial, or a change of plan during one, is only billed when the trial converts.
+	// A trial only carries over to a plan which offers one and which the member has not
+	// trialed before; changing to any other plan ends the trial, and the new plan is
+	// billed from now.
+	trialing := current != nil && current.Status == data.SubscriptionTrialing
+	isTrial := false
+	if (current == nil || trialing) && plan.TrialDays > 0 {
+		trialed, err := app.Models.Subscription.HasTrialed(user.ID, plan.ID)
+		if err != nil {
+			app.ErrorLog.Println(err)
+			app.Session.Put(r.Context(), "error", app.T(r, "Unable to subscribe to plan"))
+			http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+			return
+		}
+		isTrial = !trialed
+	}
+
+	var proration *data.Proration
+	if isChange && !isTrial && !trialing {
+		p := data.Prorate(*current, *plan, time.Now())
+		proration = &p
+	}
+
+	// a user re-subscribing to the plan they are already on is not billed again; anyone
+	// else pays before the subscription starts
+	var invoice *data.Invoice
+	var charge *Charge
+	var redemptionID int
+	balance := 0
+	if current != nil {
+		balance = current.CreditBalance
+	}
+	if (current == nil || isChange) && !isTrial {
+		now := time.Now()
+		periodEnd := plan.NextPeriodEnd(now)
+		if current != nil && !trialing {
+			periodEnd = current.CurrentPeriodEnd
+		}
+
+		seats, err := app.subscriptionSeats(user, current)
+		if err != nil {
+			app.ErrorLog.Println(err)
+			app.Session.Put(r.Context(), "error", app.T(r, "Unable to subscribe to plan"))
+			http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+			return
+		}
+
+		// without a new code, a coupon the member redeemed before may still apply
+		var redemption *data.CouponRedemption
+		if coupon == nil {
+			redemption, err = app.activeRedemption(user.ID, plan.ID)
+			if err != nil {
+				app.ErrorLog.Println(err)
+				app.Session.Put(r.Context(), "error", app.T(r, "Unable to subscribe to plan"))
+				http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+				return
+			}
+		}
 
-		invoice, err := app.getInvoice(user, plan)
+		inv := app.buildInvoice(user, plan, seats, now, periodEnd, proration)
+		// the subscription on the new plan starts now, so the usage so far is billed on
+		// the old plan with the change
+		if proration != nil {
+			err = app.addPeriodUsage(current, now, &inv, user.Locale)
+			if err != nil {
+				app.ErrorLog.Println(err)
+				app.Session.Put(r.Context(), "error", app.T(r, "Unable to subscribe to plan"))
+				http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+				return
+			}
+		}
+		if coupon != nil {
+			discountInvoice(&inv, coupon, user.Locale)
+		} else if redemption != nil {
+			discountInvoice(&inv, redemption.Coupon, user.Locale)
+		}
+		err = app.Tax.AddTax(user, &inv)
 		if err != nil {
-			app.ErrorChan <- err
+			app.ErrorLog.Println(err)
+			app.Session.Put(r.Context(), "error", app.T(r, "Unable to subscribe to plan"))
+			http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+			return
+		}
+		balance = settleCredit(&inv, balance, user.Locale)
+		if inv.Total > 0 && user.PaymentMethodID == "" {
+			// the member confirms their choice again on the plans page once they have one
+			next := "/members/plans?" + url.Values{"select": {id}, "coupon": {code}}.Encode()
+			app.Session.Put(r.Context(), "warning", app.T(r, "Add a payment method to subscribe to this plan"))
+			http.Redirect(w, r, "/members/payment-method?next="+url.QueryEscape(next), http.StatusSeeOther)
+			return
 		}
 
-		msg := Message{
-			To:       []string{user.Email},
-			Subject:  "Your Invoice Data",
-			Data:     invoice,
-			Template: "invoice",
+		invoice, err = app.storeInvoice(inv)
+		if err != nil {
+			app.ErrorLog.Println(err)
+			app.Session.Put(r.Context(), "error", app.T(r, "Unable to subscribe to plan"))
+			http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+			return
 		}
-		app.sendEmail(msg)
-	}()
 
-	app.Wait.Add(1)
-	go func() {
-		defer app.Wait.Done()
+		// the coupon is redeemed before the charge, so that it cannot run out in between
+		if coupon != nil {
+			redemptionID, err = app.Models.Coupon.Redeem(data.CouponRedemption{
+				CouponID:       coupon.ID,
+				UserID:         user.ID,
+				InvoiceID:      &invoice.ID,
+				PeriodsApplied: 1,
+			})
+			if err != nil {
+				if err := app.Models.Invoice.UpdateStatus(invoice.ID, data.InvoiceVoid); err != nil {
+					app.ErrorLog.Println(err)
+				}
+				msg, ok := couponMessage(err)
+				if !ok {
+					app.ErrorLog.Println(err)
+					msg = "Unable to subscribe to plan"
+				}
+				app.Session.Put(r.Context(), "error", app.T(r, msg))
+				http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+				return
+			}
+		}
 
-		pdf := app.generateManual(user, plan)
-		err := pdf.OutputFileAndClose(fmt.Sprintf("%s/%d_manual.pdf", tmpPath, user.ID))
+		charge, err = app.chargeInvoice(user, invoice)
 		if err != nil {
-			app.ErrorChan <- err
+			app.ErrorLog.Println(err)
+			if err := app.Models.Invoice.UpdateStatus(invoice.ID, data.InvoiceVoid); err != nil {
+				app.ErrorLog.Println(err)
+			}
+			app.releaseRedemption(redemptionID)
+
+			msg := app.T(r, "Your payment could not be processed. Please try again.")
+			if errors.Is(err, ErrPaymentDeclined) {
+				msg = app.T(r, "Your payment was declined. Please use another payment method.")
+			}
+			app.Session.Put(r.Context(), "error", msg)
+			http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
 			return
 		}
 
-		msg := Message{
-			To:            []string{user.Email},
-			Subject:       "Your Manual",
-			Data:          "Your manual is attached",
-			AttachmentMap: map[string]string{"Manual.pdf": fmt.Sprintf("%s/%d_manual.pdf", tmpPath, user.ID)},
+		if redemption != nil {
+			err = app.Models.Coupon.ApplyRedemption(redemption.ID)
+			if err != nil {
+				app.ErrorLog.Println(err)
+			}
 		}
-		app.sendEmail(msg)
-	}()
+	}
 
-	err = app.Models.Plan.SubscribeUserToPlan(user, *plan)
+	// a coupon redeemed on a free trial starts discounting when the trial converts
+	if coupon != nil && isTrial && (current == nil || isChange) {
+		redemptionID, err = app.redeemCoupon(coupon, user)
+		if err != nil {
+			msg, ok := couponMessage(err)
+			if !ok {
+				app.ErrorLog.Println(err)
+				msg = "Unable to subscribe to plan"
+			}
+			app.Session.Put(r.Context(), "error", app.T(r, msg))
+			http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+			return
+		}
+	}
+
+	var sub *data.Subscription
+	if isChange {
+		sub, err = app.Models.Subscription.ChangePlan(*current, *plan, mode)
+	} else {
+		sub, err = app.Models.Subscription.Subscribe(user, *plan)
+	}
 	if err != nil {
-		app.Session.Put(r.Context(), "error", "Unable to subscribe to plan")
+		app.ErrorLog.Println(err)
+		if invoice != nil {
+			// the member has paid for a subscription we could not start
+			if charge != nil {
+				err = app.refundInvoice(invoice, charge)
+			} else {
+				err = app.Models.Invoice.UpdateStatus(invoice.ID, data.InvoiceVoid)
+			}
+			if err != nil {
+				app.ErrorLog.Println(err)
+			}
+		}
+		app.releaseRedemption(redemptionID)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to subscribe to plan"))
 		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
 		return
 	}
 
+	// the new subscription keeps whatever credit the change left over
+	if current != nil && balance != current.CreditBalance {
+		err = app.Models.Subscription.SetCreditBalance(sub.ID, balance)
+		if err != nil {
+			app.ErrorLog.Println(err)
+		}
+	}
+
+	// emails are sent in the background, after the request is done with
+	locale := app.locale(r)
+
+	if invoice != nil {
+		invoice.SubscriptionID = &sub.ID
+		err = app.Models.Invoice.Update(*invoice)
+		if err != nil {
+			app.ErrorLog.Println(err)
+		}
+
+		app.Wait.Add(1)
+		go func() {
+			defer app.Wait.Done()
+
+			app.sendInvoice(user, invoice, Message{
+				Subject:  translate(locale, "Your Invoice Data"),
+				Template: "invoice",
+				Data:     InvoiceEmail{Invoice: invoice},
+				Locale:   locale,
+			})
+		}()
+	}
+
+	if current == nil || isChange {
+		app.Wait.Add(1)
+		go func() {
+			defer app.Wait.Done()
+
+			pdf := app.generateManual(user, plan)
+			err := pdf.OutputFileAndClose(fmt.Sprintf("%s/%d_manual.pdf", tmpPath, user.ID))
+			if err != nil {
+				app.ErrorChan <- err
+				return
+			}
+
+			msg := Message{
+				To:            []string{user.Email},
+				Subject:       translate(locale, "Your Manual"),
+				Data:          MessageEmail{Message: translate(locale, "Your manual is attached")},
+				Locale:        locale,
+				AttachmentMap: map[string]string{"Manual.pdf": fmt.Sprintf("%s/%d_manual.pdf", tmpPath, user.ID)},
+			}
+			app.sendEmail(msg)
+		}()
+	}
+
 	u, err := app.Models.User.GetOne(user.ID)
 	if err != nil {
-		app.Session.Put(r.Context(), "error", "Unable to get user from db")
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to get user from db"))
 		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
 		return
 	}
 	app.Session.Put(r.Context(), "user", u)
 
-	app.Session.Put(r.Context(), "flash", "Subscribed!")
+	if current == nil && isTrial {
+		app.Session.Put(r.Context(), "flash", app.T(r, "Your %d-day free trial of the %s has started!",
+			plan.TrialDays, plan.PlanName))
+	} else {
+		app.Session.Put(r.Context(), "flash", app.T(r, "Subscribed!"))
+	}
 	http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
 }
 
-func (app *Config) getInvoice(u data.User, plan *data.Plan) (string, error) {
-	return plan.PlanAmountFormatted, nil //todo - complete
+// storeInvoice issues invoice, giving it its number, and returns it as stored
+func (app *Config) storeInvoice(invoice data.Invoice) (*data.Invoice, error) {
+	id, err := app.Models.Invoice.Insert(invoice)
+	if err != nil {
+		return nil, err
+	}
+
+	return app.Models.Invoice.GetOne(id)
+}
+
+// buildInvoice puts together an open invoice for subscribing user u to plan from start to
+// end, for seats seats if the plan is priced per seat, written in the user's language.
+// When the user is switching from another plan, proration holds the credit for the unused
+// time on the old plan and the charge for the rest of the current period on the new one.
+// The caller links the invoice to its subscription.
+func (app *Config) buildInvoice(u data.User, plan *data.Plan, seats int, start, end time.Time, proration *data.Proration) data.Invoice {
+	now := time.Now()
+
+	invoice := data.Invoice{
+		UserID:   u.ID,
+		Status:   data.InvoiceOpen,
+		Currency: plan.Currency,
+		IssuedAt: now,
+		DueAt:    now.AddDate(0, 0, invoiceDueDays),
+	}
+
+	if proration == nil {
+		period := fmt.Sprintf("%s - %s", formatDate(u.Locale, start), formatDate(u.Locale, end))
+		if plan.PerSeat && seats > 1 {
+			invoice.AddLine(data.LineItem, translate(u.Locale, "%s, %d seats (%s)", plan.PlanName, seats, period),
+				seats, plan.PlanAmount)
+		} else {
+			invoice.AddLine(data.LineItem, fmt.Sprintf("%s (%s)", plan.PlanName, period), 1, plan.PlanAmount)
+		}
+		return invoice
+	}
+
+	invoice.AddLine(data.LineProration, translate(u.Locale, "Unused time on %s", proration.OldPlan.PlanName),
+		1, -proration.Credit)
+	invoice.AddLine(data.LineProration, translate(u.Locale, "Remaining time on %s until %s", plan.PlanName,
+		formatDate(u.Locale, proration.PeriodEnd)), 1, proration.Charge)
+
+	return invoice
+}
+
+// settleCredit evens invoice out against balance, the credit its subscription has left
+// from earlier plan changes, once the discount and tax are on it. As much of the balance
+// as the invoice comes to is taken off it, and an invoice that comes to less than nothing,
+// such as a downgrade part way through a period, is brought to nothing, the difference
+// going to the balance. The lines are written in locale. It returns the balance left.
+func settleCredit(invoice *data.Invoice, balance int, locale string) int {
+	if invoice.Total < 0 {
+		credit := -invoice.Total
+		invoice.AddLine(data.LineCredit, translate(locale, "Credit to your balance"), 1, credit)
+		return balance + credit
+	}
+
+	applied := min(balance, invoice.Total)
+	if applied > 0 {
+		invoice.AddLine(data.LineCredit, translate(locale, "Credit from your balance"), 1, -applied)
+	}
+	return balance - applied
 }
 
 func (app *Config) ChooseSubscription(w http.ResponseWriter, r *http.Request) {
@@ -236,12 +643,576 @@ func (app *Config) ChooseSubscription(w http.ResponseWriter, r *http.Request) {
 	}
 
 	dataMap := make(map[string]any)
+
+	var current *data.Subscription
+	user, ok := app.Session.Get(r.Context(), "user").(data.User)
+	if ok {
+		sub, err := app.Models.Subscription.GetCurrentByUser(user.ID)
+		if err == nil {
+			current = sub
+			dataMap["subscription"] = sub
+		}
+	}
+
+	// archived plans are only shown to the members still on them
+	currency := data.GetCurrency(user.Currency).Code
+	var available []*data.Plan
+	for _, plan := range plans {
+		if plan.Archived && (current == nil || current.PlanID != plan.ID) {
+			continue
+		}
+		available = append(available, plan.InCurrency(currency))
+	}
+	plans = available
+
+	// a member sent to add a payment method part way through choosing a plan picks up
+	// where they left off, confirming their choice again
+	if id, err := strconv.Atoi(r.URL.Query().Get("select")); err == nil {
+		for _, plan := range plans {
+			if plan.ID == id {
+				dataMap["selected"] = plan
+				dataMap["coupon"] = r.URL.Query().Get("coupon")
+			}
+		}
+	}
+
 	dataMap["plans"] = plans
+	dataMap["currency"] = currency
+	dataMap["currencies"] = data.SupportedCurrencies()
 	app.render(w, r, "plans.page.gohtml", &TemplateData{
 		Data: dataMap,
 	})
 }
 
+func (app *Config) SetCurrency(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	currency := r.Form.Get("currency")
+	if !data.IsSupportedCurrency(currency) {
+		app.Session.Put(r.Context(), "error", app.T(r, "Unsupported currency"))
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+
+	user, ok := app.Session.Get(r.Context(), "user").(data.User)
+	if !ok {
+		app.Session.Put(r.Context(), "error", app.T(r, "Log In First!"))
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	user.Currency = currency
+	err = app.Models.User.Update(user)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to update currency"))
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+	app.Session.Put(r.Context(), "user", user)
+
+	http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+}
+
+// SetLocale changes the language the site and emails are written in. Anyone can choose
+// one for their session; for a logged in user it is saved, and their emails use it too.
+func (app *Config) SetLocale(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// only ever send the visitor back to one of our own pages
+	next := r.Form.Get("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		next = "/"
+	}
+
+	locale := r.Form.Get("locale")
+	if !IsSupportedLocale(locale) {
+		app.Session.Put(r.Context(), "error", app.T(r, "Unsupported language"))
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+	app.Session.Put(r.Context(), "locale", locale)
+
+	user, ok := app.Session.Get(r.Context(), "user").(data.User)
+	if ok {
+		user.Locale = locale
+		err = app.Models.User.Update(user)
+		if err != nil {
+			app.ErrorLog.Println(err)
+			app.Session.Put(r.Context(), "error", translate(locale, "Unable to update language"))
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+		app.Session.Put(r.Context(), "user", user)
+	}
+
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+func (app *Config) PaymentMethodPage(w http.ResponseWriter, r *http.Request) {
+	dataMap := make(map[string]any)
+	dataMap["next"] = r.URL.Query().Get("next")
+	app.render(w, r, "payment-method.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+func (app *Config) SavePaymentMethod(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, ok := app.Session.Get(r.Context(), "user").(data.User)
+	if !ok {
+		app.Session.Put(r.Context(), "error", app.T(r, "Log In First!"))
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	// only ever send the member back to one of our own pages
+	next := r.Form.Get("next")
+	if !strings.HasPrefix(next, "/members/") {
+		next = "/members/plans"
+	}
+
+	if user.PaymentCustomerID == "" {
+		user.PaymentCustomerID, err = app.Payments.CreateCustomer(user)
+		if err != nil {
+			app.ErrorLog.Println(err)
+			app.Session.Put(r.Context(), "error", app.T(r, "Unable to save payment method"))
+			http.Redirect(w, r, "/members/payment-method", http.StatusSeeOther)
+			return
+		}
+	}
+
+	user.PaymentMethodID, err = app.Payments.AttachPaymentMethod(user.PaymentCustomerID, r.Form.Get("token"))
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to save payment method"))
+		http.Redirect(w, r, "/members/payment-method?next="+url.QueryEscape(next), http.StatusSeeOther)
+		return
+	}
+
+	err = app.Models.User.UpdatePaymentDetails(user)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to save payment method"))
+		http.Redirect(w, r, "/members/payment-method?next="+url.QueryEscape(next), http.StatusSeeOther)
+		return
+	}
+	app.Session.Put(r.Context(), "user", user)
+
+	// a past due member's outstanding invoice is charged to the new payment method
+	// straight away; if that fails too the dunning schedule carries on as before
+	current, err := app.Models.Subscription.GetCurrentByUser(user.ID)
+	if err == nil && current.Status == data.SubscriptionPastDue {
+		invoice, err := app.Models.Invoice.GetOpenBySubscription(current.ID)
+		if err == nil {
+			err = app.collectPastDue(user, current, invoice)
+		}
+		if err != nil {
+			app.ErrorLog.Println(err)
+			app.Session.Put(r.Context(), "error", app.T(r, "Payment method saved, but your outstanding invoice could not be charged to it"))
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+
+		app.Session.Put(r.Context(), "flash", app.T(r, "Payment method saved and your outstanding invoice has been paid"))
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", app.T(r, "Payment method saved"))
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+func (app *Config) BillingDetailsPage(w http.ResponseWriter, r *http.Request) {
+	dataMap := make(map[string]any)
+	dataMap["countries"] = data.SupportedCountries()
+	dataMap["countryNames"] = data.Countries
+	app.render(w, r, "billing.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+func (app *Config) SaveBillingDetails(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, ok := app.Session.Get(r.Context(), "user").(data.User)
+	if !ok {
+		app.Session.Put(r.Context(), "error", app.T(r, "Log In First!"))
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	user.AddressLine1 = strings.TrimSpace(r.Form.Get("address_line1"))
+	user.AddressLine2 = strings.TrimSpace(r.Form.Get("address_line2"))
+	user.City = strings.TrimSpace(r.Form.Get("city"))
+	user.Region = strings.ToUpper(strings.TrimSpace(r.Form.Get("region")))
+	user.PostalCode = strings.TrimSpace(r.Form.Get("postal_code"))
+	user.Country = r.Form.Get("country")
+	user.TaxID = normalizeTaxID(r.Form.Get("tax_id"))
+
+	if user.Country != "" && !data.IsSupportedCountry(user.Country) {
+		app.Session.Put(r.Context(), "error", app.T(r, "We cannot bill to that country"))
+		http.Redirect(w, r, "/members/billing", http.StatusSeeOther)
+		return
+	}
+
+	if user.TaxID != "" && !validTaxID(user.Country, user.TaxID) {
+		app.Session.Put(r.Context(), "error", app.T(r, "Enter a valid tax ID together with your country"))
+		http.Redirect(w, r, "/members/billing", http.StatusSeeOther)
+		return
+	}
+
+	// the tax ID may have been verified since the user logged in, and stays verified only
+	// as long as it does not change
+	saved, err := app.Models.User.GetOne(user.ID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to save billing details"))
+		http.Redirect(w, r, "/members/billing", http.StatusSeeOther)
+		return
+	}
+	user.TaxIDVerified = saved.TaxIDVerified && saved.TaxID == user.TaxID && saved.Country == user.Country
+
+	err = app.Models.User.UpdateBillingDetails(user)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to save billing details"))
+		http.Redirect(w, r, "/members/billing", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "user", user)
+
+	app.Session.Put(r.Context(), "flash", app.T(r, "Billing details saved"))
+	http.Redirect(w, r, "/members/billing", http.StatusSeeOther)
+}
+
+func (app *Config) CancelPage(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.Session.Get(r.Context(), "user").(data.User)
+	if !ok {
+		app.Session.Put(r.Context(), "error", app.T(r, "Log In First!"))
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	current, err := app.Models.Subscription.GetCurrentByUser(user.ID)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", app.T(r, "You have no subscription to cancel"))
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["subscription"] = current
+	dataMap["reasons"] = data.CancellationReasons
+	app.render(w, r, "cancel.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+func (app *Config) CancelSubscription(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, ok := app.Session.Get(r.Context(), "user").(data.User)
+	if !ok {
+		app.Session.Put(r.Context(), "error", app.T(r, "Log In First!"))
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	current, err := app.Models.Subscription.GetCurrentByUser(user.ID)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", app.T(r, "You have no subscription to cancel"))
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+
+	// a paused subscription has no period running out, so it can only end straight away
+	immediate := r.Form.Get("mode") == data.ChangeImmediately || current.IsPaused()
+
+	// the usage so far is billed on the subscription as it was before it ended
+	last := *current
+
+	now := time.Now()
+	current.CanceledAt = &now
+	current.ScheduledPlanID = nil
+	if immediate {
+		wasPastDue := current.Status == data.SubscriptionPastDue
+		current.Status = data.SubscriptionCanceled
+		current.EndedAt = &now
+		current.NextPaymentAttemptAt = nil
+
+		// the period that was not paid for is not owed for a subscription that has ended,
+		// but the usage in it is
+		if wasPastDue {
+			invoice, err := app.Models.Invoice.GetOpenBySubscription(current.ID)
+			if err == nil {
+				err = app.Models.Invoice.UpdateStatus(invoice.ID, data.InvoiceVoid)
+			}
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				app.ErrorLog.Println(err)
+			}
+		}
+	} else {
+		current.CancelAtPeriodEnd = true
+	}
+
+	err = app.Models.Subscription.Update(*current)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to cancel subscription"))
+		http.Redirect(w, r, "/members/cancel", http.StatusSeeOther)
+		return
+	}
+
+	if immediate {
+		err = app.invoiceFinalUsage(&last, now)
+		if err != nil {
+			app.ErrorLog.Println(err)
+		}
+	}
+
+	// the survey is optional, so a member who skipped it is not asked again
+	reason := r.Form.Get("reason")
+	if _, ok := data.CancellationReasons[reason]; !ok {
+		reason = ""
+	}
+	comment := strings.TrimSpace(r.Form.Get("comment"))
+	if reason != "" || comment != "" {
+		_, err = app.Models.CancellationFeedback.Insert(data.CancellationFeedback{
+			UserID:         user.ID,
+			SubscriptionID: current.ID,
+			Reason:         reason,
+			Comment:        comment,
+		})
+		if err != nil {
+			app.ErrorLog.Println(err)
+		}
+	}
+
+	msg := Message{
+		To:       []string{user.Email},
+		Subject:  app.T(r, "Your Subscription Has Been Canceled"),
+		Locale:   app.locale(r),
+		Template: "subscription-canceled",
+		Data: CancellationEmail{
+			Plan:         current.Plan,
+			Subscription: current,
+			Immediate:    immediate,
+		},
+	}
+	app.sendEmail(msg)
+
+	app.refreshSessionUser(r, user.ID)
+
+	if immediate {
+		app.Session.Put(r.Context(), "flash", app.T(r, "Your subscription has been canceled"))
+	} else {
+		app.Session.Put(r.Context(), "flash", app.T(r, "Your subscription will end on %s",
+			formatDate(app.locale(r), current.CurrentPeriodEnd)))
+	}
+	http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+}
+
+func (app *Config) PauseSubscription(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.Session.Get(r.Context(), "user").(data.User)
+	if !ok {
+		app.Session.Put(r.Context(), "error", app.T(r, "Log In First!"))
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	current, err := app.Models.Subscription.GetCurrentByUser(user.ID)
+	if err != nil || current.Status != data.SubscriptionActive || current.CancelAtPeriodEnd {
+		app.Session.Put(r.Context(), "error", app.T(r, "Only an active subscription can be paused"))
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+
+	now := time.Now()
+	current.Status = data.SubscriptionPaused
+	current.PausedAt = &now
+
+	err = app.Models.Subscription.Update(*current)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to pause subscription"))
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+
+	msg := Message{
+		To:       []string{user.Email},
+		Subject:  app.T(r, "Your Subscription Has Been Paused"),
+		Locale:   app.locale(r),
+		Template: "subscription-paused",
+		Data: SubscriptionEmail{
+			Plan:         current.Plan,
+			Subscription: current,
+		},
+	}
+	app.sendEmail(msg)
+
+	app.refreshSessionUser(r, user.ID)
+
+	app.Session.Put(r.Context(), "flash", app.T(r, "Your subscription has been paused"))
+	http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+}
+
+func (app *Config) ReactivateSubscription(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.Session.Get(r.Context(), "user").(data.User)
+	if !ok {
+		app.Session.Put(r.Context(), "error", app.T(r, "Log In First!"))
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	current, err := app.Models.Subscription.GetCurrentByUser(user.ID)
+	if err != nil || (!current.IsPaused() && !current.CancelAtPeriodEnd) {
+		app.Session.Put(r.Context(), "error", app.T(r, "You have no subscription to reactivate"))
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+
+	if current.IsPaused() {
+		// the member gets back the part of the period that was left when they paused; once
+		// that has run out the subscription renews as usual
+		now := time.Now()
+		remaining := current.CurrentPeriodEnd.Sub(*current.PausedAt)
+		if remaining < 0 {
+			remaining = 0
+		}
+		current.Status = data.SubscriptionActive
+		current.CurrentPeriodEnd = now.Add(remaining)
+		current.PausedAt = nil
+	} else {
+		current.CancelAtPeriodEnd = false
+		current.CanceledAt = nil
+	}
+
+	err = app.Models.Subscription.Update(*current)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to reactivate subscription"))
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+
+	msg := Message{
+		To:       []string{user.Email},
+		Subject:  app.T(r, "Your Subscription Has Been Reactivated"),
+		Locale:   app.locale(r),
+		Template: "subscription-reactivated",
+		Data: SubscriptionEmail{
+			Plan:         current.Plan,
+			Subscription: current,
+		},
+	}
+	app.sendEmail(msg)
+
+	app.refreshSessionUser(r, user.ID)
+
+	app.Session.Put(r.Context(), "flash", app.T(r, "Welcome back! Your subscription has been reactivated"))
+	http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+}
+
+// refreshSessionUser reloads the user in the session, e.g. after their plan changed
+func (app *Config) refreshSessionUser(r *http.Request, userID int) {
+	u, err := app.Models.User.GetOne(userID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		return
+	}
+	app.Session.Put(r.Context(), "user", *u)
+}
+
+func (app *Config) Invoices(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.Session.Get(r.Context(), "user").(data.User)
+	if !ok {
+		app.Session.Put(r.Context(), "error", app.T(r, "Log In First!"))
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	account, err := app.invoiceAccount(user)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	invoices, err := app.Models.Invoice.GetAllByUser(account.ID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["invoices"] = invoices
+	app.render(w, r, "invoices.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+func (app *Config) InvoicePDF(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.Session.Get(r.Context(), "user").(data.User)
+	if !ok {
+		app.Session.Put(r.Context(), "error", app.T(r, "Log In First!"))
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	account, err := app.invoiceAccount(user)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	invoice, err := app.Models.Invoice.GetOne(id)
+	if err != nil || invoice.UserID != account.ID {
+		http.NotFound(w, r)
+		return
+	}
+
+	pdf := app.generateInvoicePDF(account, invoice)
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="Invoice-%s.pdf"`, invoice.Number))
+	if err := pdf.Output(w); err != nil {
+		app.ErrorLog.Println(err)
+	}
+}
+
 func (app *Config) generateManual(u data.User, plan *data.Plan) *gofpdf.Fpdf {
 	pdf := gofpdf.New("P", "mm", "Letter", "")
 	pdf.SetMargins(10, 13, 10)
@@ -264,3 +1235,89 @@ func (app *Config) generateManual(u data.User, plan *data.Plan) *gofpdf.Fpdf {
 
 	return pdf
 }
+
+// billingAddress returns the lines of the billing address of u, leaving out those the
+// member has not filled in
+func billingAddress(u data.User) []string {
+	cityLine := strings.TrimSpace(strings.Join([]string{u.City, u.Region, u.PostalCode}, " "))
+
+	var lines []string
+	for _, line := range []string{u.AddressLine1, u.AddressLine2, cityLine, data.Countries[u.Country]} {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// generateInvoicePDF lays out invoice as a one page PDF in the language of u: company
+// header, customer block, line items and totals
+func (app *Config) generateInvoicePDF(u data.User, invoice *data.Invoice) *gofpdf.Fpdf {
+	pdf := gofpdf.New("P", "mm", "Letter", "")
+	pdf.SetMargins(15, 15, 15)
+	pdf.AddPage()
+
+	// the core fonts are cp1252 encoded, so translate our UTF-8 strings
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+
+	pdf.SetFont("Arial", "B", 18)
+	pdf.CellFormat(110, 10, tr(companyName), "", 0, "L", false, 0, "")
+	pdf.CellFormat(0, 10, tr(strings.ToUpper(translate(u.Locale, "Invoice"))), "", 1, "R", false, 0, "")
+
+	pdf.SetFont("Arial", "", 10)
+	pdf.CellFormat(110, 5, tr(app.Mailer.FromAddress), "", 0, "L", false, 0, "")
+	pdf.CellFormat(0, 5, tr(invoice.Number), "", 1, "R", false, 0, "")
+	pdf.CellFormat(110, 5, "", "", 0, "L", false, 0, "")
+	pdf.CellFormat(0, 5, tr(translate(u.Locale, "Issued: %s", formatDate(u.Locale, invoice.IssuedAt))), "", 1, "R", false, 0, "")
+	pdf.CellFormat(110, 5, "", "", 0, "L", false, 0, "")
+	pdf.CellFormat(0, 5, tr(translate(u.Locale, "Due: %s", formatDate(u.Locale, invoice.DueAt))), "", 1, "R", false, 0, "")
+	pdf.Ln(8)
+
+	pdf.SetFont("Arial", "B", 10)
+	pdf.CellFormat(0, 5, tr(translate(u.Locale, "Bill To")), "", 1, "L", false, 0, "")
+	pdf.SetFont("Arial", "", 10)
+	pdf.CellFormat(0, 5, tr(fmt.Sprintf("%s %s", u.FirstName, u.LastName)), "", 1, "L", false, 0, "")
+	pdf.CellFormat(0, 5, tr(u.Email), "", 1, "L", false, 0, "")
+	for _, line := range billingAddress(u) {
+		pdf.CellFormat(0, 5, tr(line), "", 1, "L", false, 0, "")
+	}
+	if u.TaxID != "" {
+		pdf.CellFormat(0, 5, tr(translate(u.Locale, "Tax ID: %s", u.TaxID)), "", 1, "L", false, 0, "")
+	}
+	pdf.Ln(8)
+
+	widths := []float64{100, 20, 30, 35}
+
+	pdf.SetFont("Arial", "B", 10)
+	pdf.SetFillColor(230, 230, 230)
+	pdf.CellFormat(widths[0], 7, tr(translate(u.Locale, "Description")), "B", 0, "L", true, 0, "")
+	pdf.CellFormat(widths[1], 7, tr(translate(u.Locale, "Qty")), "B", 0, "R", true, 0, "")
+	pdf.CellFormat(widths[2], 7, tr(translate(u.Locale, "Unit Price")), "B", 0, "R", true, 0, "")
+	pdf.CellFormat(widths[3], 7, tr(translate(u.Locale, "Amount")), "B", 1, "R", true, 0, "")
+
+	pdf.SetFont("Arial", "", 10)
+	for _, line := range invoice.Items() {
+		pdf.CellFormat(widths[0], 7, tr(line.Description), "", 0, "L", false, 0, "")
+		pdf.CellFormat(widths[1], 7, strconv.Itoa(line.Quantity), "", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[2], 7, tr(formatMoney(u.Locale, line.UnitAmount, invoice.Currency)), "", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[3], 7, tr(formatMoney(u.Locale, line.Amount, invoice.Currency)), "", 1, "R", false, 0, "")
+	}
+
+	labelWidth := widths[0] + widths[1] + widths[2]
+
+	pdf.CellFormat(labelWidth, 7, tr(translate(u.Locale, "Subtotal")), "T", 0, "R", false, 0, "")
+	pdf.CellFormat(widths[3], 7, tr(formatMoney(u.Locale, invoice.Subtotal, invoice.Currency)), "T", 1, "R", false, 0, "")
+	for _, line := range invoice.TaxLines() {
+		pdf.CellFormat(labelWidth, 7, tr(line.Description), "", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[3], 7, tr(formatMoney(u.Locale, line.Amount, invoice.Currency)), "", 1, "R", false, 0, "")
+	}
+	pdf.SetFont("Arial", "B", 10)
+	pdf.CellFormat(labelWidth, 7, tr(translate(u.Locale, "Total")), "", 0, "R", false, 0, "")
+	pdf.CellFormat(widths[3], 7, tr(formatMoney(u.Locale, invoice.Total, invoice.Currency)), "", 1, "R", false, 0, "")
+
+	pdf.Ln(8)
+	pdf.SetFont("Arial", "", 9)
+	pdf.CellFormat(0, 5, tr(translate(u.Locale, "Status: %s", translate(u.Locale, invoice.Status))), "", 1, "L", false, 0, "")
+
+	return pdf
+}
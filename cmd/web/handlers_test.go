@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
+	"github.com/go-chi/chi/v5"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
 	"subscription-service/data"
 	"testing"
+	"time"
 )
 
 var pageTests = []struct {
@@ -30,6 +33,146 @@ var pageTests = []struct {
 		handler:      testApp.LoginPage,
 		expectedHTML: `<h1 class="mt-5">Login</h1>`,
 	},
+	{
+		name:         "login page in a chosen language",
+		url:          "/login",
+		expectedCode: http.StatusOK,
+		handler:      testApp.LoginPage,
+		sessionData:  map[string]any{"locale": "de"},
+		expectedHTML: `<h1 class="mt-5">Anmelden</h1>`,
+	},
+	{
+		name:         "usage",
+		url:          "/members/usage",
+		expectedCode: http.StatusOK,
+		handler:      testApp.UsagePage,
+		sessionData: map[string]any{
+			"userId": 1,
+			"user":   data.User{ID: 1},
+		},
+		expectedHTML: `<td class="text-end">$5.00</td>`,
+	},
+	{
+		name:         "usage of an organization member",
+		url:          "/members/usage",
+		expectedCode: http.StatusOK,
+		handler:      testApp.UsagePage,
+		sessionData: map[string]any{
+			"userId": 2,
+			"user":   data.User{ID: 2},
+		},
+		expectedHTML: `<td class="text-end">$15.00</td>`,
+	},
+	{
+		name:         "plans",
+		url:          "/members/plans",
+		expectedCode: http.StatusOK,
+		handler:      testApp.ChooseSubscription,
+		sessionData: map[string]any{
+			"userId": 1,
+			"user":   data.User{ID: 1},
+		},
+		expectedHTML: `<h1 class="mt-5">Plans</h1>`,
+	},
+	{
+		name:         "plans in euros",
+		url:          "/members/plans",
+		expectedCode: http.StatusOK,
+		handler:      testApp.ChooseSubscription,
+		sessionData: map[string]any{
+			"userId": 1,
+			"user":   data.User{ID: 1, Currency: "EUR"},
+		},
+		expectedHTML: `9.00 €/month`,
+	},
+	{
+		name:         "plans resuming a choice",
+		url:          "/members/plans?select=1&coupon=WELCOME20",
+		expectedCode: http.StatusOK,
+		handler:      testApp.ChooseSubscription,
+		sessionData: map[string]any{
+			"userId": 7,
+			"user":   data.User{ID: 7},
+		},
+		expectedHTML: `selectPlan( 1 , 'Bronze Plan', false, "WELCOME20");`,
+	},
+	{
+		name:         "invoices",
+		url:          "/members/invoices",
+		expectedCode: http.StatusOK,
+		handler:      testApp.Invoices,
+		sessionData: map[string]any{
+			"userId": 1,
+			"user":   data.User{ID: 1},
+		},
+		expectedHTML: `<td>INV-000001</td>`,
+	},
+	{
+		name:         "organization",
+		url:          "/members/organization",
+		expectedCode: http.StatusOK,
+		handler:      testApp.OrganizationPage,
+		sessionData: map[string]any{
+			"userId": 6,
+			"user":   data.User{ID: 6},
+		},
+		expectedHTML: `<td>new@example.com</td>`,
+	},
+	{
+		name:         "new organization",
+		url:          "/members/organization",
+		expectedCode: http.StatusOK,
+		handler:      testApp.OrganizationPage,
+		sessionData: map[string]any{
+			"userId": 1,
+			"user":   data.User{ID: 1},
+		},
+		expectedHTML: `<form method="post" action="/members/organization" class="row g-2">`,
+	},
+	{
+		name:         "payment method",
+		url:          "/members/payment-method?next=/members/plans?select=2",
+		expectedCode: http.StatusOK,
+		handler:      testApp.PaymentMethodPage,
+		sessionData: map[string]any{
+			"userId": 1,
+			"user":   data.User{ID: 1},
+		},
+		expectedHTML: `<h1 class="mt-5">Payment Method</h1>`,
+	},
+	{
+		name:         "past due banner",
+		url:          "/members/plans",
+		expectedCode: http.StatusOK,
+		handler:      testApp.ChooseSubscription,
+		sessionData: map[string]any{
+			"userId": 3,
+			"user":   data.User{ID: 3},
+		},
+		expectedHTML: pastDueWarning,
+	},
+	{
+		name:         "billing details",
+		url:          "/members/billing",
+		expectedCode: http.StatusOK,
+		handler:      testApp.BillingDetailsPage,
+		sessionData: map[string]any{
+			"userId": 1,
+			"user":   data.User{ID: 1, Country: "DE"},
+		},
+		expectedHTML: `<option value="DE" selected>Germany</option>`,
+	},
+	{
+		name:         "cancel",
+		url:          "/members/cancel",
+		expectedCode: http.StatusOK,
+		handler:      testApp.CancelPage,
+		sessionData: map[string]any{
+			"userId": 1,
+			"user":   data.User{ID: 1},
+		},
+		expectedHTML: `<h1 class="mt-5">Cancel Subscription</h1>`,
+	},
 	{
 		name:         "logout",
 		url:          "/logout",
@@ -72,6 +215,28 @@ func Test_Pages(t *testing.T) {
 	}
 }
 
+func TestConfig_ChooseSubscription(t *testing.T) {
+	templatesPath = "./templates"
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/members/plans", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+
+	testApp.Session.Put(ctx, "userId", 1)
+	testApp.Session.Put(ctx, "user", data.User{ID: 1})
+
+	testApp.ChooseSubscription(rw, req)
+
+	html := rw.Body.String()
+	if !strings.Contains(html, "Bronze Plan") {
+		t.Error("expected the Bronze Plan to be offered")
+	}
+	if strings.Contains(html, "Legacy Plan") {
+		t.Error("did not expect the archived Legacy Plan to be offered")
+	}
+}
+
 func TestConfig_Login(t *testing.T) {
 	templatesPath = "./templates"
 
@@ -97,27 +262,559 @@ func TestConfig_Login(t *testing.T) {
 	}
 }
 
+var subscribeTests = []struct {
+	name            string
+	form            url.Values
+	paymentMethodID string
+	paymentMode     string
+	expectedCode    int
+	expectedKey     string
+	expectedMessage string
+}{
+	{"change plan now", url.Values{"id": {"2"}}, "pm_test", FakeSucceed, http.StatusSeeOther, "flash", "Subscribed!"},
+	{"change plan at period end", url.Values{"id": {"2"}, "change": {"period_end"}}, "pm_test", FakeSucceed, http.StatusSeeOther, "flash", "Your plan will change to Silver Plan on"},
+	{"same plan", url.Values{"id": {"1"}}, "pm_test", FakeSucceed, http.StatusSeeOther, "flash", "Subscribed!"},
+	{"no payment method", url.Values{"id": {"2"}}, "", FakeSucceed, http.StatusSeeOther, "warning", "Add a payment method"},
+	{"payment declined", url.Values{"id": {"2"}}, "pm_test", FakeDecline, http.StatusSeeOther, "error", "Your payment was declined"},
+	{"payment failed", url.Values{"id": {"2"}}, "pm_test", FakeFail, http.StatusSeeOther, "error", "Your payment could not be processed"},
+	{"coupon", url.Values{"id": {"2"}, "coupon": {"welcome20"}}, "pm_test", FakeSucceed, http.StatusSeeOther, "flash", "Subscribed!"},
+	{"coupon at period end", url.Values{"id": {"2"}, "change": {"period_end"}, "coupon": {"SAVE5"}}, "pm_test", FakeSucceed, http.StatusSeeOther, "flash", "Your plan will change to Silver Plan on"},
+	{"unknown coupon", url.Values{"id": {"2"}, "coupon": {"NOPE"}}, "pm_test", FakeSucceed, http.StatusSeeOther, "error", "That promotion code is not valid"},
+	{"expired coupon", url.Values{"id": {"2"}, "coupon": {"EXPIRED"}}, "pm_test", FakeSucceed, http.StatusSeeOther, "error", "That promotion code has expired"},
+	{"coupon for another plan", url.Values{"id": {"3"}, "coupon": {"SILVER"}}, "pm_test", FakeSucceed, http.StatusSeeOther, "error", "That promotion code does not apply to this plan"},
+	{"coupon already used", url.Values{"id": {"2"}, "coupon": {"USED"}}, "pm_test", FakeSucceed, http.StatusSeeOther, "error", "You have already used that promotion code"},
+	{"coupon ran out", url.Values{"id": {"2"}, "coupon": {"LASTONE"}}, "pm_test", FakeSucceed, http.StatusSeeOther, "error", "That promotion code is no longer available"},
+	{"coupon ran out at period end", url.Values{"id": {"2"}, "change": {"period_end"}, "coupon": {"LASTONE"}}, "pm_test", FakeSucceed, http.StatusSeeOther, "error", "That promotion code is no longer available"},
+	{"archived plan", url.Values{"id": {"9"}}, "pm_test", FakeSucceed, http.StatusSeeOther, "error", "That plan is no longer available"},
+}
+
+// subscribeRequest returns a request choosing a plan on the plans page with form
+func subscribeRequest(form url.Values) *http.Request {
+	req, _ := http.NewRequest("POST", "/members/subscribe", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
 func TestConfig_SubscribeToPlan(t *testing.T) {
-	rw := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/subscribe?id=1", nil)
+	defer testPayments.SetMode(FakeSucceed)
+
+	for _, e := range subscribeTests {
+		testPayments.SetMode(e.paymentMode)
+
+		rw := httptest.NewRecorder()
+		req := subscribeRequest(e.form)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		testApp.Session.Put(ctx, "userId", 1)
+		testApp.Session.Put(ctx, "user", data.User{
+			ID:                1,
+			Email:             "admin@example.com",
+			FirstName:         "Admin",
+			LastName:          "Admin",
+			Active:            1,
+			PaymentCustomerID: "cus_test",
+			PaymentMethodID:   e.paymentMethodID,
+		})
+
+		handler := http.HandlerFunc(testApp.SubscribeToPlan)
+		handler.ServeHTTP(rw, req)
+
+		testApp.Wait.Wait()
+
+		if rw.Code != e.expectedCode {
+			t.Errorf("%s: expected status code %d but got %d", e.name, e.expectedCode, rw.Code)
+		}
+
+		msg := testApp.Session.PopString(ctx, e.expectedKey)
+		if !strings.HasPrefix(msg, e.expectedMessage) {
+			t.Errorf("%s: expected %s %q but got %q", e.name, e.expectedKey, e.expectedMessage, msg)
+		}
+	}
+}
+
+func TestConfig_SubscribeToPlan_duringTrial(t *testing.T) {
+	// user 11 is trialing the Bronze Plan without a payment method, so a change that ends
+	// the trial asks for one
+	tests := []struct {
+		name            string
+		form            url.Values
+		expectedKey     string
+		expectedMessage string
+	}{
+		{"plan without a trial", url.Values{"id": {"2"}}, "warning", "Add a payment method"},
+		{"plan trialed before", url.Values{"id": {"3"}}, "warning", "Add a payment method"},
+		{"plan not trialed yet", url.Values{"id": {"4"}}, "flash", "Subscribed!"},
+		{"coupon ran out", url.Values{"id": {"4"}, "coupon": {"LASTONE"}}, "error", "That promotion code is no longer available"},
+	}
+
+	for _, e := range tests {
+		req := subscribeRequest(e.form)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		testApp.Session.Put(ctx, "userId", 11)
+		testApp.Session.Put(ctx, "user", data.User{ID: 11, Email: "member@example.com"})
+
+		testApp.SubscribeToPlan(httptest.NewRecorder(), req)
+		testApp.Wait.Wait()
+
+		if msg := testApp.Session.PopString(ctx, e.expectedKey); !strings.HasPrefix(msg, e.expectedMessage) {
+			t.Errorf("%s: expected %s %q but got %q", e.name, e.expectedKey, e.expectedMessage, msg)
+		}
+	}
+}
+
+func TestConfig_SubscribeToPlan_pastDue(t *testing.T) {
+	// user 3 is past due, so the open invoice has to be paid before the plan can change
+	for _, form := range []url.Values{{"id": {"2"}}, {"id": {"2"}, "change": {"period_end"}}} {
+		req := subscribeRequest(form)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		testApp.Session.Put(ctx, "userId", 3)
+		testApp.Session.Put(ctx, "user", data.User{ID: 3, PaymentCustomerID: "cus_test", PaymentMethodID: "pm_test"})
+
+		rw := httptest.NewRecorder()
+		testApp.SubscribeToPlan(rw, req)
+
+		if location := rw.Header().Get("Location"); location != "/members/payment-method" {
+			t.Errorf("%s: expected a redirect to /members/payment-method but got %q", form.Encode(), location)
+		}
+		if msg := testApp.Session.PopString(ctx, "error"); !strings.HasPrefix(msg, "Your last payment failed") {
+			t.Errorf("%s: expected the plan change to be refused but got %q", form.Encode(), msg)
+		}
+	}
+}
+
+func TestConfig_SubscribeToPlan_email(t *testing.T) {
+	sentMail()
+
+	req := subscribeRequest(url.Values{"id": {"2"}})
 	ctx := getCtx(req)
 	req = req.WithContext(ctx)
 
 	testApp.Session.Put(ctx, "userId", 1)
 	testApp.Session.Put(ctx, "user", data.User{
-		ID:        1,
-		Email:     "admin@example.com",
-		FirstName: "Admin",
-		LastName:  "Admin",
-		Active:    1,
+		ID:                1,
+		Email:             "admin@example.com",
+		FirstName:         "Admin",
+		PaymentCustomerID: "cus_test",
+		PaymentMethodID:   "pm_test",
 	})
 
-	handler := http.HandlerFunc(testApp.SubscribeToPlan)
-	handler.ServeHTTP(rw, req)
+	testApp.SubscribeToPlan(httptest.NewRecorder(), req)
 
-	testApp.Wait.Wait()
+	subjects := make(map[string]data.Email)
+	for _, email := range sentMail() {
+		subjects[email.Subject] = email
+	}
 
-	if rw.Code != http.StatusSeeOther {
-		t.Errorf("expected status code %d but got %d", http.StatusSeeOther, rw.Code)
+	invoice, ok := subjects["Your Invoice Data"]
+	if !ok {
+		t.Fatal("expected the invoice to be emailed")
+	}
+	if invoice.To[0] != "admin@example.com" {
+		t.Errorf("expected the invoice to go to admin@example.com but it went to %v", invoice.To)
+	}
+	if len(invoice.Attachments) != 1 {
+		t.Errorf("expected the invoice PDF to be attached but got %v", invoice.Attachments)
+	}
+
+	manual, ok := subjects["Your Manual"]
+	if !ok {
+		t.Fatal("expected the manual to be emailed")
+	}
+	if _, ok := manual.Attachments["Manual.pdf"]; !ok {
+		t.Errorf("expected the manual to be attached but got %v", manual.Attachments)
+	}
+}
+
+func TestConfig_SavePaymentMethod(t *testing.T) {
+	tests := []struct {
+		name             string
+		next             string
+		expectedLocation string
+	}{
+		{"back to checkout", "/members/plans?select=2", "/members/plans?select=2"},
+		{"elsewhere", "https://example.com/", "/members/plans"},
+	}
+
+	for _, e := range tests {
+		postedData := url.Values{
+			"token": {FakeTokenVisa},
+			"next":  {e.next},
+		}
+
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/members/payment-method", strings.NewReader(postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		testApp.Session.Put(ctx, "userId", 1)
+		testApp.Session.Put(ctx, "user", data.User{ID: 1})
+
+		handler := http.HandlerFunc(testApp.SavePaymentMethod)
+		handler.ServeHTTP(rw, req)
+
+		if location := rw.Header().Get("Location"); location != e.expectedLocation {
+			t.Errorf("%s: expected redirect to %s but got %s", e.name, e.expectedLocation, location)
+		}
+
+		user := testApp.Session.Get(ctx, "user").(data.User)
+		if user.PaymentCustomerID == "" || user.PaymentMethodID == "" {
+			t.Errorf("%s: expected payment details to be stored in the session", e.name)
+		}
+	}
+}
+
+var subscriptionActionTests = []struct {
+	name            string
+	url             string
+	userID          int
+	form            url.Values
+	handler         http.HandlerFunc
+	expectedKey     string
+	expectedMessage string
+}{
+	{"cancel now", "/members/cancel", 1, url.Values{"mode": {"immediate"}, "reason": {"too_expensive"}}, testApp.CancelSubscription, "flash", "Your subscription has been canceled"},
+	{"cancel at period end", "/members/cancel", 1, url.Values{"mode": {"period_end"}}, testApp.CancelSubscription, "flash", "Your subscription will end on"},
+	{"cancel past due", "/members/cancel", 3, url.Values{"mode": {"immediate"}}, testApp.CancelSubscription, "flash", "Your subscription has been canceled"},
+	{"cancel paused", "/members/cancel", 4, url.Values{"mode": {"period_end"}}, testApp.CancelSubscription, "flash", "Your subscription has been canceled"},
+	{"pause", "/members/pause", 1, nil, testApp.PauseSubscription, "flash", "Your subscription has been paused"},
+	{"pause past due", "/members/pause", 3, nil, testApp.PauseSubscription, "error", "Only an active subscription can be paused"},
+	{"reactivate paused", "/members/reactivate", 4, nil, testApp.ReactivateSubscription, "flash", "Welcome back!"},
+	{"reactivate active", "/members/reactivate", 1, nil, testApp.ReactivateSubscription, "error", "You have no subscription to reactivate"},
+}
+
+func TestConfig_subscriptionActions(t *testing.T) {
+	for _, e := range subscriptionActionTests {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", e.url, strings.NewReader(e.form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		testApp.Session.Put(ctx, "userId", e.userID)
+		testApp.Session.Put(ctx, "user", data.User{ID: e.userID, Email: "admin@example.com"})
+
+		e.handler.ServeHTTP(rw, req)
+
+		testApp.Wait.Wait()
+
+		if rw.Code != http.StatusSeeOther {
+			t.Errorf("%s: expected status code %d but got %d", e.name, http.StatusSeeOther, rw.Code)
+		}
+
+		msg := testApp.Session.PopString(ctx, e.expectedKey)
+		if !strings.HasPrefix(msg, e.expectedMessage) {
+			t.Errorf("%s: expected %s %q but got %q", e.name, e.expectedKey, e.expectedMessage, msg)
+		}
+	}
+}
+
+func TestConfig_CancelSubscription_usage(t *testing.T) {
+	tests := []struct {
+		name     string
+		userID   int
+		mode     string
+		invoiced bool
+	}{
+		{"immediately", 1, data.ChangeImmediately, true},
+		{"at period end", 1, data.ChangeAtPeriodEnd, false},
+		{"trial", 11, data.ChangeImmediately, false},
+	}
+
+	for _, e := range tests {
+		sentMail()
+
+		form := url.Values{"mode": {e.mode}}
+		req, _ := http.NewRequest("POST", "/members/cancel", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		testApp.Session.Put(ctx, "userId", e.userID)
+		testApp.Session.Put(ctx, "user", data.User{ID: e.userID, Email: "admin@example.com"})
+
+		testApp.CancelSubscription(httptest.NewRecorder(), req)
+
+		invoiced := false
+		for _, email := range sentMail() {
+			if email.Subject == "Your Invoice Data" {
+				invoiced = true
+			}
+		}
+		if invoiced != e.invoiced {
+			t.Errorf("%s: expected the usage so far to be invoiced %t but got %t", e.name, e.invoiced, invoiced)
+		}
+	}
+}
+
+func TestConfig_SaveBillingDetails(t *testing.T) {
+	tests := []struct {
+		name             string
+		userID           int
+		country          string
+		taxID            string
+		expectedTaxID    string
+		expectedVerified bool
+		expectedError    string
+	}{
+		{"business", 1, "DE", "de 123.456.789", "DE123456789", false, ""},
+		{"consumer", 1, "US", "", "", false, ""},
+		{"business elsewhere", 1, "US", "12-3456789", "123456789", false, ""},
+		{"unsupported country", 1, "XX", "", "", false, "We cannot bill to that country"},
+		{"tax id without country", 1, "", "DE123456789", "", false, "Enter a valid tax ID together with your country"},
+		{"malformed vat id", 1, "DE", "AAAA", "", false, "Enter a valid tax ID together with your country"},
+		{"vat id of another country", 1, "DE", "FR12345678901", "", false, "Enter a valid tax ID together with your country"},
+		{"verified tax id kept", 8, "DE", "DE123456789", "DE123456789", true, ""},
+		{"verified tax id changed", 8, "DE", "DE987654321", "DE987654321", false, ""},
+	}
+
+	for _, e := range tests {
+		postedData := url.Values{
+			"address_line1": {"1 Main Street"},
+			"city":          {"Berlin"},
+			"country":       {e.country},
+			"tax_id":        {e.taxID},
+		}
+
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/members/billing", strings.NewReader(postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		testApp.Session.Put(ctx, "userId", e.userID)
+		testApp.Session.Put(ctx, "user", data.User{ID: e.userID})
+
+		handler := http.HandlerFunc(testApp.SaveBillingDetails)
+		handler.ServeHTTP(rw, req)
+
+		if rw.Code != http.StatusSeeOther {
+			t.Errorf("%s: expected status code %d but got %d", e.name, http.StatusSeeOther, rw.Code)
+		}
+
+		if msg := testApp.Session.PopString(ctx, "error"); msg != e.expectedError {
+			t.Errorf("%s: expected error %q but got %q", e.name, e.expectedError, msg)
+		}
+
+		user := testApp.Session.Get(ctx, "user").(data.User)
+		if e.expectedError == "" && user.TaxID != e.expectedTaxID {
+			t.Errorf("%s: expected tax ID %q but got %q", e.name, e.expectedTaxID, user.TaxID)
+		}
+		if e.expectedError == "" && user.TaxIDVerified != e.expectedVerified {
+			t.Errorf("%s: expected the tax ID verified %t but got %t", e.name, e.expectedVerified, user.TaxIDVerified)
+		}
+	}
+}
+
+func TestConfig_buildInvoice(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	oldPlan := data.Plan{ID: 1, PlanName: "Bronze Plan", PlanAmount: 1000}
+	newPlan := data.Plan{ID: 2, PlanName: "Silver Plan", PlanAmount: 2000}
+
+	sub := data.Subscription{
+		ID:                 1,
+		PlanID:             oldPlan.ID,
+		CurrentPeriodStart: start,
+		CurrentPeriodEnd:   start.AddDate(0, 0, 30),
+		Plan:               &oldPlan,
+	}
+
+	invoice := testApp.buildInvoice(data.User{ID: 1}, &oldPlan, 1, sub.CurrentPeriodStart, sub.CurrentPeriodEnd, nil)
+	if invoice.Total != 1000 || len(invoice.Lines) != 1 {
+		t.Errorf("expected one line totalling 1000 but got %d lines totalling %d", len(invoice.Lines), invoice.Total)
+	}
+
+	// half way through the period: $5.00 credit, $10.00 charge
+	proration := data.Prorate(sub, newPlan, start.AddDate(0, 0, 15))
+	if proration.Credit != 500 || proration.Charge != 1000 {
+		t.Errorf("expected credit 500 and charge 1000 but got %d and %d", proration.Credit, proration.Charge)
+	}
+
+	invoice = testApp.buildInvoice(data.User{ID: 1}, &newPlan, 1, proration.ChangeAt, proration.PeriodEnd, &proration)
+	if invoice.Total != 500 {
+		t.Errorf("expected prorated total 500 but got %d", invoice.Total)
+	}
+	if invoice.Status != data.InvoiceOpen {
+		t.Errorf("expected status %s but got %s", data.InvoiceOpen, invoice.Status)
+	}
+
+	// downgrading half way through the period: $10.00 credit, $5.00 charge, so the
+	// invoice comes to nothing and the $5.00 left goes to the balance
+	sub.PlanID = newPlan.ID
+	sub.Plan = &newPlan
+	proration = data.Prorate(sub, oldPlan, start.AddDate(0, 0, 15))
+	invoice = testApp.buildInvoice(data.User{ID: 1}, &oldPlan, 1, proration.ChangeAt, proration.PeriodEnd, &proration)
+	if invoice.Total != -500 {
+		t.Errorf("expected prorated total -500 but got %d", invoice.Total)
+	}
+	balance := settleCredit(&invoice, 0, DefaultLocale)
+	if invoice.Total != 0 || balance != 500 {
+		t.Errorf("expected total 0 and a balance of 500 but got %d and %d", invoice.Total, balance)
+	}
+
+	// a plan priced per seat is charged once for every seat
+	teamPlan := data.Plan{ID: 3, PlanName: "Team Plan", PlanAmount: 500, PerSeat: true}
+	invoice = testApp.buildInvoice(data.User{ID: 1}, &teamPlan, 4, sub.CurrentPeriodStart, sub.CurrentPeriodEnd, nil)
+	if invoice.Total != 2000 || len(invoice.Lines) != 1 || invoice.Lines[0].Quantity != 4 {
+		t.Errorf("expected one line for 4 seats totalling 2000 but got %d lines totalling %d", len(invoice.Lines), invoice.Total)
+	}
+
+	// the lines are written in the member's language
+	invoice = testApp.buildInvoice(data.User{ID: 1, Locale: "de"}, &teamPlan, 4, sub.CurrentPeriodStart, sub.CurrentPeriodEnd, nil)
+	if expected := "Team Plan, 4 Plätze (01.01.2024 - 31.01.2024)"; invoice.Lines[0].Description != expected {
+		t.Errorf("expected description %q but got %q", expected, invoice.Lines[0].Description)
+	}
+}
+
+func Test_prorateIntervalChange(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	monthly := data.Plan{ID: 1, PlanName: "Bronze Plan", PlanAmount: 1000, Interval: data.IntervalMonth}
+	yearly := data.Plan{ID: 2, PlanName: "Bronze Plan Yearly", PlanAmount: 12000, Interval: data.IntervalYear}
+
+	tests := []struct {
+		name           string
+		oldPlan        data.Plan
+		newPlan        data.Plan
+		periodEnd      time.Time
+		at             time.Time
+		expectedCredit int
+		expectedCharge int
+	}{
+		// 15 of 30 days left of the month; 15 of the 366 days of a year on the new plan
+		{"monthly to yearly", monthly, yearly, start.AddDate(0, 0, 30), start.AddDate(0, 0, 15), 500, 492},
+		// 30 of 366 days left of the year; 30 of the 31 days of a month on the new plan
+		{"yearly to monthly", yearly, monthly, start.AddDate(1, 0, 0), start.AddDate(1, 0, -30), 984, 968},
+	}
+
+	for _, e := range tests {
+		sub := data.Subscription{
+			PlanID:             e.oldPlan.ID,
+			Quantity:           1,
+			CurrentPeriodStart: start,
+			CurrentPeriodEnd:   e.periodEnd,
+			Plan:               &e.oldPlan,
+		}
+
+		proration := data.Prorate(sub, e.newPlan, e.at)
+		if proration.Credit != e.expectedCredit || proration.Charge != e.expectedCharge {
+			t.Errorf("%s: expected credit %d and charge %d but got %d and %d", e.name,
+				e.expectedCredit, e.expectedCharge, proration.Credit, proration.Charge)
+		}
+	}
+}
+
+func Test_settleCredit(t *testing.T) {
+	tests := []struct {
+		name            string
+		amounts         []int
+		balance         int
+		expectedTotal   int
+		expectedBalance int
+	}{
+		{"no credit", []int{1000}, 0, 1000, 0},
+		{"credit covers part", []int{1000}, 400, 600, 0},
+		{"credit covers all", []int{1000}, 1500, 0, 500},
+		{"downgrade", []int{-1000, 500}, 0, 0, 500},
+		{"downgrade adds to credit", []int{-1000, 500}, 200, 0, 700},
+	}
+
+	for _, e := range tests {
+		invoice := data.Invoice{Currency: data.DefaultCurrency}
+		for _, amount := range e.amounts {
+			invoice.AddLine(data.LineProration, "Change", 1, amount)
+		}
+
+		balance := settleCredit(&invoice, e.balance, DefaultLocale)
+		if invoice.Total != e.expectedTotal {
+			t.Errorf("%s: expected total %d but got %d", e.name, e.expectedTotal, invoice.Total)
+		}
+		if balance != e.expectedBalance {
+			t.Errorf("%s: expected balance %d but got %d", e.name, e.expectedBalance, balance)
+		}
+	}
+}
+
+func TestConfig_InvoicePDF(t *testing.T) {
+	tests := []struct {
+		name         string
+		userID       int
+		expectedCode int
+	}{
+		{"own invoice", 1, http.StatusOK},
+		{"someone else's invoice", 2, http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/invoices/1/pdf", nil)
+
+		chiCtx := chi.NewRouteContext()
+		chiCtx.URLParams.Add("id", "1")
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		testApp.Session.Put(ctx, "userId", e.userID)
+		testApp.Session.Put(ctx, "user", data.User{ID: e.userID, FirstName: "Admin", LastName: "Admin"})
+
+		handler := http.HandlerFunc(testApp.InvoicePDF)
+		handler.ServeHTTP(rw, req)
+
+		if rw.Code != e.expectedCode {
+			t.Errorf("%s: expected status code %d but got %d", e.name, e.expectedCode, rw.Code)
+		}
+
+		if e.expectedCode == http.StatusOK && rw.Header().Get("Content-Type") != "application/pdf" {
+			t.Errorf("%s: expected a pdf but got %s", e.name, rw.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestConfig_SetCurrency(t *testing.T) {
+	tests := []struct {
+		name             string
+		currency         string
+		expectedCurrency string
+		expectedError    string
+	}{
+		{"supported", "GBP", "GBP", ""},
+		{"unsupported", "XYZ", "USD", "Unsupported currency"},
+	}
+
+	for _, e := range tests {
+		postedData := url.Values{
+			"currency": {e.currency},
+		}
+
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/members/currency", strings.NewReader(postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		testApp.Session.Put(ctx, "userId", 1)
+		testApp.Session.Put(ctx, "user", data.User{ID: 1, Currency: "USD"})
+
+		handler := http.HandlerFunc(testApp.SetCurrency)
+		handler.ServeHTTP(rw, req)
+
+		if rw.Code != http.StatusSeeOther {
+			t.Errorf("%s: expected status code %d but got %d", e.name, http.StatusSeeOther, rw.Code)
+		}
+
+		user := testApp.Session.Get(ctx, "user").(data.User)
+		if user.Currency != e.expectedCurrency {
+			t.Errorf("%s: expected currency %s but got %s", e.name, e.expectedCurrency, user.Currency)
+		}
+
+		if msg := testApp.Session.PopString(ctx, "error"); msg != e.expectedError {
+			t.Errorf("%s: expected error %q but got %q", e.name, e.expectedError, msg)
+		}
 	}
 }
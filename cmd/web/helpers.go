@@ -1,6 +1,25 @@
 package main
 
-func (app *Config) sendEmail(msg Message) {
-	app.Wait.Add(1)
-	app.Mailer.MailChan <- msg
+import (
+	"fmt"
+	"subscription-service/data"
+)
+
+// sendInvoice renders invoice as a PDF and emails it to user and the billing contacts of
+// their organization, attached to msg. The data of msg is expected to show the invoice.
+func (app *Config) sendInvoice(user data.User, invoice *data.Invoice, msg Message) {
+	invoicePath := fmt.Sprintf("%s/%d_%s.pdf", tmpPath, user.ID, invoice.Number)
+	pdf := app.generateInvoicePDF(user, invoice)
+	err := pdf.OutputFileAndClose(invoicePath)
+	if err != nil {
+		app.ErrorChan <- err
+		return
+	}
+
+	if msg.AttachmentMap == nil {
+		msg.AttachmentMap = make(map[string]string)
+	}
+	msg.AttachmentMap[fmt.Sprintf("Invoice-%s.pdf", invoice.Number)] = invoicePath
+
+	app.sendBillingEmail(user, msg)
 }
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"subscription-service/data"
+	"time"
+)
+
+// DefaultLocale is the language the site is written in. Its strings, in the code and
+// the templates, are the keys of the catalogs of the other locales.
+const DefaultLocale = "en"
+
+// localeKey is the key the locale of a request is stored under in its context
+const localeKey contextKey = "locale"
+
+// Locale describes how text, dates and amounts are written in one language
+type Locale struct {
+	Code string
+	// Name is the name of the language in that language, for choosing it
+	Name string
+	// DateLayout is the layout dates are written with, in the form of time.Format
+	DateLayout string
+	// Decimal separates the fraction of an amount, Group the thousands
+	Decimal string
+	Group   string
+	// SymbolAfter puts the currency symbol after the amount, whatever the currency
+	SymbolAfter bool
+}
+
+// Locales holds every language we have a catalog for, keyed by language code
+var Locales = map[string]Locale{
+	"en": {Code: "en", Name: "English", DateLayout: "Jan 2, 2006", Decimal: ".", Group: ","},
+	"de": {Code: "de", Name: "Deutsch", DateLayout: "02.01.2006", Decimal: ",", Group: ".", SymbolAfter: true},
+	"es": {Code: "es", Name: "Español", DateLayout: "02/01/2006", Decimal: ",", Group: ".", SymbolAfter: true},
+}
+
+// localeFS holds the catalogs, one locales/<code>.json per locale but the default. Each
+// maps the English text to its translation; text missing from a catalog stays English.
+//
+//go:embed locales/*.json
+var localeFS embed.FS
+
+// catalogs holds the translations of every locale, keyed by language code
+var catalogs = mustLoadCatalogs(localeFS)
+
+// mustLoadCatalogs reads the catalogs in fsys. The catalogs are built into the binary,
+// so a broken one is a bug and it panics.
+func mustLoadCatalogs(fsys fs.FS) map[string]map[string]string {
+	files, err := fs.Glob(fsys, "locales/*.json")
+	if err != nil {
+		panic(err)
+	}
+
+	loaded := make(map[string]map[string]string)
+	for _, file := range files {
+		code := strings.TrimSuffix(path.Base(file), ".json")
+		if _, ok := Locales[code]; !ok {
+			panic(fmt.Sprintf("catalog %s is for an unknown locale", file))
+		}
+
+		content, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			panic(err)
+		}
+
+		var catalog map[string]string
+		if err := json.Unmarshal(content, &catalog); err != nil {
+			panic(fmt.Sprintf("catalog %s: %s", file, err))
+		}
+		loaded[code] = catalog
+	}
+
+	return loaded
+}
+
+// SupportedLocales returns the codes of all languages we have, sorted
+func SupportedLocales() []string {
+	var codes []string
+	for code := range Locales {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// IsSupportedLocale reports whether code is a language we have
+func IsSupportedLocale(code string) bool {
+	_, ok := Locales[code]
+	return ok
+}
+
+// getLocale returns the locale for code, or the default locale if we do not have it
+func getLocale(code string) Locale {
+	if l, ok := Locales[code]; ok {
+		return l
+	}
+	return Locales[DefaultLocale]
+}
+
+// translate returns the translation of key into locale, formatted with args if there
+// are any. Keys are written in English, and are returned as they are when there is no
+// translation.
+func translate(locale, key string, args ...any) string {
+	if translation, ok := catalogs[locale][key]; ok && translation != "" {
+		key = translation
+	}
+	if len(args) == 0 {
+		return key
+	}
+	return fmt.Sprintf(key, args...)
+}
+
+// formatDate writes t the way dates are written in locale
+func formatDate(locale string, t time.Time) string {
+	return t.Format(getLocale(locale).DateLayout)
+}
+
+// formatMoney writes an amount in minor units of currency the way amounts are written
+// in locale. English follows the conventions of the currency itself.
+func formatMoney(locale string, amount int, currency string) string {
+	l := getLocale(locale)
+	c := data.GetCurrency(currency)
+	if l.Code == DefaultLocale {
+		return c.Format(amount)
+	}
+
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	whole, fraction, _ := strings.Cut(c.Number(amount), ".")
+	number := groupDigits(whole, l.Group)
+	if fraction != "" {
+		number += l.Decimal + fraction
+	}
+
+	if l.SymbolAfter {
+		return fmt.Sprintf("%s%s %s", sign, number, c.Symbol)
+	}
+	return fmt.Sprintf("%s%s%s", sign, c.Symbol, number)
+}
+
+// formatInterval writes a billing interval of count days, weeks, months or years in
+// locale, the way Plan.IntervalForDisplay does in English
+func formatInterval(locale, interval string, count int) string {
+	if interval == "" {
+		interval = data.IntervalMonth
+	}
+	if count <= 1 {
+		return translate(locale, interval)
+	}
+	return translate(locale, "%d "+interval+"s", count)
+}
+
+// groupDigits separates the thousands of a whole number with sep
+func groupDigits(digits, sep string) string {
+	for i := len(digits) - 3; i > 0; i -= 3 {
+		digits = digits[:i] + sep + digits[i:]
+	}
+	return digits
+}
+
+// negotiateLocale returns the language we have which the Accept-Language header
+// prefers most, or the default locale if we have none of them. A regional variant, such
+// as de-AT, is matched by its language.
+func negotiateLocale(acceptLanguage string) string {
+	type preference struct {
+		tag string
+		q   float64
+	}
+
+	var preferences []preference
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if tag == "" || tag == "*" || q <= 0 {
+			continue
+		}
+		preferences = append(preferences, preference{strings.ToLower(tag), q})
+	}
+
+	sort.SliceStable(preferences, func(i, j int) bool { return preferences[i].q > preferences[j].q })
+
+	for _, p := range preferences {
+		language, _, _ := strings.Cut(p.tag, "-")
+		if IsSupportedLocale(language) {
+			return language
+		}
+	}
+
+	return DefaultLocale
+}
+
+// localeFuncs returns the functions available in templates rendered in locale:
+//
+//	{{t "Hello %s," .User.FirstName}}     translates text
+//	{{date .CreatedAt}}                   writes a date
+//	{{money .Amount .Currency}}           writes an amount in minor units
+//	{{interval .Interval .IntervalCount}} writes a billing interval
+//	{{year}}                              is the current year
+//	{{locales}}                           lists the languages we have
+func localeFuncs(locale string) map[string]any {
+	return map[string]any{
+		"t": func(key string, args ...any) string {
+			return translate(locale, key, args...)
+		},
+		"date": func(t time.Time) string {
+			return formatDate(locale, t)
+		},
+		"money": func(amount int, currency string) string {
+			return formatMoney(locale, amount, currency)
+		},
+		"interval": func(interval string, count int) string {
+			return formatInterval(locale, interval, count)
+		},
+		"year": func() int {
+			return time.Now().Year()
+		},
+		"locales": func() []Locale {
+			var locales []Locale
+			for _, code := range SupportedLocales() {
+				locales = append(locales, Locales[code])
+			}
+			return locales
+		},
+	}
+}
+
+// locale returns the language to answer r in: the one chosen by the user, if they
+// have, and otherwise the one their browser prefers most of those we have
+func (app *Config) locale(r *http.Request) string {
+	if locale, ok := r.Context().Value(localeKey).(string); ok {
+		return locale
+	}
+
+	if user, ok := app.Session.Get(r.Context(), "user").(data.User); ok && IsSupportedLocale(user.Locale) {
+		return user.Locale
+	}
+	if locale := app.Session.GetString(r.Context(), "locale"); IsSupportedLocale(locale) {
+		return locale
+	}
+	return negotiateLocale(r.Header.Get("Accept-Language"))
+}
+
+// T translates key into the language of r; see translate
+func (app *Config) T(r *http.Request, key string, args ...any) string {
+	return translate(app.locale(r), key, args...)
+}
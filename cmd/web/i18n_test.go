@@ -0,0 +1,350 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"subscription-service/data"
+	"testing"
+	"time"
+)
+
+func Test_negotiateLocale(t *testing.T) {
+	tests := []struct {
+		name           string
+		acceptLanguage string
+		expected       string
+	}{
+		{"none", "", "en"},
+		{"supported", "de", "de"},
+		{"regional variant", "es-MX", "es"},
+		{"case", "DE-at", "de"},
+		{"first supported", "fr, es;q=0.8, de;q=0.5", "es"},
+		{"by quality", "de;q=0.3, es;q=0.9", "es"},
+		{"unsupported", "fr, it", "en"},
+		{"refused", "de;q=0, es;q=0.1", "es"},
+		{"wildcard", "*", "en"},
+		{"malformed quality", "de;q=high, es", "es"},
+	}
+
+	for _, e := range tests {
+		if locale := negotiateLocale(e.acceptLanguage); locale != e.expected {
+			t.Errorf("%s: expected %s but got %s", e.name, e.expected, locale)
+		}
+	}
+}
+
+func Test_translate(t *testing.T) {
+	tests := []struct {
+		name     string
+		locale   string
+		key      string
+		args     []any
+		expected string
+	}{
+		{"default locale", "en", "Subscribed!", nil, "Subscribed!"},
+		{"translated", "de", "Subscribed!", nil, "Abonniert!"},
+		{"with arguments", "es", "Welcome to %s!", []any{"Acme"}, "¡Bienvenido a Acme!"},
+		{"reordered arguments", "de", "Your plan will change to %s on %s", []any{"Gold Plan", "01.02.2026"}, "Ihr Tarif wechselt am 01.02.2026 zu Gold Plan"},
+		{"missing translation", "de", "Not in the catalog", nil, "Not in the catalog"},
+		{"unknown locale", "fr", "Subscribed!", nil, "Subscribed!"},
+		{"verbs kept without arguments", "de", "Welcome to %s!", nil, "Willkommen bei %s!"},
+	}
+
+	for _, e := range tests {
+		if s := translate(e.locale, e.key, e.args...); s != e.expected {
+			t.Errorf("%s: expected %q but got %q", e.name, e.expected, s)
+		}
+	}
+}
+
+func Test_formatMoney(t *testing.T) {
+	tests := []struct {
+		name     string
+		locale   string
+		amount   int
+		currency string
+		expected string
+	}{
+		{"english", "en", 123456, "USD", "$1234.56"},
+		{"english follows the currency", "en", 999, "EUR", "9.99 €"},
+		{"german", "de", 123456, "USD", "1.234,56 $"},
+		{"german euros", "de", 999, "EUR", "9,99 €"},
+		{"spanish millions", "es", 123456789, "EUR", "1.234.567,89 €"},
+		{"no minor units", "de", 1500, "JPY", "1.500 ¥"},
+		{"negative", "es", -250, "GBP", "-2,50 £"},
+		{"unknown locale", "fr", 999, "USD", "$9.99"},
+	}
+
+	for _, e := range tests {
+		if s := formatMoney(e.locale, e.amount, e.currency); s != e.expected {
+			t.Errorf("%s: expected %q but got %q", e.name, e.expected, s)
+		}
+	}
+}
+
+func Test_formatDate(t *testing.T) {
+	date := time.Date(2026, time.March, 7, 12, 0, 0, 0, time.UTC)
+
+	tests := map[string]string{
+		"en": "Mar 7, 2026",
+		"de": "07.03.2026",
+		"es": "07/03/2026",
+		"fr": "Mar 7, 2026",
+	}
+
+	for locale, expected := range tests {
+		if s := formatDate(locale, date); s != expected {
+			t.Errorf("%s: expected %q but got %q", locale, expected, s)
+		}
+	}
+}
+
+func Test_formatInterval(t *testing.T) {
+	tests := []struct {
+		locale   string
+		interval string
+		count    int
+		expected string
+	}{
+		{"en", "month", 1, "month"},
+		{"en", "", 0, "month"},
+		{"en", "year", 2, "2 years"},
+		{"de", "month", 1, "Monat"},
+		{"de", "week", 3, "3 Wochen"},
+		{"es", "day", 10, "10 días"},
+	}
+
+	for _, e := range tests {
+		if s := formatInterval(e.locale, e.interval, e.count); s != e.expected {
+			t.Errorf("%s %d %s: expected %q but got %q", e.locale, e.count, e.interval, e.expected, s)
+		}
+	}
+}
+
+var (
+	// translatedInCode matches text translated in Go code, as app.T(r, "...") or
+	// translate(locale, "...")
+	translatedInCode = regexp.MustCompile(`(?:app\.T\(r, |translate\([\w.]+, )("(?:[^"\\]|\\.)*")`)
+	// translatedInTemplates matches text translated in templates, as {{t "..."}}
+	translatedInTemplates = regexp.MustCompile(`[{(]-?\s*t ("(?:[^"\\]|\\.)*")`)
+	// formatVerb matches the verbs of the fmt package used in messages
+	formatVerb = regexp.MustCompile(`%(?:\[\d+\])?[sd]`)
+)
+
+// translationKeys returns every text translated by the site: the literal text in the
+// code and the templates, and the text which is only translated as a value
+func translationKeys(t *testing.T) map[string]bool {
+	keys := make(map[string]bool)
+
+	sources := []struct {
+		pattern string
+		match   *regexp.Regexp
+	}{
+		{"*.go", translatedInCode},
+		{"templates/*.gohtml", translatedInTemplates},
+	}
+	for _, source := range sources {
+		files, err := filepath.Glob(source.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range files {
+			if strings.HasSuffix(file, "_test.go") {
+				continue
+			}
+			content, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, m := range source.match.FindAllStringSubmatch(string(content), -1) {
+				key, err := strconv.Unquote(m[1])
+				if err != nil {
+					t.Fatalf("%s: %s", file, err)
+				}
+				keys[key] = true
+			}
+		}
+	}
+
+	// text kept in constants and maps, and values from the data package
+	values := []string{pastDueWarning, forgotPasswordSent, "Unable to use that link"}
+	for _, msg := range tokenMessages {
+		values = append(values, msg)
+	}
+	for _, msg := range couponMessages {
+		values = append(values, msg)
+	}
+	for _, reason := range data.CancellationReasons {
+		values = append(values, reason)
+	}
+	for _, interval := range data.Intervals {
+		values = append(values, interval, "%d "+interval+"s")
+	}
+	values = append(values, data.InvoiceDraft, data.InvoiceOpen, data.InvoicePaid, data.InvoiceVoid)
+	values = append(values, data.SubscriptionTrialing, data.SubscriptionActive, data.SubscriptionPastDue,
+		data.SubscriptionPaused, data.SubscriptionCanceled, data.SubscriptionExpired)
+	values = append(values, data.RoleOwner, data.RoleBilling, data.RoleMember)
+	for _, value := range values {
+		keys[value] = true
+	}
+
+	// formatInterval builds its keys from the interval
+	delete(keys, "%d ")
+
+	return keys
+}
+
+// verbs counts the %s and %d verbs of a message, which a translation may reorder but
+// must keep
+func verbs(msg string) map[string]int {
+	counts := make(map[string]int)
+	for _, verb := range formatVerb.FindAllString(msg, -1) {
+		counts[verb[len(verb)-1:]]++
+	}
+	return counts
+}
+
+func TestCatalogs_complete(t *testing.T) {
+	keys := translationKeys(t)
+
+	for _, code := range SupportedLocales() {
+		if code == DefaultLocale {
+			if _, ok := catalogs[code]; ok {
+				t.Errorf("%s: the default locale is written in the code and needs no catalog", code)
+			}
+			continue
+		}
+
+		catalog, ok := catalogs[code]
+		if !ok {
+			t.Errorf("%s: no catalog", code)
+			continue
+		}
+
+		for key := range keys {
+			translation, ok := catalog[key]
+			if !ok {
+				t.Errorf("%s: no translation of %q", code, key)
+				continue
+			}
+
+			if !reflect.DeepEqual(verbs(translation), verbs(key)) {
+				t.Errorf("%s: translation of %q does not keep its verbs: %q", code, key, translation)
+			}
+		}
+
+		for key := range catalog {
+			if !keys[key] {
+				t.Errorf("%s: %q is translated but not used", code, key)
+			}
+		}
+	}
+}
+
+func TestConfig_Localize(t *testing.T) {
+	tests := []struct {
+		name           string
+		acceptLanguage string
+		sessionLocale  string
+		userLocale     string
+		expected       string
+	}{
+		{"default", "", "", "", "en"},
+		{"browser", "es-ES,es;q=0.9", "", "", "es"},
+		{"chosen for the session", "es", "de", "", "de"},
+		{"saved for the user", "es", "en", "de", "de"},
+		{"unsupported choice", "es", "fr", "", "es"},
+	}
+
+	for _, e := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if e.acceptLanguage != "" {
+			req.Header.Set("Accept-Language", e.acceptLanguage)
+		}
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		if e.sessionLocale != "" {
+			testApp.Session.Put(ctx, "locale", e.sessionLocale)
+		}
+		if e.userLocale != "" {
+			testApp.Session.Put(ctx, "user", data.User{ID: 1, Locale: e.userLocale})
+		}
+
+		var locale string
+		handler := testApp.Localize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			locale = testApp.locale(r)
+		}))
+
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+
+		if locale != e.expected {
+			t.Errorf("%s: expected locale %s but got %s", e.name, e.expected, locale)
+		}
+		if language := rw.Header().Get("Content-Language"); language != e.expected {
+			t.Errorf("%s: expected Content-Language %s but got %s", e.name, e.expected, language)
+		}
+	}
+}
+
+func TestConfig_SetLocale(t *testing.T) {
+	tests := []struct {
+		name             string
+		locale           string
+		next             string
+		user             bool
+		expectedLocale   string
+		expectedError    string
+		expectedLocation string
+	}{
+		{"visitor", "de", "/login", false, "de", "", "/login"},
+		{"user", "es", "/members/plans?x=1", true, "es", "", "/members/plans?x=1"},
+		{"unsupported", "fr", "/login", false, "", "Unsupported language", "/login"},
+		{"no way back", "de", "", false, "de", "", "/"},
+		{"elsewhere", "de", "//example.com/", false, "de", "", "/"},
+		{"elsewhere by backslash", "de", `/\example.com`, false, "de", "", "/"},
+		{"absolute", "de", "https://example.com/", false, "de", "", "/"},
+	}
+
+	for _, e := range tests {
+		form := url.Values{"locale": {e.locale}, "next": {e.next}}
+		req := httptest.NewRequest("POST", "/locale", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		if e.user {
+			testApp.Session.Put(ctx, "user", data.User{ID: 1, Email: "admin@example.com"})
+		}
+
+		rw := httptest.NewRecorder()
+		testApp.SetLocale(rw, req)
+
+		if rw.Code != http.StatusSeeOther {
+			t.Errorf("%s: expected status code %d but got %d", e.name, http.StatusSeeOther, rw.Code)
+		}
+		if location := rw.Header().Get("Location"); location != e.expectedLocation {
+			t.Errorf("%s: expected redirect to %q but got %q", e.name, e.expectedLocation, location)
+		}
+		if locale := testApp.Session.GetString(ctx, "locale"); locale != e.expectedLocale {
+			t.Errorf("%s: expected %q in the session but got %q", e.name, e.expectedLocale, locale)
+		}
+		if msg := testApp.Session.PopString(ctx, "error"); msg != e.expectedError {
+			t.Errorf("%s: expected error %q but got %q", e.name, e.expectedError, msg)
+		}
+		if e.user {
+			user, _ := testApp.Session.Get(ctx, "user").(data.User)
+			if user.Locale != e.expectedLocale {
+				t.Errorf("%s: expected the user to be saved with %q but got %q", e.name, e.expectedLocale, user.Locale)
+			}
+		}
+	}
+}
@@ -1,57 +1,87 @@
 package main
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
 	"github.com/vanng822/go-premailer/premailer"
-	mail "github.com/xhit/go-simple-mail/v2"
-	"html/template"
+	netmail "net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"subscription-service/data"
 	"sync"
-	"time"
 )
 
 type Mail struct {
 	Domain      string
-	Host        string
-	Port        int
-	Username    string
-	Password    string
-	Encryption  string
 	FromAddress string
 	FromName    string
+	Templates   *EmailTemplates
+	Transport   Transport
+	Workers     int
+	MaxAttempts int
 	Wait        *sync.WaitGroup
-	MailChan    chan Message
-	ErrorChan   chan error
+	Notify      chan struct{}
 	DoneChan    chan bool
 }
 
+var (
+	// ErrNoRecipients is returned when queuing a message that goes to nobody
+	ErrNoRecipients = errors.New("email has no recipients")
+	// ErrInvalidAddress is returned when queuing a message with a malformed address
+	ErrInvalidAddress = errors.New("invalid email address")
+	// ErrInvalidHeader is returned when queuing a message with a header we cannot send
+	ErrInvalidHeader = errors.New("invalid email header")
+)
+
+// reservedHeaders are set from the fields of a Message, and cannot be set in its Headers
+var reservedHeaders = map[string]bool{
+	"From":                      true,
+	"Sender":                    true,
+	"To":                        true,
+	"Cc":                        true,
+	"Bcc":                       true,
+	"Reply-To":                  true,
+	"Return-Path":               true,
+	"Subject":                   true,
+	"Date":                      true,
+	"Message-Id":                true,
+	"Mime-Version":              true,
+	"Content-Type":              true,
+	"Content-Transfer-Encoding": true,
+}
+
+// Message is an email to send. It goes to everyone in To, Cc and Bcc; Bcc recipients
+// are not shown to the others. Replies go to ReplyTo if set, and Headers are extra
+// headers to send, such as List-Unsubscribe. Data is what Template is rendered with, of
+// the type listed for it in emailContracts; the default template, "mail", takes a
+// MessageEmail. The template is rendered in Locale, or the default locale if it is
+// empty; the Subject is sent as it is, so callers translate it.
 type Message struct {
 	From          string
 	FromName      string
 	To            []string
+	Cc            []string
+	Bcc           []string
+	ReplyTo       string
+	Headers       map[string]string
 	Subject       string
 	Attachment    []string
 	AttachmentMap map[string]string
 	Data          any
-	DataMap       map[string]any
 	Template      string
+	Locale        string
 }
 
-func (app *Config) listenForMail() {
-	for {
-		select {
-		case msg := <-app.Mailer.MailChan:
-			go app.Mailer.send(msg)
-		case err := <-app.Mailer.ErrorChan:
-			app.ErrorLog.Println(err)
-		case <-app.Mailer.DoneChan:
-			return
-		}
+// render renders msg into an email for the outbox. Templates are rendered and attached
+// files read when a message is queued, while the data they use is still at hand, and a
+// message with a malformed address or header is rejected rather than failing later.
+func (m *Mail) render(msg Message) (data.Email, error) {
+	err := validateMessage(msg)
+	if err != nil {
+		return data.Email{}, err
 	}
-}
-
-func (m *Mail) send(msg Message) {
-	defer m.Wait.Done()
 
 	if msg.Template == "" {
 		msg.Template = "mail"
@@ -62,94 +92,90 @@ func (m *Mail) send(msg Message) {
 	if msg.FromName == "" {
 		msg.FromName = m.FromName
 	}
-	if msg.AttachmentMap == nil {
-		msg.AttachmentMap = make(map[string]string)
-	}
-	if len(msg.DataMap) == 0 {
-		msg.DataMap = make(map[string]any)
-	}
-	msg.DataMap["message"] = msg.Data
 
-	formattedMsg, err := m.buildHtml(msg)
+	htmlMsg, plainMsg, err := m.Templates.Render(msg.Template, msg.Locale, msg.Data)
 	if err != nil {
-		m.ErrorChan <- err
+		return data.Email{}, err
 	}
-	plainMsg, err := m.buildPlain(msg)
+	formattedMsg, err := m.inlineCss(htmlMsg)
 	if err != nil {
-		m.ErrorChan <- err
+		return data.Email{}, err
 	}
 
-	server := mail.NewSMTPClient()
-	server.Host = m.Host
-	server.Port = m.Port
-	server.Username = m.Username
-	server.Password = m.Password
-	server.Encryption = m.getEnc(m.Encryption)
-	server.KeepAlive = false
-	server.ConnectTimeout = 10 * time.Second
-	server.SendTimeout = 10 * time.Second
-
-	smtpClient, err := server.Connect()
-	if err != nil {
-		m.ErrorChan <- err
+	files := make(map[string]string)
+	for _, file := range msg.Attachment {
+		files[filepath.Base(file)] = file
 	}
-
-	email := mail.NewMSG()
-	email.SetFrom(msg.From).AddTo(msg.To[0]).SetSubject(msg.Subject)
-	email.SetBody(mail.TextPlain, plainMsg)
-	email.AddAlternative(mail.TextHTML, formattedMsg)
-
-	if len(msg.Attachment) > 0 {
-		for _, file := range msg.Attachment {
-			email.AddAttachment(file)
-		}
+	for name, file := range msg.AttachmentMap {
+		files[name] = file
 	}
 
-	if len(msg.AttachmentMap) > 0 {
-		for key, value := range msg.AttachmentMap {
-			email.AddAttachment(value, key)
+	attachments := make(map[string][]byte)
+	for name, file := range files {
+		attachments[name], err = os.ReadFile(file)
+		if err != nil {
+			return data.Email{}, err
 		}
 	}
 
-	err = email.Send(smtpClient)
-	if err != nil {
-		m.ErrorChan <- err
-	}
+	return data.Email{
+		From:        msg.From,
+		FromName:    msg.FromName,
+		To:          msg.To,
+		Cc:          msg.Cc,
+		Bcc:         msg.Bcc,
+		ReplyTo:     msg.ReplyTo,
+		Headers:     msg.Headers,
+		Subject:     msg.Subject,
+		PlainBody:   plainMsg,
+		HTMLBody:    formattedMsg,
+		Attachments: attachments,
+	}, nil
 }
 
-func (m *Mail) buildHtml(msg Message) (string, error) {
-	templateScheme := fmt.Sprintf("./cmd/web/templates/%s.html.gohtml", msg.Template)
-	templ, err := template.New("email-html").ParseFiles(templateScheme)
-	if err != nil {
-		return "", err
+// validateMessage returns an error if msg goes to nobody, or has an address or header we
+// cannot send
+func validateMessage(msg Message) error {
+	if len(msg.To)+len(msg.Cc)+len(msg.Bcc) == 0 {
+		return ErrNoRecipients
 	}
 
-	var tpl bytes.Buffer
-	if err = templ.ExecuteTemplate(&tpl, "body", msg.DataMap); err != nil {
-		return "", err
+	addresses := append(append(append([]string{}, msg.To...), msg.Cc...), msg.Bcc...)
+	if msg.ReplyTo != "" {
+		addresses = append(addresses, msg.ReplyTo)
+	}
+	if msg.From != "" {
+		addresses = append(addresses, msg.From)
+	}
+	for _, address := range addresses {
+		if _, err := netmail.ParseAddress(address); err != nil {
+			return fmt.Errorf("%w %q", ErrInvalidAddress, address)
+		}
 	}
 
-	formattedMsg, err := m.inlineCss(tpl.String())
-	if err != nil {
-		return "", err
+	for name, value := range msg.Headers {
+		if !validHeaderName(name) || reservedHeaders[textproto.CanonicalMIMEHeaderKey(name)] {
+			return fmt.Errorf("%w %q", ErrInvalidHeader, name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("%w %q: value spans lines", ErrInvalidHeader, name)
+		}
 	}
 
-	return formattedMsg, nil
+	return nil
 }
 
-func (m *Mail) buildPlain(msg Message) (string, error) {
-	templateScheme := fmt.Sprintf("./cmd/web/templates/%s.plain.gohtml", msg.Template)
-	templ, err := template.New("email-plain").ParseFiles(templateScheme)
-	if err != nil {
-		return "", err
+// validHeaderName reports whether name can be used as the name of a header
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
 	}
-
-	var tpl bytes.Buffer
-	if err = templ.ExecuteTemplate(&tpl, "body", msg.DataMap); err != nil {
-		return "", err
+	for _, c := range name {
+		if c <= ' ' || c > '~' || c == ':' {
+			return false
+		}
 	}
-
-	return tpl.String(), nil
+	return true
 }
 
 func (m *Mail) inlineCss(s string) (string, error) {
@@ -171,21 +197,7 @@ func (m *Mail) inlineCss(s string) (string, error) {
 	return html, nil
 }
 
-func (m *Mail) getEnc(e string) mail.Encryption {
-	switch e {
-	case "tls":
-		return mail.EncryptionSTARTTLS
-	case "ssl":
-		return mail.EncryptionSSLTLS
-	case "none":
-		return mail.EncryptionNone
-	default:
-		return mail.EncryptionSTARTTLS
-	}
-}
-
 func (m *Mail) terminate() {
-	close(m.MailChan)
-	close(m.ErrorChan)
+	close(m.Notify)
 	close(m.DoneChan)
 }
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMail_render(t *testing.T) {
+	m := Mail{FromAddress: "info@myco.com", FromName: "no-reply", Templates: testApp.Mailer.Templates}
+
+	dir := t.TempDir()
+	manual := filepath.Join(dir, "1_manual.pdf")
+	invoice := filepath.Join(dir, "1_1.pdf")
+	if err := os.WriteFile(manual, []byte("%PDF-1.3 manual"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(invoice, []byte("%PDF-1.3 invoice"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	email, err := m.render(Message{
+		To:            []string{"admin@example.com"},
+		Subject:       "Your Manual",
+		Data:          MessageEmail{Message: "Your manual is attached"},
+		Attachment:    []string{manual},
+		AttachmentMap: map[string]string{"Invoice-1.pdf": invoice},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if email.From != "info@myco.com" || email.FromName != "no-reply" {
+		t.Errorf("expected the default sender but got %s <%s>", email.FromName, email.From)
+	}
+	if !strings.Contains(email.PlainBody, "Your manual is attached") {
+		t.Errorf("expected the message in the plain body but got %q", email.PlainBody)
+	}
+	if !strings.Contains(email.HTMLBody, "Your manual is attached") {
+		t.Error("expected the message in the html body")
+	}
+	if contents := email.Attachments["1_manual.pdf"]; string(contents) != "%PDF-1.3 manual" {
+		t.Errorf("expected the manual to be attached under its file name but got %q", contents)
+	}
+	if contents := email.Attachments["Invoice-1.pdf"]; string(contents) != "%PDF-1.3 invoice" {
+		t.Errorf("expected the invoice to be attached under its name but got %q", contents)
+	}
+
+	// the file is gone once the email is queued, so it is not sent without it
+	os.Remove(manual)
+	if _, err := m.render(Message{To: []string{"admin@example.com"}, Data: MessageEmail{}, Attachment: []string{manual}}); err == nil {
+		t.Error("expected an error for a missing attachment")
+	}
+
+	if _, err := m.render(Message{To: []string{"admin@example.com"}, Template: "no-such-template"}); err == nil {
+		t.Error("expected an error for a missing template")
+	}
+	if _, err := m.render(Message{To: []string{"admin@example.com"}, Data: "Your manual is attached"}); err == nil {
+		t.Error("expected an error for data of the wrong type")
+	}
+}
+
+func Test_validateMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      Message
+		expected error
+	}{
+		{"valid", Message{To: []string{"admin@example.com", "Jane Doe <jane@example.com>"}, Cc: []string{"billing@example.com"}, ReplyTo: "support@myco.com", Headers: map[string]string{"List-Unsubscribe": "<https://myco.com/unsubscribe>"}}, nil},
+		{"only bcc", Message{Bcc: []string{"admin@example.com"}}, nil},
+		{"no recipients", Message{}, ErrNoRecipients},
+		{"malformed to", Message{To: []string{"admin@example.com", "jane"}}, ErrInvalidAddress},
+		{"malformed cc", Message{To: []string{"admin@example.com"}, Cc: []string{"jane@"}}, ErrInvalidAddress},
+		{"malformed bcc", Message{To: []string{"admin@example.com"}, Bcc: []string{""}}, ErrInvalidAddress},
+		{"malformed reply to", Message{To: []string{"admin@example.com"}, ReplyTo: "support"}, ErrInvalidAddress},
+		{"malformed from", Message{To: []string{"admin@example.com"}, From: "info at myco"}, ErrInvalidAddress},
+		{"reserved header", Message{To: []string{"admin@example.com"}, Headers: map[string]string{"bcc": "spy@example.com"}}, ErrInvalidHeader},
+		{"bad header name", Message{To: []string{"admin@example.com"}, Headers: map[string]string{"X Tag": "1"}}, ErrInvalidHeader},
+		{"header injection", Message{To: []string{"admin@example.com"}, Headers: map[string]string{"X-Tag": "1\r\nBcc: spy@example.com"}}, ErrInvalidHeader},
+	}
+
+	for _, e := range tests {
+		if err := validateMessage(e.msg); !errors.Is(err, e.expected) {
+			t.Errorf("%s: expected %v but got %v", e.name, e.expected, err)
+		}
+	}
+}
@@ -11,6 +11,8 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"subscription-service/data"
 	"sync"
 	"syscall"
@@ -37,13 +39,18 @@ func main() {
 		ErrorLog:      log.New(os.Stderr, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile),
 		Wait:          &wg,
 		Models:        data.New(db),
+		Payments:      initPayments(),
+		Tax:           initTax(),
 		ErrorChan:     make(chan error),
 		ErrorChanDone: make(chan bool),
+		RenewalDone:   make(chan bool),
 	}
 	app.Mailer = app.createMailer()
+	initDunning()
 
 	go app.listenForMail()
 	go app.listenForErrors()
+	go app.listenForRenewals()
 	go app.listenForShutdown()
 
 	app.serve()
@@ -116,6 +123,58 @@ func openDB(dsn string) (*sql.DB, error) {
 	return db, nil
 }
 
+// initPayments sets up the payment provider. Until a real gateway is configured
+// payments go through the fake provider, whose mode is read from FAKE_PAYMENTS.
+// Webhooks are signed with WEBHOOK_SECRET, which must be set: anyone could sign a
+// webhook with an empty one.
+func initPayments() PaymentProvider {
+	secret := os.Getenv("WEBHOOK_SECRET")
+	if secret == "" {
+		log.Panicf("WEBHOOK_SECRET is not set")
+	}
+
+	mode := os.Getenv("FAKE_PAYMENTS")
+	if mode == "" {
+		mode = FakeSucceed
+	}
+	return NewFakePaymentProvider(mode, secret)
+}
+
+// initTax sets up the tax calculator with the default rates, for a business based in
+// TAX_COUNTRY (US if unset)
+func initTax() TaxCalculator {
+	country := os.Getenv("TAX_COUNTRY")
+	if country == "" {
+		country = "US"
+	}
+	return NewTableTaxCalculator(country, defaultTaxRates)
+}
+
+// initDunning reads the dunning schedule from the environment: DUNNING_RETRY_DAYS is a
+// comma separated list of days, e.g. "1,3,7", and DUNNING_DOWNGRADE_PLAN the id of the
+// plan members are moved to after the last failed retry
+func initDunning() {
+	if days := os.Getenv("DUNNING_RETRY_DAYS"); days != "" {
+		var schedule []int
+		for _, day := range strings.Split(days, ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(day))
+			if err != nil || n < 1 {
+				log.Panicf("Invalid DUNNING_RETRY_DAYS %q", days)
+			}
+			schedule = append(schedule, n)
+		}
+		dunningRetryDays = schedule
+	}
+
+	if planID := os.Getenv("DUNNING_DOWNGRADE_PLAN"); planID != "" {
+		id, err := strconv.Atoi(planID)
+		if err != nil {
+			log.Panicf("Invalid DUNNING_DOWNGRADE_PLAN %q", planID)
+		}
+		dunningDowngradePlanID = id
+	}
+}
+
 func initSession() *scs.SessionManager {
 	gob.Register(data.User{})
 
@@ -151,34 +210,79 @@ func (app *Config) listenForShutdown() {
 func (app *Config) shutdown() {
 	app.InfoLog.Println("running cleanup tasks...")
 
-	app.Wait.Wait()
+	// stop renewing before waiting, so no new work is started after the wait
+	app.RenewalDone <- true
+
+	// stop claiming emails; the ones being sent are waited for below, the rest stay in
+	// the outbox until we start again
 	app.Mailer.DoneChan <- true
+
+	app.Wait.Wait()
 	app.ErrorChanDone <- true
 
 	app.Mailer.terminate()
 	close(app.ErrorChan)
 	close(app.ErrorChanDone)
+	close(app.RenewalDone)
 
 	app.InfoLog.Println("performing application shutdown...")
 }
 
 func (app *Config) createMailer() Mail {
-	errChan := make(chan error)
-	mailerChan := make(chan Message, 100)
+	notify := make(chan struct{}, 1)
 	doneChan := make(chan bool)
 
 	return Mail{
 		Domain:      "127.0.0.1",
-		Host:        "127.0.0.1",
-		Port:        1025,
-		Username:    "your-email@your-domain.com",
-		Password:    "your-password",
-		Encryption:  "none",
 		FromAddress: "info@myco.com",
 		FromName:    "no-reply",
+		Templates:   initEmailTemplates(),
+		Transport:   initMailTransport(),
+		Workers:     4,
+		MaxAttempts: 8,
 		Wait:        app.Wait,
-		ErrorChan:   errChan,
-		MailChan:    mailerChan,
+		Notify:      notify,
 		DoneChan:    doneChan,
 	}
 }
+
+// initEmailTemplates loads the email templates built into the binary, or those in the
+// EMAIL_TEMPLATES directory if it is set, so that they can be edited without rebuilding.
+// It panics if any template is broken, so that we find out now rather than when sending.
+func initEmailTemplates() *EmailTemplates {
+	fsys := embeddedEmailTemplates()
+	if dir := os.Getenv("EMAIL_TEMPLATES"); dir != "" {
+		fsys = os.DirFS(dir)
+	}
+
+	templates, err := LoadEmailTemplates(fsys, emailContracts)
+	if err != nil {
+		log.Panicf("Invalid email templates: %s", err)
+	}
+	return templates
+}
+
+// initMailTransport sets up how email is delivered. MAIL_TRANSPORT "file" writes every
+// email to a .eml file in MAIL_DIR (./tmp/mail if unset) instead of sending it;
+// otherwise email is sent through the local SMTP server.
+func initMailTransport() Transport {
+	switch transport := os.Getenv("MAIL_TRANSPORT"); transport {
+	case "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "./tmp/mail"
+		}
+		return NewFileTransport(dir)
+	case "", "smtp":
+		return &SMTPTransport{
+			Host:       "127.0.0.1",
+			Port:       1025,
+			Username:   "your-email@your-domain.com",
+			Password:   "your-password",
+			Encryption: "none",
+		}
+	default:
+		log.Panicf("Invalid MAIL_TRANSPORT %q", transport)
+		return nil
+	}
+}
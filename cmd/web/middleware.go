@@ -1,17 +1,122 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"subscription-service/data"
+)
 
 func (app *Config) SessionLoad(next http.Handler) http.Handler {
 	return app.Session.LoadAndSave(next)
 }
 
+// Localize decides the language each request is answered in, once, and keeps it in the
+// request context for the handlers and templates; see locale. It must run after
+// SessionLoad, as a choice of language is kept in the session.
+func (app *Config) Localize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		locale := app.locale(r)
+
+		w.Header().Set("Content-Language", locale)
+		w.Header().Add("Vary", "Accept-Language")
+
+		ctx := context.WithValue(r.Context(), localeKey, locale)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 func (app *Config) Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !app.Session.Exists(r.Context(), "userId") {
-			app.Session.Put(r.Context(), "error", "Log In First!")
+			app.Session.Put(r.Context(), "error", app.T(r, "Log In First!"))
 			http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
 		}
 		next.ServeHTTP(w, r)
 	})
 }
+
+// Admin only lets active administrators through. The user is looked up again on every
+// request, so that revoking admin rights takes effect straight away.
+func (app *Config) Admin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := app.Session.Get(r.Context(), "userId").(int)
+		if !ok {
+			app.Session.Put(r.Context(), "error", app.T(r, "Log In First!"))
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		user, err := app.Models.User.GetOne(userID)
+		if err != nil || user.IsAdmin != 1 || user.Active != 1 {
+			app.Session.Put(r.Context(), "error", app.T(r, "You are not allowed to view that page"))
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireFeature only lets members through whose plan includes feature, so routes can
+// be gated by what a plan includes rather than by plan ID. Members without the feature
+// are sent to the plans page to upgrade.
+func (app *Config) RequireFeature(feature string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := app.Session.Get(r.Context(), "user").(data.User)
+			if !ok {
+				app.Session.Put(r.Context(), "error", app.T(r, "Log In First!"))
+				http.Redirect(w, r, "/login", http.StatusSeeOther)
+				return
+			}
+
+			entitled, err := app.Models.Entitlement.HasEntitlement(user, feature)
+			if err != nil {
+				app.ErrorLog.Println(err)
+				http.Error(w, "unable to check your plan", http.StatusInternalServerError)
+				return
+			}
+
+			if !entitled {
+				app.Session.Put(r.Context(), "warning", app.T(r, "Your plan does not include that feature. Upgrade to use it."))
+				http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// APIAuth authenticates API requests by the API key in their Authorization header,
+// e.g. "Authorization: Bearer sk_...", and only lets active users through
+func (app *Config) APIAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || key == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, http.StatusUnauthorized, "missing API key")
+			return
+		}
+
+		user, err := app.Models.APIKey.Authenticate(strings.TrimSpace(key))
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				app.ErrorLog.Println(err)
+			}
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, http.StatusUnauthorized, "invalid API key")
+			return
+		}
+
+		if user.Active != 1 {
+			writeJSONError(w, http.StatusForbidden, "account is not active")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(apiUser(r.Context(), user)))
+	})
+}
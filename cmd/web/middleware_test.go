@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"subscription-service/data"
+	"testing"
+)
+
+func TestConfig_RequireFeature(t *testing.T) {
+	tests := []struct {
+		name             string
+		userID           int
+		feature          string
+		expectedCode     int
+		expectedLocation string
+	}{
+		{"included", 1, data.FeatureAPICalls, http.StatusOK, ""},
+		{"not included", 1, data.FeaturePrioritySupport, http.StatusSeeOther, "/members/plans"},
+		{"included in silver", 5, data.FeaturePrioritySupport, http.StatusOK, ""},
+		{"past due", 3, data.FeatureAPICalls, http.StatusOK, ""},
+		{"paused", 4, data.FeatureAPICalls, http.StatusSeeOther, "/members/plans"},
+		{"logged out", 0, data.FeatureAPICalls, http.StatusSeeOther, "/login"},
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, e := range tests {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/members/api", nil)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		if e.userID != 0 {
+			testApp.Session.Put(ctx, "userId", e.userID)
+			testApp.Session.Put(ctx, "user", data.User{ID: e.userID})
+		}
+
+		testApp.RequireFeature(e.feature)(next).ServeHTTP(rw, req)
+
+		if rw.Code != e.expectedCode {
+			t.Errorf("%s: expected status code %d but got %d", e.name, e.expectedCode, rw.Code)
+		}
+
+		if location := rw.Header().Get("Location"); location != e.expectedLocation {
+			t.Errorf("%s: expected redirect to %q but got %q", e.name, e.expectedLocation, location)
+		}
+	}
+}
@@ -0,0 +1,616 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"html/template"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"subscription-service/data"
+)
+
+// OrganizationPage shows the organization of the member with its members and seats, or
+// lets them create one if they belong to none
+func (app *Config) OrganizationPage(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.Session.Get(r.Context(), "user").(data.User)
+	if !ok {
+		app.Session.Put(r.Context(), "error", app.T(r, "Log In First!"))
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	org, err := app.userOrganization(user)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, "unable to get organization", http.StatusInternalServerError)
+		return
+	}
+
+	dataMap := make(map[string]any)
+
+	if org != nil {
+		member := org.Member(user.ID)
+		dataMap["organization"] = org
+		dataMap["member"] = member
+		dataMap["roles"] = []string{data.RoleMember, data.RoleBilling}
+
+		sub, err := app.Models.Subscription.GetCurrentByUser(org.OwnerID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			app.ErrorLog.Println(err)
+		}
+		dataMap["subscription"] = sub
+
+		if member.CanManageSeats() {
+			invitations, err := app.Models.Organization.GetPendingInvitations(org.ID)
+			if err != nil {
+				app.ErrorLog.Println(err)
+				http.Error(w, "unable to get invitations", http.StatusInternalServerError)
+				return
+			}
+			dataMap["invitations"] = invitations
+
+			limit, err := app.seatLimit(org)
+			if err != nil {
+				app.ErrorLog.Println(err)
+				http.Error(w, "unable to get seats", http.StatusInternalServerError)
+				return
+			}
+			dataMap["seatLimit"] = limit
+		}
+	}
+
+	app.render(w, r, "organization.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+// CreateOrganization creates an organization owned by the member, sharing their
+// subscription
+func (app *Config) CreateOrganization(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.Session.Get(r.Context(), "user").(data.User)
+	if !ok {
+		app.Session.Put(r.Context(), "error", app.T(r, "Log In First!"))
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(r.Form.Get("name"))
+	if name == "" || len(name) > 255 {
+		app.Session.Put(r.Context(), "error", app.T(r, "Enter a name for the organization"))
+		http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+		return
+	}
+
+	_, err = app.Models.Organization.Insert(data.Organization{Name: name, OwnerID: user.ID})
+	if err != nil {
+		msg := app.T(r, "Unable to create organization")
+		if errors.Is(err, data.ErrAlreadyInOrganization) {
+			msg = app.T(r, "You already belong to an organization")
+		} else {
+			app.ErrorLog.Println(err)
+		}
+		app.Session.Put(r.Context(), "error", msg)
+		http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", app.T(r, "%s created", name))
+	http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+}
+
+// InviteMember emails a signed link to join the organization to someone. The owner and
+// billing members can invite as many members as the plan has seats for; a plan priced
+// per seat has room for any number, each added seat being charged from the next renewal.
+func (app *Config) InviteMember(w http.ResponseWriter, r *http.Request) {
+	user, org, ok := app.organizationManager(w, r)
+	if !ok {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	addr, err := mail.ParseAddress(strings.TrimSpace(r.Form.Get("email")))
+	if err != nil {
+		app.Session.Put(r.Context(), "error", app.T(r, "Enter a valid email address"))
+		http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+		return
+	}
+	email := strings.ToLower(addr.Address)
+
+	role := r.Form.Get("role")
+	if role != data.RoleMember && role != data.RoleBilling {
+		app.Session.Put(r.Context(), "error", app.T(r, "Choose the role of the new member"))
+		http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+		return
+	}
+
+	for _, m := range org.Members {
+		if strings.EqualFold(m.User.Email, email) {
+			app.Session.Put(r.Context(), "warning", app.T(r, "%s is already a member of %s", email, org.Name))
+			http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+			return
+		}
+	}
+
+	invitations, err := app.Models.Organization.GetPendingInvitations(org.ID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to send invitation"))
+		http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+		return
+	}
+
+	limit, err := app.seatLimit(org)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to send invitation"))
+		http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+		return
+	}
+
+	// pending invitations hold a seat, except one being sent again
+	taken := len(org.Members)
+	for _, inv := range invitations {
+		if inv.Email != email {
+			taken++
+		}
+	}
+	if limit != data.Unlimited && taken >= limit {
+		app.Session.Put(r.Context(), "error",
+			app.T(r, "Your plan includes %d seats, and they are all taken. Upgrade to invite more members.", limit))
+		http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+		return
+	}
+
+	id, err := app.Models.Organization.CreateInvitation(data.Invitation{
+		OrganizationID: org.ID,
+		Email:          email,
+		Role:           role,
+		InvitedBy:      user.ID,
+	})
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to send invitation"))
+		http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+		return
+	}
+
+	signedLink, err := app.issueLink("/members/organization/join", data.Token{
+		Purpose:   data.TokenInvitation,
+		Email:     email,
+		SubjectID: &id,
+	}, invitationExpiry)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to send invitation"))
+		http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+		return
+	}
+
+	msg := Message{
+		To:       []string{email},
+		Subject:  app.T(r, "You're Invited to Join %s", org.Name),
+		Locale:   app.locale(r),
+		Template: "organization-invitation",
+		Data: InvitationEmail{
+			Inviter:      user,
+			Organization: org,
+			Link:         template.URL(signedLink),
+		},
+	}
+	app.sendEmail(msg)
+
+	app.Session.Put(r.Context(), "flash", app.T(r, "Invitation sent to %s", email))
+	http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+}
+
+// CancelInvitation withdraws an invitation which has not been accepted yet
+func (app *Config) CancelInvitation(w http.ResponseWriter, r *http.Request) {
+	_, org, ok := app.organizationManager(w, r)
+	if !ok {
+		return
+	}
+
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	err := app.Models.Organization.DeleteInvitation(org.ID, id)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to cancel invitation"))
+		http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+		return
+	}
+
+	err = app.Models.Token.RevokeSubject(data.TokenInvitation, id)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	app.Session.Put(r.Context(), "flash", app.T(r, "Invitation canceled"))
+	http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+}
+
+// JoinOrganization accepts the invitation in a signed link, which works once. The member
+// must be logged in with the address the invitation was sent to. Members with a
+// subscription of their own cancel it first, so that they are not billed twice.
+func (app *Config) JoinOrganization(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.Session.Get(r.Context(), "user").(data.User)
+	if !ok {
+		app.Session.Put(r.Context(), "error", app.T(r, "Log In First!"))
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	token, err := app.checkLink(r, data.TokenInvitation)
+	if err == nil && token.SubjectID == nil {
+		err = data.ErrTokenInvalid
+	}
+	if err != nil {
+		app.Session.Put(r.Context(), "error", app.linkMessage(r, err))
+		http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+		return
+	}
+
+	inv, err := app.Models.Organization.GetInvitation(*token.SubjectID)
+	if err != nil || inv.AcceptedAt != nil {
+		app.Session.Put(r.Context(), "error", app.T(r, "That invitation is no longer valid"))
+		http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+		return
+	}
+
+	if !strings.EqualFold(inv.Email, user.Email) {
+		app.Session.Put(r.Context(), "error", app.T(r, "That invitation was sent to %s. Log in with that address to accept it.", inv.Email))
+		http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+		return
+	}
+
+	existing, err := app.userOrganization(user)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to join organization"))
+		http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+		return
+	}
+	if existing != nil {
+		app.Session.Put(r.Context(), "error", app.T(r, "You already belong to an organization"))
+		http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+		return
+	}
+
+	current, err := app.Models.Subscription.GetCurrentByUser(user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to join organization"))
+		http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+		return
+	}
+	if current != nil {
+		app.Session.Put(r.Context(), "error", app.T(r, "Cancel your own subscription before joining an organization"))
+		http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+		return
+	}
+
+	// the link is only used up once the member is known to be able to join
+	_, err = app.consumeLink(r, data.TokenInvitation)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", app.linkMessage(r, err))
+		http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+		return
+	}
+
+	err = app.Models.Organization.AcceptInvitation(inv.ID, user.ID)
+	if err != nil {
+		msg := app.T(r, "Unable to join organization")
+		if errors.Is(err, data.ErrAlreadyInOrganization) {
+			msg = app.T(r, "You already belong to an organization")
+		} else {
+			app.ErrorLog.Println(err)
+		}
+		app.Session.Put(r.Context(), "error", msg)
+		http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+		return
+	}
+
+	org, err := app.Models.Organization.GetByUser(user.ID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "flash", app.T(r, "Invitation accepted"))
+		http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+		return
+	}
+
+	if err := app.syncSeats(org.OwnerID); err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	app.Session.Put(r.Context(), "flash", app.T(r, "Welcome to %s!", org.Name))
+	http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+}
+
+// ChangeMemberRole lets the owner make a member a billing member, or the other way around
+func (app *Config) ChangeMemberRole(w http.ResponseWriter, r *http.Request) {
+	user, org, ok := app.organizationManager(w, r)
+	if !ok {
+		return
+	}
+
+	if org.OwnerID != user.ID {
+		app.Session.Put(r.Context(), "error", app.T(r, "Only the owner can change roles"))
+		http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	memberID, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	member := org.Member(memberID)
+	role := r.Form.Get("role")
+
+	switch {
+	case member == nil:
+		app.Session.Put(r.Context(), "error", app.T(r, "That user is not a member of your organization"))
+	case member.Role == data.RoleOwner:
+		app.Session.Put(r.Context(), "error", app.T(r, "The owner's role cannot be changed"))
+	case role != data.RoleMember && role != data.RoleBilling:
+		app.Session.Put(r.Context(), "error", app.T(r, "Choose the role of the member"))
+	default:
+		err = app.Models.Organization.SetRole(org.ID, memberID, role)
+		if err != nil {
+			app.ErrorLog.Println(err)
+			app.Session.Put(r.Context(), "error", app.T(r, "Unable to change role"))
+			break
+		}
+		app.Session.Put(r.Context(), "flash", app.T(r, "%s is now a %s member", member.User.Email, app.T(r, role)))
+	}
+
+	http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+}
+
+// RemoveMember takes a member out of the organization, freeing their seat from the next
+// renewal. The owner and billing members can remove anyone but the owner, and members
+// can leave by removing themselves.
+func (app *Config) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.Session.Get(r.Context(), "user").(data.User)
+	if !ok {
+		app.Session.Put(r.Context(), "error", app.T(r, "Log In First!"))
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	org, err := app.userOrganization(user)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to remove member"))
+		http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+		return
+	}
+	if org == nil {
+		app.Session.Put(r.Context(), "error", app.T(r, "You do not belong to an organization"))
+		http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+		return
+	}
+
+	memberID, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	member := org.Member(memberID)
+	leaving := memberID == user.ID
+
+	switch {
+	case member == nil:
+		app.Session.Put(r.Context(), "error", app.T(r, "That user is not a member of your organization"))
+		http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+		return
+	case member.Role == data.RoleOwner:
+		app.Session.Put(r.Context(), "error", app.T(r, "The owner cannot be removed from the organization"))
+		http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+		return
+	case !leaving && !org.Member(user.ID).CanManageSeats():
+		app.Session.Put(r.Context(), "error", app.T(r, "Only the owner and billing members can manage members"))
+		http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+		return
+	}
+
+	err = app.Models.Organization.RemoveMember(org.ID, memberID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to remove member"))
+		http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+		return
+	}
+
+	if err := app.syncSeats(org.OwnerID); err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	if leaving {
+		app.Session.Put(r.Context(), "flash", app.T(r, "You have left %s", org.Name))
+	} else {
+		app.Session.Put(r.Context(), "flash", app.T(r, "%s removed from %s", member.User.Email, org.Name))
+	}
+	http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+}
+
+// userOrganization returns the organization user belongs to, or nil if they belong to none
+func (app *Config) userOrganization(user data.User) (*data.Organization, error) {
+	org, err := app.Models.Organization.GetByUser(user.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return org, err
+}
+
+// organizationManager returns the user in the session and their organization if they
+// may manage its members. Otherwise it redirects and reports false.
+func (app *Config) organizationManager(w http.ResponseWriter, r *http.Request) (data.User, *data.Organization, bool) {
+	user, ok := app.Session.Get(r.Context(), "user").(data.User)
+	if !ok {
+		app.Session.Put(r.Context(), "error", app.T(r, "Log In First!"))
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return user, nil, false
+	}
+
+	org, err := app.userOrganization(user)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, "unable to get organization", http.StatusInternalServerError)
+		return user, nil, false
+	}
+	if org == nil {
+		app.Session.Put(r.Context(), "error", app.T(r, "You do not belong to an organization"))
+		http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+		return user, nil, false
+	}
+	if !org.Member(user.ID).CanManageSeats() {
+		app.Session.Put(r.Context(), "error", app.T(r, "Only the owner and billing members can manage members"))
+		http.Redirect(w, r, "/members/organization", http.StatusSeeOther)
+		return user, nil, false
+	}
+
+	return user, org, true
+}
+
+// seatLimit returns how many members the organization can have: Unlimited on a plan
+// priced per seat, and otherwise the seats the plan of the owner includes, the owner's
+// own seat at least
+func (app *Config) seatLimit(org *data.Organization) (int, error) {
+	sub, err := app.Models.Subscription.GetCurrentByUser(org.OwnerID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+	if sub != nil && sub.IsLive() {
+		plan, err := app.Models.Plan.GetOne(sub.PlanID)
+		if err != nil {
+			return 0, err
+		}
+		if plan.PerSeat {
+			return data.Unlimited, nil
+		}
+	}
+
+	limit, err := app.Models.Entitlement.Limit(data.User{ID: org.OwnerID}, data.FeatureSeats)
+	if err != nil {
+		return 0, err
+	}
+	if limit == 0 {
+		return 1, nil
+	}
+	return limit, nil
+}
+
+// syncSeats makes the subscription of the owner of an organization count its members.
+// The change is billed from the next renewal.
+func (app *Config) syncSeats(ownerID int) error {
+	sub, err := app.Models.Subscription.GetCurrentByUser(ownerID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	seats, err := app.Models.Organization.CountSeats(ownerID)
+	if err != nil {
+		return err
+	}
+	if seats == sub.Quantity {
+		return nil
+	}
+
+	return app.Models.Subscription.SetQuantity(sub.ID, seats)
+}
+
+// subscriptionSeats returns the number of seats to bill a subscription of user for: those
+// of current if they are changing plan, and otherwise one for every member of the
+// organization they own
+func (app *Config) subscriptionSeats(user data.User, current *data.Subscription) (int, error) {
+	if current != nil {
+		return max(current.Quantity, 1), nil
+	}
+	return app.Models.Organization.CountSeats(user.ID)
+}
+
+// billingAccount returns the user whose subscription user uses, and whom their usage is
+// billed to: the owner of their organization, or else themselves
+func (app *Config) billingAccount(user data.User) (data.User, error) {
+	org, err := app.userOrganization(user)
+	if err != nil || org == nil || org.OwnerID == user.ID {
+		return user, err
+	}
+
+	owner, err := app.Models.User.GetOne(org.OwnerID)
+	if err != nil {
+		return user, err
+	}
+	return *owner, nil
+}
+
+// invoiceAccount returns the user whose invoices user may see: the owner of their
+// organization if they have the billing role, and otherwise themselves
+func (app *Config) invoiceAccount(user data.User) (data.User, error) {
+	org, err := app.userOrganization(user)
+	if err != nil {
+		return user, err
+	}
+	if org == nil || org.OwnerID == user.ID || org.Member(user.ID).Role != data.RoleBilling {
+		return user, nil
+	}
+
+	owner, err := app.Models.User.GetOne(org.OwnerID)
+	if err != nil {
+		return user, err
+	}
+	return *owner, nil
+}
+
+// billingContacts returns the addresses of the billing members of the organization user
+// owns, who are copied on its billing email. There are none if user owns no organization.
+func (app *Config) billingContacts(user data.User) ([]string, error) {
+	org, err := app.userOrganization(user)
+	if err != nil || org == nil || org.OwnerID != user.ID {
+		return nil, err
+	}
+
+	var contacts []string
+	for _, member := range org.Members {
+		if member.Role == data.RoleBilling && member.User != nil && member.User.Email != user.Email {
+			contacts = append(contacts, member.User.Email)
+		}
+	}
+	return contacts, nil
+}
+
+// sendBillingEmail sends msg to user, copied to the billing contacts of their
+// organization. It is written in the language of user unless msg has one. The contacts
+// are copied on the same email, so they get it in that language too, whatever their own.
+func (app *Config) sendBillingEmail(user data.User, msg Message) {
+	contacts, err := app.billingContacts(user)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	msg.To = []string{user.Email}
+	msg.Cc = append(msg.Cc, contacts...)
+	if msg.Locale == "" {
+		msg.Locale = user.Locale
+	}
+	app.sendEmail(msg)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"subscription-service/data"
+	"testing"
+)
+
+// invitationLink returns the path of a signed link carrying token, as sent in an
+// invitation to join an organization
+func invitationLink(token string) string {
+	NewURLSigner()
+	link := GenerateTokenFromString("http://localhost:3000/members/organization/join?token=" + token)
+	return strings.TrimPrefix(link, "http://localhost:3000")
+}
+
+// In the test models Acme is owned by user 5, on the Silver Plan with 5 seats; user 2 is
+// a member and user 6 has the billing role. Invitation 1 is pending for new@example.com.
+var organizationTests = []struct {
+	name            string
+	method          string
+	url             string
+	id              string
+	user            data.User
+	form            url.Values
+	handler         http.HandlerFunc
+	expectedKey     string
+	expectedMessage string
+}{
+	{"create", "POST", "/members/organization", "", data.User{ID: 1}, url.Values{"name": {"Initech"}}, testApp.CreateOrganization, "flash", "Initech created"},
+	{"create without a name", "POST", "/members/organization", "", data.User{ID: 1}, url.Values{"name": {" "}}, testApp.CreateOrganization, "error", "Enter a name for the organization"},
+	{"invite", "POST", "/members/organization/invitations", "", data.User{ID: 6}, url.Values{"email": {"Jane <Jane@Example.com>"}, "role": {"member"}}, testApp.InviteMember, "flash", "Invitation sent to jane@example.com"},
+	{"invite as member", "POST", "/members/organization/invitations", "", data.User{ID: 2}, url.Values{"email": {"jane@example.com"}, "role": {"member"}}, testApp.InviteMember, "error", "Only the owner and billing members can manage members"},
+	{"invite outside an organization", "POST", "/members/organization/invitations", "", data.User{ID: 1}, url.Values{"email": {"jane@example.com"}, "role": {"member"}}, testApp.InviteMember, "error", "You do not belong to an organization"},
+	{"invite bad email", "POST", "/members/organization/invitations", "", data.User{ID: 5}, url.Values{"email": {"jane"}, "role": {"member"}}, testApp.InviteMember, "error", "Enter a valid email address"},
+	{"invite as owner", "POST", "/members/organization/invitations", "", data.User{ID: 5}, url.Values{"email": {"jane@example.com"}, "role": {"owner"}}, testApp.InviteMember, "error", "Choose the role of the new member"},
+	{"invite a member", "POST", "/members/organization/invitations", "", data.User{ID: 5}, url.Values{"email": {"member@example.com"}, "role": {"member"}}, testApp.InviteMember, "warning", "member@example.com is already a member of Acme"},
+	{"cancel invitation", "POST", "/members/organization/invitations/1/cancel", "1", data.User{ID: 5}, nil, testApp.CancelInvitation, "flash", "Invitation canceled"},
+	{"join", "GET", invitationLink("invitation-token"), "", data.User{ID: 7, Email: "new@example.com"}, nil, testApp.JoinOrganization, "flash", "Invitation accepted"},
+	{"join as someone else", "GET", invitationLink("invitation-token"), "", data.User{ID: 8, Email: "other@example.com"}, nil, testApp.JoinOrganization, "error", "That invitation was sent to new@example.com. Log in with that address to accept it."},
+	{"join with a subscription", "GET", invitationLink("invitation-token"), "", data.User{ID: 1, Email: "new@example.com"}, nil, testApp.JoinOrganization, "error", "Cancel your own subscription before joining an organization"},
+	{"join another organization", "GET", invitationLink("invitation-token"), "", data.User{ID: 2, Email: "new@example.com"}, nil, testApp.JoinOrganization, "error", "You already belong to an organization"},
+	{"join twice", "GET", invitationLink("used-token"), "", data.User{ID: 7, Email: "new@example.com"}, nil, testApp.JoinOrganization, "error", "That link has already been used"},
+	{"join canceled invitation", "GET", invitationLink("revoked-token"), "", data.User{ID: 7, Email: "new@example.com"}, nil, testApp.JoinOrganization, "error", "That link is no longer valid"},
+	{"join unsigned", "GET", "/members/organization/join?token=invitation-token", "", data.User{ID: 7, Email: "new@example.com"}, nil, testApp.JoinOrganization, "error", "That link is not valid"},
+	{"change role", "POST", "/members/organization/members/2/role", "2", data.User{ID: 5}, url.Values{"role": {"billing"}}, testApp.ChangeMemberRole, "flash", "member@example.com is now a billing member"},
+	{"change role as billing", "POST", "/members/organization/members/2/role", "2", data.User{ID: 6}, url.Values{"role": {"billing"}}, testApp.ChangeMemberRole, "error", "Only the owner can change roles"},
+	{"change owner role", "POST", "/members/organization/members/5/role", "5", data.User{ID: 5}, url.Values{"role": {"member"}}, testApp.ChangeMemberRole, "error", "The owner's role cannot be changed"},
+	{"remove", "POST", "/members/organization/members/2/remove", "2", data.User{ID: 6}, nil, testApp.RemoveMember, "flash", "member@example.com removed from Acme"},
+	{"remove as member", "POST", "/members/organization/members/6/remove", "6", data.User{ID: 2}, nil, testApp.RemoveMember, "error", "Only the owner and billing members can manage members"},
+	{"leave", "POST", "/members/organization/members/2/remove", "2", data.User{ID: 2}, nil, testApp.RemoveMember, "flash", "You have left Acme"},
+	{"remove owner", "POST", "/members/organization/members/5/remove", "5", data.User{ID: 6}, nil, testApp.RemoveMember, "error", "The owner cannot be removed from the organization"},
+	{"subscribe as member", "POST", "/members/subscribe", "", data.User{ID: 2}, url.Values{"id": {"2"}}, testApp.SubscribeToPlan, "error", "Your plan is managed by Acme"},
+}
+
+func TestConfig_organizationHandlers(t *testing.T) {
+	for _, e := range organizationTests {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(e.method, e.url, strings.NewReader(e.form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		chiCtx := chi.NewRouteContext()
+		chiCtx.URLParams.Add("id", e.id)
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		testApp.Session.Put(ctx, "userId", e.user.ID)
+		testApp.Session.Put(ctx, "user", e.user)
+
+		e.handler.ServeHTTP(rw, req)
+
+		testApp.Wait.Wait()
+
+		if rw.Code != http.StatusSeeOther {
+			t.Errorf("%s: expected status code %d but got %d", e.name, http.StatusSeeOther, rw.Code)
+		}
+
+		if msg := testApp.Session.PopString(ctx, e.expectedKey); msg != e.expectedMessage {
+			t.Errorf("%s: expected %s %q but got %q", e.name, e.expectedKey, e.expectedMessage, msg)
+		}
+	}
+}
+
+func TestConfig_seatLimit(t *testing.T) {
+	org, _ := testApp.Models.Organization.GetByUser(5)
+
+	limit, err := testApp.seatLimit(org)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit != 5 {
+		t.Errorf("expected the 5 seats of the Silver Plan but got %d", limit)
+	}
+
+	// a plan without seats still has room for its owner
+	org.OwnerID = 4
+	limit, _ = testApp.seatLimit(org)
+	if limit != 1 {
+		t.Errorf("expected 1 seat for a paused subscription but got %d", limit)
+	}
+}
+
+func TestConfig_invoiceAccount(t *testing.T) {
+	tests := []struct {
+		name       string
+		userID     int
+		expectedID int
+	}{
+		{"no organization", 1, 1},
+		{"owner", 5, 5},
+		{"member", 2, 2},
+		{"billing member", 6, 5},
+	}
+
+	for _, e := range tests {
+		account, err := testApp.invoiceAccount(data.User{ID: e.userID})
+		if err != nil {
+			t.Errorf("%s: %s", e.name, err)
+			continue
+		}
+		if account.ID != e.expectedID {
+			t.Errorf("%s: expected the invoices of user %d but got those of %d", e.name, e.expectedID, account.ID)
+		}
+	}
+}
+
+func TestConfig_sendInvoice_billingContacts(t *testing.T) {
+	sentMail()
+
+	invoice, _ := testApp.Models.Invoice.GetOne(1)
+	testApp.sendInvoice(data.User{ID: 5, Email: "owner@example.com"}, invoice, Message{
+		Subject:  "Your Invoice Data",
+		Template: "invoice",
+		Data:     InvoiceEmail{Invoice: invoice},
+	})
+
+	sent := sentMail()
+	if len(sent) != 1 {
+		t.Fatalf("expected one email but got %d", len(sent))
+	}
+	if len(sent[0].To) != 1 || sent[0].To[0] != "owner@example.com" {
+		t.Errorf("expected the invoice to go to the owner but it went to %v", sent[0].To)
+	}
+	if len(sent[0].Cc) != 1 || sent[0].Cc[0] != "billing@example.com" {
+		t.Errorf("expected the billing member to be copied but got %v", sent[0].Cc)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"subscription-service/data"
+	"time"
+)
+
+const (
+	// outboxPollInterval is how often the outbox is checked for emails that are due,
+	// when nothing new has been queued
+	outboxPollInterval = 10 * time.Second
+
+	// outboxLease is how long a claimed email is left alone before it is assumed that
+	// whoever was sending it died, and it is tried again
+	outboxLease = 5 * time.Minute
+
+	// mailRetryDelay is how long we wait before trying a failed email again the first
+	// time; the wait doubles with each further attempt, up to mailMaxRetryDelay
+	mailRetryDelay    = time.Minute
+	mailMaxRetryDelay = 6 * time.Hour
+)
+
+// sendEmail renders msg and stores it in the outbox, to be sent by listenForMail
+func (app *Config) sendEmail(msg Message) {
+	email, err := app.Mailer.render(msg)
+	if err != nil {
+		app.ErrorLog.Printf("unable to render email %q to %v: %s", msg.Subject, msg.To, err)
+		return
+	}
+
+	_, err = app.Models.Email.Enqueue(email)
+	if err != nil {
+		app.ErrorLog.Printf("unable to queue email %q to %v: %s", msg.Subject, msg.To, err)
+		return
+	}
+
+	app.Mailer.notify()
+}
+
+// notify wakes listenForMail up to look for emails to send, unless it is already awake
+func (m *Mail) notify() {
+	select {
+	case m.Notify <- struct{}{}:
+	default:
+	}
+}
+
+// listenForMail sends the emails in the outbox as they fall due, with at most
+// Mailer.Workers being sent at once. Once told to stop it claims no more emails; the
+// ones being sent are waited for by shutdown through app.Wait.
+func (app *Config) listenForMail() {
+	workers := make(chan struct{}, app.Mailer.Workers)
+
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		app.dispatchMail(workers)
+
+		select {
+		case <-app.Mailer.Notify:
+		case <-ticker.C:
+		case <-app.Mailer.DoneChan:
+			return
+		}
+	}
+}
+
+// dispatchMail claims as many due emails as there are idle workers, sends each of them
+// in the background, and returns how many it claimed
+func (app *Config) dispatchMail(workers chan struct{}) int {
+	idle := cap(workers) - len(workers)
+	if idle == 0 {
+		return 0
+	}
+
+	emails, err := app.Models.Email.Claim(time.Now(), outboxLease, idle)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		return 0
+	}
+
+	for _, email := range emails {
+		workers <- struct{}{}
+		app.Wait.Add(1)
+
+		go func(email *data.Email) {
+			defer app.Wait.Done()
+			defer func() {
+				<-workers
+				// there may be more emails waiting for a worker
+				app.Mailer.notify()
+			}()
+
+			app.deliverEmail(email)
+		}(email)
+	}
+
+	return len(emails)
+}
+
+// deliverEmail sends a claimed email and records how it went. An email that fails is
+// tried again later, until it has had Mailer.MaxAttempts attempts and is marked dead.
+func (app *Config) deliverEmail(email *data.Email) {
+	err := app.Mailer.Transport.Send(email)
+	if err == nil {
+		err = app.Models.Email.MarkSent(email.ID)
+		if err != nil {
+			app.ErrorLog.Println(err)
+		}
+		return
+	}
+
+	if email.Attempts >= app.Mailer.MaxAttempts {
+		app.ErrorLog.Printf("giving up on email %d %q to %v after %d attempts: %s", email.ID, email.Subject, email.To, email.Attempts, err)
+		err = app.Models.Email.MarkDead(email.ID, err.Error())
+		if err != nil {
+			app.ErrorLog.Println(err)
+		}
+		return
+	}
+
+	retryAt := time.Now().Add(retryDelay(email.Attempts))
+	app.ErrorLog.Println(fmt.Errorf("email %d %q to %v failed, retrying at %s: %w", email.ID, email.Subject, email.To, retryAt.Format(time.RFC3339), err))
+	err = app.Models.Email.Retry(email.ID, err.Error(), retryAt)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+}
+
+// retryDelay returns how long to wait before trying an email again, after it failed
+// attempts times
+func retryDelay(attempts int) time.Duration {
+	delay := mailRetryDelay
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= mailMaxRetryDelay {
+			return mailMaxRetryDelay
+		}
+	}
+	return delay
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_retryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{4, 8 * time.Minute},
+		{9, 256 * time.Minute},
+		{10, mailMaxRetryDelay},
+		{50, mailMaxRetryDelay},
+	}
+
+	for _, e := range tests {
+		if delay := retryDelay(e.attempts); delay != e.expected {
+			t.Errorf("after %d attempts: expected %s but got %s", e.attempts, e.expected, delay)
+		}
+	}
+}
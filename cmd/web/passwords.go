@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"html/template"
+	"net/http"
+	"strings"
+	"subscription-service/data"
+)
+
+// minPasswordLength is the shortest password we accept
+const minPasswordLength = 8
+
+// forgotPasswordSent is shown whether or not there is an account for the address, so
+// that the form cannot be used to find out who has an account
+const forgotPasswordSent = "If there is an account for that address, we've emailed it a link to reset the password."
+
+func (app *Config) ForgotPasswordPage(w http.ResponseWriter, r *http.Request) {
+	app.render(w, r, "forgot-password.page.gohtml", nil)
+}
+
+// ForgotPassword emails a signed link to reset the password to the account with the
+// address entered, if there is one
+func (app *Config) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	email := strings.TrimSpace(r.Form.Get("email"))
+	if email == "" {
+		app.Session.Put(r.Context(), "error", app.T(r, "Enter your email address"))
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	user, err := app.Models.User.GetByEmail(email)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			app.ErrorLog.Println(err)
+		}
+		app.Session.Put(r.Context(), "flash", app.T(r, forgotPasswordSent))
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	// only the link sent last works
+	err = app.Models.Token.Revoke(data.TokenPasswordReset, user.ID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	signedLink, err := app.issueLink("/reset-password", data.Token{
+		Purpose: data.TokenPasswordReset,
+		UserID:  &user.ID,
+		Email:   user.Email,
+	}, passwordResetExpiry)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to send a reset link. Please try again."))
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	msg := Message{
+		To:       []string{user.Email},
+		Subject:  app.T(r, "Reset Your Password"),
+		Locale:   app.locale(r),
+		Template: "password-reset",
+		Data: PasswordResetEmail{
+			User:    user,
+			Link:    template.URL(signedLink),
+			Minutes: int(passwordResetExpiry.Minutes()),
+		},
+	}
+	app.sendEmail(msg)
+
+	app.Session.Put(r.Context(), "flash", app.T(r, forgotPasswordSent))
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// ResetPasswordPage asks for a new password, if the link followed can still be used
+func (app *Config) ResetPasswordPage(w http.ResponseWriter, r *http.Request) {
+	if _, err := app.checkLink(r, data.TokenPasswordReset); err != nil {
+		app.Session.Put(r.Context(), "error", app.T(r, "%s. Request a new one.", app.linkMessage(r, err)))
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["action"] = r.RequestURI
+	app.render(w, r, "reset-password.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+// ResetPassword sets the new password of the user the link was sent to, using the link
+// up. Every other session of the user is logged out, in case someone else got hold of
+// the old password, and the user is told that their password was changed.
+func (app *Config) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	if _, err := app.checkLink(r, data.TokenPasswordReset); err != nil {
+		app.Session.Put(r.Context(), "error", app.T(r, "%s. Request a new one.", app.linkMessage(r, err)))
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	password := r.Form.Get("password")
+	switch {
+	case len(password) < minPasswordLength:
+		app.Session.Put(r.Context(), "error", app.T(r, "Your password must be at least %d characters", minPasswordLength))
+		http.Redirect(w, r, r.RequestURI, http.StatusSeeOther)
+		return
+	case password != r.Form.Get("confirm-password"):
+		app.Session.Put(r.Context(), "error", app.T(r, "The passwords do not match"))
+		http.Redirect(w, r, r.RequestURI, http.StatusSeeOther)
+		return
+	}
+
+	// the link is only used up once the new password is known to be acceptable
+	token, err := app.consumeLink(r, data.TokenPasswordReset)
+	if err == nil && token.UserID == nil {
+		err = data.ErrTokenInvalid
+	}
+	if err != nil {
+		app.Session.Put(r.Context(), "error", app.T(r, "%s. Request a new one.", app.linkMessage(r, err)))
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(*token.UserID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to change your password"))
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	err = app.Models.User.ResetPassword(user.ID, password)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to change your password"))
+		http.Redirect(w, r, r.RequestURI, http.StatusSeeOther)
+		return
+	}
+
+	err = app.destroyUserSessions(r.Context(), user.ID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	// links sent before the password was changed stop working
+	err = app.Models.Token.Revoke(data.TokenPasswordReset, user.ID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	msg := Message{
+		To:       []string{user.Email},
+		Subject:  app.T(r, "Your Password Was Changed"),
+		Locale:   app.locale(r),
+		Template: "password-changed",
+		Data: PasswordChangedEmail{
+			User: user,
+		},
+	}
+	app.sendEmail(msg)
+
+	app.Session.Put(r.Context(), "flash", app.T(r, "Your password has been changed. You can now log in."))
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// destroyUserSessions logs the user with userID out everywhere but in the session of
+// ctx, which is given a new token
+func (app *Config) destroyUserSessions(ctx context.Context, userID int) error {
+	current := app.Session.Token(ctx)
+
+	err := app.Session.Iterate(ctx, func(ctx context.Context) error {
+		if app.Session.GetInt(ctx, "userId") != userID || app.Session.Token(ctx) == current {
+			return nil
+		}
+		return app.Session.Destroy(ctx)
+	})
+	if err != nil {
+		return err
+	}
+
+	return app.Session.RenewToken(ctx)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// resetPasswordLink returns the path of a signed link carrying token, as sent to reset
+// a password
+func resetPasswordLink(token string) string {
+	NewURLSigner()
+	link := GenerateTokenFromString("http://localhost:3000/reset-password?token=" + token)
+	return strings.TrimPrefix(link, "http://localhost:3000")
+}
+
+var passwordTests = []struct {
+	name             string
+	method           string
+	url              string
+	form             url.Values
+	handler          http.HandlerFunc
+	expectedCode     int
+	expectedHTML     string
+	expectedKey      string
+	expectedMessage  string
+	expectedLocation string
+}{
+	{"forgot password page", "GET", "/forgot-password", nil, testApp.ForgotPasswordPage, http.StatusOK, `<h1 class="mt-5">Forgot Password</h1>`, "", "", ""},
+	{"forgot password", "POST", "/forgot-password", url.Values{"email": {"admin@example.com"}}, testApp.ForgotPassword, http.StatusSeeOther, "", "flash", forgotPasswordSent, "/login"},
+	{"forgot password of nobody", "POST", "/forgot-password", url.Values{"email": {"nobody@example.com"}}, testApp.ForgotPassword, http.StatusSeeOther, "", "flash", forgotPasswordSent, "/login"},
+	{"forgot password without email", "POST", "/forgot-password", url.Values{"email": {" "}}, testApp.ForgotPassword, http.StatusSeeOther, "", "error", "Enter your email address", "/forgot-password"},
+	{"reset password page", "GET", resetPasswordLink("password_reset-token"), nil, testApp.ResetPasswordPage, http.StatusOK, `<h1 class="mt-5">Reset Password</h1>`, "", "", ""},
+	{"unsigned reset password page", "GET", "/reset-password?token=password_reset-token", nil, testApp.ResetPasswordPage, http.StatusSeeOther, "", "error", "That link is not valid. Request a new one.", "/forgot-password"},
+	{"expired reset password page", "GET", resetPasswordLink("expired-token"), nil, testApp.ResetPasswordPage, http.StatusSeeOther, "", "error", "That link has expired. Request a new one.", "/forgot-password"},
+	{"reset password", "POST", resetPasswordLink("password_reset-token"), url.Values{"password": {"correct horse"}, "confirm-password": {"correct horse"}}, testApp.ResetPassword, http.StatusSeeOther, "", "flash", "Your password has been changed. You can now log in.", "/login"},
+	{"reset password twice", "POST", resetPasswordLink("used-token"), url.Values{"password": {"correct horse"}, "confirm-password": {"correct horse"}}, testApp.ResetPassword, http.StatusSeeOther, "", "error", "That link has already been used. Request a new one.", "/forgot-password"},
+	{"reset to a short password", "POST", resetPasswordLink("password_reset-token"), url.Values{"password": {"horse"}, "confirm-password": {"horse"}}, testApp.ResetPassword, http.StatusSeeOther, "", "error", "Your password must be at least 8 characters", resetPasswordLink("password_reset-token")},
+	{"reset to mismatched passwords", "POST", resetPasswordLink("password_reset-token"), url.Values{"password": {"correct horse"}, "confirm-password": {"battery staple"}}, testApp.ResetPassword, http.StatusSeeOther, "", "error", "The passwords do not match", resetPasswordLink("password_reset-token")},
+}
+
+func TestConfig_passwordHandlers(t *testing.T) {
+	templatesPath = "./templates"
+
+	for _, e := range passwordTests {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(e.method, e.url, strings.NewReader(e.form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		e.handler.ServeHTTP(rw, req)
+
+		testApp.Wait.Wait()
+
+		if rw.Code != e.expectedCode {
+			t.Errorf("%s: expected status code %d but got %d", e.name, e.expectedCode, rw.Code)
+		}
+
+		if e.expectedHTML != "" && !strings.Contains(rw.Body.String(), e.expectedHTML) {
+			t.Errorf("%s: did not find %s", e.name, e.expectedHTML)
+		}
+
+		if e.expectedKey != "" {
+			if msg := testApp.Session.PopString(ctx, e.expectedKey); msg != e.expectedMessage {
+				t.Errorf("%s: expected %s %q but got %q", e.name, e.expectedKey, e.expectedMessage, msg)
+			}
+		}
+
+		if location := rw.Header().Get("Location"); location != e.expectedLocation {
+			t.Errorf("%s: expected redirect to %q but got %q", e.name, e.expectedLocation, location)
+		}
+	}
+}
+
+func TestConfig_ForgotPassword_email(t *testing.T) {
+	sentMail()
+
+	for _, email := range []string{"admin@example.com", "nobody@example.com"} {
+		form := url.Values{"email": {email}}
+		req := httptest.NewRequest("POST", "/forgot-password", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = req.WithContext(getCtx(req))
+
+		testApp.ForgotPassword(httptest.NewRecorder(), req)
+	}
+
+	// nobody@example.com has no account, so is sent nothing
+	sent := sentMail()
+	if len(sent) != 1 {
+		t.Fatalf("expected one email but got %d", len(sent))
+	}
+	if sent[0].To[0] != "admin@example.com" || sent[0].Subject != "Reset Your Password" {
+		t.Errorf("expected the reset link to be sent to admin@example.com but got %q to %v", sent[0].Subject, sent[0].To)
+	}
+	if !strings.Contains(sent[0].PlainBody, "/reset-password?token=password_reset-token") {
+		t.Error("did not find the reset link in the email")
+	}
+}
+
+func TestConfig_destroyUserSessions(t *testing.T) {
+	// newSession stores a session logged in as userID and returns its token
+	newSession := func(userID int) string {
+		ctx, _ := testApp.Session.Load(context.Background(), "")
+		testApp.Session.Put(ctx, "userId", userID)
+		token, _, err := testApp.Session.Commit(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	other := newSession(1)
+	someoneElse := newSession(2)
+
+	current := newSession(1)
+	ctx, _ := testApp.Session.Load(context.Background(), current)
+
+	if err := testApp.destroyUserSessions(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, found, _ := testApp.Session.Store.Find(other); found {
+		t.Error("expected the other session of the user to be destroyed")
+	}
+	if _, found, _ := testApp.Session.Store.Find(someoneElse); !found {
+		t.Error("expected the session of another user to be kept")
+	}
+	if token := testApp.Session.Token(ctx); token == current {
+		t.Error("expected the current session to get a new token")
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"subscription-service/data"
+	"sync"
+	"time"
+)
+
+// Charge statuses
+const (
+	ChargeSucceeded = "succeeded"
+	ChargeDeclined  = "declined"
+	ChargeFailed    = "failed"
+)
+
+// Payment event types, as reported by a provider's webhooks
+const (
+	EventPaymentSucceeded = "payment.succeeded"
+	EventPaymentFailed    = "payment.failed"
+	EventPaymentRefunded  = "payment.refunded"
+	EventDisputeOpened    = "dispute.opened"
+)
+
+// PaymentSignatureHeader carries the hex encoded HMAC-SHA256 of a webhook payload
+const PaymentSignatureHeader = "X-Payment-Signature"
+
+var (
+	// ErrPaymentDeclined is returned when the member's bank or card issuer refuses a charge
+	ErrPaymentDeclined = errors.New("payment declined")
+	// ErrPaymentFailed is returned when a charge could not be made for any other reason
+	ErrPaymentFailed = errors.New("payment failed")
+	// ErrNoPaymentMethod is returned when charging a member who has no payment method on file
+	ErrNoPaymentMethod = errors.New("no payment method on file")
+	// ErrInvalidSignature is returned for webhook deliveries whose signature does not match
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+)
+
+// PaymentProvider is implemented by the payment gateways we can take payments through.
+// Amounts are in the minor units of currency.
+type PaymentProvider interface {
+	CreateCustomer(user data.User) (string, error)
+	AttachPaymentMethod(customerID, token string) (string, error)
+	Charge(customerID, paymentMethodID string, amount int, currency, description string) (*Charge, error)
+	Refund(chargeID string, amount int) (*Refund, error)
+	HandleWebhook(payload []byte, header http.Header) (*PaymentEvent, error)
+}
+
+// Charge is the outcome of charging a payment method. A declined or failed charge is
+// returned together with ErrPaymentDeclined or ErrPaymentFailed.
+type Charge struct {
+	ID             string
+	Amount         int
+	Currency       string
+	Status         string
+	FailureMessage string
+	CreatedAt      time.Time
+}
+
+// Refund is money given back on an earlier charge
+type Refund struct {
+	ID        string
+	ChargeID  string
+	Amount    int
+	CreatedAt time.Time
+}
+
+// PaymentEvent is a notification from the provider about something that happened to a charge
+type PaymentEvent struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	ChargeID  string    `json:"charge_id"`
+	Amount    int       `json:"amount"`
+	Currency  string    `json:"currency"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Fake payment provider modes
+const (
+	FakeSucceed = "succeed"
+	FakeDecline = "decline"
+	FakeFail    = "fail"
+)
+
+// Test card tokens understood by the fake payment provider. A payment method attached
+// with one of these always behaves accordingly, whatever the provider's mode.
+const (
+	FakeTokenVisa    = "tok_visa"
+	FakeTokenDecline = "tok_decline"
+	FakeTokenFail    = "tok_fail"
+)
+
+// FakePaymentProvider is an in-process payment gateway for local development and tests.
+// Every charge succeeds, is declined or fails depending on its mode and on the test card
+// token the payment method was attached with.
+type FakePaymentProvider struct {
+	mu            sync.Mutex
+	mode          string
+	webhookSecret string
+	seq           int
+	methods       map[string]string
+	charges       map[string]*Charge
+}
+
+// NewFakePaymentProvider returns a fake provider in the given mode, which signs its
+// webhooks with webhookSecret
+func NewFakePaymentProvider(mode, webhookSecret string) *FakePaymentProvider {
+	return &FakePaymentProvider{
+		mode:          mode,
+		webhookSecret: webhookSecret,
+		methods:       make(map[string]string),
+		charges:       make(map[string]*Charge),
+	}
+}
+
+// SetMode changes how the fake provider answers charges that do not use a test card token
+func (f *FakePaymentProvider) SetMode(mode string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.mode = mode
+}
+
+// CreateCustomer registers user with the provider and returns their customer id
+func (f *FakePaymentProvider) CreateCustomer(user data.User) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.nextID("cus"), nil
+}
+
+// AttachPaymentMethod stores a card token for a customer and returns its payment method id
+func (f *FakePaymentProvider) AttachPaymentMethod(customerID, token string) (string, error) {
+	if customerID == "" {
+		return "", errors.New("missing customer")
+	}
+	if token == "" {
+		return "", errors.New("missing card token")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := f.nextID("pm")
+	f.methods[id] = token
+	return id, nil
+}
+
+// Charge takes amount from the customer's payment method
+func (f *FakePaymentProvider) Charge(customerID, paymentMethodID string, amount int, currency, description string) (*Charge, error) {
+	if customerID == "" || paymentMethodID == "" {
+		return nil, ErrNoPaymentMethod
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	outcome := f.mode
+	switch f.methods[paymentMethodID] {
+	case FakeTokenDecline:
+		outcome = FakeDecline
+	case FakeTokenFail:
+		outcome = FakeFail
+	}
+
+	charge := &Charge{
+		ID:        f.nextID("ch"),
+		Amount:    amount,
+		Currency:  currency,
+		Status:    ChargeSucceeded,
+		CreatedAt: time.Now(),
+	}
+	f.charges[charge.ID] = charge
+
+	switch outcome {
+	case FakeDecline:
+		charge.Status = ChargeDeclined
+		charge.FailureMessage = "Your card was declined."
+		return charge, ErrPaymentDeclined
+	case FakeFail:
+		charge.Status = ChargeFailed
+		charge.FailureMessage = "The payment could not be processed."
+		return charge, ErrPaymentFailed
+	}
+
+	return charge, nil
+}
+
+// Refund gives back amount of a successful charge
+func (f *FakePaymentProvider) Refund(chargeID string, amount int) (*Refund, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	charge, ok := f.charges[chargeID]
+	if !ok || charge.Status != ChargeSucceeded {
+		return nil, fmt.Errorf("no successful charge %s", chargeID)
+	}
+	if amount <= 0 || amount > charge.Amount {
+		return nil, fmt.Errorf("cannot refund %d of charge %s", amount, chargeID)
+	}
+
+	return &Refund{
+		ID:        f.nextID("re"),
+		ChargeID:  chargeID,
+		Amount:    amount,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// SignWebhook returns the signature the fake provider sends along with payload
+func (f *FakePaymentProvider) SignWebhook(payload []byte) string {
+	return signPayload(payload, f.webhookSecret)
+}
+
+// HandleWebhook verifies the signature of an event posted by the provider and decodes it.
+// Without a webhook secret no signature can be trusted, so every event is refused.
+func (f *FakePaymentProvider) HandleWebhook(payload []byte, header http.Header) (*PaymentEvent, error) {
+	if f.webhookSecret == "" {
+		return nil, ErrInvalidSignature
+	}
+
+	expected, _ := hex.DecodeString(f.SignWebhook(payload))
+	signature, err := hex.DecodeString(header.Get(PaymentSignatureHeader))
+	if err != nil || !hmac.Equal(signature, expected) {
+		return nil, ErrInvalidSignature
+	}
+
+	var event PaymentEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, err
+	}
+	if event.ID == "" || event.Type == "" {
+		return nil, errors.New("incomplete payment event")
+	}
+	return &event, nil
+}
+
+// signPayload returns the hex encoded HMAC-SHA256 of payload under secret
+func signPayload(payload []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// nextID returns a new provider id with the given prefix. The caller must hold f.mu.
+func (f *FakePaymentProvider) nextID(prefix string) string {
+	f.seq++
+	return fmt.Sprintf("%s_fake_%d", prefix, f.seq)
+}
+
+// chargeInvoice charges user's payment method for the total of a stored invoice and
+// records the attempt. A successful charge marks the invoice paid; invoices with
+// nothing to pay are marked paid without charging, and no charge is returned.
+func (app *Config) chargeInvoice(user data.User, invoice *data.Invoice) (*Charge, error) {
+	if invoice.Total <= 0 {
+		return nil, app.markInvoicePaid(invoice)
+	}
+
+	if user.PaymentCustomerID == "" || user.PaymentMethodID == "" {
+		return nil, ErrNoPaymentMethod
+	}
+
+	charge, chargeErr := app.Payments.Charge(user.PaymentCustomerID, user.PaymentMethodID, invoice.Total,
+		invoice.Currency, fmt.Sprintf("Invoice %s", invoice.Number))
+	if charge == nil {
+		return nil, chargeErr
+	}
+
+	payment := data.Payment{
+		UserID:           user.ID,
+		InvoiceID:        invoice.ID,
+		ProviderChargeID: charge.ID,
+		Amount:           charge.Amount,
+		Currency:         charge.Currency,
+		Status:           charge.Status,
+		FailureMessage:   charge.FailureMessage,
+	}
+	_, err := app.Models.Payment.Insert(payment)
+	if err != nil {
+		return charge, err
+	}
+
+	if chargeErr != nil {
+		return charge, chargeErr
+	}
+
+	return charge, app.markInvoicePaid(invoice)
+}
+
+// isPaymentError reports whether err means the member's payment could not be taken, as
+// opposed to an error on our side
+func isPaymentError(err error) bool {
+	return errors.Is(err, ErrPaymentDeclined) || errors.Is(err, ErrPaymentFailed) || errors.Is(err, ErrNoPaymentMethod)
+}
+
+// markInvoicePaid records that invoice has been paid in full
+func (app *Config) markInvoicePaid(invoice *data.Invoice) error {
+	now := time.Now()
+	invoice.Status = data.InvoicePaid
+	invoice.PaidAt = &now
+	return app.Models.Invoice.Update(*invoice)
+}
+
+// refundInvoice gives back everything paid on invoice by charge and voids the invoice,
+// e.g. when the subscription it paid for could not be started
+func (app *Config) refundInvoice(invoice *data.Invoice, charge *Charge) error {
+	_, err := app.Payments.Refund(charge.ID, charge.Amount)
+	if err != nil {
+		return err
+	}
+
+	payment, err := app.Models.Payment.GetByChargeID(charge.ID)
+	if err != nil {
+		return err
+	}
+
+	err = app.Models.Payment.UpdateStatus(payment.ID, data.PaymentRefunded)
+	if err != nil {
+		return err
+	}
+
+	invoice.Status = data.InvoiceVoid
+	return app.Models.Invoice.Update(*invoice)
+}
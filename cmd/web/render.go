@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
+	"path/filepath"
 	"subscription-service/data"
 	"time"
 )
@@ -21,6 +22,10 @@ type TemplateData struct {
 	Authenticated bool
 	Now           time.Time
 	User          *data.User
+	// Locale is the language the page is written in, and Path the page itself, for the
+	// language picker to come back to
+	Locale string
+	Path   string
 }
 
 func (app *Config) render(w http.ResponseWriter, r *http.Request, t string, td *TemplateData) {
@@ -43,7 +48,8 @@ func (app *Config) render(w http.ResponseWriter, r *http.Request, t string, td *
 		td = &TemplateData{}
 	}
 
-	tmpl, err := template.ParseFiles(templateSlice...)
+	// the page is named after its file, so that Execute runs it
+	tmpl, err := template.New(filepath.Base(t)).Funcs(localeFuncs(app.locale(r))).ParseFiles(templateSlice...)
 	if err != nil {
 		app.ErrorLog.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -67,9 +73,16 @@ func (app *Config) AddDefaultData(td *TemplateData, r *http.Request) *TemplateDa
 			app.ErrorLog.Println("Failed to get User from session")
 		} else {
 			td.User = &user
+
+			sub, err := app.Models.Subscription.GetCurrentByUser(user.ID)
+			if err == nil && sub.Status == data.SubscriptionPastDue && td.Warning == "" {
+				td.Warning = app.T(r, pastDueWarning)
+			}
 		}
 	}
 	td.Now = time.Now()
+	td.Locale = app.locale(r)
+	td.Path = r.URL.RequestURI()
 	return td
 }
 
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"subscription-service/data"
+	"time"
+)
+
+// renewalCheckInterval is how often we look for subscriptions whose period has ended
+var renewalCheckInterval = 10 * time.Minute
+
+// trialReminderDays is how many days before the end of a free trial the member is reminded
+const trialReminderDays = 3
+
+func (app *Config) listenForRenewals() {
+	ticker := time.NewTicker(renewalCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			app.remindEndingTrials()
+			app.renewDueSubscriptions()
+			app.retryPastDuePayments()
+		case <-app.RenewalDone:
+			return
+		}
+	}
+}
+
+// renewDueSubscriptions renews every subscription whose current period has ended. A
+// subscription that is several periods behind is renewed one period per run.
+func (app *Config) renewDueSubscriptions() {
+	app.Wait.Add(1)
+	defer app.Wait.Done()
+
+	subs, err := app.Models.Subscription.GetDueForRenewal(time.Now())
+	if err != nil {
+		app.ErrorChan <- err
+		return
+	}
+
+	for _, sub := range subs {
+		if err := app.renewSubscription(sub); err != nil {
+			app.ErrorChan <- err
+		}
+	}
+}
+
+// remindEndingTrials emails every member whose free trial ends within trialReminderDays
+func (app *Config) remindEndingTrials() {
+	app.Wait.Add(1)
+	defer app.Wait.Done()
+
+	subs, err := app.Models.Subscription.GetTrialsEndingBefore(time.Now().AddDate(0, 0, trialReminderDays))
+	if err != nil {
+		app.ErrorChan <- err
+		return
+	}
+
+	for _, sub := range subs {
+		if err := app.remindTrial(sub); err != nil {
+			app.ErrorChan <- err
+		}
+	}
+}
+
+// remindTrial tells the member when their trial of sub ends and what happens then
+func (app *Config) remindTrial(sub *data.Subscription) error {
+	user, err := app.Models.User.GetOne(sub.UserID)
+	if err != nil {
+		return err
+	}
+
+	plan, err := app.Models.Plan.GetOne(sub.PlanID)
+	if err != nil {
+		return err
+	}
+	plan = plan.InCurrency(sub.Currency)
+
+	now := time.Now()
+	sub.TrialReminderSentAt = &now
+	err = app.Models.Subscription.Update(*sub)
+	if err != nil {
+		return err
+	}
+
+	msg := Message{
+		To:       []string{user.Email},
+		Subject:  translate(user.Locale, "Your Free Trial Is Ending Soon"),
+		Locale:   user.Locale,
+		Template: "trial-ending",
+		Data: SubscriptionEmail{
+			Plan:         plan,
+			Subscription: sub,
+		},
+	}
+	app.sendEmail(msg)
+
+	return nil
+}
+
+// renewSubscription ends sub if it was canceled at the end of the period, billing the
+// usage of the last period; a trial that was canceled, or that the member never added a
+// payment method for, simply expires. Otherwise it invoices the next period together
+// with the usage of the period ending, taking off the discount of the member's coupon if
+// they have one and adding tax, charges it and, once paid, starts it, converting a trial
+// to a paid subscription and switching to a scheduled plan if there is one. A
+// subscription whose payment fails becomes past due and enters dunning. The next period
+// is invoiced once: if renewing failed after the invoice was stored, the next run charges
+// the same invoice, or only starts the period if it was paid.
+func (app *Config) renewSubscription(sub *data.Subscription) error {
+	if sub.CancelAtPeriodEnd {
+		err := app.invoiceFinalUsage(sub, sub.CurrentPeriodEnd)
+		if err != nil {
+			return err
+		}
+
+		if sub.Status == data.SubscriptionTrialing {
+			sub.Status = data.SubscriptionExpired
+		} else {
+			sub.Status = data.SubscriptionCanceled
+		}
+		sub.EndedAt = &sub.CurrentPeriodEnd
+		return app.Models.Subscription.Update(*sub)
+	}
+
+	user, err := app.Models.User.GetOne(sub.UserID)
+	if err != nil {
+		return err
+	}
+
+	plan, err := app.renewalPlan(sub)
+	if err != nil {
+		return err
+	}
+
+	if sub.Status == data.SubscriptionTrialing && plan.PlanAmount > 0 && user.PaymentMethodID == "" {
+		sub.Status = data.SubscriptionExpired
+		sub.EndedAt = &sub.CurrentPeriodEnd
+		return app.Models.Subscription.Update(*sub)
+	}
+
+	invoice, err := app.Models.Invoice.GetByPeriod(sub.ID, sub.CurrentPeriodEnd)
+	if errors.Is(err, sql.ErrNoRows) {
+		invoice, err = app.invoiceRenewal(*user, sub, plan)
+	}
+	if err != nil {
+		return err
+	}
+
+	if invoice.Status == data.InvoicePaid {
+		// an earlier run took the payment but could not start the period
+		return app.completeRenewal(*user, sub, plan, invoice)
+	}
+
+	_, err = app.chargeInvoice(*user, invoice)
+	if isPaymentError(err) {
+		// the invoice stays open while we retry it
+		return app.startDunning(*user, sub, invoice)
+	}
+	if err != nil {
+		return err
+	}
+
+	return app.completeRenewal(*user, sub, plan, invoice)
+}
+
+// invoiceRenewal stores the invoice for the period of sub after the current one on plan,
+// together with the usage of the period ending, taking off the discount of the member's
+// coupon if they have one, adding tax and taking off any credit sub has left
+func (app *Config) invoiceRenewal(user data.User, sub *data.Subscription, plan *data.Plan) (*data.Invoice, error) {
+	redemption, err := app.activeRedemption(user.ID, plan.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	start := sub.CurrentPeriodEnd
+	inv := app.buildInvoice(user, plan, sub.Quantity, start, plan.NextPeriodEnd(start), nil)
+	inv.SubscriptionID = &sub.ID
+	inv.PeriodStart = &start
+	err = app.addPeriodUsage(sub, start, &inv, user.Locale)
+	if err != nil {
+		return nil, err
+	}
+	if redemption != nil {
+		discountInvoice(&inv, redemption.Coupon, user.Locale)
+	}
+	err = app.Tax.AddTax(user, &inv)
+	if err != nil {
+		return nil, err
+	}
+	balance := settleCredit(&inv, sub.CreditBalance, user.Locale)
+
+	invoice, err := app.storeInvoice(inv)
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.spendCredit(sub, balance)
+	if err != nil {
+		return nil, err
+	}
+
+	// the discounted invoice counts as a period of the coupon even if it is only paid
+	// during dunning
+	if redemption != nil {
+		err = app.Models.Coupon.ApplyRedemption(redemption.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return invoice, nil
+}
+
+// invoiceFinalUsage bills the usage of the last period of sub up to end, when the period
+// ends without being renewed: at its end, or earlier when the subscription is canceled or
+// replaced straight away. Like a renewal it is invoiced once; an invoice whose payment
+// fails stays open for the member to pay.
+func (app *Config) invoiceFinalUsage(sub *data.Subscription, end time.Time) error {
+	if sub.Status == data.SubscriptionTrialing {
+		return nil
+	}
+
+	user, err := app.Models.User.GetOne(sub.UserID)
+	if err != nil {
+		return err
+	}
+
+	invoice, err := app.Models.Invoice.GetByPeriod(sub.ID, end)
+	if errors.Is(err, sql.ErrNoRows) {
+		invoice, err = app.invoiceUsage(*user, sub, end)
+	}
+	if err != nil || invoice == nil || invoice.Status == data.InvoicePaid {
+		return err
+	}
+
+	_, err = app.chargeInvoice(*user, invoice)
+	if isPaymentError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	app.sendInvoice(*user, invoice, Message{
+		Subject:  translate(user.Locale, "Your Invoice Data"),
+		Template: "invoice",
+		Data:     InvoiceEmail{Invoice: invoice},
+	})
+
+	return nil
+}
+
+// invoiceUsage stores an invoice for the usage of the current period of sub up to end, or
+// returns nil if there is none to bill
+func (app *Config) invoiceUsage(user data.User, sub *data.Subscription, end time.Time) (*data.Invoice, error) {
+	now := time.Now()
+	inv := data.Invoice{
+		UserID:         user.ID,
+		SubscriptionID: &sub.ID,
+		Status:         data.InvoiceOpen,
+		Currency:       sub.Currency,
+		IssuedAt:       now,
+		DueAt:          now.AddDate(0, 0, invoiceDueDays),
+		PeriodStart:    &end,
+	}
+	err := app.addPeriodUsage(sub, end, &inv, user.Locale)
+	if err != nil {
+		return nil, err
+	}
+	if len(inv.Lines) == 0 {
+		return nil, nil
+	}
+
+	err = app.Tax.AddTax(user, &inv)
+	if err != nil {
+		return nil, err
+	}
+	balance := settleCredit(&inv, sub.CreditBalance, user.Locale)
+
+	invoice, err := app.storeInvoice(inv)
+	if err != nil {
+		return nil, err
+	}
+
+	return invoice, app.spendCredit(sub, balance)
+}
+
+// spendCredit records the credit balance sub has left once an invoice has taken what it
+// could of it. The credit goes with the invoice, so it is spent even if the invoice is
+// only paid during dunning.
+func (app *Config) spendCredit(sub *data.Subscription, balance int) error {
+	if balance == sub.CreditBalance {
+		return nil
+	}
+
+	sub.CreditBalance = balance
+	return app.Models.Subscription.SetCreditBalance(sub.ID, balance)
+}
+
+// renewalPlan returns the plan sub renews on: the plan scheduled to take over at the end
+// of the period if there is one, or else its current plan, priced in its currency
+func (app *Config) renewalPlan(sub *data.Subscription) (*data.Plan, error) {
+	planID := sub.PlanID
+	if sub.ScheduledPlanID != nil {
+		planID = *sub.ScheduledPlanID
+	}
+
+	plan, err := app.Models.Plan.GetOne(planID)
+	if err != nil {
+		return nil, err
+	}
+
+	return plan.InCurrency(sub.Currency), nil
+}
+
+// completeRenewal starts the period of sub that the paid invoice covers, and sends the
+// member their invoice
+func (app *Config) completeRenewal(user data.User, sub *data.Subscription, plan *data.Plan, invoice *data.Invoice) error {
+	renewed, err := app.Models.Subscription.Renew(*sub, *plan)
+	if err != nil {
+		return err
+	}
+
+	if renewed.ID != sub.ID {
+		invoice.SubscriptionID = &renewed.ID
+		err = app.Models.Invoice.Update(*invoice)
+		if err != nil {
+			return err
+		}
+	}
+
+	app.sendInvoice(user, invoice, Message{
+		Subject:  translate(user.Locale, "Your Subscription Has Been Renewed"),
+		Template: "renewal",
+		Data: RenewalEmail{
+			Plan:         plan,
+			Subscription: renewed,
+			Invoice:      invoice,
+		},
+	})
+
+	return nil
+}
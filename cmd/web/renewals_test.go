@@ -0,0 +1,196 @@
+package main
+
+import (
+	"strings"
+	"subscription-service/data"
+	"testing"
+	"time"
+)
+
+func TestConfig_renewDueSubscriptions(t *testing.T) {
+	sentMail()
+
+	testApp.renewDueSubscriptions()
+	testApp.Wait.Wait()
+
+	// the one subscription due is renewed and its invoice sent
+	sent := sentMail()
+	if len(sent) != 1 || sent[0].Subject != "Your Subscription Has Been Renewed" {
+		t.Fatalf("expected the renewal email but got %d emails", len(sent))
+	}
+	if sent[0].To[0] != "admin@example.com" || !strings.Contains(sent[0].PlainBody, "Bronze Plan has been renewed") {
+		t.Errorf("expected the Bronze Plan renewal to go to admin@example.com but got %q to %v", sent[0].PlainBody, sent[0].To)
+	}
+	if len(sent[0].Attachments) != 1 {
+		t.Errorf("expected the invoice to be attached but got %d attachments", len(sent[0].Attachments))
+	}
+}
+
+func TestConfig_remindEndingTrials(t *testing.T) {
+	sub, _ := testApp.Models.Subscription.GetOne(1)
+	sub.Status = data.SubscriptionTrialing
+
+	err := testApp.remindTrial(sub)
+	if err != nil {
+		t.Error(err)
+	}
+	if sub.TrialReminderSentAt == nil {
+		t.Error("expected the reminder to be recorded")
+	}
+	sentMail()
+
+	testApp.remindEndingTrials()
+	testApp.Wait.Wait()
+
+	// the one trial ending is reminded of what it will cost afterwards
+	sent := sentMail()
+	if len(sent) != 1 || sent[0].Subject != "Your Free Trial Is Ending Soon" {
+		t.Fatalf("expected the trial reminder but got %d emails", len(sent))
+	}
+	if !strings.Contains(sent[0].PlainBody, "continues at $10.00/month") {
+		t.Errorf("expected the reminder to give the price after the trial but got %q", sent[0].PlainBody)
+	}
+}
+
+func TestConfig_renewSubscription(t *testing.T) {
+	end := time.Now()
+
+	canceled := &data.Subscription{
+		ID:                 1,
+		UserID:             1,
+		PlanID:             1,
+		Status:             data.SubscriptionActive,
+		Currency:           data.DefaultCurrency,
+		CurrentPeriodStart: end.AddDate(0, -1, 0),
+		CurrentPeriodEnd:   end,
+		CancelAtPeriodEnd:  true,
+	}
+
+	sentMail()
+	err := testApp.renewSubscription(canceled)
+	if err != nil {
+		t.Error(err)
+	}
+	if canceled.Status != data.SubscriptionCanceled || canceled.EndedAt == nil {
+		t.Errorf("expected subscription canceled at period end but got status %s", canceled.Status)
+	}
+	// the usage of the last period is still billed
+	if sent := sentMail(); len(sent) != 1 || sent[0].Subject != "Your Invoice Data" {
+		t.Errorf("expected the usage of the last period to be invoiced but got %d emails", len(sent))
+	}
+
+	trial := &data.Subscription{
+		ID:                 1,
+		UserID:             1,
+		PlanID:             1,
+		Status:             data.SubscriptionTrialing,
+		CurrentPeriodStart: end.AddDate(0, 0, -14),
+		CurrentPeriodEnd:   end,
+		TrialEnd:           &end,
+		CancelAtPeriodEnd:  true,
+	}
+
+	err = testApp.renewSubscription(trial)
+	if err != nil {
+		t.Error(err)
+	}
+	if trial.Status != data.SubscriptionExpired {
+		t.Errorf("expected canceled trial to expire but got status %s", trial.Status)
+	}
+	if sent := sentMail(); len(sent) != 0 {
+		t.Errorf("expected the usage of a trial to be free but got %d emails", len(sent))
+	}
+
+	scheduled := 2
+	sub := &data.Subscription{
+		ID:                 1,
+		UserID:             1,
+		PlanID:             1,
+		ScheduledPlanID:    &scheduled,
+		Status:             data.SubscriptionActive,
+		Currency:           "EUR",
+		CurrentPeriodStart: end.AddDate(0, -1, 0),
+		CurrentPeriodEnd:   end,
+	}
+
+	err = testApp.renewSubscription(sub)
+	if err != nil {
+		t.Error(err)
+	}
+	testApp.Wait.Wait()
+
+	// the subscription renews onto the scheduled plan for another month
+	sent := sentMail()
+	if len(sent) != 1 || sent[0].Subject != "Your Subscription Has Been Renewed" {
+		t.Fatalf("expected the renewal email but got %d emails", len(sent))
+	}
+	until := end.AddDate(0, 1, 0).Format("Jan 2, 2006")
+	if !strings.Contains(sent[0].PlainBody, "Silver Plan has been renewed until "+until) {
+		t.Errorf("expected the renewal to the Silver Plan until %s but got %q", until, sent[0].PlainBody)
+	}
+	if len(sent[0].Attachments) != 1 {
+		t.Errorf("expected the invoice to be attached but got %d attachments", len(sent[0].Attachments))
+	}
+}
+
+func TestConfig_renewSubscription_paymentFailed(t *testing.T) {
+	testPayments.SetMode(FakeDecline)
+	defer testPayments.SetMode(FakeSucceed)
+
+	end := time.Now()
+	sub := &data.Subscription{
+		ID:                 1,
+		UserID:             1,
+		PlanID:             1,
+		Status:             data.SubscriptionActive,
+		Currency:           data.DefaultCurrency,
+		CurrentPeriodStart: end.AddDate(0, -1, 0),
+		CurrentPeriodEnd:   end,
+	}
+
+	err := testApp.renewSubscription(sub)
+	if err != nil {
+		t.Error(err)
+	}
+	if sub.Status != data.SubscriptionPastDue {
+		t.Errorf("expected subscription to be past due but got status %s", sub.Status)
+	}
+	if sub.NextPaymentAttemptAt == nil {
+		t.Error("expected a payment retry to be scheduled")
+	}
+	if !sub.CurrentPeriodEnd.Equal(end) {
+		t.Error("expected an unpaid subscription not to be renewed")
+	}
+	testApp.Wait.Wait()
+}
+
+func TestConfig_renewSubscription_alreadyPaid(t *testing.T) {
+	// charging again would fail, so the period must be started from the paid invoice
+	testPayments.SetMode(FakeDecline)
+	defer testPayments.SetMode(FakeSucceed)
+	sentMail()
+
+	end := time.Now()
+	sub := &data.Subscription{
+		ID:                 2,
+		UserID:             1,
+		PlanID:             1,
+		Status:             data.SubscriptionActive,
+		Currency:           data.DefaultCurrency,
+		CurrentPeriodStart: end.AddDate(0, -1, 0),
+		CurrentPeriodEnd:   end,
+	}
+
+	err := testApp.renewSubscription(sub)
+	if err != nil {
+		t.Error(err)
+	}
+	if sub.Status != data.SubscriptionActive || sub.NextPaymentAttemptAt != nil {
+		t.Errorf("expected the paid period not to be charged again but got status %s", sub.Status)
+	}
+
+	sent := sentMail()
+	if len(sent) != 1 || sent[0].Subject != "Your Subscription Has Been Renewed" {
+		t.Errorf("expected the renewal email but got %d emails", len(sent))
+	}
+}
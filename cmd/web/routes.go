@@ -9,37 +9,56 @@ import (
 func (app *Config) routes() http.Handler {
 	mux := chi.NewRouter()
 	mux.Use(middleware.Recoverer)
-	mux.Use(app.SessionLoad)
-
-	mux.Get("/", app.HomePage)
-
-	mux.Get("/login", app.LoginPage)
-	mux.Post("/login", app.Login)
-	mux.Get("/logout", app.Logout)
-	mux.Get("/register", app.RegisterPage)
-	mux.Post("/register", app.Register)
-	mux.Get("/activate-acc", app.ActivateAccount)
-	//mux.Get("/email", func(writer http.ResponseWriter, request *http.Request) {
-	//	m := Mail{
-	//		Domain:      "127.0.0.1",
-	//		Host:        "127.0.0.1",
-	//		Port:        1025,
-	//		Username:    "your-email@your-domain.com",
-	//		Password:    "your-password",
-	//		Encryption:  "none",
-	//		FromAddress: "info@myco.com",
-	//		FromName:    "no-reply",
-	//		ErrorChan:   make(chan error),
-	//	}
-	//	msg := Message{
-	//		To:      []string{"me@here.com"},
-	//		Subject: "Welcome to MyCo",
-	//		Data:    "Your account has been activated.",
-	//	}
-	//	m.send(msg)
-	//})
-
-	mux.Mount("/members", app.authRoutes())
+
+	// the payment provider calls in without a session; requests are authenticated by
+	// their signature instead
+	mux.Post("/webhooks/payments", app.PaymentWebhook)
+
+	// the systems of our members call the API without a session too; they authenticate
+	// with their API key
+	mux.Mount("/api", app.apiRoutes())
+
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.SessionLoad)
+		mux.Use(app.Localize)
+
+		mux.Get("/", app.HomePage)
+
+		mux.Get("/login", app.LoginPage)
+		mux.Post("/login", app.Login)
+		mux.Get("/logout", app.Logout)
+		mux.Get("/register", app.RegisterPage)
+		mux.Post("/register", app.Register)
+		mux.Get("/activate-acc", app.ActivateAccount)
+		mux.Get("/forgot-password", app.ForgotPasswordPage)
+		mux.Post("/forgot-password", app.ForgotPassword)
+		mux.Get("/reset-password", app.ResetPasswordPage)
+		mux.Post("/reset-password", app.ResetPassword)
+		mux.Post("/locale", app.SetLocale)
+		//mux.Get("/email", func(writer http.ResponseWriter, request *http.Request) {
+		//	m := Mail{
+		//		Domain:      "127.0.0.1",
+		//		Host:        "127.0.0.1",
+		//		Port:        1025,
+		//		Username:    "your-email@your-domain.com",
+		//		Password:    "your-password",
+		//		Encryption:  "none",
+		//		FromAddress: "info@myco.com",
+		//		FromName:    "no-reply",
+		//		ErrorChan:   make(chan error),
+		//	}
+		//	msg := Message{
+		//		To:      []string{"me@here.com"},
+		//		Subject: "Welcome to MyCo",
+		//		Data:    "Your account has been activated.",
+		//	}
+		//	m.send(msg)
+		//})
+
+		mux.Mount("/members", app.authRoutes())
+		mux.Mount("/admin", app.adminRoutes())
+	})
+
 	return mux
 }
 
@@ -48,7 +67,57 @@ func (app *Config) authRoutes() http.Handler {
 	mux.Use(app.Auth)
 
 	mux.Get("/plans", app.ChooseSubscription)
-	mux.Get("/subscribe", app.SubscribeToPlan)
+	mux.Post("/subscribe", app.SubscribeToPlan)
+	mux.Get("/billing", app.BillingDetailsPage)
+	mux.Post("/billing", app.SaveBillingDetails)
+	mux.Get("/usage", app.UsagePage)
+	mux.Post("/usage/api-key", app.GenerateAPIKey)
+	mux.Get("/organization", app.OrganizationPage)
+	mux.Post("/organization", app.CreateOrganization)
+	mux.Get("/organization/join", app.JoinOrganization)
+	mux.Post("/organization/invitations", app.InviteMember)
+	mux.Post("/organization/invitations/{id}/cancel", app.CancelInvitation)
+	mux.Post("/organization/members/{id}/role", app.ChangeMemberRole)
+	mux.Post("/organization/members/{id}/remove", app.RemoveMember)
+	mux.Get("/cancel", app.CancelPage)
+	mux.Post("/cancel", app.CancelSubscription)
+	mux.Post("/pause", app.PauseSubscription)
+	mux.Post("/reactivate", app.ReactivateSubscription)
+	mux.Post("/currency", app.SetCurrency)
+	mux.Get("/payment-method", app.PaymentMethodPage)
+	mux.Post("/payment-method", app.SavePaymentMethod)
+	mux.Get("/invoices", app.Invoices)
+	mux.Get("/invoices/{id}/pdf", app.InvoicePDF)
+
+	return mux
+}
+
+func (app *Config) apiRoutes() http.Handler {
+	mux := chi.NewRouter()
+	mux.Use(app.APIAuth)
+
+	mux.Post("/usage", app.RecordUsage)
+
+	return mux
+}
+
+func (app *Config) adminRoutes() http.Handler {
+	mux := chi.NewRouter()
+	mux.Use(app.Admin)
+
+	mux.Get("/users", app.AdminUsers)
+	mux.Get("/users/{id}", app.AdminUser)
+	mux.Post("/users/{id}/activate", app.AdminActivateUser)
+	mux.Post("/users/{id}/deactivate", app.AdminDeactivateUser)
+	mux.Post("/users/{id}/tax-id/verify", app.AdminVerifyTaxID)
+	mux.Post("/users/{id}/plan", app.AdminChangePlan)
+	mux.Post("/users/{id}/delete", app.AdminDeleteUser)
+	mux.Get("/plans", app.AdminPlans)
+	mux.Get("/plans/new", app.AdminNewPlan)
+	mux.Post("/plans", app.AdminCreatePlan)
+	mux.Get("/plans/{id}", app.AdminPlan)
+	mux.Post("/plans/{id}", app.AdminUpdatePlan)
+	mux.Post("/plans/{id}/archive", app.AdminArchivePlan)
 
 	return mux
 }
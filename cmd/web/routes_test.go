@@ -12,8 +12,40 @@ var routes = []string{
 	"/logout",
 	"/register",
 	"/activate-acc",
+	"/forgot-password",
+	"/reset-password",
+	"/locale",
+	"/webhooks/payments",
+	"/api/usage",
 	"/members/plans",
 	"/members/subscribe",
+	"/members/billing",
+	"/members/usage",
+	"/members/usage/api-key",
+	"/members/organization",
+	"/members/organization/join",
+	"/members/organization/invitations",
+	"/members/organization/invitations/{id}/cancel",
+	"/members/organization/members/{id}/role",
+	"/members/organization/members/{id}/remove",
+	"/members/cancel",
+	"/members/pause",
+	"/members/reactivate",
+	"/members/currency",
+	"/members/payment-method",
+	"/members/invoices",
+	"/members/invoices/{id}/pdf",
+	"/admin/users",
+	"/admin/users/{id}",
+	"/admin/users/{id}/activate",
+	"/admin/users/{id}/deactivate",
+	"/admin/users/{id}/tax-id/verify",
+	"/admin/users/{id}/plan",
+	"/admin/users/{id}/delete",
+	"/admin/plans",
+	"/admin/plans/new",
+	"/admin/plans/{id}",
+	"/admin/plans/{id}/archive",
 }
 
 func Test_RoutesExists(t *testing.T) {
@@ -15,10 +15,16 @@ import (
 
 var testApp Config
 
+var testPayments = NewFakePaymentProvider(FakeSucceed, "test-secret")
+
+// testMail captures the email sent by testApp; see deliverMail
+var testMail = NewCaptureTransport()
+
 func TestMain(m *testing.M) {
 	gob.Register(data.User{})
 
 	tmpPath = "./../../tmp"
+	templatesPath = "./templates"
 	manualPath = "./../../pdf"
 
 	session := scs.New()
@@ -35,28 +41,28 @@ func TestMain(m *testing.M) {
 		ErrorLog:      log.New(os.Stderr, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile),
 		Wait:          &sync.WaitGroup{},
 		Models:        data.TestNew(nil),
+		Payments:      testPayments,
+		Tax:           NewTableTaxCalculator("US", defaultTaxRates),
 		ErrorChan:     make(chan error),
 		ErrorChanDone: make(chan bool),
 	}
 
-	testApp.Mailer = Mail{
-		Wait:      testApp.Wait,
-		ErrorChan: make(chan error),
-		MailChan:  make(chan Message),
-		DoneChan:  make(chan bool),
+	emailTemplates, err := LoadEmailTemplates(os.DirFS(templatesPath), emailContracts)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	go func() {
-		for {
-			select {
-			case <-testApp.Mailer.MailChan:
-				testApp.Wait.Done()
-			case <-testApp.Mailer.ErrorChan:
-			case <-testApp.Mailer.DoneChan:
-				return
-			}
-		}
-	}()
+	testApp.Mailer = Mail{
+		FromAddress: "info@myco.com",
+		FromName:    "no-reply",
+		Templates:   emailTemplates,
+		Transport:   testMail,
+		Workers:     1,
+		MaxAttempts: 3,
+		Wait:        testApp.Wait,
+		Notify:      make(chan struct{}, 1),
+		DoneChan:    make(chan bool),
+	}
 
 	go func() {
 		for {
@@ -79,3 +85,23 @@ func getCtx(req *http.Request) context.Context {
 	}
 	return ctx
 }
+
+// deliverMail waits for the work testApp is doing in the background, then sends every
+// email due in the test outbox to testMail
+func deliverMail() {
+	testApp.Wait.Wait()
+
+	workers := make(chan struct{}, testApp.Mailer.Workers)
+	for testApp.dispatchMail(workers) > 0 {
+		testApp.Wait.Wait()
+	}
+}
+
+// sentMail delivers the email queued so far and returns it, forgetting it for the next
+// call
+func sentMail() []data.Email {
+	deliverMail()
+	sent := testMail.Sent()
+	testMail.Reset()
+	return sent
+}
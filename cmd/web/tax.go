@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"subscription-service/data"
+)
+
+// vatIDFormats holds the format of a VAT ID, prefix included, in each country whose VAT
+// we reverse charge to businesses, e.g. "DE123456789"
+var vatIDFormats = map[string]*regexp.Regexp{
+	"AT": regexp.MustCompile(`^ATU\d{8}$`),
+	"BE": regexp.MustCompile(`^BE[01]\d{9}$`),
+	"DE": regexp.MustCompile(`^DE\d{9}$`),
+	"DK": regexp.MustCompile(`^DK\d{8}$`),
+	"ES": regexp.MustCompile(`^ES[A-Z0-9]\d{7}[A-Z0-9]$`),
+	"FI": regexp.MustCompile(`^FI\d{8}$`),
+	"FR": regexp.MustCompile(`^FR[A-HJ-NP-Z0-9]{2}\d{9}$`),
+	"GB": regexp.MustCompile(`^GB(\d{9}|\d{12}|GD\d{3}|HA\d{3})$`),
+	"IE": regexp.MustCompile(`^IE(\d{7}[A-W][A-I]?|\d[A-Z+*]\d{5}[A-W])$`),
+	"IT": regexp.MustCompile(`^IT\d{11}$`),
+	"NL": regexp.MustCompile(`^NL\d{9}B\d{2}$`),
+	"PL": regexp.MustCompile(`^PL\d{10}$`),
+	"PT": regexp.MustCompile(`^PT\d{9}$`),
+	"SE": regexp.MustCompile(`^SE\d{10}01$`),
+}
+
+// taxIDPattern matches a tax ID once normalized in a country without a format of its
+// own in vatIDFormats
+var taxIDPattern = regexp.MustCompile(`^[A-Z0-9]{4,20}$`)
+
+// validTaxID reports whether taxID, once normalized, is written the way tax IDs are in
+// country. It does not tell whether the ID was ever issued; see data.User.TaxIDVerified.
+func validTaxID(country, taxID string) bool {
+	if format, ok := vatIDFormats[country]; ok {
+		return format.MatchString(taxID)
+	}
+	return country != "" && taxIDPattern.MatchString(taxID)
+}
+
+// normalizeTaxID uppercases a tax ID and strips the spaces, dots and dashes it is often
+// written with
+func normalizeTaxID(taxID string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '.', '-':
+			return -1
+		}
+		return r
+	}, strings.ToUpper(strings.TrimSpace(taxID)))
+}
+
+// TaxCalculator works out the tax owed on an invoice billed to a user, and adds it to
+// the invoice as tax lines. It is called once the invoice has all its other lines.
+type TaxCalculator interface {
+	AddTax(user data.User, invoice *data.Invoice) error
+}
+
+// TaxRate is one tax levied in a country, or only in one region of it when Region is
+// set. Rate is in hundredths of a percent, so 2000 is 20%. Inclusive rates are already
+// part of the prices charged there. A ReverseCharge rate is not charged to a business
+// whose tax ID we have verified and which is based in another country than we are; the
+// business accounts for the tax itself.
+type TaxRate struct {
+	Country       string
+	Region        string
+	Name          string
+	Rate          int
+	Inclusive     bool
+	ReverseCharge bool
+}
+
+// RateForDisplay formats the rate as a percentage, e.g. "19%" or "6.25%"
+func (r TaxRate) RateForDisplay() string {
+	return strconv.FormatFloat(float64(r.Rate)/100, 'f', -1, 64) + "%"
+}
+
+// defaultTaxRates are the rates we charge unless configured otherwise. Where a country
+// has rates for regions too, both apply. Rates for one place must agree on Inclusive
+// and ReverseCharge.
+var defaultTaxRates = []TaxRate{
+	{Country: "AT", Name: "VAT", Rate: 2000, Inclusive: true, ReverseCharge: true},
+	{Country: "BE", Name: "VAT", Rate: 2100, Inclusive: true, ReverseCharge: true},
+	{Country: "DE", Name: "VAT", Rate: 1900, Inclusive: true, ReverseCharge: true},
+	{Country: "DK", Name: "VAT", Rate: 2500, Inclusive: true, ReverseCharge: true},
+	{Country: "ES", Name: "VAT", Rate: 2100, Inclusive: true, ReverseCharge: true},
+	{Country: "FI", Name: "VAT", Rate: 2550, Inclusive: true, ReverseCharge: true},
+	{Country: "FR", Name: "VAT", Rate: 2000, Inclusive: true, ReverseCharge: true},
+	{Country: "IE", Name: "VAT", Rate: 2300, Inclusive: true, ReverseCharge: true},
+	{Country: "IT", Name: "VAT", Rate: 2200, Inclusive: true, ReverseCharge: true},
+	{Country: "NL", Name: "VAT", Rate: 2100, Inclusive: true, ReverseCharge: true},
+	{Country: "PL", Name: "VAT", Rate: 2300, Inclusive: true, ReverseCharge: true},
+	{Country: "PT", Name: "VAT", Rate: 2300, Inclusive: true, ReverseCharge: true},
+	{Country: "SE", Name: "VAT", Rate: 2500, Inclusive: true, ReverseCharge: true},
+	{Country: "GB", Name: "VAT", Rate: 2000, Inclusive: true, ReverseCharge: true},
+	{Country: "AU", Name: "GST", Rate: 1000, Inclusive: true},
+	{Country: "CA", Name: "GST", Rate: 500},
+	{Country: "CA", Region: "BC", Name: "PST", Rate: 700},
+	{Country: "US", Region: "NY", Name: "Sales Tax", Rate: 400},
+	{Country: "US", Region: "TX", Name: "Sales Tax", Rate: 625},
+	{Country: "US", Region: "WA", Name: "Sales Tax", Rate: 650},
+}
+
+// TableTaxCalculator charges the rates from its table that apply to the billing address
+// of the user. Country is the country we are based in.
+type TableTaxCalculator struct {
+	Country string
+	Rates   []TaxRate
+}
+
+// NewTableTaxCalculator returns a tax calculator for a business based in country
+// charging rates
+func NewTableTaxCalculator(country string, rates []TaxRate) *TableTaxCalculator {
+	return &TableTaxCalculator{
+		Country: strings.ToUpper(country),
+		Rates:   rates,
+	}
+}
+
+// AddTax adds a line to the invoice for every rate that applies to the user. Nothing
+// is taxed when the invoice comes to nothing or is a credit. Tax is only reverse charged
+// on a verified tax ID, and the invoice then gets a tax line of nothing, saying so;
+// prices which include the tax are charged without it.
+func (t *TableTaxCalculator) AddTax(user data.User, invoice *data.Invoice) error {
+	rates := t.ratesFor(user.Country, user.Region)
+	if len(rates) == 0 || invoice.Subtotal <= 0 {
+		return nil
+	}
+
+	invoice.TaxInclusive = rates[0].Inclusive
+	total := 0
+	for _, rate := range rates {
+		total += rate.Rate
+	}
+
+	if rates[0].ReverseCharge && user.TaxID != "" && user.TaxIDVerified && user.Country != t.Country {
+		if invoice.TaxInclusive {
+			excludeTax(invoice, total)
+		}
+		invoice.AddLine(data.LineTax, fmt.Sprintf("%s reverse charged (tax ID %s)", rates[0].Name, user.TaxID), 1, 0)
+		return nil
+	}
+
+	// included tax is worked out on the price without it
+	base := invoice.Subtotal
+	if invoice.TaxInclusive {
+		base = roundDiv(invoice.Subtotal*10000, 10000+total)
+	}
+
+	for _, rate := range rates {
+		description := fmt.Sprintf("%s (%s)", rate.Name, rate.RateForDisplay())
+		if rate.Inclusive {
+			description = fmt.Sprintf("%s (%s, included)", rate.Name, rate.RateForDisplay())
+		}
+		invoice.AddLine(data.LineTax, description, 1, roundDiv(base*rate.Rate, 10000))
+	}
+
+	return nil
+}
+
+// excludeTax takes tax at rate, in hundredths of a percent, out of the prices of an
+// invoice whose prices include it
+func excludeTax(invoice *data.Invoice, rate int) {
+	for _, line := range invoice.Lines {
+		unit := roundDiv(abs(line.UnitAmount)*10000, 10000+rate)
+		if line.UnitAmount < 0 {
+			unit = -unit
+		}
+		line.UnitAmount = unit
+		line.Amount = line.Quantity * unit
+	}
+	invoice.TaxInclusive = false
+	invoice.Calculate()
+}
+
+// ratesFor returns the rates levied in country, followed by those of region within it
+func (t *TableTaxCalculator) ratesFor(country, region string) []TaxRate {
+	var rates []TaxRate
+	for _, rate := range t.Rates {
+		if rate.Country == country && rate.Region == "" {
+			rates = append(rates, rate)
+		}
+	}
+	if region == "" {
+		return rates
+	}
+	for _, rate := range t.Rates {
+		if rate.Country == country && rate.Region == region {
+			rates = append(rates, rate)
+		}
+	}
+	return rates
+}
+
+// roundDiv divides a by b, rounding to the nearest whole number. Both must be positive.
+func roundDiv(a, b int) int {
+	return (a + b/2) / b
+}
+
+// abs returns the absolute value of n
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
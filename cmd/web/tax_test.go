@@ -0,0 +1,80 @@
+package main
+
+import (
+	"subscription-service/data"
+	"testing"
+)
+
+func TestTableTaxCalculator_AddTax(t *testing.T) {
+	calculator := NewTableTaxCalculator("US", defaultTaxRates)
+
+	tests := []struct {
+		name          string
+		user          data.User
+		amount        int
+		expectedLines int
+		expectedTax   int
+		expectedTotal int
+	}{
+		{"no billing address", data.User{}, 10000, 0, 0, 10000},
+		{"state without sales tax", data.User{Country: "US", Region: "OR"}, 10000, 0, 0, 10000},
+		{"state sales tax", data.User{Country: "US", Region: "NY"}, 10000, 1, 400, 10400},
+		{"federal and provincial tax", data.User{Country: "CA", Region: "BC"}, 10000, 2, 1200, 11200},
+		{"vat included", data.User{Country: "DE"}, 11900, 1, 1900, 11900},
+		{"vat reverse charged", data.User{Country: "DE", TaxID: "DE123456789", TaxIDVerified: true}, 11900, 1, 0, 10000},
+		{"vat id not verified", data.User{Country: "DE", TaxID: "DE123456789"}, 11900, 1, 1900, 11900},
+		{"credit", data.User{Country: "US", Region: "NY"}, -500, 0, 0, -500},
+	}
+
+	for _, e := range tests {
+		invoice := data.Invoice{Currency: "USD"}
+		invoice.AddLine(data.LineItem, "Bronze Plan", 1, e.amount)
+
+		err := calculator.AddTax(e.user, &invoice)
+		if err != nil {
+			t.Errorf("%s: %s", e.name, err)
+			continue
+		}
+
+		if lines := len(invoice.TaxLines()); lines != e.expectedLines {
+			t.Errorf("%s: expected %d tax lines but got %d", e.name, e.expectedLines, lines)
+		}
+
+		if invoice.Tax != e.expectedTax {
+			t.Errorf("%s: expected tax of %d but got %d", e.name, e.expectedTax, invoice.Tax)
+		}
+
+		if invoice.Total != e.expectedTotal {
+			t.Errorf("%s: expected a total of %d but got %d", e.name, e.expectedTotal, invoice.Total)
+		}
+	}
+}
+
+func Test_validTaxID(t *testing.T) {
+	tests := []struct {
+		country  string
+		taxID    string
+		expected bool
+	}{
+		{"DE", "DE123456789", true},
+		{"DE", "DE12345678", false},
+		{"DE", "AAAA", false},
+		{"DE", "FR12345678901", false},
+		{"AT", "ATU12345678", true},
+		{"NL", "NL123456789B01", true},
+		{"FR", "FRAB123456789", true},
+		{"IE", "IE1234567T", true},
+		{"SE", "SE123456789001", true},
+		{"SE", "SE123456789012", false},
+		{"GB", "GB123456789", true},
+		{"US", "123456789", true},
+		{"US", "12", false},
+		{"", "123456789", false},
+	}
+
+	for _, e := range tests {
+		if valid := validTaxID(e.country, e.taxID); valid != e.expected {
+			t.Errorf("%s %s: expected %t but got %t", e.country, e.taxID, e.expected, valid)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"subscription-service/data"
+	"time"
+)
+
+// How long the links we email stay valid
+const (
+	activationExpiry    = 48 * time.Hour
+	passwordResetExpiry = time.Hour
+	invitationExpiry    = 7 * 24 * time.Hour
+)
+
+// linkExpiry is how long the links for each purpose stay valid. The signature of a link
+// older than that has expired, whatever its token says; a purpose we issue no links for
+// has none that are valid.
+var linkExpiry = map[string]time.Duration{
+	data.TokenActivation:    activationExpiry,
+	data.TokenPasswordReset: passwordResetExpiry,
+	data.TokenInvitation:    invitationExpiry,
+}
+
+// tokenMessages tell the user why the link they followed did not work
+var tokenMessages = map[error]string{
+	data.ErrTokenInvalid: "That link is not valid",
+	data.ErrTokenExpired: "That link has expired",
+	data.ErrTokenUsed:    "That link has already been used",
+	data.ErrTokenRevoked: "That link is no longer valid",
+}
+
+// tokenMessage returns the message for a token that cannot be used, and whether err is
+// such a reason at all
+func tokenMessage(err error) (string, bool) {
+	for reason, msg := range tokenMessages {
+		if errors.Is(err, reason) {
+			return msg, true
+		}
+	}
+	return "", false
+}
+
+// issueLink issues a token for token.Purpose, valid for ttl, and returns a signed link to
+// path carrying it. The token makes the link single use; the signature stops anyone
+// from tampering with the rest of the link.
+func (app *Config) issueLink(path string, token data.Token, ttl time.Duration) (string, error) {
+	token.ExpiresAt = time.Now().Add(ttl)
+
+	plainText, err := app.Models.Token.Issue(token)
+	if err != nil {
+		return "", err
+	}
+
+	link := fmt.Sprintf("http://localhost:3000%s?token=%s", path, url.QueryEscape(plainText))
+	return GenerateTokenFromString(link), nil
+}
+
+// checkLink returns the token for purpose in the signed link r was made with, if it can
+// still be used, without using it up
+func (app *Config) checkLink(r *http.Request, purpose string) (*data.Token, error) {
+	plainText, err := linkToken(r, purpose)
+	if err != nil {
+		return nil, err
+	}
+
+	return app.Models.Token.Check(purpose, plainText)
+}
+
+// consumeLink uses up the token for purpose in the signed link r was made with, and
+// returns it
+func (app *Config) consumeLink(r *http.Request, purpose string) (*data.Token, error) {
+	plainText, err := linkToken(r, purpose)
+	if err != nil {
+		return nil, err
+	}
+
+	return app.Models.Token.Consume(purpose, plainText)
+}
+
+// linkMessage returns the message telling the user why the link they followed did not
+// work, in the language of r. Errors other than the token being unusable are logged.
+func (app *Config) linkMessage(r *http.Request, err error) string {
+	msg, ok := tokenMessage(err)
+	if !ok {
+		app.ErrorLog.Println(err)
+		msg = "Unable to use that link"
+	}
+	return app.T(r, msg)
+}
+
+// linkToken returns the token in the signed link for purpose r was made with, or
+// ErrTokenInvalid if the link is not validly signed and ErrTokenExpired if it was signed
+// longer ago than links for purpose stay valid
+func linkToken(r *http.Request, purpose string) (string, error) {
+	testURL := fmt.Sprintf("http://localhost:3000%s", r.RequestURI)
+	if !VerifyToken(testURL) {
+		return "", data.ErrTokenInvalid
+	}
+	if Expired(testURL, int(linkExpiry[purpose].Minutes())) {
+		return "", data.ErrTokenExpired
+	}
+
+	return r.URL.Query().Get("token"), nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"subscription-service/data"
+	"testing"
+	"time"
+)
+
+// activationLink returns the path of a signed link carrying token, as sent to activate
+// an account
+func activationLink(token string) string {
+	NewURLSigner()
+	link := GenerateTokenFromString("http://localhost:3000/activate-acc?token=" + token)
+	return strings.TrimPrefix(link, "http://localhost:3000")
+}
+
+func TestConfig_ActivateAccount(t *testing.T) {
+	tests := []struct {
+		name             string
+		url              string
+		expectedKey      string
+		expectedMessage  string
+		expectedLocation string
+	}{
+		{"activate", activationLink("activation-token"), "flash", "Account Activated. You can now login.", "/login"},
+		{"activate twice", activationLink("used-token"), "error", "That link has already been used", "/"},
+		{"activate expired", activationLink("expired-token"), "error", "That link has expired", "/"},
+		{"activate unknown", activationLink("nonsense"), "error", "That link is not valid", "/"},
+		{"activate unsigned", "/activate-acc?token=activation-token", "error", "That link is not valid", "/"},
+	}
+
+	for _, e := range tests {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", e.url, nil)
+
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		testApp.ActivateAccount(rw, req)
+
+		if rw.Code != http.StatusSeeOther {
+			t.Errorf("%s: expected status code %d but got %d", e.name, http.StatusSeeOther, rw.Code)
+		}
+
+		if msg := testApp.Session.PopString(ctx, e.expectedKey); msg != e.expectedMessage {
+			t.Errorf("%s: expected %s %q but got %q", e.name, e.expectedKey, e.expectedMessage, msg)
+		}
+
+		if location := rw.Header().Get("Location"); location != e.expectedLocation {
+			t.Errorf("%s: expected redirect to %q but got %q", e.name, e.expectedLocation, location)
+		}
+	}
+}
+
+func Test_linkToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		purpose  string
+		expiry   time.Duration
+		expected error
+	}{
+		{"valid", data.TokenActivation, activationExpiry, nil},
+		{"signed too long ago", data.TokenActivation, 0, data.ErrTokenExpired},
+		{"no links for purpose", data.TokenEmailChange, activationExpiry, data.ErrTokenExpired},
+	}
+
+	defer func() { linkExpiry[data.TokenActivation] = activationExpiry }()
+
+	for _, e := range tests {
+		linkExpiry[data.TokenActivation] = e.expiry
+		req := httptest.NewRequest("GET", activationLink("activation-token"), nil)
+
+		token, err := linkToken(req, e.purpose)
+		if err != e.expected {
+			t.Errorf("%s: expected %v but got %v", e.name, e.expected, err)
+		}
+		if e.expected == nil && token != "activation-token" {
+			t.Errorf("%s: expected the token of the link but got %q", e.name, token)
+		}
+	}
+}
+
+func TestToken_Valid(t *testing.T) {
+	now := time.Now()
+	earlier := now.Add(-time.Minute)
+
+	tests := []struct {
+		name     string
+		token    data.Token
+		expected error
+	}{
+		{"valid", data.Token{ExpiresAt: now.Add(time.Hour)}, nil},
+		{"expired", data.Token{ExpiresAt: now}, data.ErrTokenExpired},
+		{"used", data.Token{ExpiresAt: now.Add(time.Hour), ConsumedAt: &earlier}, data.ErrTokenUsed},
+		{"revoked", data.Token{ExpiresAt: now.Add(time.Hour), ConsumedAt: &earlier, RevokedAt: &earlier}, data.ErrTokenRevoked},
+	}
+
+	for _, e := range tests {
+		if err := e.token.Valid(now); err != e.expected {
+			t.Errorf("%s: expected %v but got %v", e.name, e.expected, err)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	mail "github.com/xhit/go-simple-mail/v2"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"subscription-service/data"
+	"sync"
+	"time"
+)
+
+// Transport is implemented by the ways we can deliver an email from the outbox
+type Transport interface {
+	Send(email *data.Email) error
+}
+
+// SMTPTransport delivers email through an SMTP server. Encryption is one of "tls",
+// "ssl" or "none"; anything else means STARTTLS.
+type SMTPTransport struct {
+	Host       string
+	Port       int
+	Username   string
+	Password   string
+	Encryption string
+}
+
+// Send delivers email through the SMTP server, connecting for each email
+func (t *SMTPTransport) Send(email *data.Email) error {
+	msg, err := buildMessage(email)
+	if err != nil {
+		return err
+	}
+
+	server := mail.NewSMTPClient()
+	server.Host = t.Host
+	server.Port = t.Port
+	server.Username = t.Username
+	server.Password = t.Password
+	server.Encryption = t.encryption()
+	server.KeepAlive = false
+	server.ConnectTimeout = 10 * time.Second
+	server.SendTimeout = 10 * time.Second
+
+	smtpClient, err := server.Connect()
+	if err != nil {
+		return err
+	}
+
+	return msg.Send(smtpClient)
+}
+
+func (t *SMTPTransport) encryption() mail.Encryption {
+	switch t.Encryption {
+	case "tls":
+		return mail.EncryptionSTARTTLS
+	case "ssl":
+		return mail.EncryptionSSLTLS
+	case "none":
+		return mail.EncryptionNone
+	default:
+		return mail.EncryptionSTARTTLS
+	}
+}
+
+// FileTransport writes each email to a .eml file in Dir instead of sending it, for
+// development without a mail server. The files open in any mail client.
+type FileTransport struct {
+	Dir string
+}
+
+// NewFileTransport returns a FileTransport writing to dir
+func NewFileTransport(dir string) *FileTransport {
+	return &FileTransport{Dir: dir}
+}
+
+// Send writes email to a file named after the time it was written and its id
+func (t *FileTransport) Send(email *data.Email) error {
+	msg, err := buildMessage(email)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(t.Dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%d.eml", time.Now().Format("20060102-150405.000000000"), email.ID)
+	return os.WriteFile(filepath.Join(t.Dir, name), []byte(msg.GetMessage()), 0644)
+}
+
+// CaptureTransport keeps the emails it is given in memory instead of sending them, so
+// that tests can look at what was sent
+type CaptureTransport struct {
+	mu   sync.Mutex
+	sent []data.Email
+}
+
+// NewCaptureTransport returns a CaptureTransport which has captured nothing yet
+func NewCaptureTransport() *CaptureTransport {
+	return &CaptureTransport{}
+}
+
+// Send captures email
+func (t *CaptureTransport) Send(email *data.Email) error {
+	if len(email.Recipients()) == 0 {
+		return ErrNoRecipients
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sent = append(t.sent, *email)
+	return nil
+}
+
+// Sent returns the emails captured so far, in the order they were sent
+func (t *CaptureTransport) Sent() []data.Email {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sent := make([]data.Email, len(t.sent))
+	copy(sent, t.sent)
+	return sent
+}
+
+// Reset forgets the emails captured so far
+func (t *CaptureTransport) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sent = nil
+}
+
+// buildMessage builds the MIME message for email, addressed to all of its recipients
+func buildMessage(email *data.Email) (*mail.Email, error) {
+	if len(email.Recipients()) == 0 {
+		return nil, ErrNoRecipients
+	}
+
+	from := netmail.Address{Name: email.FromName, Address: email.From}
+
+	msg := mail.NewMSG()
+	msg.SetFrom(from.String()).SetSubject(email.Subject)
+	if len(email.To) > 0 {
+		msg.AddTo(email.To...)
+	}
+	if len(email.Cc) > 0 {
+		msg.AddCc(email.Cc...)
+	}
+	if len(email.Bcc) > 0 {
+		msg.AddBcc(email.Bcc...)
+	}
+	if email.ReplyTo != "" {
+		msg.SetReplyTo(email.ReplyTo)
+	}
+	for name, value := range email.Headers {
+		msg.AddHeader(name, value)
+	}
+	msg.SetBody(mail.TextPlain, email.PlainBody)
+	msg.AddAlternative(mail.TextHTML, email.HTMLBody)
+
+	for name, contents := range email.Attachments {
+		msg.Attach(&mail.File{Name: name, Data: contents})
+	}
+	if msg.Error != nil {
+		return nil, msg.Error
+	}
+
+	return msg, nil
+}
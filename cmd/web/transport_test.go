@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"subscription-service/data"
+	"testing"
+)
+
+func TestFileTransport_Send(t *testing.T) {
+	dir := t.TempDir()
+
+	transport := NewFileTransport(filepath.Join(dir, "mail"))
+	err := transport.Send(&data.Email{
+		ID:          7,
+		From:        "info@myco.com",
+		FromName:    "MyCo",
+		To:          []string{"admin@example.com", "jane@example.com"},
+		Cc:          []string{"billing@example.com"},
+		Bcc:         []string{"archive@myco.com"},
+		ReplyTo:     "support@myco.com",
+		Headers:     map[string]string{"List-Unsubscribe": "<https://myco.com/unsubscribe>"},
+		Subject:     "Your Manual",
+		PlainBody:   "Your manual is attached",
+		HTMLBody:    "<p>Your manual is attached</p>",
+		Attachments: map[string][]byte{"Manual.pdf": []byte("%PDF-1.3")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "mail", "*-7.eml"))
+	if len(files) != 1 {
+		t.Fatalf("expected one .eml file but found %d", len(files))
+	}
+
+	eml, _ := os.ReadFile(files[0])
+	for _, expected := range []string{
+		`From: "MyCo" <info@myco.com>`,
+		"To: <admin@example.com>, <jane@example.com>",
+		"Cc: <billing@example.com>",
+		"Reply-To: <support@myco.com>",
+		"List-Unsubscribe: <https://myco.com/unsubscribe>",
+		"Subject: Your Manual",
+		"Your manual is attached",
+		`filename="Manual.pdf"`,
+	} {
+		if !strings.Contains(string(eml), expected) {
+			t.Errorf("did not find %s in the .eml file", expected)
+		}
+	}
+	if strings.Contains(string(eml), "archive@myco.com") {
+		t.Error("expected the Bcc recipient to be left out of the headers")
+	}
+
+	if err := transport.Send(&data.Email{Subject: "Nobody"}); err == nil {
+		t.Error("expected an error for an email without recipients")
+	}
+}
+
+func TestConfig_sendEmail(t *testing.T) {
+	sentMail()
+
+	attachment := filepath.Join(t.TempDir(), "1_manual.pdf")
+	if err := os.WriteFile(attachment, []byte("%PDF-1.3"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	testApp.sendEmail(Message{
+		To:            []string{"admin@example.com"},
+		Subject:       "Your Manual",
+		Data:          MessageEmail{Message: "Your manual is attached"},
+		AttachmentMap: map[string]string{"Manual.pdf": attachment},
+	})
+	// the email is sent from what was stored, even once the file is gone
+	os.Remove(attachment)
+
+	sent := sentMail()
+	if len(sent) != 1 {
+		t.Fatalf("expected one email but got %d", len(sent))
+	}
+
+	email := sent[0]
+	if len(email.To) != 1 || email.To[0] != "admin@example.com" {
+		t.Errorf("expected the email to go to admin@example.com but it went to %v", email.To)
+	}
+	if email.Subject != "Your Manual" {
+		t.Errorf("expected subject %q but got %q", "Your Manual", email.Subject)
+	}
+	if !strings.Contains(email.PlainBody, "Your manual is attached") || !strings.Contains(email.HTMLBody, "Your manual is attached") {
+		t.Error("expected the message in both bodies")
+	}
+	if string(email.Attachments["Manual.pdf"]) != "%PDF-1.3" {
+		t.Errorf("expected the manual to be attached but got %v", email.Attachments)
+	}
+}
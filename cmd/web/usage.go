@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"subscription-service/data"
+	"time"
+)
+
+// maxUsageBytes is the largest usage report we accept
+const maxUsageBytes = 16 << 10
+
+// usageClockSkew is how far in the future a usage report may be dated, allowing for
+// clocks which run a little fast
+const usageClockSkew = 5 * time.Minute
+
+// contextKey is the type of the keys we store values in request contexts under
+type contextKey string
+
+// apiUserKey holds the user an API request was authenticated as
+const apiUserKey contextKey = "apiUser"
+
+// usageReport is a usage record as members send it to the API. The idempotency key may
+// also be sent in the Idempotency-Key header. Without a timestamp the usage is recorded
+// as of now.
+type usageReport struct {
+	IdempotencyKey string    `json:"idempotency_key"`
+	Metric         string    `json:"metric"`
+	Quantity       int       `json:"quantity"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
+// usageReceipt is our answer to a usage report. Duplicate is set when the idempotency
+// key had been used before; the receipt then describes the usage reported first.
+type usageReceipt struct {
+	ID             int       `json:"id"`
+	IdempotencyKey string    `json:"idempotency_key"`
+	Metric         string    `json:"metric"`
+	Quantity       int       `json:"quantity"`
+	Timestamp      time.Time `json:"timestamp"`
+	Duplicate      bool      `json:"duplicate"`
+}
+
+// RecordUsage receives usage reported by the systems of a member, authenticated with
+// their API key. Usage can only be reported for the current period of a live
+// subscription, because earlier periods have already been billed. The usage of a member
+// of an organization is recorded against the subscription of its owner, who is billed
+// for it.
+func (app *Config) RecordUsage(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(apiUserKey).(*data.User)
+
+	var report usageReport
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxUsageBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&report); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	if report.IdempotencyKey == "" {
+		report.IdempotencyKey = r.Header.Get("Idempotency-Key")
+	}
+	report.IdempotencyKey = strings.TrimSpace(report.IdempotencyKey)
+
+	now := time.Now()
+	if report.Timestamp.IsZero() {
+		report.Timestamp = now
+	}
+
+	switch {
+	case report.IdempotencyKey == "" || len(report.IdempotencyKey) > 100:
+		writeJSONError(w, http.StatusUnprocessableEntity, "an idempotency key of up to 100 characters is required")
+		return
+	case !featurePattern.MatchString(report.Metric):
+		writeJSONError(w, http.StatusUnprocessableEntity, "metric must be lowercase letters, digits and underscores")
+		return
+	case report.Quantity <= 0:
+		writeJSONError(w, http.StatusUnprocessableEntity, "quantity must be a positive whole number")
+		return
+	case report.Timestamp.After(now.Add(usageClockSkew)):
+		writeJSONError(w, http.StatusUnprocessableEntity, "timestamp is in the future")
+		return
+	}
+
+	account, err := app.billingAccount(*user)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		writeJSONError(w, http.StatusInternalServerError, "unable to record usage")
+		return
+	}
+
+	sub, err := app.Models.Subscription.GetCurrentByUser(account.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.ErrorLog.Println(err)
+		writeJSONError(w, http.StatusInternalServerError, "unable to record usage")
+		return
+	}
+	if sub == nil || !sub.IsLive() {
+		writeJSONError(w, http.StatusForbidden, "no active subscription")
+		return
+	}
+	if report.Timestamp.Before(sub.CurrentPeriodStart) {
+		writeJSONError(w, http.StatusUnprocessableEntity, "timestamp is before the current billing period")
+		return
+	}
+
+	record, isNew, err := app.Models.Usage.Record(data.UsageRecord{
+		UserID:         account.ID,
+		SubscriptionID: sub.ID,
+		Metric:         report.Metric,
+		Quantity:       report.Quantity,
+		IdempotencyKey: report.IdempotencyKey,
+		RecordedAt:     report.Timestamp,
+	})
+	if err != nil {
+		app.ErrorLog.Println(err)
+		writeJSONError(w, http.StatusInternalServerError, "unable to record usage")
+		return
+	}
+
+	status := http.StatusCreated
+	if !isNew {
+		status = http.StatusOK
+	}
+
+	writeJSON(w, status, usageReceipt{
+		ID:             record.ID,
+		IdempotencyKey: record.IdempotencyKey,
+		Metric:         record.Metric,
+		Quantity:       record.Quantity,
+		Timestamp:      record.RecordedAt,
+		Duplicate:      !isNew,
+	})
+}
+
+// usageRow is one metric on the usage page. Limit is what the plan includes, Unlimited
+// or 0 if it sets no limit on the metric, and Charge what the usage so far costs, if
+// the plan charges for it.
+type usageRow struct {
+	Metric    string
+	Quantity  int
+	Limit     int
+	Percent   int
+	OverLimit bool
+	Charge    string
+}
+
+// UsagePage shows the usage of the member in the current period against the limits of
+// their plan, and lets them manage the API key they report usage with. Members of an
+// organization see the usage of everyone in it, which counts against the owner's plan.
+func (app *Config) UsagePage(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.Session.Get(r.Context(), "user").(data.User)
+	if !ok {
+		app.Session.Put(r.Context(), "error", app.T(r, "Log In First!"))
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	dataMap := make(map[string]any)
+
+	account, err := app.billingAccount(user)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, "unable to get usage", http.StatusInternalServerError)
+		return
+	}
+
+	sub, err := app.Models.Subscription.GetCurrentByUser(account.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.ErrorLog.Println(err)
+	}
+
+	if sub != nil && sub.IsLive() {
+		rows, err := app.usageRows(account, sub)
+		if err != nil {
+			app.ErrorLog.Println(err)
+			http.Error(w, "unable to get usage", http.StatusInternalServerError)
+			return
+		}
+		dataMap["subscription"] = sub
+		dataMap["usage"] = rows
+	}
+
+	key, err := app.Models.APIKey.GetByUser(user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.ErrorLog.Println(err)
+	}
+	dataMap["apiKey"] = key
+
+	// a newly generated key is shown once, straight after it is generated
+	dataMap["newAPIKey"] = app.Session.PopString(r.Context(), "apiKey")
+
+	app.render(w, r, "usage.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+// usageRows adds up the usage of account in the current period of sub, for every metric
+// it used or its plan charges for
+func (app *Config) usageRows(account data.User, sub *data.Subscription) ([]usageRow, error) {
+	plan, err := app.Models.Plan.GetOne(sub.PlanID)
+	if err != nil {
+		return nil, err
+	}
+
+	totals, err := app.Models.Usage.GetTotals(account.ID, sub.CurrentPeriodStart, sub.CurrentPeriodEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, price := range plan.MeteredPrices {
+		if _, ok := totals[price.Metric]; !ok && price.Currency == sub.Currency {
+			totals[price.Metric] = 0
+		}
+	}
+
+	var rows []usageRow
+	for metric, quantity := range totals {
+		limit, err := app.Models.Entitlement.Limit(account, metric)
+		if err != nil {
+			return nil, err
+		}
+
+		row := usageRow{
+			Metric:   metric,
+			Quantity: quantity,
+			Limit:    limit,
+		}
+		if limit > 0 {
+			row.Percent = min(quantity*100/limit, 100)
+			row.OverLimit = quantity > limit
+		}
+		if price := plan.MeteredPrice(metric, sub.Currency); price != nil {
+			row.Charge = data.FormatAmount(price.Amount(quantity), sub.Currency)
+		}
+		rows = append(rows, row)
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].Metric < rows[j].Metric
+	})
+
+	return rows, nil
+}
+
+// GenerateAPIKey gives the member a new API key, replacing the one they had
+func (app *Config) GenerateAPIKey(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.Session.Get(r.Context(), "user").(data.User)
+	if !ok {
+		app.Session.Put(r.Context(), "error", app.T(r, "Log In First!"))
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	key, err := app.Models.APIKey.Generate(user.ID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", app.T(r, "Unable to generate an API key"))
+		http.Redirect(w, r, "/members/usage", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "apiKey", key)
+	app.Session.Put(r.Context(), "flash", app.T(r, "New API key generated. Copy it now; it will not be shown again."))
+	http.Redirect(w, r, "/members/usage", http.StatusSeeOther)
+}
+
+// addPeriodUsage adds the usage recorded against sub, by its subscriber and the members
+// of their organization, from the start of its current period until end to invoice,
+// charged at the usage prices of its plan and written in locale. Usage during a free
+// trial is not charged.
+func (app *Config) addPeriodUsage(sub *data.Subscription, end time.Time, invoice *data.Invoice, locale string) error {
+	if sub.Status == data.SubscriptionTrialing {
+		return nil
+	}
+
+	plan, err := app.Models.Plan.GetOne(sub.PlanID)
+	if err != nil {
+		return err
+	}
+	if len(plan.MeteredPrices) == 0 {
+		return nil
+	}
+
+	totals, err := app.Models.Usage.GetTotals(sub.UserID, sub.CurrentPeriodStart, end)
+	if err != nil {
+		return err
+	}
+
+	addUsageLines(invoice, plan, totals, sub.CurrentPeriodStart, end, locale)
+	return nil
+}
+
+// addUsageLines adds a line to invoice for every tier of every usage price of plan in
+// the invoice's currency that totals reaches, and a line for the flat fee of a tier if
+// it has one, written in locale. Usage the plan does not charge for in that currency is
+// left off.
+func addUsageLines(invoice *data.Invoice, plan *data.Plan, totals map[string]int, start, end time.Time, locale string) {
+	metrics := make([]string, 0, len(totals))
+	for metric := range totals {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+
+	period := fmt.Sprintf("%s - %s", formatDate(locale, start), formatDate(locale, end))
+
+	for _, metric := range metrics {
+		price := plan.MeteredPrice(metric, invoice.Currency)
+		if price == nil {
+			continue
+		}
+
+		for _, charge := range price.Charges(totals[metric]) {
+			description := translate(locale, "%s usage, units %d - %d (%s)", metric, charge.From, charge.To, period)
+			invoice.AddLine(data.LineUsage, description, charge.Quantity, charge.Tier.UnitAmount)
+			if charge.Tier.FlatAmount > 0 {
+				invoice.AddLine(data.LineUsage, translate(locale, "%s usage, flat fee (%s)", metric, period),
+					1, charge.Tier.FlatAmount)
+			}
+		}
+	}
+}
+
+// writeJSON answers an API request with v encoded as JSON
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONError answers an API request with an error message
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// apiUser returns a copy of ctx carrying the user an API request was authenticated as
+func apiUser(ctx context.Context, user *data.User) context.Context {
+	return context.WithValue(ctx, apiUserKey, user)
+}
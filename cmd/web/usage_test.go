@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"subscription-service/data"
+	"testing"
+	"time"
+)
+
+func Test_addUsageLines(t *testing.T) {
+	bronze, _ := testApp.Models.Plan.GetOne(1)
+	silver, _ := testApp.Models.Plan.GetOne(2)
+
+	tests := []struct {
+		name          string
+		plan          *data.Plan
+		currency      string
+		totals        map[string]int
+		expectedLines int
+		expectedTotal int
+	}{
+		{"within the free tier", bronze, "USD", map[string]int{"api_calls": 800}, 1, 0},
+		{"tiered", bronze, "USD", map[string]int{"api_calls": 1500}, 2, 500},
+		{"volume", silver, "USD", map[string]int{"api_calls": 5000}, 1, 5000},
+		{"volume with flat fee", silver, "USD", map[string]int{"api_calls": 12000}, 2, 5000},
+		{"no usage", bronze, "USD", map[string]int{"api_calls": 0}, 0, 0},
+		{"metric not charged", bronze, "USD", map[string]int{"storage_gb": 30}, 0, 0},
+		{"currency not charged", bronze, "EUR", map[string]int{"api_calls": 1500}, 0, 0},
+	}
+
+	for _, e := range tests {
+		invoice := data.Invoice{Currency: e.currency}
+		addUsageLines(&invoice, e.plan, e.totals, time.Now().AddDate(0, -1, 0), time.Now(), DefaultLocale)
+
+		if len(invoice.Lines) != e.expectedLines {
+			t.Errorf("%s: expected %d lines but got %d", e.name, e.expectedLines, len(invoice.Lines))
+		}
+		if invoice.Total != e.expectedTotal {
+			t.Errorf("%s: expected total %d but got %d", e.name, e.expectedTotal, invoice.Total)
+		}
+	}
+}
+
+var recordUsageTests = []struct {
+	name              string
+	apiKey            string
+	idempotencyHeader string
+	body              string
+	expectedCode      int
+	expectedError     string
+}{
+	{"recorded", "sk_test", "", `{"idempotency_key": "k1", "metric": "api_calls", "quantity": 5}`, http.StatusCreated, ""},
+	{"key in header", "sk_test", "k2", `{"metric": "api_calls", "quantity": 5}`, http.StatusCreated, ""},
+	{"duplicate", "sk_test", "", `{"idempotency_key": "dup", "metric": "api_calls", "quantity": 5}`, http.StatusOK, ""},
+	{"no API key", "", "", `{"idempotency_key": "k1", "metric": "api_calls", "quantity": 5}`, http.StatusUnauthorized, "missing API key"},
+	{"unknown API key", "sk_nope", "", `{"idempotency_key": "k1", "metric": "api_calls", "quantity": 5}`, http.StatusUnauthorized, "invalid API key"},
+	{"invalid JSON", "sk_test", "", `{"metric": `, http.StatusBadRequest, "invalid JSON body"},
+	{"unknown field", "sk_test", "", `{"idempotency_key": "k1", "metric": "api_calls", "quantity": 5, "units": 5}`, http.StatusBadRequest, "invalid JSON body"},
+	{"no idempotency key", "sk_test", "", `{"metric": "api_calls", "quantity": 5}`, http.StatusUnprocessableEntity, "an idempotency key of up to 100 characters is required"},
+	{"bad metric", "sk_test", "", `{"idempotency_key": "k1", "metric": "API calls", "quantity": 5}`, http.StatusUnprocessableEntity, "metric must be lowercase letters, digits and underscores"},
+	{"no quantity", "sk_test", "", `{"idempotency_key": "k1", "metric": "api_calls", "quantity": 0}`, http.StatusUnprocessableEntity, "quantity must be a positive whole number"},
+	{"future", "sk_test", "", `{"idempotency_key": "k1", "metric": "api_calls", "quantity": 5, "timestamp": "` + time.Now().Add(time.Hour).Format(time.RFC3339) + `"}`, http.StatusUnprocessableEntity, "timestamp is in the future"},
+	{"previous period", "sk_test", "", `{"idempotency_key": "k1", "metric": "api_calls", "quantity": 5, "timestamp": "` + time.Now().AddDate(0, -2, 0).Format(time.RFC3339) + `"}`, http.StatusUnprocessableEntity, "timestamp is before the current billing period"},
+	{"paused", "sk_paused", "", `{"idempotency_key": "k1", "metric": "api_calls", "quantity": 5}`, http.StatusForbidden, "no active subscription"},
+	{"member of an organization", "sk_member", "", `{"idempotency_key": "k1", "metric": "api_calls", "quantity": 5}`, http.StatusCreated, ""},
+}
+
+func TestConfig_RecordUsage(t *testing.T) {
+	handler := testApp.APIAuth(http.HandlerFunc(testApp.RecordUsage))
+
+	for _, e := range recordUsageTests {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/usage", strings.NewReader(e.body))
+		req.Header.Set("Content-Type", "application/json")
+		if e.apiKey != "" {
+			req.Header.Set("Authorization", "Bearer "+e.apiKey)
+		}
+		if e.idempotencyHeader != "" {
+			req.Header.Set("Idempotency-Key", e.idempotencyHeader)
+		}
+
+		handler.ServeHTTP(rw, req)
+
+		if rw.Code != e.expectedCode {
+			t.Errorf("%s: expected status code %d but got %d", e.name, e.expectedCode, rw.Code)
+		}
+
+		var body map[string]any
+		if err := json.Unmarshal(rw.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s: expected a JSON answer but got %q", e.name, rw.Body.String())
+			continue
+		}
+
+		if e.expectedError != "" && body["error"] != e.expectedError {
+			t.Errorf("%s: expected error %q but got %v", e.name, e.expectedError, body["error"])
+		}
+
+		if e.expectedError == "" && body["duplicate"] != (e.expectedCode == http.StatusOK) {
+			t.Errorf("%s: expected duplicate to be %v but got %v", e.name, e.expectedCode == http.StatusOK, body["duplicate"])
+		}
+	}
+}
+
+func TestConfig_GenerateAPIKey(t *testing.T) {
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/members/usage/api-key", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+
+	testApp.Session.Put(ctx, "userId", 1)
+	testApp.Session.Put(ctx, "user", data.User{ID: 1})
+
+	testApp.GenerateAPIKey(rw, req)
+
+	if rw.Code != http.StatusSeeOther {
+		t.Errorf("expected status code %d but got %d", http.StatusSeeOther, rw.Code)
+	}
+
+	if key := testApp.Session.PopString(ctx, "apiKey"); key != "sk_test" {
+		t.Errorf("expected the new key to be kept for the usage page but got %q", key)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"net/http"
+	"subscription-service/data"
+)
+
+// maxWebhookBytes is the largest webhook payload we accept
+const maxWebhookBytes = 64 << 10
+
+// PaymentWebhook receives events from the payment provider. Every event is recorded by
+// id before it is handled, so replayed deliveries are acknowledged without being handled
+// twice. An event we fail to handle is forgotten again and answered with an error, so
+// the provider retries it.
+func (app *Config) PaymentWebhook(w http.ResponseWriter, r *http.Request) {
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBytes))
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, "unable to read payload", http.StatusBadRequest)
+		return
+	}
+
+	event, err := app.Payments.HandleWebhook(payload, r.Header)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, "invalid event", http.StatusBadRequest)
+		return
+	}
+
+	isNew, err := app.Models.WebhookEvent.Record(data.WebhookEvent{ID: event.ID, Type: event.Type})
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, "unable to record event", http.StatusInternalServerError)
+		return
+	}
+
+	if isNew {
+		err = app.handlePaymentEvent(event)
+		if err != nil {
+			app.ErrorLog.Println(err)
+			if err := app.Models.WebhookEvent.Delete(event.ID); err != nil {
+				app.ErrorLog.Println(err)
+			}
+			http.Error(w, "unable to handle event", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handlePaymentEvent applies a payment event to the payment, invoice and subscription it
+// concerns. Events about charges we have no record of are ignored.
+func (app *Config) handlePaymentEvent(event *PaymentEvent) error {
+	payment, err := app.Models.Payment.GetByChargeID(event.ChargeID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	invoice, err := app.Models.Invoice.GetOne(payment.InvoiceID)
+	if err != nil {
+		return err
+	}
+
+	switch event.Type {
+	case EventPaymentSucceeded:
+		return app.paymentSucceeded(payment, invoice)
+	case EventPaymentFailed:
+		err = app.Models.Payment.UpdateStatus(payment.ID, data.PaymentFailed)
+		if err != nil {
+			return err
+		}
+		return app.paymentReversed(invoice)
+	case EventPaymentRefunded:
+		err = app.Models.Payment.UpdateStatus(payment.ID, data.PaymentRefunded)
+		if err != nil {
+			return err
+		}
+		// a partial refund leaves the invoice paid
+		if event.Amount < payment.Amount || invoice.Status == data.InvoiceVoid {
+			return nil
+		}
+		invoice.Status = data.InvoiceVoid
+		return app.Models.Invoice.Update(*invoice)
+	case EventDisputeOpened:
+		err = app.Models.Payment.UpdateStatus(payment.ID, data.PaymentDisputed)
+		if err != nil {
+			return err
+		}
+		return app.paymentReversed(invoice)
+	}
+
+	return nil
+}
+
+// paymentSucceeded marks the invoice of a payment that went through paid. A past due
+// subscription the invoice was for becomes active again.
+func (app *Config) paymentSucceeded(payment *data.Payment, invoice *data.Invoice) error {
+	if payment.Status != data.PaymentSucceeded {
+		err := app.Models.Payment.UpdateStatus(payment.ID, data.PaymentSucceeded)
+		if err != nil {
+			return err
+		}
+	}
+
+	if invoice.Status == data.InvoicePaid {
+		return nil
+	}
+
+	err := app.markInvoicePaid(invoice)
+	if err != nil {
+		return err
+	}
+
+	sub, err := app.invoiceSubscription(invoice)
+	if err != nil || sub == nil || sub.Status != data.SubscriptionPastDue {
+		return err
+	}
+
+	user, err := app.Models.User.GetOne(sub.UserID)
+	if err != nil {
+		return err
+	}
+
+	return app.recoverSubscription(*user, sub, invoice)
+}
+
+// paymentReversed reopens an invoice whose payment failed or was disputed after the
+// fact, and puts the active subscription it paid for into dunning
+func (app *Config) paymentReversed(invoice *data.Invoice) error {
+	if invoice.Status == data.InvoiceVoid {
+		return nil
+	}
+
+	invoice.Status = data.InvoiceOpen
+	invoice.PaidAt = nil
+	err := app.Models.Invoice.Update(*invoice)
+	if err != nil {
+		return err
+	}
+
+	sub, err := app.invoiceSubscription(invoice)
+	if err != nil || sub == nil || sub.Status != data.SubscriptionActive {
+		return err
+	}
+
+	user, err := app.Models.User.GetOne(sub.UserID)
+	if err != nil {
+		return err
+	}
+
+	return app.startDunning(*user, sub, invoice)
+}
+
+// invoiceSubscription returns the subscription an invoice was issued for, if any
+func (app *Config) invoiceSubscription(invoice *data.Invoice) (*data.Subscription, error) {
+	if invoice.SubscriptionID == nil {
+		return nil, nil
+	}
+	return app.Models.Subscription.GetOne(*invoice.SubscriptionID)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var webhookTests = []struct {
+	name         string
+	payload      string
+	signed       bool
+	expectedCode int
+}{
+	{"payment succeeded", `{"id":"evt_1","type":"payment.succeeded","charge_id":"ch_1","amount":1000}`, true, http.StatusOK},
+	{"payment failed", `{"id":"evt_2","type":"payment.failed","charge_id":"ch_1","amount":1000}`, true, http.StatusOK},
+	{"payment refunded", `{"id":"evt_3","type":"payment.refunded","charge_id":"ch_1","amount":1000}`, true, http.StatusOK},
+	{"dispute opened", `{"id":"evt_4","type":"dispute.opened","charge_id":"ch_1","amount":1000}`, true, http.StatusOK},
+	{"unknown event type", `{"id":"evt_5","type":"customer.created"}`, true, http.StatusOK},
+	{"replayed event", `{"id":"evt_seen","type":"payment.succeeded","charge_id":"ch_1","amount":1000}`, true, http.StatusOK},
+	{"bad signature", `{"id":"evt_6","type":"payment.succeeded","charge_id":"ch_1","amount":1000}`, false, http.StatusBadRequest},
+	{"bad payload", `not json`, true, http.StatusBadRequest},
+}
+
+func TestConfig_PaymentWebhook(t *testing.T) {
+	routes := testApp.routes()
+
+	for _, e := range webhookTests {
+		payload := []byte(e.payload)
+
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/webhooks/payments", bytes.NewReader(payload))
+		if e.signed {
+			req.Header.Set(PaymentSignatureHeader, testPayments.SignWebhook(payload))
+		} else {
+			req.Header.Set(PaymentSignatureHeader, testPayments.SignWebhook([]byte("something else")))
+		}
+
+		routes.ServeHTTP(rw, req)
+		testApp.Wait.Wait()
+
+		if rw.Code != e.expectedCode {
+			t.Errorf("%s: expected status code %d but got %d", e.name, e.expectedCode, rw.Code)
+		}
+	}
+}
+
+func Test_initPayments(t *testing.T) {
+	tests := []struct {
+		name        string
+		secret      string
+		expectPanic bool
+	}{
+		{"secret set", "test-secret", false},
+		{"no secret", "", true},
+	}
+
+	for _, e := range tests {
+		t.Setenv("WEBHOOK_SECRET", e.secret)
+
+		func() {
+			defer func() {
+				if r := recover(); (r != nil) != e.expectPanic {
+					t.Errorf("%s: expected panic %t but got %v", e.name, e.expectPanic, r)
+				}
+			}()
+			initPayments()
+		}()
+	}
+}
+
+func TestFakePaymentProvider_HandleWebhook_noSecret(t *testing.T) {
+	provider := NewFakePaymentProvider(FakeSucceed, "")
+	payload := []byte(`{"id":"evt_1","type":"payment.succeeded","charge_id":"ch_1","amount":1000}`)
+
+	header := http.Header{}
+	header.Set(PaymentSignatureHeader, provider.SignWebhook(payload))
+
+	if _, err := provider.HandleWebhook(payload, header); err != ErrInvalidSignature {
+		t.Errorf("expected %v but got %v", ErrInvalidSignature, err)
+	}
+}
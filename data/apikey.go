@@ -0,0 +1,96 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// apiKeyPrefix starts every API key, so that keys are easy to recognise in logs and
+// secret scanners
+const apiKeyPrefix = "sk_"
+
+// APIKey lets the systems of a member call our API on their behalf, e.g. to report
+// usage. Every user has at most one key. Only a hash of the key is stored; the key
+// itself is shown to the member once, when it is generated. Hint is the start of the
+// key, so that members can tell which key they have.
+type APIKey struct {
+	ID         int
+	UserID     int
+	Hint       string
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+}
+
+// Generate creates a new API key for a user, replacing the one they had, and returns it
+func (k *APIKey) Generate(userID int) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	key := apiKeyPrefix + hex.EncodeToString(b)
+
+	stmt := `insert into api_keys (user_id, key_hash, hint, created_at)
+		values ($1, $2, $3, $4)
+		on conflict (user_id) do update set key_hash = excluded.key_hash, hint = excluded.hint,
+			created_at = excluded.created_at, last_used_at = null`
+
+	_, err := db.ExecContext(ctx, stmt, userID, hashAPIKey(key), key[:len(apiKeyPrefix)+4], time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	return key, nil
+}
+
+// GetByUser returns the API key of a user, without the key itself
+func (k *APIKey) GetByUser(userID int) (*APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, hint, created_at, last_used_at from api_keys where user_id = $1`
+
+	var key APIKey
+	err := db.QueryRowContext(ctx, query, userID).Scan(
+		&key.ID,
+		&key.UserID,
+		&key.Hint,
+		&key.CreatedAt,
+		&key.LastUsedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+// Authenticate returns the user an API key belongs to, and records that the key was
+// used. It returns sql.ErrNoRows if there is no such key.
+func (k *APIKey) Authenticate(key string) (*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update api_keys set last_used_at = $1 where key_hash = $2 returning user_id`
+
+	var userID int
+	err := db.QueryRowContext(ctx, stmt, time.Now(), hashAPIKey(key)).Scan(&userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var u User
+	return u.GetOne(userID)
+}
+
+// hashAPIKey returns the hash we store of an API key. Keys are long and random, so a
+// plain hash is enough to keep them safe.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
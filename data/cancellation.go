@@ -0,0 +1,51 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// CancellationReasons are the answers a member can pick when asked why they are
+// canceling, keyed by the value stored in the database
+var CancellationReasons = map[string]string{
+	"too_expensive":    "It is too expensive",
+	"not_using":        "I am not using it enough",
+	"missing_features": "It is missing features I need",
+	"switching":        "I am switching to another service",
+	"other":            "Something else",
+}
+
+// CancellationFeedback is the optional survey a member fills in when canceling
+type CancellationFeedback struct {
+	ID             int
+	UserID         int
+	SubscriptionID int
+	Reason         string
+	Comment        string
+	CreatedAt      time.Time
+}
+
+// Insert stores the feedback of a member who canceled, and returns the ID of the newly
+// inserted row
+func (c *CancellationFeedback) Insert(feedback CancellationFeedback) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into cancellation_feedback (user_id, subscription_id, reason, comment, created_at)
+		values ($1, $2, $3, $4, $5) returning id`
+
+	err := db.QueryRowContext(ctx, stmt,
+		feedback.UserID,
+		feedback.SubscriptionID,
+		feedback.Reason,
+		feedback.Comment,
+		time.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
@@ -0,0 +1,49 @@
+package data
+
+import "sort"
+
+// Countries holds the names of the countries members can bill to, keyed by ISO 3166-1
+// alpha-2 code
+var Countries = map[string]string{
+	"AT": "Austria",
+	"AU": "Australia",
+	"BE": "Belgium",
+	"BR": "Brazil",
+	"CA": "Canada",
+	"CH": "Switzerland",
+	"DE": "Germany",
+	"DK": "Denmark",
+	"ES": "Spain",
+	"FI": "Finland",
+	"FR": "France",
+	"GB": "United Kingdom",
+	"IE": "Ireland",
+	"IN": "India",
+	"IT": "Italy",
+	"JP": "Japan",
+	"MX": "Mexico",
+	"NL": "Netherlands",
+	"NO": "Norway",
+	"NZ": "New Zealand",
+	"PL": "Poland",
+	"PT": "Portugal",
+	"SE": "Sweden",
+	"SG": "Singapore",
+	"US": "United States",
+}
+
+// SupportedCountries returns the codes of all countries members can bill to, sorted
+func SupportedCountries() []string {
+	var codes []string
+	for code := range Countries {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// IsSupportedCountry reports whether code is a country members can bill to
+func IsSupportedCountry(code string) bool {
+	_, ok := Countries[code]
+	return ok
+}
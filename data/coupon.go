@@ -0,0 +1,361 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Coupon durations
+const (
+	CouponOnce      = "once"
+	CouponRepeating = "repeating"
+	CouponForever   = "forever"
+)
+
+// Reasons a coupon cannot be redeemed
+var (
+	ErrCouponNotFound  = errors.New("coupon not found")
+	ErrCouponExpired   = errors.New("coupon has expired")
+	ErrCouponExhausted = errors.New("coupon has no redemptions left")
+	ErrCouponPlan      = errors.New("coupon does not apply to plan")
+	ErrCouponCurrency  = errors.New("coupon does not apply to currency")
+	ErrCouponRedeemed  = errors.New("coupon already redeemed by user")
+)
+
+// Coupon is a discount members get by entering its Code when they subscribe. It takes
+// either PercentOff percent or AmountOff (in the minor units of Currency) off the
+// invoice for the first period only (once), for the first DurationPeriods periods
+// (repeating) or for every period (forever). A coupon can be redeemed MaxRedemptions
+// times in total, 0 meaning without limit, but only once by each user. When PlanIDs is
+// not empty the coupon only applies to those plans.
+type Coupon struct {
+	ID              int
+	Code            string
+	PercentOff      int
+	AmountOff       int
+	Currency        string
+	Duration        string
+	DurationPeriods int
+	MaxRedemptions  int
+	TimesRedeemed   int
+	ExpiresAt       *time.Time
+	Active          bool
+	PlanIDs         []int
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// CouponRedemption records that a user redeemed a coupon, and for how many periods it
+// has discounted their invoices so far. InvoiceID is the invoice it was redeemed on; a
+// coupon redeemed on a free trial discounts nothing until the trial converts.
+type CouponRedemption struct {
+	ID             int
+	CouponID       int
+	UserID         int
+	InvoiceID      *int
+	PeriodsApplied int
+	CreatedAt      time.Time
+	Coupon         *Coupon
+}
+
+const couponColumns = `id, code, percent_off, amount_off, currency, duration, duration_periods,
+	max_redemptions, times_redeemed, expires_at, active, created_at, updated_at`
+
+// Check reports why the coupon cannot be redeemed on a subscription to planID billed in
+// currency at the given time, or returns nil if it can
+func (c *Coupon) Check(planID int, currency string, at time.Time) error {
+	switch {
+	case !c.Active:
+		return ErrCouponNotFound
+	case c.ExpiresAt != nil && !at.Before(*c.ExpiresAt):
+		return ErrCouponExpired
+	case c.MaxRedemptions > 0 && c.TimesRedeemed >= c.MaxRedemptions:
+		return ErrCouponExhausted
+	case !c.AppliesTo(planID):
+		return ErrCouponPlan
+	case c.AmountOff > 0 && c.Currency != currency:
+		return ErrCouponCurrency
+	}
+	return nil
+}
+
+// AppliesTo reports whether the coupon can discount a subscription to planID
+func (c *Coupon) AppliesTo(planID int) bool {
+	if len(c.PlanIDs) == 0 {
+		return true
+	}
+	for _, id := range c.PlanIDs {
+		if id == planID {
+			return true
+		}
+	}
+	return false
+}
+
+// Continues reports whether the coupon still discounts a period after it has already
+// discounted periodsApplied of them
+func (c *Coupon) Continues(periodsApplied int) bool {
+	switch c.Duration {
+	case CouponForever:
+		return true
+	case CouponRepeating:
+		return periodsApplied < c.DurationPeriods
+	default:
+		return periodsApplied < 1
+	}
+}
+
+// Discount returns how much the coupon takes off amount. It never takes off more than
+// amount.
+func (c *Coupon) Discount(amount int) int {
+	if amount <= 0 {
+		return 0
+	}
+
+	discount := c.AmountOff
+	if c.PercentOff > 0 {
+		// rounded to the nearest minor unit
+		discount = (amount*c.PercentOff + 50) / 100
+	}
+
+	if discount > amount {
+		return amount
+	}
+	return discount
+}
+
+// OffForDisplay describes the discount, e.g. "20% off" or "$5.00 off"
+func (c *Coupon) OffForDisplay() string {
+	if c.PercentOff > 0 {
+		return fmt.Sprintf("%d%% off", c.PercentOff)
+	}
+	return FormatAmount(c.AmountOff, c.Currency) + " off"
+}
+
+// GetByCode returns the coupon with the given code, ignoring case
+func (c *Coupon) GetByCode(code string) (*Coupon, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + couponColumns + ` from coupons where code = $1`
+
+	coupon, err := scanCoupon(db.QueryRowContext(ctx, query, strings.ToUpper(strings.TrimSpace(code))))
+	if err != nil {
+		return nil, err
+	}
+
+	coupon.PlanIDs, err = getCouponPlanIDs(ctx, coupon.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return coupon, nil
+}
+
+// HasRedeemed reports whether the user has already redeemed the coupon
+func (c *Coupon) HasRedeemed(couponID, userID int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select exists(select 1 from coupon_redemptions where coupon_id = $1 and user_id = $2)`
+
+	var redeemed bool
+	err := db.QueryRowContext(ctx, query, couponID, userID).Scan(&redeemed)
+	if err != nil {
+		return false, err
+	}
+
+	return redeemed, nil
+}
+
+// Redeem records a redemption of a coupon and counts it against the coupon's limit, and
+// returns the ID of the newly inserted row. It returns ErrCouponExhausted if the limit
+// has been reached and ErrCouponRedeemed if the user has redeemed the coupon before.
+func (c *Coupon) Redeem(redemption CouponRedemption) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stmt := `update coupons set times_redeemed = times_redeemed + 1, updated_at = $1
+		where id = $2 and (max_redemptions = 0 or times_redeemed < max_redemptions)`
+
+	result, err := tx.ExecContext(ctx, stmt, time.Now(), redemption.CouponID)
+	if err != nil {
+		return 0, err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if updated == 0 {
+		return 0, ErrCouponExhausted
+	}
+
+	var newID int
+	stmt = `insert into coupon_redemptions (coupon_id, user_id, invoice_id, periods_applied, created_at)
+		values ($1, $2, $3, $4, $5) on conflict (coupon_id, user_id) do nothing returning id`
+
+	err = tx.QueryRowContext(ctx, stmt,
+		redemption.CouponID,
+		redemption.UserID,
+		redemption.InvoiceID,
+		redemption.PeriodsApplied,
+		time.Now(),
+	).Scan(&newID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrCouponRedeemed
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// ReleaseRedemption deletes a redemption whose invoice was never paid, and gives the
+// redemption back to the coupon
+func (c *Coupon) ReleaseRedemption(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var couponID int
+	stmt := `delete from coupon_redemptions where id = $1 returning coupon_id`
+	err = tx.QueryRowContext(ctx, stmt, id).Scan(&couponID)
+	if err != nil {
+		return err
+	}
+
+	stmt = `update coupons set times_redeemed = times_redeemed - 1, updated_at = $1 where id = $2`
+	_, err = tx.ExecContext(ctx, stmt, time.Now(), couponID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetActiveRedemption returns the most recent redemption of a user whose coupon still
+// discounts their next period, including its coupon. It returns sql.ErrNoRows if there
+// is none.
+func (c *Coupon) GetActiveRedemption(userID int) (*CouponRedemption, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select r.id, r.coupon_id, r.user_id, r.invoice_id, r.periods_applied, r.created_at
+		from coupon_redemptions r join coupons c on c.id = r.coupon_id
+		where r.user_id = $1 and (c.duration = $2 or (c.duration = $3 and r.periods_applied < c.duration_periods)
+			or (c.duration = $4 and r.periods_applied = 0))
+		order by r.created_at desc, r.id desc limit 1`
+
+	var redemption CouponRedemption
+	err := db.QueryRowContext(ctx, query, userID, CouponForever, CouponRepeating, CouponOnce).Scan(
+		&redemption.ID,
+		&redemption.CouponID,
+		&redemption.UserID,
+		&redemption.InvoiceID,
+		&redemption.PeriodsApplied,
+		&redemption.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `select ` + couponColumns + ` from coupons where id = $1`
+	redemption.Coupon, err = scanCoupon(db.QueryRowContext(ctx, query, redemption.CouponID))
+	if err != nil {
+		return nil, err
+	}
+
+	redemption.Coupon.PlanIDs, err = getCouponPlanIDs(ctx, redemption.CouponID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &redemption, nil
+}
+
+// ApplyRedemption counts one more period discounted by a redemption
+func (c *Coupon) ApplyRedemption(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update coupon_redemptions set periods_applied = periods_applied + 1 where id = $1`
+
+	_, err := db.ExecContext(ctx, stmt, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// scanCoupon reads one coupon, selected with couponColumns, from row
+func scanCoupon(row scanner) (*Coupon, error) {
+	var coupon Coupon
+	err := row.Scan(
+		&coupon.ID,
+		&coupon.Code,
+		&coupon.PercentOff,
+		&coupon.AmountOff,
+		&coupon.Currency,
+		&coupon.Duration,
+		&coupon.DurationPeriods,
+		&coupon.MaxRedemptions,
+		&coupon.TimesRedeemed,
+		&coupon.ExpiresAt,
+		&coupon.Active,
+		&coupon.CreatedAt,
+		&coupon.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &coupon, nil
+}
+
+// getCouponPlanIDs returns the plans a coupon is restricted to, if any
+func getCouponPlanIDs(ctx context.Context, couponID int) ([]int, error) {
+	query := `select plan_id from coupon_plans where coupon_id = $1 order by plan_id`
+
+	rows, err := db.QueryContext(ctx, query, couponID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var planIDs []int
+
+	for rows.Next() {
+		var planID int
+		err := rows.Scan(&planID)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+		planIDs = append(planIDs, planID)
+	}
+
+	return planIDs, nil
+}
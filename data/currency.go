@@ -0,0 +1,110 @@
+package data
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultCurrency is used for plans, users and invoices which do not specify a currency
+const DefaultCurrency = "USD"
+
+// Currency describes how amounts in one currency are stored and displayed. Amounts are
+// always stored in the currency's minor unit (cents, pence, ...).
+type Currency struct {
+	Code        string
+	Symbol      string
+	MinorUnits  int
+	SymbolAfter bool
+}
+
+// Currencies holds every currency we sell in, keyed by ISO 4217 code
+var Currencies = map[string]Currency{
+	"USD": {Code: "USD", Symbol: "$", MinorUnits: 2},
+	"EUR": {Code: "EUR", Symbol: "€", MinorUnits: 2, SymbolAfter: true},
+	"GBP": {Code: "GBP", Symbol: "£", MinorUnits: 2},
+	"JPY": {Code: "JPY", Symbol: "¥", MinorUnits: 0},
+}
+
+// SupportedCurrencies returns the codes of all currencies we sell in, sorted
+func SupportedCurrencies() []string {
+	var codes []string
+	for code := range Currencies {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// IsSupportedCurrency reports whether code is a currency we sell in
+func IsSupportedCurrency(code string) bool {
+	_, ok := Currencies[code]
+	return ok
+}
+
+// GetCurrency returns the currency for code. Unknown codes are displayed with two
+// decimals and the code itself as symbol.
+func GetCurrency(code string) Currency {
+	if code == "" {
+		code = DefaultCurrency
+	}
+	if c, ok := Currencies[code]; ok {
+		return c
+	}
+	return Currency{Code: code, Symbol: code, MinorUnits: 2, SymbolAfter: true}
+}
+
+// Format formats an amount in minor units as a currency string
+func (c Currency) Format(amount int) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	number := c.Number(amount)
+
+	if c.SymbolAfter {
+		return fmt.Sprintf("%s%s %s", sign, number, c.Symbol)
+	}
+	return fmt.Sprintf("%s%s%s", sign, c.Symbol, number)
+}
+
+// Number formats a positive amount in minor units as a plain number in major units,
+// e.g. "9.99". It is the inverse of ParseAmount.
+func (c Currency) Number(amount int) string {
+	if c.MinorUnits == 0 {
+		return strconv.Itoa(amount)
+	}
+
+	factor := 1
+	for i := 0; i < c.MinorUnits; i++ {
+		factor *= 10
+	}
+	return fmt.Sprintf("%d.%0*d", amount/factor, c.MinorUnits, amount%factor)
+}
+
+// ParseAmount reads an amount written in major units, such as "9.99", and returns it in
+// the minor units of the currency. It returns an error for negative amounts and for
+// amounts with more decimals than the currency has.
+func (c Currency) ParseAmount(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	whole, fraction, _ := strings.Cut(s, ".")
+	if whole == "" || len(fraction) > c.MinorUnits || strings.HasPrefix(whole, "-") || strings.HasPrefix(whole, "+") {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+
+	fraction += strings.Repeat("0", c.MinorUnits-len(fraction))
+	amount, err := strconv.Atoi(whole + fraction)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+
+	return amount, nil
+}
+
+// FormatAmount formats an amount in minor units of the given currency as a currency string
+func FormatAmount(amount int, currency string) string {
+	return GetCurrency(currency).Format(amount)
+}
@@ -0,0 +1,230 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Statuses of an email in the outbox
+const (
+	EmailPending = "pending"
+	EmailSending = "sending"
+	EmailSent    = "sent"
+	EmailDead    = "dead"
+)
+
+// Email is a message in the outbox, rendered and ready to be sent. Emails are stored
+// before they are sent, so that none are lost if the mail server is down or we restart.
+// An email is tried again later each time sending it fails, until it has had too many
+// attempts and is marked dead. Headers are extra headers to send, such as
+// List-Unsubscribe. Attachments holds the contents of each attached file by its name, so
+// that an email can still be sent once the file it was made from is gone.
+type Email struct {
+	ID            int
+	From          string
+	FromName      string
+	To            []string
+	Cc            []string
+	Bcc           []string
+	ReplyTo       string
+	Headers       map[string]string
+	Subject       string
+	PlainBody     string
+	HTMLBody      string
+	Attachments   map[string][]byte
+	Status        string
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+	SentAt        *time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// Recipients returns every address the email goes to
+func (e *Email) Recipients() []string {
+	recipients := make([]string, 0, len(e.To)+len(e.Cc)+len(e.Bcc))
+	recipients = append(recipients, e.To...)
+	recipients = append(recipients, e.Cc...)
+	return append(recipients, e.Bcc...)
+}
+
+// Enqueue stores an email to be sent as soon as possible, and returns its id
+func (e *Email) Enqueue(email Email) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	to, err := json.Marshal(email.To)
+	if err != nil {
+		return 0, err
+	}
+	cc, err := json.Marshal(email.Cc)
+	if err != nil {
+		return 0, err
+	}
+	bcc, err := json.Marshal(email.Bcc)
+	if err != nil {
+		return 0, err
+	}
+	headers, err := json.Marshal(email.Headers)
+	if err != nil {
+		return 0, err
+	}
+	attachments, err := json.Marshal(email.Attachments)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+
+	var newID int
+	stmt := `insert into emails (from_address, from_name, to_addresses, cc_addresses, bcc_addresses, reply_to,
+			headers, subject, plain_body, html_body, attachments, status, next_attempt_at, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15) returning id`
+
+	err = db.QueryRowContext(ctx, stmt,
+		email.From,
+		email.FromName,
+		to,
+		cc,
+		bcc,
+		email.ReplyTo,
+		headers,
+		email.Subject,
+		email.PlainBody,
+		email.HTMLBody,
+		attachments,
+		EmailPending,
+		now,
+		now,
+		now,
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// Claim marks up to limit emails due at at as being sent, counts the attempt, and
+// returns them. A claimed email is due again after lease, so that one whose sender died
+// part way through is picked up again; emails claimed by another process are skipped.
+func (e *Email) Claim(at time.Time, lease time.Duration, limit int) ([]*Email, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update emails set status = $1, attempts = attempts + 1, next_attempt_at = $2, updated_at = $3
+		where id in (
+			select id from emails
+			where status in ($4, $1) and next_attempt_at <= $3
+			order by next_attempt_at
+			limit $5
+			for update skip locked
+		)
+		returning id, from_address, from_name, to_addresses, cc_addresses, bcc_addresses, reply_to, headers,
+			subject, plain_body, html_body, attachments, status, attempts, next_attempt_at, last_error, sent_at, created_at, updated_at`
+
+	rows, err := db.QueryContext(ctx, stmt, EmailSending, at.Add(lease), at, EmailPending, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var emails []*Email
+
+	for rows.Next() {
+		var email Email
+		var to, cc, bcc, headers, attachments []byte
+		err := rows.Scan(
+			&email.ID,
+			&email.From,
+			&email.FromName,
+			&to,
+			&cc,
+			&bcc,
+			&email.ReplyTo,
+			&headers,
+			&email.Subject,
+			&email.PlainBody,
+			&email.HTMLBody,
+			&attachments,
+			&email.Status,
+			&email.Attempts,
+			&email.NextAttemptAt,
+			&email.LastError,
+			&email.SentAt,
+			&email.CreatedAt,
+			&email.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(to, &email.To); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(cc, &email.Cc); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(bcc, &email.Bcc); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(headers, &email.Headers); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(attachments, &email.Attachments); err != nil {
+			return nil, err
+		}
+
+		emails = append(emails, &email)
+	}
+
+	return emails, rows.Err()
+}
+
+// MarkSent records that an email was sent
+func (e *Email) MarkSent(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	now := time.Now()
+
+	stmt := `update emails set status = $1, sent_at = $2, last_error = '', updated_at = $2 where id = $3`
+
+	_, err := db.ExecContext(ctx, stmt, EmailSent, now, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Retry records why sending an email failed, and when to try it again
+func (e *Email) Retry(id int, reason string, at time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update emails set status = $1, last_error = $2, next_attempt_at = $3, updated_at = $4 where id = $5`
+
+	_, err := db.ExecContext(ctx, stmt, EmailPending, reason, at, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// MarkDead records that we gave up on sending an email, and why
+func (e *Email) MarkDead(id int, reason string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update emails set status = $1, last_error = $2, updated_at = $3 where id = $4`
+
+	_, err := db.ExecContext(ctx, stmt, EmailDead, reason, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
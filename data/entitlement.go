@@ -0,0 +1,136 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Features plans commonly include. Product teams are free to add others; a feature is
+// just a name plans include or leave out.
+const (
+	FeatureAPICalls        = "api_calls"
+	FeatureSeats           = "seats"
+	FeaturePrioritySupport = "priority_support"
+)
+
+// Unlimited is the limit of a feature a plan includes without a limit
+const Unlimited = -1
+
+// PlanFeature is one feature a plan includes. Limit caps a countable feature such as
+// "api_calls" or "seats"; it is nil for a feature which is simply switched on, such as
+// "priority_support", or which has no limit. A plan leaves a feature out by not having
+// it at all.
+type PlanFeature struct {
+	ID        int
+	PlanID    int
+	Feature   string
+	Limit     *int
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// ValueForDisplay describes the limit, e.g. "10000" or "unlimited"
+func (f *PlanFeature) ValueForDisplay() string {
+	if f.Limit == nil {
+		return "unlimited"
+	}
+	return strconv.Itoa(*f.Limit)
+}
+
+// Entitlement answers which features a user may use, going by the plan of their current
+// subscription, or of the subscription of its owner for a member of an organization.
+// Members whose subscription is paused or has ended are entitled to nothing.
+type Entitlement struct{}
+
+// HasEntitlement reports whether the plan of the user includes feature. A feature with a
+// limit of 0 is not included.
+func (e *Entitlement) HasEntitlement(user User, feature string) (bool, error) {
+	limit, err := e.Limit(user, feature)
+	if err != nil {
+		return false, err
+	}
+
+	return limit != 0, nil
+}
+
+// Limit returns how much of feature the plan of the user includes: Unlimited if there is
+// no limit, and 0 if the plan does not include it
+func (e *Entitlement) Limit(user User, feature string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select f.limit_value from plan_features f
+		join subscriptions s on s.plan_id = f.plan_id
+		where s.user_id = coalesce((select o.owner_id from organizations o
+			join organization_members m on m.organization_id = o.id where m.user_id = $1), $1)
+		and s.status in ($2, $3, $4) and f.feature = $5
+		order by s.created_at desc, s.id desc limit 1`
+
+	var limit *int
+	err := db.QueryRowContext(ctx, query, user.ID,
+		SubscriptionTrialing, SubscriptionActive, SubscriptionPastDue, feature).Scan(&limit)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if limit == nil {
+		return Unlimited, nil
+	}
+	return *limit, nil
+}
+
+// insertPlanFeatures stores the features of a plan
+func insertPlanFeatures(ctx context.Context, tx *sql.Tx, planID int, features []*PlanFeature) error {
+	stmt := `insert into plan_features (plan_id, feature, limit_value, created_at, updated_at)
+		values ($1, $2, $3, $4, $5)`
+
+	for _, feature := range features {
+		_, err := tx.ExecContext(ctx, stmt, planID, feature.Feature, feature.Limit, time.Now(), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getPlanFeatures returns the features of one plan, or of every plan when planID is 0,
+// keyed by plan id
+func getPlanFeatures(ctx context.Context, planID int) (map[int][]*PlanFeature, error) {
+	query := `select id, plan_id, feature, limit_value, created_at, updated_at
+		from plan_features where $1 = 0 or plan_id = $1 order by plan_id, feature`
+
+	rows, err := db.QueryContext(ctx, query, planID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	features := make(map[int][]*PlanFeature)
+
+	for rows.Next() {
+		var feature PlanFeature
+		err := rows.Scan(
+			&feature.ID,
+			&feature.PlanID,
+			&feature.Feature,
+			&feature.Limit,
+			&feature.CreatedAt,
+			&feature.UpdatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+		features[feature.PlanID] = append(features[feature.PlanID], &feature)
+	}
+
+	return features, nil
+}
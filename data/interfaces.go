@@ -1,5 +1,7 @@
 package data
 
+import "time"
+
 type UserInterface interface {
 	GetAll() ([]*User, error)
 	GetByEmail(email string) (*User, error)
@@ -8,13 +10,112 @@ type UserInterface interface {
 	Delete() error
 	DeleteByID(id int) error
 	Insert(user User) (int, error)
-	ResetPassword(password string) error
+	UpdatePaymentDetails(user User) error
+	UpdateBillingDetails(user User) error
+	ResetPassword(id int, password string) error
 	PasswordMatches(plainText string) (bool, error)
 }
 
 type PlanInterface interface {
 	GetAll() ([]*Plan, error)
 	GetOne(id int) (*Plan, error)
-	SubscribeUserToPlan(user User, plan Plan) error
+	Insert(plan Plan) (int, error)
+	Update(plan Plan) error
+	Archive(id int) error
 	AmountForDisplay() string
 }
+
+type SubscriptionInterface interface {
+	GetOne(id int) (*Subscription, error)
+	GetCurrentByUser(userID int) (*Subscription, error)
+	GetAllByUser(userID int) ([]*Subscription, error)
+	Subscribe(user User, plan Plan) (*Subscription, error)
+	ChangePlan(sub Subscription, plan Plan, mode string) (*Subscription, error)
+	GetDueForRenewal(at time.Time) ([]*Subscription, error)
+	GetTrialsEndingBefore(at time.Time) ([]*Subscription, error)
+	GetDueForPaymentRetry(at time.Time) ([]*Subscription, error)
+	HasTrialed(userID, planID int) (bool, error)
+	Renew(sub Subscription, plan Plan) (*Subscription, error)
+	SetQuantity(id, quantity int) error
+	SetCreditBalance(id, amount int) error
+	Update(sub Subscription) error
+}
+
+type InvoiceInterface interface {
+	GetOne(id int) (*Invoice, error)
+	GetAllByUser(userID int) ([]*Invoice, error)
+	GetOpenBySubscription(subscriptionID int) (*Invoice, error)
+	GetByPeriod(subscriptionID int, start time.Time) (*Invoice, error)
+	Insert(invoice Invoice) (int, error)
+	Update(invoice Invoice) error
+	UpdateStatus(id int, status string) error
+}
+
+type CouponInterface interface {
+	GetByCode(code string) (*Coupon, error)
+	HasRedeemed(couponID, userID int) (bool, error)
+	Redeem(redemption CouponRedemption) (int, error)
+	ReleaseRedemption(id int) error
+	GetActiveRedemption(userID int) (*CouponRedemption, error)
+	ApplyRedemption(id int) error
+}
+
+type CancellationFeedbackInterface interface {
+	Insert(feedback CancellationFeedback) (int, error)
+}
+
+type EntitlementInterface interface {
+	HasEntitlement(user User, feature string) (bool, error)
+	Limit(user User, feature string) (int, error)
+}
+
+type UsageInterface interface {
+	Record(record UsageRecord) (*UsageRecord, bool, error)
+	GetTotals(userID int, start, end time.Time) (map[string]int, error)
+}
+
+type APIKeyInterface interface {
+	Generate(userID int) (string, error)
+	GetByUser(userID int) (*APIKey, error)
+	Authenticate(key string) (*User, error)
+}
+
+type OrganizationInterface interface {
+	Insert(org Organization) (int, error)
+	GetByUser(userID int) (*Organization, error)
+	SetRole(orgID, userID int, role string) error
+	RemoveMember(orgID, userID int) error
+	CountSeats(ownerID int) (int, error)
+	CreateInvitation(inv Invitation) (int, error)
+	GetInvitation(id int) (*Invitation, error)
+	GetPendingInvitations(orgID int) ([]*Invitation, error)
+	AcceptInvitation(id, userID int) error
+	DeleteInvitation(orgID, id int) error
+}
+
+type TokenInterface interface {
+	Issue(token Token) (string, error)
+	Check(purpose, plainText string) (*Token, error)
+	Consume(purpose, plainText string) (*Token, error)
+	Revoke(purpose string, userID int) error
+	RevokeSubject(purpose string, subjectID int) error
+}
+
+type EmailInterface interface {
+	Enqueue(email Email) (int, error)
+	Claim(at time.Time, lease time.Duration, limit int) ([]*Email, error)
+	MarkSent(id int) error
+	Retry(id int, reason string, at time.Time) error
+	MarkDead(id int, reason string) error
+}
+
+type WebhookEventInterface interface {
+	Record(event WebhookEvent) (bool, error)
+	Delete(id string) error
+}
+
+type PaymentInterface interface {
+	GetByChargeID(chargeID string) (*Payment, error)
+	Insert(payment Payment) (int, error)
+	UpdateStatus(id int, status string) error
+}
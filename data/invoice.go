@@ -0,0 +1,398 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Invoice statuses
+const (
+	InvoiceDraft = "draft"
+	InvoiceOpen  = "open"
+	InvoicePaid  = "paid"
+	InvoiceVoid  = "void"
+)
+
+// Invoice line kinds
+const (
+	LineItem      = "item"
+	LineProration = "proration"
+	LineDiscount  = "discount"
+	LineUsage     = "usage"
+	LineCredit    = "credit"
+	LineTax       = "tax"
+)
+
+// Invoice is the type for one invoice issued to a user. All amounts are in the minor
+// units of Currency. When TaxInclusive is set the prices on the invoice already include
+// its tax, so the tax lines show how much of the total is tax rather than add to it.
+// PeriodStart is set on the invoices issued when a period of a subscription ends, for
+// its renewal or its last usage, to the start of the next period; each is issued once.
+type Invoice struct {
+	ID             int
+	Number         string
+	UserID         int
+	SubscriptionID *int
+	Status         string
+	Currency       string
+	Subtotal       int
+	Tax            int
+	Total          int
+	TaxInclusive   bool
+	IssuedAt       time.Time
+	DueAt          time.Time
+	PaidAt         *time.Time
+	PeriodStart    *time.Time
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	Lines          []*InvoiceLine
+}
+
+// InvoiceLine is one line of an invoice. Tax is kept on lines of its own so that
+// Subtotal, Tax and Total can always be recomputed from the lines. Currency is not
+// stored; it is copied from the invoice the line belongs to.
+type InvoiceLine struct {
+	ID          int
+	InvoiceID   int
+	Kind        string
+	Description string
+	Quantity    int
+	UnitAmount  int
+	Amount      int
+	Currency    string
+	CreatedAt   time.Time
+}
+
+const invoiceColumns = `id, number, user_id, subscription_id, status, currency, subtotal, tax, total,
+	tax_inclusive, issued_at, due_at, paid_at, period_start, created_at, updated_at`
+
+// AddLine appends a line to the invoice and recalculates its totals
+func (i *Invoice) AddLine(kind, description string, quantity, unitAmount int) {
+	i.Lines = append(i.Lines, &InvoiceLine{
+		Kind:        kind,
+		Description: description,
+		Quantity:    quantity,
+		UnitAmount:  unitAmount,
+		Amount:      quantity * unitAmount,
+		Currency:    i.Currency,
+	})
+	i.Calculate()
+}
+
+// Calculate recomputes Subtotal, Tax and Total from the invoice lines
+func (i *Invoice) Calculate() {
+	i.Subtotal = 0
+	i.Tax = 0
+	for _, line := range i.Lines {
+		if line.Kind == LineTax {
+			i.Tax += line.Amount
+		} else {
+			i.Subtotal += line.Amount
+		}
+	}
+	i.Total = i.Subtotal
+	if !i.TaxInclusive {
+		i.Total += i.Tax
+	}
+}
+
+// Items returns every line except the tax lines
+func (i *Invoice) Items() []*InvoiceLine {
+	var items []*InvoiceLine
+	for _, line := range i.Lines {
+		if line.Kind != LineTax {
+			items = append(items, line)
+		}
+	}
+	return items
+}
+
+// TaxLines returns the tax lines of the invoice
+func (i *Invoice) TaxLines() []*InvoiceLine {
+	var taxes []*InvoiceLine
+	for _, line := range i.Lines {
+		if line.Kind == LineTax {
+			taxes = append(taxes, line)
+		}
+	}
+	return taxes
+}
+
+// SubtotalForDisplay formats the subtotal as a currency string
+func (i *Invoice) SubtotalForDisplay() string {
+	return FormatAmount(i.Subtotal, i.Currency)
+}
+
+// TaxForDisplay formats the tax as a currency string
+func (i *Invoice) TaxForDisplay() string {
+	return FormatAmount(i.Tax, i.Currency)
+}
+
+// TotalForDisplay formats the total as a currency string
+func (i *Invoice) TotalForDisplay() string {
+	return FormatAmount(i.Total, i.Currency)
+}
+
+// UnitAmountForDisplay formats the unit amount as a currency string
+func (l *InvoiceLine) UnitAmountForDisplay() string {
+	return FormatAmount(l.UnitAmount, l.Currency)
+}
+
+// AmountForDisplay formats the line amount as a currency string
+func (l *InvoiceLine) AmountForDisplay() string {
+	return FormatAmount(l.Amount, l.Currency)
+}
+
+// GetOne returns one invoice, including its lines, by id
+func (i *Invoice) GetOne(id int) (*Invoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + invoiceColumns + ` from invoices where id = $1`
+
+	invoice, err := scanInvoice(db.QueryRowContext(ctx, query, id))
+	if err != nil {
+		return nil, err
+	}
+
+	query = `select id, invoice_id, kind, description, quantity, unit_amount, amount, created_at
+		from invoice_lines where invoice_id = $1 order by id`
+
+	rows, err := db.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var line InvoiceLine
+		err := rows.Scan(
+			&line.ID,
+			&line.InvoiceID,
+			&line.Kind,
+			&line.Description,
+			&line.Quantity,
+			&line.UnitAmount,
+			&line.Amount,
+			&line.CreatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+		line.Currency = invoice.Currency
+		invoice.Lines = append(invoice.Lines, &line)
+	}
+
+	return invoice, nil
+}
+
+// GetAllByUser returns the invoices of a user, newest first. Lines are not loaded.
+func (i *Invoice) GetAllByUser(userID int) ([]*Invoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + invoiceColumns + ` from invoices where user_id = $1 order by issued_at desc, id desc`
+
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invoices []*Invoice
+
+	for rows.Next() {
+		invoice, err := scanInvoice(rows)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+		invoices = append(invoices, invoice)
+	}
+
+	return invoices, nil
+}
+
+// GetOpenBySubscription returns the oldest open invoice of a subscription, including its
+// lines
+func (i *Invoice) GetOpenBySubscription(subscriptionID int) (*Invoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id from invoices where subscription_id = $1 and status = $2 order by issued_at, id limit 1`
+
+	var id int
+	err := db.QueryRowContext(ctx, query, subscriptionID, InvoiceOpen).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.GetOne(id)
+}
+
+// GetByPeriod returns the open or paid invoice of a subscription for the period starting
+// at start, including its lines, so that a period is never invoiced twice
+func (i *Invoice) GetByPeriod(subscriptionID int, start time.Time) (*Invoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id from invoices where subscription_id = $1 and period_start = $2 and status in ($3, $4)
+		order by id limit 1`
+
+	var id int
+	err := db.QueryRowContext(ctx, query, subscriptionID, start, InvoiceOpen, InvoicePaid).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.GetOne(id)
+}
+
+// Insert inserts a new invoice and its lines into the database, assigning it the next
+// sequential invoice number, and returns the ID of the newly inserted row
+func (i *Invoice) Insert(invoice Invoice) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var seq int
+	err = tx.QueryRowContext(ctx, `select nextval('invoice_number_seq')`).Scan(&seq)
+	if err != nil {
+		return 0, err
+	}
+
+	invoice.Calculate()
+
+	var newID int
+	stmt := `insert into invoices (number, user_id, subscription_id, status, currency, subtotal, tax, total,
+		tax_inclusive, issued_at, due_at, paid_at, period_start, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15) returning id`
+
+	err = tx.QueryRowContext(ctx, stmt,
+		fmt.Sprintf("INV-%06d", seq),
+		invoice.UserID,
+		invoice.SubscriptionID,
+		invoice.Status,
+		invoice.Currency,
+		invoice.Subtotal,
+		invoice.Tax,
+		invoice.Total,
+		invoice.TaxInclusive,
+		invoice.IssuedAt,
+		invoice.DueAt,
+		invoice.PaidAt,
+		invoice.PeriodStart,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt = `insert into invoice_lines (invoice_id, kind, description, quantity, unit_amount, amount, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7)`
+
+	for _, line := range invoice.Lines {
+		_, err = tx.ExecContext(ctx, stmt,
+			newID,
+			line.Kind,
+			line.Description,
+			line.Quantity,
+			line.UnitAmount,
+			line.Amount,
+			time.Now(),
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// Update updates the status, subscription and dates of one invoice, using the information
+// stored in the parameter invoice. Lines and amounts never change once an invoice is issued.
+func (i *Invoice) Update(invoice Invoice) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update invoices set
+		subscription_id = $1,
+		status = $2,
+		due_at = $3,
+		paid_at = $4,
+		updated_at = $5
+		where id = $6`
+
+	_, err := db.ExecContext(ctx, stmt,
+		invoice.SubscriptionID,
+		invoice.Status,
+		invoice.DueAt,
+		invoice.PaidAt,
+		time.Now(),
+		invoice.ID,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UpdateStatus moves an invoice to a new status, recording when it was paid
+func (i *Invoice) UpdateStatus(id int, status string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update invoices set
+		status = $1,
+		paid_at = case when $1 = 'paid' then $2 else paid_at end,
+		updated_at = $2
+		where id = $3`
+
+	_, err := db.ExecContext(ctx, stmt, status, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func scanInvoice(row scanner) (*Invoice, error) {
+	var invoice Invoice
+	err := row.Scan(
+		&invoice.ID,
+		&invoice.Number,
+		&invoice.UserID,
+		&invoice.SubscriptionID,
+		&invoice.Status,
+		&invoice.Currency,
+		&invoice.Subtotal,
+		&invoice.Tax,
+		&invoice.Total,
+		&invoice.TaxInclusive,
+		&invoice.IssuedAt,
+		&invoice.DueAt,
+		&invoice.PaidAt,
+		&invoice.PeriodStart,
+		&invoice.CreatedAt,
+		&invoice.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &invoice, nil
+}
@@ -15,8 +15,20 @@ func New(dbPool *sql.DB) Models {
 	db = dbPool
 
 	return Models{
-		User: &User{},
-		Plan: &Plan{},
+		User:                 &User{},
+		Plan:                 &Plan{},
+		Subscription:         &Subscription{},
+		Invoice:              &Invoice{},
+		Payment:              &Payment{},
+		Coupon:               &Coupon{},
+		WebhookEvent:         &WebhookEvent{},
+		CancellationFeedback: &CancellationFeedback{},
+		Entitlement:          &Entitlement{},
+		Usage:                &Usage{},
+		APIKey:               &APIKey{},
+		Organization:         &Organization{},
+		Token:                &Token{},
+		Email:                &Email{},
 	}
 }
 
@@ -24,6 +36,18 @@ func New(dbPool *sql.DB) Models {
 // in this type is available to us throughout the application, anywhere that the
 // app variable is used, provided that the model is also added in the New function.
 type Models struct {
-	User UserInterface
-	Plan PlanInterface
+	User                 UserInterface
+	Plan                 PlanInterface
+	Subscription         SubscriptionInterface
+	Invoice              InvoiceInterface
+	Payment              PaymentInterface
+	Coupon               CouponInterface
+	WebhookEvent         WebhookEventInterface
+	CancellationFeedback CancellationFeedbackInterface
+	Entitlement          EntitlementInterface
+	Usage                UsageInterface
+	APIKey               APIKeyInterface
+	Organization         OrganizationInterface
+	Token                TokenInterface
+	Email                EmailInterface
 }
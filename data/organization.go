@@ -0,0 +1,376 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+// Organization roles. The owner holds the subscription of the organization and pays for
+// it. Billing members manage the seats and see the invoices; members only use the plan.
+const (
+	RoleOwner   = "owner"
+	RoleBilling = "billing"
+	RoleMember  = "member"
+)
+
+// ErrAlreadyInOrganization is returned when adding a user who already belongs to an
+// organization; a user belongs to one at most
+var ErrAlreadyInOrganization = errors.New("user already belongs to an organization")
+
+// Organization is a team sharing the subscription of its owner. Every member, the owner
+// included, takes up one seat.
+type Organization struct {
+	ID        int
+	Name      string
+	OwnerID   int
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Members   []*OrganizationMember
+}
+
+// OrganizationMember is one user's membership of an organization
+type OrganizationMember struct {
+	ID             int
+	OrganizationID int
+	UserID         int
+	Role           string
+	CreatedAt      time.Time
+	User           *User
+}
+
+// Invitation invites whoever has Email to join an organization with Role. It is sent as
+// a signed link and can be accepted once.
+type Invitation struct {
+	ID             int
+	OrganizationID int
+	Email          string
+	Role           string
+	InvitedBy      int
+	AcceptedAt     *time.Time
+	CreatedAt      time.Time
+}
+
+// Member returns the membership of a user, or nil if they are not a member
+func (o *Organization) Member(userID int) *OrganizationMember {
+	for _, m := range o.Members {
+		if m.UserID == userID {
+			return m
+		}
+	}
+	return nil
+}
+
+// CanManageSeats reports whether the member may invite and remove members
+func (m *OrganizationMember) CanManageSeats() bool {
+	return m.Role == RoleOwner || m.Role == RoleBilling
+}
+
+// Insert creates an organization owned by org.OwnerID, who becomes its first member,
+// and returns the ID of the newly inserted row
+func (o *Organization) Insert(org Organization) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var newID int
+	stmt := `insert into organizations (name, owner_id, created_at, updated_at) values ($1, $2, $3, $4) returning id`
+
+	err = tx.QueryRowContext(ctx, stmt, org.Name, org.OwnerID, time.Now(), time.Now()).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	err = insertMember(ctx, tx, newID, org.OwnerID, RoleOwner)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// GetByUser returns the organization a user belongs to, with its members. It returns
+// sql.ErrNoRows if the user does not belong to one.
+func (o *Organization) GetByUser(userID int) (*Organization, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select o.id, o.name, o.owner_id, o.created_at, o.updated_at
+		from organizations o join organization_members m on m.organization_id = o.id
+		where m.user_id = $1`
+
+	var org Organization
+	err := db.QueryRowContext(ctx, query, userID).Scan(
+		&org.ID,
+		&org.Name,
+		&org.OwnerID,
+		&org.CreatedAt,
+		&org.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `select m.id, m.organization_id, m.user_id, m.role, m.created_at,
+		u.email, u.first_name, u.last_name
+		from organization_members m join users u on u.id = m.user_id
+		where m.organization_id = $1 order by m.created_at, m.id`
+
+	rows, err := db.QueryContext(ctx, query, org.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var m OrganizationMember
+		var u User
+		err := rows.Scan(
+			&m.ID,
+			&m.OrganizationID,
+			&m.UserID,
+			&m.Role,
+			&m.CreatedAt,
+			&u.Email,
+			&u.FirstName,
+			&u.LastName,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+		u.ID = m.UserID
+		m.User = &u
+		org.Members = append(org.Members, &m)
+	}
+
+	return &org, nil
+}
+
+// SetRole changes the role of a member. The owner's role cannot be changed.
+func (o *Organization) SetRole(orgID, userID int, role string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update organization_members set role = $1
+		where organization_id = $2 and user_id = $3 and role <> $4`
+
+	_, err := db.ExecContext(ctx, stmt, role, orgID, userID, RoleOwner)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RemoveMember takes a user out of an organization. The owner cannot be removed.
+func (o *Organization) RemoveMember(orgID, userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `delete from organization_members where organization_id = $1 and user_id = $2 and role <> $3`
+
+	_, err := db.ExecContext(ctx, stmt, orgID, userID, RoleOwner)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// CountSeats returns the number of seats a subscription of the user takes up: one for
+// every member of the organization they own, or one if they own none
+func (o *Organization) CountSeats(ownerID int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	return countSeats(ctx, db, ownerID)
+}
+
+// CreateInvitation stores an invitation and returns the ID of the newly inserted row.
+// An invitation still pending for the same email is replaced.
+func (o *Organization) CreateInvitation(inv Invitation) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	email := strings.ToLower(strings.TrimSpace(inv.Email))
+
+	stmt := `delete from organization_invitations
+		where organization_id = $1 and email = $2 and accepted_at is null`
+	_, err = tx.ExecContext(ctx, stmt, inv.OrganizationID, email)
+	if err != nil {
+		return 0, err
+	}
+
+	var newID int
+	stmt = `insert into organization_invitations (organization_id, email, role, invited_by, created_at)
+		values ($1, $2, $3, $4, $5) returning id`
+	err = tx.QueryRowContext(ctx, stmt, inv.OrganizationID, email, inv.Role, inv.InvitedBy, time.Now()).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// GetInvitation returns one invitation by id
+func (o *Organization) GetInvitation(id int) (*Invitation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, organization_id, email, role, invited_by, accepted_at, created_at
+		from organization_invitations where id = $1`
+
+	return scanInvitation(db.QueryRowContext(ctx, query, id))
+}
+
+// GetPendingInvitations returns the invitations of an organization which have not been
+// accepted yet, oldest first
+func (o *Organization) GetPendingInvitations(orgID int) ([]*Invitation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, organization_id, email, role, invited_by, accepted_at, created_at
+		from organization_invitations where organization_id = $1 and accepted_at is null
+		order by created_at, id`
+
+	rows, err := db.QueryContext(ctx, query, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invitations []*Invitation
+
+	for rows.Next() {
+		inv, err := scanInvitation(rows)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+		invitations = append(invitations, inv)
+	}
+
+	return invitations, nil
+}
+
+// AcceptInvitation adds the user to the organization of the invitation with its role,
+// and marks the invitation accepted. It returns ErrAlreadyInOrganization if the user
+// already belongs to an organization.
+func (o *Organization) AcceptInvitation(id, userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var orgID int
+	var role string
+	stmt := `update organization_invitations set accepted_at = $1
+		where id = $2 and accepted_at is null returning organization_id, role`
+	err = tx.QueryRowContext(ctx, stmt, time.Now(), id).Scan(&orgID, &role)
+	if err != nil {
+		return err
+	}
+
+	err = insertMember(ctx, tx, orgID, userID, role)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteInvitation withdraws an invitation of an organization
+func (o *Organization) DeleteInvitation(orgID, id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `delete from organization_invitations where organization_id = $1 and id = $2`
+
+	_, err := db.ExecContext(ctx, stmt, orgID, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// insertMember adds a user to an organization. Every user belongs to one organization
+// at most, which the unique user_id column enforces.
+func insertMember(ctx context.Context, tx *sql.Tx, orgID, userID int, role string) error {
+	stmt := `insert into organization_members (organization_id, user_id, role, created_at)
+		values ($1, $2, $3, $4) on conflict (user_id) do nothing`
+
+	result, err := tx.ExecContext(ctx, stmt, orgID, userID, role, time.Now())
+	if err != nil {
+		return err
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if inserted == 0 {
+		return ErrAlreadyInOrganization
+	}
+
+	return nil
+}
+
+// countSeats returns the number of members of the organization owned by a user, or 1
+// if they own none
+func countSeats(ctx context.Context, q queryer, ownerID int) (int, error) {
+	query := `select count(*) from organization_members m join organizations o on o.id = m.organization_id
+		where o.owner_id = $1`
+
+	var seats int
+	err := q.QueryRowContext(ctx, query, ownerID).Scan(&seats)
+	if err != nil {
+		return 0, err
+	}
+
+	return max(seats, 1), nil
+}
+
+func scanInvitation(row scanner) (*Invitation, error) {
+	var inv Invitation
+	err := row.Scan(
+		&inv.ID,
+		&inv.OrganizationID,
+		&inv.Email,
+		&inv.Role,
+		&inv.InvitedBy,
+		&inv.AcceptedAt,
+		&inv.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
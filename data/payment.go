@@ -0,0 +1,101 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// Payment statuses
+const (
+	PaymentSucceeded = "succeeded"
+	PaymentDeclined  = "declined"
+	PaymentFailed    = "failed"
+	PaymentRefunded  = "refunded"
+	PaymentDisputed  = "disputed"
+)
+
+// Payment records one attempt to charge a user for an invoice through the payment provider
+type Payment struct {
+	ID               int
+	UserID           int
+	InvoiceID        int
+	ProviderChargeID string
+	Amount           int
+	Currency         string
+	Status           string
+	FailureMessage   string
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+}
+
+// GetByChargeID returns the payment made with the given provider charge
+func (p *Payment) GetByChargeID(chargeID string) (*Payment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, invoice_id, provider_charge_id, amount, currency, status, failure_message,
+		created_at, updated_at from payments where provider_charge_id = $1`
+
+	var payment Payment
+	err := db.QueryRowContext(ctx, query, chargeID).Scan(
+		&payment.ID,
+		&payment.UserID,
+		&payment.InvoiceID,
+		&payment.ProviderChargeID,
+		&payment.Amount,
+		&payment.Currency,
+		&payment.Status,
+		&payment.FailureMessage,
+		&payment.CreatedAt,
+		&payment.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &payment, nil
+}
+
+// Insert inserts a new payment into the database, and returns the ID of the newly inserted row
+func (p *Payment) Insert(payment Payment) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into payments (user_id, invoice_id, provider_charge_id, amount, currency, status,
+		failure_message, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id`
+
+	err := db.QueryRowContext(ctx, stmt,
+		payment.UserID,
+		payment.InvoiceID,
+		payment.ProviderChargeID,
+		payment.Amount,
+		payment.Currency,
+		payment.Status,
+		payment.FailureMessage,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// UpdateStatus moves a payment to a new status, e.g. when it is refunded or disputed
+func (p *Payment) UpdateStatus(id int, status string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update payments set status = $1, updated_at = $2 where id = $3`
+
+	_, err := db.ExecContext(ctx, stmt, status, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -2,27 +2,65 @@ package data
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"log"
 	"time"
 )
 
-// Plan is the type for subscription plans
+// Billing intervals
+const (
+	IntervalDay   = "day"
+	IntervalWeek  = "week"
+	IntervalMonth = "month"
+	IntervalYear  = "year"
+)
+
+// Intervals lists the billing intervals a plan can have, shortest first
+var Intervals = []string{IntervalDay, IntervalWeek, IntervalMonth, IntervalYear}
+
+// Plan is the type for subscription plans. PlanAmount is the base price in the minor
+// units of Currency; Prices holds the price of the plan in other currencies, if any.
+// A plan is billed every IntervalCount Intervals, e.g. every 3 months, and new
+// subscribers get TrialDays days for free. Features lists what the plan includes, and
+// MeteredPrices what it charges for usage on top of its price. The price of a plan which
+// is PerSeat is charged for every seat of the subscription. An archived plan can no
+// longer be chosen, but members already on it keep it.
 type Plan struct {
 	ID                  int
 	PlanName            string
 	PlanAmount          int
 	PlanAmountFormatted string
+	Currency            string
+	Prices              []*PlanPrice
+	Features            []*PlanFeature
+	MeteredPrices       []*MeteredPrice
+	Interval            string
+	IntervalCount       int
+	TrialDays           int
+	PerSeat             bool
+	Archived            bool
 	CreatedAt           time.Time
 	UpdatedAt           time.Time
 }
 
+// PlanPrice is the price of a plan in one additional currency
+type PlanPrice struct {
+	ID        int
+	PlanID    int
+	Currency  string
+	Amount    int
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// GetAll returns every plan, archived ones included
 func (p *Plan) GetAll() ([]*Plan, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, plan_name, plan_amount, created_at, updated_at
-	from plans order by id`
+	query := `select id, plan_name, plan_amount, currency, billing_interval, interval_count, trial_days,
+	per_seat, archived, created_at, updated_at from plans order by id`
 
 	rows, err := db.QueryContext(ctx, query)
 	if err != nil {
@@ -38,6 +76,12 @@ func (p *Plan) GetAll() ([]*Plan, error) {
 			&plan.ID,
 			&plan.PlanName,
 			&plan.PlanAmount,
+			&plan.Currency,
+			&plan.Interval,
+			&plan.IntervalCount,
+			&plan.TrialDays,
+			&plan.PerSeat,
+			&plan.Archived,
 			&plan.CreatedAt,
 			&plan.UpdatedAt,
 		)
@@ -51,6 +95,27 @@ func (p *Plan) GetAll() ([]*Plan, error) {
 		plans = append(plans, &plan)
 	}
 
+	prices, err := getPlanPrices(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	features, err := getPlanFeatures(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	metered, err := getPlanMeteredPrices(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, plan := range plans {
+		plan.Prices = prices[plan.ID]
+		plan.Features = features[plan.ID]
+		plan.MeteredPrices = metered[plan.ID]
+	}
+
 	return plans, nil
 }
 
@@ -59,7 +124,8 @@ func (p *Plan) GetOne(id int) (*Plan, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, plan_name, plan_amount, created_at, updated_at from plans where id = $1`
+	query := `select id, plan_name, plan_amount, currency, billing_interval, interval_count, trial_days,
+	per_seat, archived, created_at, updated_at from plans where id = $1`
 
 	var plan Plan
 	row := db.QueryRowContext(ctx, query, id)
@@ -68,6 +134,12 @@ func (p *Plan) GetOne(id int) (*Plan, error) {
 		&plan.ID,
 		&plan.PlanName,
 		&plan.PlanAmount,
+		&plan.Currency,
+		&plan.Interval,
+		&plan.IntervalCount,
+		&plan.TrialDays,
+		&plan.PerSeat,
+		&plan.Archived,
 		&plan.CreatedAt,
 		&plan.UpdatedAt,
 	)
@@ -76,37 +148,279 @@ func (p *Plan) GetOne(id int) (*Plan, error) {
 		return nil, err
 	}
 
+	prices, err := getPlanPrices(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	features, err := getPlanFeatures(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	metered, err := getPlanMeteredPrices(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	plan.Prices = prices[plan.ID]
+	plan.Features = features[plan.ID]
+	plan.MeteredPrices = metered[plan.ID]
 	plan.PlanAmountFormatted = plan.AmountForDisplay()
 
 	return &plan, nil
 }
 
-// SubscribeUserToPlan subscribes a user to one plan by insert
-// values into user_plans table
-func (p *Plan) SubscribeUserToPlan(user User, plan Plan) error {
+// Insert inserts a new plan, its prices in other currencies and its features into the
+// database, and returns the ID of the newly inserted row
+func (p *Plan) Insert(plan Plan) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	// delete existing plan, if any
-	stmt := `delete from user_plans where user_id = $1`
-	_, err := db.ExecContext(ctx, stmt, user.ID)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var newID int
+	stmt := `insert into plans (plan_name, plan_amount, currency, billing_interval, interval_count, trial_days,
+		per_seat, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id`
+
+	err = tx.QueryRowContext(ctx, stmt,
+		plan.PlanName,
+		plan.PlanAmount,
+		plan.Currency,
+		plan.Interval,
+		plan.IntervalCount,
+		plan.TrialDays,
+		plan.PerSeat,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	err = insertPlanPrices(ctx, tx, newID, plan.Prices)
+	if err != nil {
+		return 0, err
+	}
+
+	err = insertPlanFeatures(ctx, tx, newID, plan.Features)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// Update updates one plan in the database, using the information stored in the
+// parameter plan. Its prices in other currencies and its features are replaced by
+// plan.Prices and plan.Features. Members already on the plan are billed the new price
+// from their next renewal.
+func (p *Plan) Update(plan Plan) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `update plans set
+		plan_name = $1,
+		plan_amount = $2,
+		currency = $3,
+		billing_interval = $4,
+		interval_count = $5,
+		trial_days = $6,
+		per_seat = $7,
+		updated_at = $8
+		where id = $9`
+
+	_, err = tx.ExecContext(ctx, stmt,
+		plan.PlanName,
+		plan.PlanAmount,
+		plan.Currency,
+		plan.Interval,
+		plan.IntervalCount,
+		plan.TrialDays,
+		plan.PerSeat,
+		time.Now(),
+		plan.ID,
+	)
 	if err != nil {
 		return err
 	}
 
-	// subscribe to new plan
-	stmt = `insert into user_plans (user_id, plan_id, created_at, updated_at)
-			values ($1, $2, $3, $4)`
+	_, err = tx.ExecContext(ctx, `delete from plan_prices where plan_id = $1`, plan.ID)
+	if err != nil {
+		return err
+	}
+
+	err = insertPlanPrices(ctx, tx, plan.ID, plan.Prices)
+	if err != nil {
+		return err
+	}
 
-	_, err = db.ExecContext(ctx, stmt, user.ID, plan.ID, time.Now(), time.Now())
+	_, err = tx.ExecContext(ctx, `delete from plan_features where plan_id = $1`, plan.ID)
 	if err != nil {
 		return err
 	}
+
+	err = insertPlanFeatures(ctx, tx, plan.ID, plan.Features)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Archive retires a plan: it can no longer be chosen, but members on it keep it
+func (p *Plan) Archive(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update plans set archived = true, updated_at = $1 where id = $2`
+
+	_, err := db.ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
 // AmountForDisplay formats the price we have in the DB as a currency string
 func (p *Plan) AmountForDisplay() string {
-	amount := float64(p.PlanAmount) / 100.0
-	return fmt.Sprintf("$%.2f", amount)
+	return FormatAmount(p.PlanAmount, p.Currency)
+}
+
+// NextPeriodEnd returns the end of a billing period of the plan starting at start
+func (p *Plan) NextPeriodEnd(start time.Time) time.Time {
+	count := p.IntervalCount
+	if count < 1 {
+		count = 1
+	}
+
+	switch p.Interval {
+	case IntervalDay:
+		return start.AddDate(0, 0, count)
+	case IntervalWeek:
+		return start.AddDate(0, 0, 7*count)
+	case IntervalYear:
+		return start.AddDate(count, 0, 0)
+	default:
+		return start.AddDate(0, count, 0)
+	}
+}
+
+// IntervalForDisplay describes the billing interval, e.g. "month" or "3 months"
+func (p *Plan) IntervalForDisplay() string {
+	interval := p.Interval
+	if interval == "" {
+		interval = IntervalMonth
+	}
+	if p.IntervalCount <= 1 {
+		return interval
+	}
+	return fmt.Sprintf("%d %ss", p.IntervalCount, interval)
+}
+
+// SameInterval reports whether the plan is billed as often as other
+func (p *Plan) SameInterval(other *Plan) bool {
+	return p.IntervalForDisplay() == other.IntervalForDisplay()
+}
+
+// AmountFor returns the price of the plan for a subscription with the given number of
+// seats. Only a plan priced per seat charges for more than one.
+func (p *Plan) AmountFor(seats int) int {
+	if !p.PerSeat || seats < 1 {
+		return p.PlanAmount
+	}
+	return p.PlanAmount * seats
+}
+
+// MeteredPrice returns the price the plan charges per unit of metric used in currency,
+// or nil if it does not charge for that usage in that currency
+func (p *Plan) MeteredPrice(metric, currency string) *MeteredPrice {
+	for _, price := range p.MeteredPrices {
+		if price.Metric == metric && price.Currency == currency {
+			return price
+		}
+	}
+	return nil
+}
+
+// InCurrency returns a copy of the plan priced in the given currency. A plan which has
+// no price in that currency keeps its base price and currency.
+func (p *Plan) InCurrency(code string) *Plan {
+	plan := *p
+	if code != "" && code != p.Currency {
+		for _, price := range p.Prices {
+			if price.Currency == code {
+				plan.PlanAmount = price.Amount
+				plan.Currency = price.Currency
+				break
+			}
+		}
+	}
+	plan.PlanAmountFormatted = plan.AmountForDisplay()
+	return &plan
+}
+
+// insertPlanPrices stores the prices of a plan in other currencies
+func insertPlanPrices(ctx context.Context, tx *sql.Tx, planID int, prices []*PlanPrice) error {
+	stmt := `insert into plan_prices (plan_id, currency, amount, created_at, updated_at)
+		values ($1, $2, $3, $4, $5)`
+
+	for _, price := range prices {
+		_, err := tx.ExecContext(ctx, stmt, planID, price.Currency, price.Amount, time.Now(), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getPlanPrices returns the additional prices of one plan, or of every plan when
+// planID is 0, keyed by plan id
+func getPlanPrices(ctx context.Context, planID int) (map[int][]*PlanPrice, error) {
+	query := `select id, plan_id, currency, amount, created_at, updated_at
+		from plan_prices where $1 = 0 or plan_id = $1 order by plan_id, currency`
+
+	rows, err := db.QueryContext(ctx, query, planID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prices := make(map[int][]*PlanPrice)
+
+	for rows.Next() {
+		var price PlanPrice
+		err := rows.Scan(
+			&price.ID,
+			&price.PlanID,
+			&price.Currency,
+			&price.Amount,
+			&price.CreatedAt,
+			&price.UpdatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+		prices[price.PlanID] = append(prices[price.PlanID], &price)
+	}
+
+	return prices, nil
 }
@@ -0,0 +1,61 @@
+package data
+
+import (
+	"math"
+	"time"
+)
+
+// Plan change modes
+const (
+	ChangeImmediately = "immediate"
+	ChangeAtPeriodEnd = "period_end"
+)
+
+// Proration is the result of switching plans part way through a billing period. The
+// user is credited for the unused time on the old plan and charged for the remaining
+// time on the new plan, for as many seats as the subscription has; all amounts are in
+// cents.
+type Proration struct {
+	OldPlan     *Plan
+	NewPlan     *Plan
+	ChangeAt    time.Time
+	PeriodStart time.Time
+	PeriodEnd   time.Time
+	Credit      int
+	Charge      int
+}
+
+// Prorate computes the proration for moving sub to newPlan at the given time. The new
+// plan is charged for the rest of the current period as a share of its own billing
+// period, so that moving between a monthly and a yearly plan charges for the days left
+// rather than for the same share of a year as is left of the month.
+func Prorate(sub Subscription, newPlan Plan, at time.Time) Proration {
+	p := Proration{
+		OldPlan:     sub.Plan,
+		NewPlan:     &newPlan,
+		ChangeAt:    at,
+		PeriodStart: sub.CurrentPeriodStart,
+		PeriodEnd:   sub.CurrentPeriodEnd,
+	}
+
+	period := sub.CurrentPeriodEnd.Sub(sub.CurrentPeriodStart)
+	remaining := sub.CurrentPeriodEnd.Sub(at)
+	if period <= 0 || remaining <= 0 {
+		return p
+	}
+	if remaining > period {
+		remaining = period
+	}
+
+	fraction := float64(remaining) / float64(period)
+
+	if sub.Plan != nil {
+		p.Credit = int(math.Round(float64(sub.Plan.AmountFor(sub.Quantity)) * fraction))
+	}
+	if sub.Plan != nil && !newPlan.SameInterval(sub.Plan) {
+		fraction = float64(remaining) / float64(newPlan.NextPeriodEnd(at).Sub(at))
+	}
+	p.Charge = int(math.Round(float64(newPlan.AmountFor(sub.Quantity)) * fraction))
+
+	return p
+}
@@ -0,0 +1,634 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+// Subscription statuses
+const (
+	SubscriptionTrialing = "trialing"
+	SubscriptionActive   = "active"
+	SubscriptionPastDue  = "past_due"
+	SubscriptionPaused   = "paused"
+	SubscriptionCanceled = "canceled"
+	SubscriptionExpired  = "expired"
+)
+
+// Subscription is the type for one user's subscription to a plan. Rows are never
+// deleted; when a user changes plan the old row is closed and a new one is created,
+// so the table doubles as the subscription history of every user. While a subscription
+// is past due, PastDueSince holds when its renewal charge first failed, PaymentAttempts
+// how many charges have failed since and NextPaymentAttemptAt when we charge again. A
+// paused subscription keeps the unused part of its period for when it is resumed.
+// Quantity is the number of seats billed on a plan priced per seat; it follows the
+// number of members of the subscriber's organization. CreditBalance is what a plan change
+// credited the subscriber beyond what it charged, in the minor units of Currency; it is
+// taken off the next invoices and carries over to the subscriptions that replace this one.
+type Subscription struct {
+	ID                   int
+	UserID               int
+	PlanID               int
+	PreviousPlanID       *int
+	ScheduledPlanID      *int
+	Status               string
+	Currency             string
+	Quantity             int
+	CurrentPeriodStart   time.Time
+	CurrentPeriodEnd     time.Time
+	TrialEnd             *time.Time
+	TrialReminderSentAt  *time.Time
+	CancelAtPeriodEnd    bool
+	CanceledAt           *time.Time
+	EndedAt              *time.Time
+	PausedAt             *time.Time
+	PastDueSince         *time.Time
+	PaymentAttempts      int
+	NextPaymentAttemptAt *time.Time
+	CreditBalance        int
+	CreatedAt            time.Time
+	UpdatedAt            time.Time
+	Plan                 *Plan
+}
+
+const subscriptionColumns = `id, user_id, plan_id, previous_plan_id, scheduled_plan_id, status, currency,
+	quantity, current_period_start, current_period_end, trial_end, trial_reminder_sent_at, cancel_at_period_end,
+	canceled_at, ended_at, paused_at, past_due_since, payment_attempts, next_payment_attempt_at, credit_balance,
+	created_at, updated_at`
+
+// IsLive reports whether the subscription still gives the user access to its plan
+func (s *Subscription) IsLive() bool {
+	switch s.Status {
+	case SubscriptionTrialing, SubscriptionActive, SubscriptionPastDue:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsPaused reports whether the member has paused the subscription
+func (s *Subscription) IsPaused() bool {
+	return s.Status == SubscriptionPaused
+}
+
+// IsScheduled reports whether the subscription is due to move to planID at the end of
+// the period
+func (s *Subscription) IsScheduled(planID int) bool {
+	return s.ScheduledPlanID != nil && *s.ScheduledPlanID == planID
+}
+
+// GetOne returns one subscription by id
+func (s *Subscription) GetOne(id int) (*Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + subscriptionColumns + ` from subscriptions where id = $1`
+
+	sub, err := scanSubscription(db.QueryRowContext(ctx, query, id))
+	if err != nil {
+		return nil, err
+	}
+
+	sub.Plan, err = sub.getPlan()
+	if err != nil {
+		return nil, err
+	}
+
+	return sub, nil
+}
+
+// GetCurrentByUser returns the current (trialing, active, past due or paused) subscription
+// of a user. It returns sql.ErrNoRows if the user is not subscribed to any plan.
+func (s *Subscription) GetCurrentByUser(userID int) (*Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	sub, err := currentSubscription(ctx, db, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	sub.Plan, err = sub.getPlan()
+	if err != nil {
+		return nil, err
+	}
+
+	return sub, nil
+}
+
+// GetAllByUser returns the subscription history of a user, newest first
+func (s *Subscription) GetAllByUser(userID int) ([]*Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + subscriptionColumns + ` from subscriptions where user_id = $1 order by created_at desc, id desc`
+
+	subs, err := querySubscriptions(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sub := range subs {
+		sub.Plan, err = sub.getPlan()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return subs, nil
+}
+
+// Subscribe subscribes a user to a plan. A user without a live subscription gets a new
+// one, which starts with a free trial if the plan has one and the user has never trialed
+// that plan before, and is active otherwise; a user on another plan has the current
+// subscription closed and a new one created which remembers the previous plan.
+// Subscribing to the plan the user is already on only clears a pending cancellation or
+// scheduled plan change.
+func (s *Subscription) Subscribe(user User, plan Plan) (*Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	current, err := currentSubscription(ctx, tx, user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	if current != nil && current.PlanID == plan.ID {
+		if current.CancelAtPeriodEnd || current.ScheduledPlanID != nil {
+			stmt := `update subscriptions set cancel_at_period_end = false, scheduled_plan_id = null, updated_at = $1
+				where id = $2`
+			_, err = tx.ExecContext(ctx, stmt, now, current.ID)
+			if err != nil {
+				return nil, err
+			}
+			current.CancelAtPeriodEnd = false
+			current.ScheduledPlanID = nil
+			current.UpdatedAt = now
+		}
+		current.Plan = &plan
+		return current, tx.Commit()
+	}
+
+	seats, err := countSeats(ctx, tx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	next := Subscription{
+		UserID:             user.ID,
+		PlanID:             plan.ID,
+		Status:             SubscriptionActive,
+		Currency:           plan.Currency,
+		Quantity:           seats,
+		CurrentPeriodStart: now,
+		CurrentPeriodEnd:   plan.NextPeriodEnd(now),
+		CreatedAt:          now,
+		UpdatedAt:          now,
+		Plan:               &plan,
+	}
+
+	if current == nil && plan.TrialDays > 0 {
+		trialed, err := hasTrialed(ctx, tx, user.ID, plan.ID)
+		if err != nil {
+			return nil, err
+		}
+		if !trialed {
+			trialEnd := now.AddDate(0, 0, plan.TrialDays)
+			next.Status = SubscriptionTrialing
+			next.CurrentPeriodEnd = trialEnd
+			next.TrialEnd = &trialEnd
+		}
+	}
+
+	if current != nil {
+		err = closeSubscription(ctx, tx, current.ID, now)
+		if err != nil {
+			return nil, err
+		}
+		next.PreviousPlanID = &current.PlanID
+	}
+
+	next.ID, err = insertSubscription(ctx, tx, next)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &next, nil
+}
+
+// ChangePlan moves a live subscription to another plan. With ChangeImmediately the current
+// subscription is closed and a new one on the new plan takes over the rest of the billing
+// period, or of the trial if the user may trial the new plan; with ChangeAtPeriodEnd the
+// new plan is only scheduled and takes effect on renewal. The new subscription's period
+// starts now, so the caller bills the usage up to the change.
+func (s *Subscription) ChangePlan(sub Subscription, plan Plan, mode string) (*Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	now := time.Now()
+
+	if mode == ChangeAtPeriodEnd {
+		stmt := `update subscriptions set scheduled_plan_id = $1, updated_at = $2 where id = $3`
+		_, err := db.ExecContext(ctx, stmt, plan.ID, now, sub.ID)
+		if err != nil {
+			return nil, err
+		}
+		sub.ScheduledPlanID = &plan.ID
+		sub.UpdatedAt = now
+		return &sub, nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	err = closeSubscription(ctx, tx, sub.ID, now)
+	if err != nil {
+		return nil, err
+	}
+
+	next := Subscription{
+		UserID:             sub.UserID,
+		PlanID:             plan.ID,
+		PreviousPlanID:     &sub.PlanID,
+		Status:             sub.Status,
+		Currency:           sub.Currency,
+		Quantity:           sub.Quantity,
+		CreditBalance:      sub.CreditBalance,
+		CurrentPeriodStart: now,
+		CurrentPeriodEnd:   sub.CurrentPeriodEnd,
+		TrialEnd:           sub.TrialEnd,
+		CancelAtPeriodEnd:  sub.CancelAtPeriodEnd,
+		CreatedAt:          now,
+		UpdatedAt:          now,
+		Plan:               &plan,
+	}
+
+	// a trial only carries over to a plan which offers one and which the user has not
+	// trialed before; otherwise it ends and a paid period starts now
+	if sub.Status == SubscriptionTrialing {
+		trialed, err := hasTrialed(ctx, tx, sub.UserID, plan.ID)
+		if err != nil {
+			return nil, err
+		}
+		if plan.TrialDays == 0 || trialed {
+			next.Status = SubscriptionActive
+			next.TrialEnd = nil
+			next.CurrentPeriodEnd = plan.NextPeriodEnd(now)
+		}
+	}
+
+	next.ID, err = insertSubscription(ctx, tx, next)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &next, nil
+}
+
+// GetDueForRenewal returns the active and trialing subscriptions whose current period
+// has ended by at
+func (s *Subscription) GetDueForRenewal(at time.Time) ([]*Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + subscriptionColumns + ` from subscriptions
+		where status in ($1, $2) and current_period_end <= $3 order by current_period_end`
+
+	return querySubscriptions(ctx, query, SubscriptionActive, SubscriptionTrialing, at)
+}
+
+// GetTrialsEndingBefore returns the trialing subscriptions whose trial ends by at and
+// whose user has not been reminded yet
+func (s *Subscription) GetTrialsEndingBefore(at time.Time) ([]*Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + subscriptionColumns + ` from subscriptions
+		where status = $1 and trial_reminder_sent_at is null and trial_end <= $2 order by trial_end`
+
+	return querySubscriptions(ctx, query, SubscriptionTrialing, at)
+}
+
+// GetDueForPaymentRetry returns the past due subscriptions whose next payment attempt is
+// due by at
+func (s *Subscription) GetDueForPaymentRetry(at time.Time) ([]*Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + subscriptionColumns + ` from subscriptions
+		where status = $1 and next_payment_attempt_at <= $2 order by next_payment_attempt_at`
+
+	return querySubscriptions(ctx, query, SubscriptionPastDue, at)
+}
+
+// Renew starts the next billing period of sub on plan. The period has been paid for, so a
+// trialing or past due subscription becomes active and any failed payments are forgotten.
+// When plan is not the plan of the subscription (a change scheduled for the end of the
+// period), the subscription is closed and a new one created on plan, just as ChangePlan
+// does.
+func (s *Subscription) Renew(sub Subscription, plan Plan) (*Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	start := sub.CurrentPeriodEnd
+	end := plan.NextPeriodEnd(start)
+
+	sub.Status = SubscriptionActive
+	sub.PastDueSince = nil
+	sub.PaymentAttempts = 0
+	sub.NextPaymentAttemptAt = nil
+
+	if plan.ID == sub.PlanID {
+		stmt := `update subscriptions set status = $1, current_period_start = $2, current_period_end = $3,
+			scheduled_plan_id = null, past_due_since = null, payment_attempts = 0, next_payment_attempt_at = null,
+			updated_at = $4 where id = $5`
+		_, err := db.ExecContext(ctx, stmt, sub.Status, start, end, time.Now(), sub.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		sub.CurrentPeriodStart = start
+		sub.CurrentPeriodEnd = end
+		sub.ScheduledPlanID = nil
+		sub.Plan = &plan
+		return &sub, nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	err = closeSubscription(ctx, tx, sub.ID, start)
+	if err != nil {
+		return nil, err
+	}
+
+	next := Subscription{
+		UserID:             sub.UserID,
+		PlanID:             plan.ID,
+		PreviousPlanID:     &sub.PlanID,
+		Status:             sub.Status,
+		Currency:           sub.Currency,
+		Quantity:           sub.Quantity,
+		CreditBalance:      sub.CreditBalance,
+		CurrentPeriodStart: start,
+		CurrentPeriodEnd:   end,
+		TrialEnd:           sub.TrialEnd,
+		CreatedAt:          time.Now(),
+		UpdatedAt:          time.Now(),
+		Plan:               &plan,
+	}
+
+	next.ID, err = insertSubscription(ctx, tx, next)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &next, nil
+}
+
+// SetQuantity changes the number of seats billed on a subscription from its next invoice
+func (s *Subscription) SetQuantity(id, quantity int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update subscriptions set quantity = $1, updated_at = $2 where id = $3`
+
+	_, err := db.ExecContext(ctx, stmt, quantity, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SetCreditBalance sets the credit a subscription has left to take off its next invoices
+func (s *Subscription) SetCreditBalance(id, amount int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update subscriptions set credit_balance = $1, updated_at = $2 where id = $3`
+
+	_, err := db.ExecContext(ctx, stmt, amount, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Update updates one subscription in the database, using the information
+// stored in the parameter sub
+func (s *Subscription) Update(sub Subscription) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update subscriptions set
+		plan_id = $1,
+		previous_plan_id = $2,
+		scheduled_plan_id = $3,
+		status = $4,
+		current_period_start = $5,
+		current_period_end = $6,
+		trial_end = $7,
+		trial_reminder_sent_at = $8,
+		cancel_at_period_end = $9,
+		canceled_at = $10,
+		ended_at = $11,
+		paused_at = $12,
+		past_due_since = $13,
+		payment_attempts = $14,
+		next_payment_attempt_at = $15,
+		updated_at = $16
+		where id = $17`
+
+	_, err := db.ExecContext(ctx, stmt,
+		sub.PlanID,
+		sub.PreviousPlanID,
+		sub.ScheduledPlanID,
+		sub.Status,
+		sub.CurrentPeriodStart,
+		sub.CurrentPeriodEnd,
+		sub.TrialEnd,
+		sub.TrialReminderSentAt,
+		sub.CancelAtPeriodEnd,
+		sub.CanceledAt,
+		sub.EndedAt,
+		sub.PausedAt,
+		sub.PastDueSince,
+		sub.PaymentAttempts,
+		sub.NextPaymentAttemptAt,
+		time.Now(),
+		sub.ID,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// getPlan loads the plan the subscription belongs to, priced in the subscription's currency
+func (s *Subscription) getPlan() (*Plan, error) {
+	var p Plan
+	plan, err := p.GetOne(s.PlanID)
+	if err != nil {
+		return nil, err
+	}
+	return plan.InCurrency(s.Currency), nil
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// scanner is implemented by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// insertSubscription inserts sub and returns the ID of the newly inserted row
+func insertSubscription(ctx context.Context, tx *sql.Tx, sub Subscription) (int, error) {
+	stmt := `insert into subscriptions (user_id, plan_id, previous_plan_id, status, currency, quantity,
+		current_period_start, current_period_end, trial_end, cancel_at_period_end, credit_balance, created_at,
+		updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) returning id`
+
+	var newID int
+	err := tx.QueryRowContext(ctx, stmt,
+		sub.UserID,
+		sub.PlanID,
+		sub.PreviousPlanID,
+		sub.Status,
+		sub.Currency,
+		sub.Quantity,
+		sub.CurrentPeriodStart,
+		sub.CurrentPeriodEnd,
+		sub.TrialEnd,
+		sub.CancelAtPeriodEnd,
+		sub.CreditBalance,
+		sub.CreatedAt,
+		sub.UpdatedAt,
+	).Scan(&newID)
+
+	return newID, err
+}
+
+// HasTrialed reports whether the user has ever had a free trial of the plan, in which
+// case subscribing to it again starts a paid subscription straight away
+func (s *Subscription) HasTrialed(userID, planID int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	return hasTrialed(ctx, db, userID, planID)
+}
+
+// closeSubscription ends a subscription that is being replaced by another one
+func closeSubscription(ctx context.Context, tx *sql.Tx, id int, at time.Time) error {
+	stmt := `update subscriptions set status = $1, canceled_at = $2, ended_at = $2, updated_at = $2 where id = $3`
+	_, err := tx.ExecContext(ctx, stmt, SubscriptionCanceled, at, id)
+	return err
+}
+
+// hasTrialed reports whether the user has ever had a free trial of the plan
+func hasTrialed(ctx context.Context, q queryer, userID, planID int) (bool, error) {
+	query := `select exists (select 1 from subscriptions
+		where user_id = $1 and plan_id = $2 and trial_end is not null)`
+
+	var exists bool
+	err := q.QueryRowContext(ctx, query, userID, planID).Scan(&exists)
+	return exists, err
+}
+
+// querySubscriptions runs a query selecting subscriptionColumns and returns its rows
+func querySubscriptions(ctx context.Context, query string, args ...any) ([]*Subscription, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []*Subscription
+
+	for rows.Next() {
+		sub, err := scanSubscription(rows)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+
+	return subs, nil
+}
+
+func currentSubscription(ctx context.Context, q queryer, userID int) (*Subscription, error) {
+	query := `select ` + subscriptionColumns + ` from subscriptions
+		where user_id = $1 and status in ($2, $3, $4, $5)
+		order by created_at desc, id desc limit 1`
+
+	return scanSubscription(q.QueryRowContext(ctx, query, userID,
+		SubscriptionTrialing, SubscriptionActive, SubscriptionPastDue, SubscriptionPaused))
+}
+
+func scanSubscription(row scanner) (*Subscription, error) {
+	var sub Subscription
+	err := row.Scan(
+		&sub.ID,
+		&sub.UserID,
+		&sub.PlanID,
+		&sub.PreviousPlanID,
+		&sub.ScheduledPlanID,
+		&sub.Status,
+		&sub.Currency,
+		&sub.Quantity,
+		&sub.CurrentPeriodStart,
+		&sub.CurrentPeriodEnd,
+		&sub.TrialEnd,
+		&sub.TrialReminderSentAt,
+		&sub.CancelAtPeriodEnd,
+		&sub.CanceledAt,
+		&sub.EndedAt,
+		&sub.PausedAt,
+		&sub.PastDueSince,
+		&sub.PaymentAttempts,
+		&sub.NextPaymentAttemptAt,
+		&sub.CreditBalance,
+		&sub.CreatedAt,
+		&sub.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
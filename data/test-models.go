@@ -2,61 +2,88 @@ package data
 
 import (
 	"database/sql"
-	"fmt"
+	"strings"
+	"sync"
 	"time"
 )
 
 func TestNew(dbPool *sql.DB) Models {
 	db = dbPool
 	return Models{
-		User: &UserTest{},
-		Plan: &PlanTest{},
+		User:                 &UserTest{},
+		Plan:                 &PlanTest{},
+		Subscription:         &SubscriptionTest{},
+		Invoice:              &InvoiceTest{},
+		Payment:              &PaymentTest{},
+		Coupon:               &CouponTest{},
+		WebhookEvent:         &WebhookEventTest{},
+		CancellationFeedback: &CancellationFeedbackTest{},
+		Entitlement:          &EntitlementTest{},
+		Usage:                &UsageTest{},
+		APIKey:               &APIKeyTest{},
+		Organization:         &OrganizationTest{},
+		Token:                &TokenTest{},
+		Email:                &EmailTest{},
 	}
 }
 
 type UserTest struct {
-	ID        int
-	Email     string
-	FirstName string
-	LastName  string
-	Password  string
-	Active    int
-	IsAdmin   int
-	CreatedAt time.Time
-	UpdatedAt time.Time
-	Plan      *Plan
+	ID                int
+	Email             string
+	FirstName         string
+	LastName          string
+	Password          string
+	Active            int
+	IsAdmin           int
+	Currency          string
+	PaymentCustomerID string
+	PaymentMethodID   string
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+	Plan              *Plan
 }
 
 // GetAll returns a slice of all users, sorted by last name
 func (u *UserTest) GetAll() ([]*User, error) {
 	var users []*User
 	user := User{
-		ID:        1,
-		Email:     "admin@example.com",
-		FirstName: "Admin",
-		LastName:  "Admin",
-		Password:  "abc",
-		Active:    1,
-		IsAdmin:   1,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		ID:                1,
+		Email:             "admin@example.com",
+		FirstName:         "Admin",
+		LastName:          "Admin",
+		Password:          "abc",
+		Active:            1,
+		IsAdmin:           1,
+		Currency:          DefaultCurrency,
+		PaymentCustomerID: "cus_test",
+		PaymentMethodID:   "pm_test",
+		CreatedAt:         time.Now(),
+		UpdatedAt:         time.Now(),
 	}
 	users = append(users, &user)
 	return users, nil
 }
 
-// GetByEmail returns one user by email
+// GetByEmail returns one user by email; there is no user with the address
+// nobody@example.com
 func (u *UserTest) GetByEmail(email string) (*User, error) {
+	if email == "nobody@example.com" {
+		return nil, sql.ErrNoRows
+	}
+
 	user := User{
-		ID:        1,
-		Email:     "admin@example.com",
-		FirstName: "Admin",
-		LastName:  "Admin",
-		Password:  "abc",
-		Active:    1,
-		IsAdmin:   1,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		ID:                1,
+		Email:             "admin@example.com",
+		FirstName:         "Admin",
+		LastName:          "Admin",
+		Password:          "abc",
+		Active:            1,
+		IsAdmin:           1,
+		Currency:          DefaultCurrency,
+		PaymentCustomerID: "cus_test",
+		PaymentMethodID:   "pm_test",
+		CreatedAt:         time.Now(),
+		UpdatedAt:         time.Now(),
 	}
 	return &user, nil
 }
@@ -64,15 +91,30 @@ func (u *UserTest) GetByEmail(email string) (*User, error) {
 // GetOne returns one user by id
 func (u *UserTest) GetOne(id int) (*User, error) {
 	user := User{
-		ID:        1,
-		Email:     "admin@example.com",
-		FirstName: "Admin",
-		LastName:  "Admin",
-		Password:  "abc",
-		Active:    1,
-		IsAdmin:   1,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		ID:                1,
+		Email:             "admin@example.com",
+		FirstName:         "Admin",
+		LastName:          "Admin",
+		Password:          "abc",
+		Active:            1,
+		IsAdmin:           1,
+		Currency:          DefaultCurrency,
+		PaymentCustomerID: "cus_test",
+		PaymentMethodID:   "pm_test",
+		CreatedAt:         time.Now(),
+		UpdatedAt:         time.Now(),
+	}
+	// only user 1 is an administrator
+	if id != 1 {
+		user.ID = id
+		user.Email = "member@example.com"
+		user.IsAdmin = 0
+	}
+	// user 8 is a business in Germany whose tax ID has been verified
+	if id == 8 {
+		user.Country = "DE"
+		user.TaxID = "DE123456789"
+		user.TaxIDVerified = true
 	}
 	return &user, nil
 }
@@ -83,13 +125,27 @@ func (u *UserTest) Update(user User) error {
 	return nil
 }
 
+// UpdatePaymentDetails stores the payment provider customer and payment method of a user
+func (u *UserTest) UpdatePaymentDetails(user User) error {
+	return nil
+}
+
+// UpdateBillingDetails stores the billing address and tax ID of a user
+func (u *UserTest) UpdateBillingDetails(user User) error {
+	return nil
+}
+
 // Delete deletes one user from the database, by User.ID
 func (u *UserTest) Delete() error {
 	return nil
 }
 
-// DeleteByID deletes one user from the database, by ID
+// DeleteByID deletes one user from the database, by ID. Only users 2 and 7 have never
+// been invoiced, so only they can be deleted.
 func (u *UserTest) DeleteByID(id int) error {
+	if id != 2 && id != 7 {
+		return ErrUserHasInvoices
+	}
 	return nil
 }
 
@@ -98,8 +154,8 @@ func (u *UserTest) Insert(user User) (int, error) {
 	return 2, nil
 }
 
-// ResetPassword is the method we will use to change a user's password.
-func (u *UserTest) ResetPassword(password string) error {
+// ResetPassword is the method we will use to change the password of the user with id.
+func (u *UserTest) ResetPassword(id int, password string) error {
 	return nil
 }
 
@@ -115,6 +171,11 @@ type PlanTest struct {
 	PlanName            string
 	PlanAmount          int
 	PlanAmountFormatted string
+	Currency            string
+	Prices              []*PlanPrice
+	Interval            string
+	IntervalCount       int
+	TrialDays           int
 	CreatedAt           time.Time
 	UpdatedAt           time.Time
 }
@@ -122,36 +183,815 @@ type PlanTest struct {
 func (p *PlanTest) GetAll() ([]*Plan, error) {
 	var plans []*Plan
 	plan := Plan{
-		ID:         1,
-		PlanName:   "Bronze Plan",
-		PlanAmount: 1000,
-		CreatedAt:  time.Now(),
-		UpdatedAt:  time.Now(),
+		ID:            1,
+		PlanName:      "Bronze Plan",
+		PlanAmount:    1000,
+		Currency:      DefaultCurrency,
+		Prices:        testPlanPrices(),
+		Features:      testPlanFeatures(1),
+		MeteredPrices: testMeteredPrices(1),
+		Interval:      IntervalMonth,
+		CreatedAt:     time.Now(),
+		UpdatedAt:     time.Now(),
 	}
+	plan.PlanAmountFormatted = plan.AmountForDisplay()
 	plans = append(plans, &plan)
+
+	legacy, _ := p.GetOne(9)
+	plans = append(plans, legacy)
 	return plans, nil
 }
 
-// GetOne returns one plan by id
+// GetOne returns one plan by id; plan 2 is the Silver Plan, plan 9 the archived Legacy
+// Plan, plan 10 the Free Plan, any other id the Bronze Plan
 func (p *PlanTest) GetOne(id int) (*Plan, error) {
 	plan := Plan{
-		ID:         1,
+		ID:         id,
 		PlanName:   "Bronze Plan",
 		PlanAmount: 1000,
+		Currency:   DefaultCurrency,
+		Prices:     testPlanPrices(),
+		Interval:   IntervalMonth,
 		CreatedAt:  time.Now(),
 		UpdatedAt:  time.Now(),
 	}
+	switch id {
+	case 2:
+		plan.PlanName = "Silver Plan"
+		plan.PlanAmount = 2000
+	case 3, 4:
+		plan.TrialDays = 14
+	case 9:
+		plan.PlanName = "Legacy Plan"
+		plan.PlanAmount = 500
+		plan.Archived = true
+	case 10:
+		plan.PlanName = "Free Plan"
+		plan.PlanAmount = 0
+		plan.Prices = nil
+	}
+	plan.Features = testPlanFeatures(id)
+	plan.MeteredPrices = testMeteredPrices(id)
+	plan.PlanAmountFormatted = plan.AmountForDisplay()
 	return &plan, nil
 }
 
-// SubscribeUserToPlan subscribes a user to one plan by insert
-// values into user_plans table
-func (p *PlanTest) SubscribeUserToPlan(user User, plan Plan) error {
+// Insert inserts a new plan and its prices
+func (p *PlanTest) Insert(plan Plan) (int, error) {
+	return 4, nil
+}
+
+// Update updates one plan and replaces its prices
+func (p *PlanTest) Update(plan Plan) error {
+	return nil
+}
+
+// Archive retires a plan
+func (p *PlanTest) Archive(id int) error {
 	return nil
 }
 
 // AmountForDisplay formats the price we have in the DB as a currency string
 func (p *PlanTest) AmountForDisplay() string {
-	amount := float64(p.PlanAmount) / 100.0
-	return fmt.Sprintf("$%.2f", amount)
+	return FormatAmount(p.PlanAmount, p.Currency)
+}
+
+func testPlanPrices() []*PlanPrice {
+	return []*PlanPrice{
+		{ID: 1, PlanID: 1, Currency: "EUR", Amount: 900, CreatedAt: time.Now(), UpdatedAt: time.Now()},
+		{ID: 2, PlanID: 1, Currency: "GBP", Amount: 800, CreatedAt: time.Now(), UpdatedAt: time.Now()},
+	}
+}
+
+// testPlanFeatures returns the features of a test plan: the Silver Plan includes more
+// API calls and seats than the others, and priority support
+func testPlanFeatures(planID int) []*PlanFeature {
+	limit := func(n int) *int { return &n }
+
+	if planID == 2 {
+		return []*PlanFeature{
+			{ID: 3, PlanID: 2, Feature: FeatureAPICalls, Limit: limit(10000)},
+			{ID: 4, PlanID: 2, Feature: FeaturePrioritySupport},
+			{ID: 5, PlanID: 2, Feature: FeatureSeats, Limit: limit(5)},
+		}
+	}
+	return []*PlanFeature{
+		{ID: 1, PlanID: planID, Feature: FeatureAPICalls, Limit: limit(1000)},
+		{ID: 2, PlanID: planID, Feature: FeatureSeats, Limit: limit(1)},
+	}
+}
+
+// testMeteredPrices returns the usage prices of a test plan. API calls are charged in
+// tiers: the first 1000 are free and every call after that costs a cent. The Silver
+// Plan charges by volume: a cent a call, or a flat 50 dollars once more than 10000 calls
+// are made.
+func testMeteredPrices(planID int) []*MeteredPrice {
+	upTo := func(n int) *int { return &n }
+
+	if planID == 2 {
+		return []*MeteredPrice{{
+			ID: 2, PlanID: 2, Metric: FeatureAPICalls, Currency: DefaultCurrency, Mode: PricingVolume,
+			Tiers: []*PriceTier{
+				{ID: 3, MeteredPriceID: 2, UpTo: upTo(10000), UnitAmount: 1},
+				{ID: 4, MeteredPriceID: 2, UnitAmount: 0, FlatAmount: 5000},
+			},
+		}}
+	}
+	return []*MeteredPrice{{
+		ID: 1, PlanID: planID, Metric: FeatureAPICalls, Currency: DefaultCurrency, Mode: PricingTiered,
+		Tiers: []*PriceTier{
+			{ID: 1, MeteredPriceID: 1, UpTo: upTo(1000), UnitAmount: 0},
+			{ID: 2, MeteredPriceID: 1, UnitAmount: 1},
+		},
+	}}
+}
+
+type SubscriptionTest struct{}
+
+// GetOne returns one subscription by id
+func (s *SubscriptionTest) GetOne(id int) (*Subscription, error) {
+	sub := testSubscription()
+	sub.ID = id
+	return &sub, nil
+}
+
+// GetCurrentByUser returns the current subscription of a user; user 3 is past due, user
+// 4 is paused, user 5 is on the Silver Plan, user 11 is trialing, and user 7 and the
+// members 2 and 6 of user 5's organization have none of their own
+func (s *SubscriptionTest) GetCurrentByUser(userID int) (*Subscription, error) {
+	sub := testSubscription()
+	sub.UserID = userID
+	switch userID {
+	case 2, 6, 7:
+		return nil, sql.ErrNoRows
+	case 3:
+		sub = testPastDueSubscription()
+	case 4:
+		pausedAt := time.Now().AddDate(0, 0, -10)
+		sub.Status = SubscriptionPaused
+		sub.PausedAt = &pausedAt
+	case 5:
+		sub.PlanID = 2
+		sub.Plan, _ = (&PlanTest{}).GetOne(2)
+	case 11:
+		sub.Status = SubscriptionTrialing
+		sub.TrialEnd = &sub.CurrentPeriodEnd
+	}
+	return &sub, nil
+}
+
+// GetAllByUser returns the subscription history of a user, newest first
+func (s *SubscriptionTest) GetAllByUser(userID int) ([]*Subscription, error) {
+	sub := testSubscription()
+	sub.UserID = userID
+	return []*Subscription{&sub}, nil
+}
+
+// Subscribe subscribes a user to a plan
+func (s *SubscriptionTest) Subscribe(user User, plan Plan) (*Subscription, error) {
+	sub := testSubscription()
+	sub.UserID = user.ID
+	sub.PlanID = plan.ID
+	sub.Plan = &plan
+	return &sub, nil
+}
+
+// ChangePlan moves a live subscription to another plan
+func (s *SubscriptionTest) ChangePlan(sub Subscription, plan Plan, mode string) (*Subscription, error) {
+	if mode == ChangeAtPeriodEnd {
+		sub.ScheduledPlanID = &plan.ID
+		return &sub, nil
+	}
+	if sub.Status == SubscriptionTrialing {
+		trialed, _ := s.HasTrialed(sub.UserID, plan.ID)
+		if plan.TrialDays == 0 || trialed {
+			sub.Status = SubscriptionActive
+			sub.TrialEnd = nil
+		}
+	}
+	sub.PreviousPlanID = &sub.PlanID
+	sub.PlanID = plan.ID
+	sub.Plan = &plan
+	return &sub, nil
+}
+
+// GetDueForRenewal returns the active subscriptions whose current period has ended by at
+func (s *SubscriptionTest) GetDueForRenewal(at time.Time) ([]*Subscription, error) {
+	sub := testSubscription()
+	sub.CurrentPeriodStart = at.AddDate(0, -1, 0)
+	sub.CurrentPeriodEnd = at
+	return []*Subscription{&sub}, nil
+}
+
+// GetTrialsEndingBefore returns the trialing subscriptions whose trial ends by at
+func (s *SubscriptionTest) GetTrialsEndingBefore(at time.Time) ([]*Subscription, error) {
+	sub := testSubscription()
+	trialEnd := at.AddDate(0, 0, -1)
+	sub.Status = SubscriptionTrialing
+	sub.CurrentPeriodEnd = trialEnd
+	sub.TrialEnd = &trialEnd
+	return []*Subscription{&sub}, nil
+}
+
+// HasTrialed reports whether the user has ever had a free trial of the plan; only user
+// 11 has, of plans 1 and 3
+func (s *SubscriptionTest) HasTrialed(userID, planID int) (bool, error) {
+	return userID == 11 && (planID == 1 || planID == 3), nil
+}
+
+// GetDueForPaymentRetry returns the past due subscriptions whose next payment attempt is
+// due by at
+func (s *SubscriptionTest) GetDueForPaymentRetry(at time.Time) ([]*Subscription, error) {
+	sub := testPastDueSubscription()
+	return []*Subscription{&sub}, nil
+}
+
+// Renew starts the next billing period of sub on plan
+func (s *SubscriptionTest) Renew(sub Subscription, plan Plan) (*Subscription, error) {
+	sub.Status = SubscriptionActive
+	sub.PastDueSince = nil
+	sub.PaymentAttempts = 0
+	sub.NextPaymentAttemptAt = nil
+	if plan.ID != sub.PlanID {
+		sub.PreviousPlanID = &sub.PlanID
+		sub.PlanID = plan.ID
+	}
+	sub.CurrentPeriodStart = sub.CurrentPeriodEnd
+	sub.CurrentPeriodEnd = plan.NextPeriodEnd(sub.CurrentPeriodStart)
+	sub.ScheduledPlanID = nil
+	sub.Plan = &plan
+	return &sub, nil
+}
+
+// SetQuantity changes the number of seats a subscription is charged for
+func (s *SubscriptionTest) SetQuantity(id, quantity int) error {
+	return nil
+}
+
+// SetCreditBalance sets the credit a subscription has left
+func (s *SubscriptionTest) SetCreditBalance(id, amount int) error {
+	return nil
+}
+
+// Update updates one subscription in the database
+func (s *SubscriptionTest) Update(sub Subscription) error {
+	return nil
+}
+
+func testSubscription() Subscription {
+	return Subscription{
+		ID:                 1,
+		UserID:             1,
+		PlanID:             1,
+		Status:             SubscriptionActive,
+		Currency:           DefaultCurrency,
+		Quantity:           1,
+		CurrentPeriodStart: time.Now().AddDate(0, 0, -1),
+		CurrentPeriodEnd:   time.Now().AddDate(0, 1, -1),
+		CreatedAt:          time.Now(),
+		UpdatedAt:          time.Now(),
+		Plan: &Plan{
+			ID:         1,
+			PlanName:   "Bronze Plan",
+			PlanAmount: 1000,
+			Currency:   DefaultCurrency,
+			Interval:   IntervalMonth,
+			CreatedAt:  time.Now(),
+			UpdatedAt:  time.Now(),
+		},
+	}
+}
+
+// testPastDueSubscription is a subscription whose renewal charge failed yesterday and
+// whose period ended then
+func testPastDueSubscription() Subscription {
+	sub := testSubscription()
+	since := time.Now().AddDate(0, 0, -1)
+	sub.Status = SubscriptionPastDue
+	sub.CurrentPeriodStart = since.AddDate(0, -1, 0)
+	sub.CurrentPeriodEnd = since
+	sub.PastDueSince = &since
+	sub.PaymentAttempts = 1
+	sub.NextPaymentAttemptAt = &sub.UpdatedAt
+	return sub
+}
+
+type InvoiceTest struct{}
+
+// GetOne returns one invoice, including its lines, by id
+func (i *InvoiceTest) GetOne(id int) (*Invoice, error) {
+	invoice := testInvoice()
+	invoice.ID = id
+	return &invoice, nil
+}
+
+// GetAllByUser returns the invoices of a user, newest first
+func (i *InvoiceTest) GetAllByUser(userID int) ([]*Invoice, error) {
+	invoice := testInvoice()
+	invoice.UserID = userID
+	return []*Invoice{&invoice}, nil
+}
+
+// GetOpenBySubscription returns the oldest open invoice of a subscription
+func (i *InvoiceTest) GetOpenBySubscription(subscriptionID int) (*Invoice, error) {
+	invoice := testInvoice()
+	invoice.SubscriptionID = &subscriptionID
+	return &invoice, nil
+}
+
+// GetByPeriod returns the open or paid invoice of a subscription for the period starting
+// at start; only subscription 2 has already paid for its period
+func (i *InvoiceTest) GetByPeriod(subscriptionID int, start time.Time) (*Invoice, error) {
+	if subscriptionID != 2 {
+		return nil, sql.ErrNoRows
+	}
+	invoice := testInvoice()
+	invoice.SubscriptionID = &subscriptionID
+	invoice.Status = InvoicePaid
+	invoice.PaidAt = &invoice.IssuedAt
+	invoice.PeriodStart = &start
+	return &invoice, nil
+}
+
+// Insert inserts a new invoice and its lines into the database
+func (i *InvoiceTest) Insert(invoice Invoice) (int, error) {
+	return 1, nil
+}
+
+// Update updates the status, subscription and dates of one invoice
+func (i *InvoiceTest) Update(invoice Invoice) error {
+	return nil
+}
+
+// UpdateStatus moves an invoice to a new status
+func (i *InvoiceTest) UpdateStatus(id int, status string) error {
+	return nil
+}
+
+func testInvoice() Invoice {
+	subID := 1
+	invoice := Invoice{
+		ID:             1,
+		Number:         "INV-000001",
+		UserID:         1,
+		SubscriptionID: &subID,
+		Status:         InvoiceOpen,
+		Currency:       DefaultCurrency,
+		IssuedAt:       time.Now(),
+		DueAt:          time.Now().AddDate(0, 0, 14),
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+	}
+	invoice.AddLine(LineItem, "Bronze Plan", 1, 1000)
+	return invoice
+}
+
+type PaymentTest struct{}
+
+// GetByChargeID returns the payment made with the given provider charge
+func (p *PaymentTest) GetByChargeID(chargeID string) (*Payment, error) {
+	payment := Payment{
+		ID:               1,
+		UserID:           1,
+		InvoiceID:        1,
+		ProviderChargeID: chargeID,
+		Amount:           1000,
+		Currency:         DefaultCurrency,
+		Status:           PaymentSucceeded,
+		CreatedAt:        time.Now(),
+		UpdatedAt:        time.Now(),
+	}
+	return &payment, nil
+}
+
+// Insert inserts a new payment into the database
+func (p *PaymentTest) Insert(payment Payment) (int, error) {
+	return 1, nil
+}
+
+// UpdateStatus moves a payment to a new status
+func (p *PaymentTest) UpdateStatus(id int, status string) error {
+	return nil
+}
+
+// WebhookEventTest treats the event id "evt_seen" as already recorded
+type WebhookEventTest struct{}
+
+// Record stores an event, and reports whether it is new
+func (e *WebhookEventTest) Record(event WebhookEvent) (bool, error) {
+	return event.ID != "evt_seen", nil
+}
+
+// Delete forgets an event
+func (e *WebhookEventTest) Delete(id string) error {
+	return nil
+}
+
+// CouponTest knows the codes "WELCOME20" (20% off once), "SAVE5" (5.00 USD off for 3
+// periods), "SILVER" (50% off the Silver Plan forever), "EXPIRED" and "USED", which
+// every user has already redeemed
+type CouponTest struct{}
+
+// GetByCode returns the coupon with the given code, ignoring case
+func (c *CouponTest) GetByCode(code string) (*Coupon, error) {
+	coupon := Coupon{
+		ID:         1,
+		Code:       strings.ToUpper(strings.TrimSpace(code)),
+		PercentOff: 20,
+		Currency:   DefaultCurrency,
+		Duration:   CouponOnce,
+		Active:     true,
+		CreatedAt:  time.Now(),
+		UpdatedAt:  time.Now(),
+	}
+
+	switch coupon.Code {
+	case "WELCOME20":
+	case "SAVE5":
+		coupon.ID = 2
+		coupon.PercentOff = 0
+		coupon.AmountOff = 500
+		coupon.Duration = CouponRepeating
+		coupon.DurationPeriods = 3
+	case "SILVER":
+		coupon.ID = 3
+		coupon.PercentOff = 50
+		coupon.Duration = CouponForever
+		coupon.PlanIDs = []int{2}
+	case "EXPIRED":
+		expiredAt := time.Now().AddDate(0, 0, -1)
+		coupon.ID = 4
+		coupon.ExpiresAt = &expiredAt
+	case "USED":
+		coupon.ID = 5
+	case "LASTONE":
+		coupon.ID = 6
+	default:
+		return nil, sql.ErrNoRows
+	}
+
+	return &coupon, nil
+}
+
+// HasRedeemed reports whether the user has already redeemed the coupon
+func (c *CouponTest) HasRedeemed(couponID, userID int) (bool, error) {
+	return couponID == 5, nil
+}
+
+// Redeem records a redemption of a coupon; coupon 6 has just run out
+func (c *CouponTest) Redeem(redemption CouponRedemption) (int, error) {
+	if redemption.CouponID == 6 {
+		return 0, ErrCouponExhausted
+	}
+	return 1, nil
+}
+
+// ReleaseRedemption deletes a redemption whose invoice was never paid
+func (c *CouponTest) ReleaseRedemption(id int) error {
+	return nil
+}
+
+// GetActiveRedemption returns the redemption still discounting a user's invoices; no
+// user has one
+func (c *CouponTest) GetActiveRedemption(userID int) (*CouponRedemption, error) {
+	return nil, sql.ErrNoRows
+}
+
+// ApplyRedemption counts one more period discounted by a redemption
+func (c *CouponTest) ApplyRedemption(id int) error {
+	return nil
+}
+
+type CancellationFeedbackTest struct{}
+
+// Insert stores the feedback of a member who canceled
+func (c *CancellationFeedbackTest) Insert(feedback CancellationFeedback) (int, error) {
+	return 1, nil
+}
+
+type EntitlementTest struct{}
+
+// HasEntitlement reports whether the plan of the user includes feature
+func (e *EntitlementTest) HasEntitlement(user User, feature string) (bool, error) {
+	limit, err := e.Limit(user, feature)
+	if err != nil {
+		return false, err
+	}
+	return limit != 0, nil
+}
+
+// Limit returns how much of feature the plan of the user's current subscription
+// includes; paused members are entitled to nothing
+func (e *EntitlementTest) Limit(user User, feature string) (int, error) {
+	sub, err := (&SubscriptionTest{}).GetCurrentByUser(user.ID)
+	if err != nil || !sub.IsLive() {
+		return 0, nil
+	}
+
+	for _, f := range testPlanFeatures(sub.PlanID) {
+		if f.Feature == feature {
+			if f.Limit == nil {
+				return Unlimited, nil
+			}
+			return *f.Limit, nil
+		}
+	}
+	return 0, nil
+}
+
+type UsageTest struct{}
+
+// Record stores a usage record; the idempotency key "dup" has been used before
+func (u *UsageTest) Record(record UsageRecord) (*UsageRecord, bool, error) {
+	if record.IdempotencyKey == "dup" {
+		record.ID = 1
+		record.Quantity = 1
+		record.CreatedAt = time.Now().Add(-time.Hour)
+		return &record, false, nil
+	}
+	record.ID = 2
+	record.CreatedAt = time.Now()
+	return &record, true, nil
+}
+
+// GetTotals adds up the usage a user reported, per metric
+func (u *UsageTest) GetTotals(userID int, start, end time.Time) (map[string]int, error) {
+	return map[string]int{FeatureAPICalls: 1500}, nil
+}
+
+type APIKeyTest struct{}
+
+// Generate creates a new API key for a user
+func (k *APIKeyTest) Generate(userID int) (string, error) {
+	return "sk_test", nil
+}
+
+// GetByUser returns the API key of a user; only user 1 has one
+func (k *APIKeyTest) GetByUser(userID int) (*APIKey, error) {
+	if userID != 1 {
+		return nil, sql.ErrNoRows
+	}
+	return &APIKey{ID: 1, UserID: 1, Hint: "sk_test", CreatedAt: time.Now()}, nil
+}
+
+// Authenticate returns the user an API key belongs to; "sk_test" is the key of user 1,
+// "sk_paused" the key of user 4, whose subscription is paused, and "sk_member" the key of
+// user 2, a member of user 5's organization
+func (k *APIKeyTest) Authenticate(key string) (*User, error) {
+	switch key {
+	case "sk_test":
+		return (&UserTest{}).GetOne(1)
+	case "sk_member":
+		return (&UserTest{}).GetOne(2)
+	case "sk_paused":
+		return (&UserTest{}).GetOne(4)
+	}
+	return nil, sql.ErrNoRows
+}
+
+type OrganizationTest struct{}
+
+// Insert creates an organization
+func (o *OrganizationTest) Insert(org Organization) (int, error) {
+	return 1, nil
+}
+
+// GetByUser returns the organization a user belongs to; Acme is owned by user 5, who is
+// on the Silver Plan, user 2 is a member and user 6 has the billing role. Other users
+// belong to none.
+func (o *OrganizationTest) GetByUser(userID int) (*Organization, error) {
+	if userID != 5 && userID != 2 && userID != 6 {
+		return nil, sql.ErrNoRows
+	}
+
+	member := func(id int, email, role string) *OrganizationMember {
+		return &OrganizationMember{
+			ID:             id,
+			OrganizationID: 1,
+			UserID:         id,
+			Role:           role,
+			CreatedAt:      time.Now(),
+			User:           &User{ID: id, Email: email, FirstName: "Test", LastName: "User"},
+		}
+	}
+
+	return &Organization{
+		ID:        1,
+		Name:      "Acme",
+		OwnerID:   5,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+		Members: []*OrganizationMember{
+			member(5, "owner@example.com", RoleOwner),
+			member(2, "member@example.com", RoleMember),
+			member(6, "billing@example.com", RoleBilling),
+		},
+	}, nil
+}
+
+// SetRole changes the role of a member
+func (o *OrganizationTest) SetRole(orgID, userID int, role string) error {
+	return nil
+}
+
+// RemoveMember takes a user out of an organization
+func (o *OrganizationTest) RemoveMember(orgID, userID int) error {
+	return nil
+}
+
+// CountSeats returns the number of seats a subscription of the user takes up; Acme,
+// owned by user 5, has 3 members
+func (o *OrganizationTest) CountSeats(ownerID int) (int, error) {
+	if ownerID == 5 {
+		return 3, nil
+	}
+	return 1, nil
+}
+
+// CreateInvitation stores an invitation
+func (o *OrganizationTest) CreateInvitation(inv Invitation) (int, error) {
+	return 1, nil
+}
+
+// GetInvitation returns one invitation by id; invitation 1 invites "new@example.com" to
+// Acme and invitation 2 has been accepted
+func (o *OrganizationTest) GetInvitation(id int) (*Invitation, error) {
+	inv := testInvitation()
+	switch id {
+	case 1:
+	case 2:
+		accepted := time.Now().Add(-time.Hour)
+		inv.ID = 2
+		inv.AcceptedAt = &accepted
+	default:
+		return nil, sql.ErrNoRows
+	}
+	return &inv, nil
+}
+
+// GetPendingInvitations returns the invitations of an organization not accepted yet
+func (o *OrganizationTest) GetPendingInvitations(orgID int) ([]*Invitation, error) {
+	inv := testInvitation()
+	return []*Invitation{&inv}, nil
+}
+
+// AcceptInvitation adds the user to the organization of the invitation
+func (o *OrganizationTest) AcceptInvitation(id, userID int) error {
+	return nil
+}
+
+// DeleteInvitation withdraws an invitation of an organization
+func (o *OrganizationTest) DeleteInvitation(orgID, id int) error {
+	return nil
+}
+
+func testInvitation() Invitation {
+	return Invitation{
+		ID:             1,
+		OrganizationID: 1,
+		Email:          "new@example.com",
+		Role:           RoleMember,
+		InvitedBy:      5,
+		CreatedAt:      time.Now(),
+	}
+}
+
+type TokenTest struct{}
+
+// Issue stores a new token; the token of every purpose is the purpose followed by
+// "-token", e.g. "activation-token"
+func (t *TokenTest) Issue(token Token) (string, error) {
+	return token.Purpose + "-token", nil
+}
+
+// Check returns the token for purpose, if it can still be used
+func (t *TokenTest) Check(purpose, plainText string) (*Token, error) {
+	token, err := testToken(purpose, plainText)
+	if err != nil {
+		return nil, err
+	}
+	if err := token.Valid(time.Now()); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// Consume uses up the token for purpose and returns it
+func (t *TokenTest) Consume(purpose, plainText string) (*Token, error) {
+	return t.Check(purpose, plainText)
+}
+
+// Revoke revokes the unused tokens for purpose issued to a user
+func (t *TokenTest) Revoke(purpose string, userID int) error {
+	return nil
+}
+
+// RevokeSubject revokes the unused tokens for purpose acting on subjectID
+func (t *TokenTest) RevokeSubject(purpose string, subjectID int) error {
+	return nil
+}
+
+// testToken returns the token for purpose issued by TokenTest. "used-token" has been
+// used, "expired-token" has expired and "revoked-token" has been revoked. Invitation
+// tokens are for invitation 1, sent to new@example.com; other tokens act for user 1.
+func testToken(purpose, plainText string) (*Token, error) {
+	userID, subjectID := 1, 1
+	token := Token{
+		ID:        1,
+		Purpose:   purpose,
+		UserID:    &userID,
+		Email:     "admin@example.com",
+		ExpiresAt: time.Now().Add(time.Hour),
+		CreatedAt: time.Now(),
+	}
+	if purpose == TokenInvitation {
+		token.UserID = nil
+		token.Email = "new@example.com"
+		token.SubjectID = &subjectID
+	}
+
+	then := time.Now().Add(-time.Minute)
+	switch plainText {
+	case purpose + "-token":
+	case "used-token":
+		token.ConsumedAt = &then
+	case "expired-token":
+		token.ExpiresAt = then
+	case "revoked-token":
+		token.RevokedAt = &then
+	default:
+		return nil, ErrTokenInvalid
+	}
+	return &token, nil
+}
+
+// EmailTest is an outbox kept in memory, so that tests can send what was queued
+type EmailTest struct {
+	mu     sync.Mutex
+	emails []*Email
+}
+
+// Enqueue stores an email to be sent
+func (e *EmailTest) Enqueue(email Email) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	email.ID = len(e.emails) + 1
+	email.Status = EmailPending
+	email.NextAttemptAt = time.Now()
+	e.emails = append(e.emails, &email)
+	return email.ID, nil
+}
+
+// Claim returns up to limit emails due at at, marked as being sent
+func (e *EmailTest) Claim(at time.Time, lease time.Duration, limit int) ([]*Email, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var claimed []*Email
+	for _, email := range e.emails {
+		if len(claimed) == limit {
+			break
+		}
+		if email.Status != EmailPending || email.NextAttemptAt.After(at) {
+			continue
+		}
+		email.Status = EmailSending
+		email.Attempts++
+		email.NextAttemptAt = at.Add(lease)
+		claimed = append(claimed, email)
+	}
+	return claimed, nil
+}
+
+// MarkSent records that an email was sent
+func (e *EmailTest) MarkSent(id int) error {
+	return e.setStatus(id, EmailSent, "")
+}
+
+// Retry records when to try an email again
+func (e *EmailTest) Retry(id int, reason string, at time.Time) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	email := e.emails[id-1]
+	email.Status = EmailPending
+	email.LastError = reason
+	email.NextAttemptAt = at
+	return nil
+}
+
+// MarkDead records that we gave up on an email
+func (e *EmailTest) MarkDead(id int, reason string) error {
+	return e.setStatus(id, EmailDead, reason)
+}
+
+func (e *EmailTest) setStatus(id int, status, reason string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	email := e.emails[id-1]
+	email.Status = status
+	email.LastError = reason
+	return nil
 }
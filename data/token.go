@@ -0,0 +1,210 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// Token purposes. A token only works for the purpose it was issued for.
+const (
+	TokenActivation    = "activation"
+	TokenPasswordReset = "password_reset"
+	TokenEmailChange   = "email_change"
+	TokenInvitation    = "invitation"
+)
+
+// Reasons a token cannot be used
+var (
+	ErrTokenInvalid = errors.New("token not found")
+	ErrTokenExpired = errors.New("token has expired")
+	ErrTokenUsed    = errors.New("token already used")
+	ErrTokenRevoked = errors.New("token has been revoked")
+)
+
+// Token is a single use secret we email to someone as part of a link, e.g. to activate
+// their account. Only a hash of the token is stored. UserID is the user it acts for, if
+// any, Email the address it was sent to, and SubjectID what it acts on, such as an
+// invitation. A token can be used until ExpiresAt, once, unless it is revoked first.
+type Token struct {
+	ID         int
+	Purpose    string
+	UserID     *int
+	Email      string
+	SubjectID  *int
+	ExpiresAt  time.Time
+	ConsumedAt *time.Time
+	RevokedAt  *time.Time
+	CreatedAt  time.Time
+}
+
+// Valid returns nil if the token can be used at at, or the reason it cannot
+func (t *Token) Valid(at time.Time) error {
+	switch {
+	case t.RevokedAt != nil:
+		return ErrTokenRevoked
+	case t.ConsumedAt != nil:
+		return ErrTokenUsed
+	case !at.Before(t.ExpiresAt):
+		return ErrTokenExpired
+	}
+	return nil
+}
+
+// Issue stores a new token, and returns the token itself to send out. It is not stored
+// and cannot be got back later.
+func (t *Token) Issue(token Token) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	plainText := hex.EncodeToString(b)
+
+	stmt := `insert into tokens (token_hash, purpose, user_id, email, subject_id, expires_at, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7)`
+
+	_, err := db.ExecContext(ctx, stmt,
+		hashToken(plainText),
+		token.Purpose,
+		token.UserID,
+		token.Email,
+		token.SubjectID,
+		token.ExpiresAt,
+		time.Now(),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return plainText, nil
+}
+
+// Check returns the token for purpose, if it can still be used, without using it up
+func (t *Token) Check(purpose, plainText string) (*Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	token, err := getToken(ctx, purpose, plainText)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := token.Valid(time.Now()); err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// Consume uses up the token for purpose and returns it. A token can only be consumed
+// once, even by requests racing each other.
+func (t *Token) Consume(purpose, plainText string) (*Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	now := time.Now()
+
+	stmt := `update tokens set consumed_at = $1
+		where token_hash = $2 and purpose = $3 and consumed_at is null and revoked_at is null and expires_at > $1
+		returning ` + tokenColumns
+
+	token, err := scanToken(db.QueryRowContext(ctx, stmt, now, hashToken(plainText), purpose))
+	if err == nil {
+		return token, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	// find out why the token could not be used
+	token, err = getToken(ctx, purpose, plainText)
+	if err != nil {
+		return nil, err
+	}
+	if err := token.Valid(now); err != nil {
+		return nil, err
+	}
+
+	return nil, ErrTokenUsed
+}
+
+// Revoke revokes every token for purpose issued to a user which has not been used yet
+func (t *Token) Revoke(purpose string, userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update tokens set revoked_at = $1
+		where purpose = $2 and user_id = $3 and consumed_at is null and revoked_at is null`
+
+	_, err := db.ExecContext(ctx, stmt, time.Now(), purpose, userID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RevokeSubject revokes every token for purpose acting on subjectID which has not been
+// used yet, e.g. the tokens of an invitation which was withdrawn
+func (t *Token) RevokeSubject(purpose string, subjectID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update tokens set revoked_at = $1
+		where purpose = $2 and subject_id = $3 and consumed_at is null and revoked_at is null`
+
+	_, err := db.ExecContext(ctx, stmt, time.Now(), purpose, subjectID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+const tokenColumns = `id, purpose, user_id, email, subject_id, expires_at, consumed_at, revoked_at, created_at`
+
+// getToken returns the token for purpose whether or not it can still be used, or
+// ErrTokenInvalid if there is no such token
+func getToken(ctx context.Context, purpose, plainText string) (*Token, error) {
+	query := `select ` + tokenColumns + ` from tokens where token_hash = $1 and purpose = $2`
+
+	token, err := scanToken(db.QueryRowContext(ctx, query, hashToken(plainText), purpose))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrTokenInvalid
+	}
+
+	return token, err
+}
+
+func scanToken(row scanner) (*Token, error) {
+	var token Token
+	err := row.Scan(
+		&token.ID,
+		&token.Purpose,
+		&token.UserID,
+		&token.Email,
+		&token.SubjectID,
+		&token.ExpiresAt,
+		&token.ConsumedAt,
+		&token.RevokedAt,
+		&token.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// hashToken returns the hash we store of a token. Tokens are long and random, so a plain
+// hash is enough to keep them safe.
+func hashToken(plainText string) string {
+	sum := sha256.Sum256([]byte(plainText))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,271 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+// Metered pricing modes
+const (
+	PricingTiered = "tiered"
+	PricingVolume = "volume"
+)
+
+// UsageRecord reports that a member used Quantity units of Metric, e.g. "api_calls", at
+// RecordedAt. Members report usage from their own systems and may retry a report; the
+// IdempotencyKey they send with it makes sure it is only counted once.
+type UsageRecord struct {
+	ID             int
+	UserID         int
+	SubscriptionID int
+	Metric         string
+	Quantity       int
+	IdempotencyKey string
+	RecordedAt     time.Time
+	CreatedAt      time.Time
+}
+
+// MeteredPrice is what a plan charges per unit of Metric used in a period, in Currency.
+// With tiered pricing every unit is charged the price of the tier it falls in; with
+// volume pricing every unit is charged the price of the tier the total falls in.
+type MeteredPrice struct {
+	ID        int
+	PlanID    int
+	Metric    string
+	Currency  string
+	Mode      string
+	Tiers     []*PriceTier
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// PriceTier is one tier of a metered price. It covers the units up to and including
+// UpTo, or every unit left when UpTo is nil. Each unit costs UnitAmount, and FlatAmount
+// is charged once when any unit falls in the tier. Amounts are in minor units.
+type PriceTier struct {
+	ID             int
+	MeteredPriceID int
+	UpTo           *int
+	UnitAmount     int
+	FlatAmount     int
+}
+
+// TierCharge is what a metered price charges for the units falling in one of its tiers.
+// From and To are the first and last unit charged.
+type TierCharge struct {
+	Tier     *PriceTier
+	From     int
+	To       int
+	Quantity int
+	Amount   int
+}
+
+// Charges works out what the price charges for quantity units, tier by tier. Tiers no
+// unit falls in are left out.
+func (m *MeteredPrice) Charges(quantity int) []TierCharge {
+	if quantity <= 0 {
+		return nil
+	}
+
+	if m.Mode == PricingVolume {
+		for _, tier := range m.Tiers {
+			if tier.UpTo == nil || quantity <= *tier.UpTo {
+				return []TierCharge{{
+					Tier:     tier,
+					From:     1,
+					To:       quantity,
+					Quantity: quantity,
+					Amount:   quantity*tier.UnitAmount + tier.FlatAmount,
+				}}
+			}
+		}
+		return nil
+	}
+
+	var charges []TierCharge
+	charged := 0
+	for _, tier := range m.Tiers {
+		upTo := quantity
+		if tier.UpTo != nil && *tier.UpTo < quantity {
+			upTo = *tier.UpTo
+		}
+		if upTo <= charged {
+			continue
+		}
+
+		units := upTo - charged
+		charges = append(charges, TierCharge{
+			Tier:     tier,
+			From:     charged + 1,
+			To:       upTo,
+			Quantity: units,
+			Amount:   units*tier.UnitAmount + tier.FlatAmount,
+		})
+
+		charged = upTo
+		if charged == quantity {
+			break
+		}
+	}
+
+	return charges
+}
+
+// Amount returns what the price charges in total for quantity units
+func (m *MeteredPrice) Amount(quantity int) int {
+	amount := 0
+	for _, charge := range m.Charges(quantity) {
+		amount += charge.Amount
+	}
+	return amount
+}
+
+// Usage is the type for recording and adding up the usage reported by members
+type Usage struct{}
+
+// Record stores a usage record, and returns it with its ID. If the user has already
+// reported usage with the same idempotency key nothing is stored; the record reported
+// first is returned instead, and isNew is false.
+func (u *Usage) Record(record UsageRecord) (*UsageRecord, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into usage_records (user_id, subscription_id, metric, quantity, idempotency_key,
+		recorded_at, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7) on conflict (user_id, idempotency_key) do nothing
+		returning id, created_at`
+
+	err := db.QueryRowContext(ctx, stmt,
+		record.UserID,
+		record.SubscriptionID,
+		record.Metric,
+		record.Quantity,
+		record.IdempotencyKey,
+		record.RecordedAt,
+		time.Now(),
+	).Scan(&record.ID, &record.CreatedAt)
+	if err == nil {
+		return &record, true, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, false, err
+	}
+
+	query := `select id, user_id, subscription_id, metric, quantity, idempotency_key, recorded_at, created_at
+		from usage_records where user_id = $1 and idempotency_key = $2`
+
+	var existing UsageRecord
+	err = db.QueryRowContext(ctx, query, record.UserID, record.IdempotencyKey).Scan(
+		&existing.ID,
+		&existing.UserID,
+		&existing.SubscriptionID,
+		&existing.Metric,
+		&existing.Quantity,
+		&existing.IdempotencyKey,
+		&existing.RecordedAt,
+		&existing.CreatedAt,
+	)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &existing, false, nil
+}
+
+// GetTotals adds up the usage a user reported from start up to end, per metric
+func (u *Usage) GetTotals(userID int, start, end time.Time) (map[string]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select metric, sum(quantity) from usage_records
+		where user_id = $1 and recorded_at >= $2 and recorded_at < $3 group by metric`
+
+	rows, err := db.QueryContext(ctx, query, userID, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := make(map[string]int)
+
+	for rows.Next() {
+		var metric string
+		var total int
+		err := rows.Scan(&metric, &total)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+		totals[metric] = total
+	}
+
+	return totals, nil
+}
+
+// getPlanMeteredPrices returns the metered prices of one plan, or of every plan when
+// planID is 0, keyed by plan id, with their tiers in order
+func getPlanMeteredPrices(ctx context.Context, planID int) (map[int][]*MeteredPrice, error) {
+	query := `select id, plan_id, metric, currency, mode, created_at, updated_at
+		from metered_prices where $1 = 0 or plan_id = $1 order by plan_id, metric, currency`
+
+	rows, err := db.QueryContext(ctx, query, planID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prices := make(map[int][]*MeteredPrice)
+	byID := make(map[int]*MeteredPrice)
+
+	for rows.Next() {
+		var price MeteredPrice
+		err := rows.Scan(
+			&price.ID,
+			&price.PlanID,
+			&price.Metric,
+			&price.Currency,
+			&price.Mode,
+			&price.CreatedAt,
+			&price.UpdatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+		prices[price.PlanID] = append(prices[price.PlanID], &price)
+		byID[price.ID] = &price
+	}
+
+	query = `select t.id, t.metered_price_id, t.up_to, t.unit_amount, t.flat_amount
+		from metered_price_tiers t join metered_prices p on p.id = t.metered_price_id
+		where $1 = 0 or p.plan_id = $1 order by t.metered_price_id, t.up_to nulls last`
+
+	tierRows, err := db.QueryContext(ctx, query, planID)
+	if err != nil {
+		return nil, err
+	}
+	defer tierRows.Close()
+
+	for tierRows.Next() {
+		var tier PriceTier
+		err := tierRows.Scan(
+			&tier.ID,
+			&tier.MeteredPriceID,
+			&tier.UpTo,
+			&tier.UnitAmount,
+			&tier.FlatAmount,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+		if price, ok := byID[tier.MeteredPriceID]; ok {
+			price.Tiers = append(price.Tiers, &tier)
+		}
+	}
+
+	return prices, nil
+}
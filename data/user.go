@@ -3,23 +3,44 @@ package data
 import (
 	"context"
 	"errors"
+	"github.com/jackc/pgx/v5/pgconn"
 	"golang.org/x/crypto/bcrypt"
 	"log"
 	"time"
 )
 
-// User is the structure which holds one user from the database.
+// ErrUserHasInvoices is returned when deleting a user who has been invoiced. Invoices
+// are kept for the accounts, so such a user can only be deactivated.
+var ErrUserHasInvoices = errors.New("user has invoices")
+
+// User is the structure which holds one user from the database. The billing address and
+// TaxID (e.g. an EU VAT ID) are printed on invoices and decide the tax charged; Country
+// is an ISO 3166-1 alpha-2 code and Region a state or province code within it. Tax is
+// only reverse charged once an administrator has checked the TaxID, which TaxIDVerified
+// records.
 type User struct {
-	ID        int
-	Email     string
-	FirstName string
-	LastName  string
-	Password  string
-	Active    int
-	IsAdmin   int
-	CreatedAt time.Time
-	UpdatedAt time.Time
-	Plan      *Plan
+	ID                int
+	Email             string
+	FirstName         string
+	LastName          string
+	Password          string
+	Active            int
+	IsAdmin           int
+	Currency          string
+	Locale            string
+	PaymentCustomerID string
+	PaymentMethodID   string
+	AddressLine1      string
+	AddressLine2      string
+	City              string
+	Region            string
+	PostalCode        string
+	Country           string
+	TaxID             string
+	TaxIDVerified     bool
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+	Plan              *Plan
 }
 
 // GetAll returns a slice of all users, sorted by last name
@@ -36,6 +57,18 @@ func (u *User) GetAll() ([]*User, error) {
        	password, 
        	user_active, 
        	is_admin, 
+       	currency, 
+       	locale, 
+       	payment_customer_id, 
+       	payment_method_id, 
+       	address_line1, 
+       	address_line2, 
+       	city, 
+       	region, 
+       	postal_code, 
+       	country, 
+       	tax_id, 
+       	tax_id_verified, 
        	created_at, 
        	updated_at
 	from 
@@ -61,6 +94,18 @@ func (u *User) GetAll() ([]*User, error) {
 			&user.Password,
 			&user.Active,
 			&user.IsAdmin,
+			&user.Currency,
+			&user.Locale,
+			&user.PaymentCustomerID,
+			&user.PaymentMethodID,
+			&user.AddressLine1,
+			&user.AddressLine2,
+			&user.City,
+			&user.Region,
+			&user.PostalCode,
+			&user.Country,
+			&user.TaxID,
+			&user.TaxIDVerified,
 			&user.CreatedAt,
 			&user.UpdatedAt,
 		)
@@ -89,6 +134,18 @@ func (u *User) GetByEmail(email string) (*User, error) {
 			    password, 
 			    user_active, 
 			    is_admin, 
+			    currency, 
+			    locale, 
+			    payment_customer_id, 
+			    payment_method_id, 
+			    address_line1, 
+			    address_line2, 
+			    city, 
+			    region, 
+			    postal_code, 
+			    country, 
+			    tax_id, 
+			    tax_id_verified, 
 			    created_at, 
 			    updated_at 
 			from 
@@ -107,6 +164,18 @@ func (u *User) GetByEmail(email string) (*User, error) {
 		&user.Password,
 		&user.Active,
 		&user.IsAdmin,
+		&user.Currency,
+		&user.Locale,
+		&user.PaymentCustomerID,
+		&user.PaymentMethodID,
+		&user.AddressLine1,
+		&user.AddressLine2,
+		&user.City,
+		&user.Region,
+		&user.PostalCode,
+		&user.Country,
+		&user.TaxID,
+		&user.TaxIDVerified,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -116,18 +185,23 @@ func (u *User) GetByEmail(email string) (*User, error) {
 	}
 
 	// get plan, if any
-	query = `select p.id, p.plan_name, p.plan_amount, p.created_at, p.updated_at from 
+	query = `select p.id, p.plan_name, p.plan_amount, p.currency, p.billing_interval, p.interval_count, p.trial_days, p.created_at, p.updated_at from 
 			plans p
-			left join user_plans up on (p.id = up.plan_id)
-			where up.user_id = $1`
+			join subscriptions s on (p.id = s.plan_id)
+			where s.user_id = $1 and s.status in ($2, $3, $4)
+			order by s.created_at desc, s.id desc limit 1`
 
 	var plan Plan
-	row = db.QueryRowContext(ctx, query, user.ID)
+	row = db.QueryRowContext(ctx, query, user.ID, SubscriptionTrialing, SubscriptionActive, SubscriptionPastDue)
 
 	err = row.Scan(
 		&plan.ID,
 		&plan.PlanName,
 		&plan.PlanAmount,
+		&plan.Currency,
+		&plan.Interval,
+		&plan.IntervalCount,
+		&plan.TrialDays,
 		&plan.CreatedAt,
 		&plan.UpdatedAt,
 	)
@@ -144,7 +218,9 @@ func (u *User) GetOne(id int) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, user_active, is_admin, created_at, updated_at 
+	query := `select id, email, first_name, last_name, password, user_active, is_admin, currency, locale,
+				payment_customer_id, payment_method_id, address_line1, address_line2, city, region, postal_code,
+				country, tax_id, tax_id_verified, created_at, updated_at 
 				from users 
 				where id = $1`
 
@@ -159,6 +235,18 @@ func (u *User) GetOne(id int) (*User, error) {
 		&user.Password,
 		&user.Active,
 		&user.IsAdmin,
+		&user.Currency,
+		&user.Locale,
+		&user.PaymentCustomerID,
+		&user.PaymentMethodID,
+		&user.AddressLine1,
+		&user.AddressLine2,
+		&user.City,
+		&user.Region,
+		&user.PostalCode,
+		&user.Country,
+		&user.TaxID,
+		&user.TaxIDVerified,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -168,18 +256,23 @@ func (u *User) GetOne(id int) (*User, error) {
 	}
 
 	// get plan, if any
-	query = `select p.id, p.plan_name, p.plan_amount, p.created_at, p.updated_at from 
+	query = `select p.id, p.plan_name, p.plan_amount, p.currency, p.billing_interval, p.interval_count, p.trial_days, p.created_at, p.updated_at from 
 			plans p
-			left join user_plans up on (p.id = up.plan_id)
-			where up.user_id = $1`
+			join subscriptions s on (p.id = s.plan_id)
+			where s.user_id = $1 and s.status in ($2, $3, $4)
+			order by s.created_at desc, s.id desc limit 1`
 
 	var plan Plan
-	row = db.QueryRowContext(ctx, query, user.ID)
+	row = db.QueryRowContext(ctx, query, user.ID, SubscriptionTrialing, SubscriptionActive, SubscriptionPastDue)
 
 	err = row.Scan(
 		&plan.ID,
 		&plan.PlanName,
 		&plan.PlanAmount,
+		&plan.Currency,
+		&plan.Interval,
+		&plan.IntervalCount,
+		&plan.TrialDays,
 		&plan.CreatedAt,
 		&plan.UpdatedAt,
 	)
@@ -204,14 +297,18 @@ func (u *User) Update(user User) error {
 		first_name = $2,
 		last_name = $3,
 		user_active = $4,
-		updated_at = $5
-		where id = $6`
+		currency = $5,
+		locale = $6,
+		updated_at = $7
+		where id = $8`
 
 	_, err := db.ExecContext(ctx, stmt,
 		user.Email,
 		user.FirstName,
 		user.LastName,
 		user.Active,
+		user.Currency,
+		user.Locale,
 		time.Now(),
 		user.ID,
 	)
@@ -232,7 +329,7 @@ func (u *User) Delete() error {
 
 	_, err := db.ExecContext(ctx, stmt, u.ID)
 	if err != nil {
-		return err
+		return deleteUserError(err)
 	}
 
 	return nil
@@ -247,12 +344,23 @@ func (u *User) DeleteByID(id int) error {
 
 	_, err := db.ExecContext(ctx, stmt, id)
 	if err != nil {
-		return err
+		return deleteUserError(err)
 	}
 
 	return nil
 }
 
+// deleteUserError returns ErrUserHasInvoices if deleting a user failed because their
+// invoices still refer to them, and err otherwise
+func deleteUserError(err error) error {
+	var pgErr *pgconn.PgError
+	// 23503 is foreign_key_violation
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+		return ErrUserHasInvoices
+	}
+	return err
+}
+
 // Insert inserts a new user into the database, and returns the ID of the newly inserted row
 func (u *User) Insert(user User) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
@@ -263,9 +371,13 @@ func (u *User) Insert(user User) (int, error) {
 		return 0, err
 	}
 
+	if user.Currency == "" {
+		user.Currency = DefaultCurrency
+	}
+
 	var newID int
-	stmt := `insert into users (email, first_name, last_name, password, user_active, created_at, updated_at)
-		values ($1, $2, $3, $4, $5, $6, $7) returning id`
+	stmt := `insert into users (email, first_name, last_name, password, user_active, currency, locale, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id`
 
 	err = db.QueryRowContext(ctx, stmt,
 		user.Email,
@@ -273,6 +385,8 @@ func (u *User) Insert(user User) (int, error) {
 		user.LastName,
 		hashedPassword,
 		user.Active,
+		user.Currency,
+		user.Locale,
 		time.Now(),
 		time.Now(),
 	).Scan(&newID)
@@ -284,8 +398,60 @@ func (u *User) Insert(user User) (int, error) {
 	return newID, nil
 }
 
-// ResetPassword is the method we will use to change a user's password.
-func (u *User) ResetPassword(password string) error {
+// UpdatePaymentDetails stores the payment provider customer and payment method of a user
+func (u *User) UpdatePaymentDetails(user User) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update users set payment_customer_id = $1, payment_method_id = $2, updated_at = $3 where id = $4`
+
+	_, err := db.ExecContext(ctx, stmt, user.PaymentCustomerID, user.PaymentMethodID, time.Now(), user.ID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UpdateBillingDetails stores the billing address and tax ID of a user, and whether the
+// tax ID has been verified
+func (u *User) UpdateBillingDetails(user User) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update users set
+		address_line1 = $1,
+		address_line2 = $2,
+		city = $3,
+		region = $4,
+		postal_code = $5,
+		country = $6,
+		tax_id = $7,
+		tax_id_verified = $8,
+		updated_at = $9
+		where id = $10`
+
+	_, err := db.ExecContext(ctx, stmt,
+		user.AddressLine1,
+		user.AddressLine2,
+		user.City,
+		user.Region,
+		user.PostalCode,
+		user.Country,
+		user.TaxID,
+		user.TaxIDVerified,
+		time.Now(),
+		user.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ResetPassword is the method we will use to change the password of the user with id.
+func (u *User) ResetPassword(id int, password string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
@@ -295,7 +461,7 @@ func (u *User) ResetPassword(password string) error {
 	}
 
 	stmt := `update users set password = $1 where id = $2`
-	_, err = db.ExecContext(ctx, stmt, hashedPassword, u.ID)
+	_, err = db.ExecContext(ctx, stmt, hashedPassword, id)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,51 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// WebhookEvent is an event received from the payment provider. Events are stored by their
+// provider id so that a delivery we have already handled is ignored when it is replayed.
+type WebhookEvent struct {
+	ID         string
+	Type       string
+	ReceivedAt time.Time
+}
+
+// Record stores an event, and reports whether it is new. An event that has already been
+// recorded is left untouched.
+func (e *WebhookEvent) Record(event WebhookEvent) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into webhook_events (id, type, received_at) values ($1, $2, $3)
+		on conflict (id) do nothing`
+
+	result, err := db.ExecContext(ctx, stmt, event.ID, event.Type, time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return inserted == 1, nil
+}
+
+// Delete forgets an event, so that the provider's next delivery of it is handled again
+func (e *WebhookEvent) Delete(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `delete from webhook_events where id = $1`
+
+	_, err := db.ExecContext(ctx, stmt, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,24 @@
+-- subscriptions replaces the delete-and-insert user_plans table. Rows are never
+-- deleted so the table also holds the plan history of every user.
+create table if not exists subscriptions (
+    id                   serial primary key,
+    user_id              integer     not null references users (id) on delete cascade,
+    plan_id              integer     not null references plans (id),
+    previous_plan_id     integer references plans (id),
+    status               varchar(20) not null default 'active',
+    current_period_start timestamp   not null,
+    current_period_end   timestamp   not null,
+    cancel_at_period_end boolean     not null default false,
+    canceled_at          timestamp,
+    ended_at             timestamp,
+    created_at           timestamp   not null default now(),
+    updated_at           timestamp   not null default now()
+);
+
+create index if not exists subscriptions_user_id_idx on subscriptions (user_id, created_at desc);
+
+-- carry over existing subscribers as active subscriptions
+insert into subscriptions (user_id, plan_id, status, current_period_start, current_period_end, created_at, updated_at)
+select up.user_id, up.plan_id, 'active', up.created_at, up.created_at + interval '1 month', up.created_at, up.updated_at
+from user_plans up
+where not exists (select 1 from subscriptions s where s.user_id = up.user_id);
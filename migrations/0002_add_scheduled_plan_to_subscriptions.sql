@@ -0,0 +1,6 @@
+-- plan changes made "at period end" are parked here until the subscription renews
+alter table subscriptions add column if not exists scheduled_plan_id integer references plans (id);
+
+-- a plan change that credits more than it charges leaves the difference here, to be
+-- taken off the next invoices
+alter table subscriptions add column if not exists credit_balance integer not null default 0;
@@ -0,0 +1,38 @@
+create sequence if not exists invoice_number_seq;
+
+create table if not exists invoices (
+    id              serial primary key,
+    number          varchar(32) not null unique,
+    user_id         integer     not null references users (id) on delete restrict,
+    subscription_id integer references subscriptions (id),
+    status          varchar(10) not null default 'draft',
+    subtotal        integer     not null default 0,
+    tax             integer     not null default 0,
+    total           integer     not null default 0,
+    issued_at       timestamp   not null,
+    due_at          timestamp   not null,
+    paid_at         timestamp,
+    -- set on the invoices issued when a period ends, for the renewal or the last usage,
+    -- to the start of the next period; each is issued at most once
+    period_start    timestamp,
+    created_at      timestamp   not null default now(),
+    updated_at      timestamp   not null default now()
+);
+
+create index if not exists invoices_user_id_idx on invoices (user_id, issued_at desc);
+
+create unique index if not exists invoices_subscription_period_idx on invoices (subscription_id, period_start)
+    where period_start is not null and status <> 'void';
+
+create table if not exists invoice_lines (
+    id          serial primary key,
+    invoice_id  integer      not null references invoices (id) on delete cascade,
+    kind        varchar(20)  not null default 'item',
+    description varchar(255) not null,
+    quantity    integer      not null default 1,
+    unit_amount integer      not null,
+    amount      integer      not null,
+    created_at  timestamp    not null default now()
+);
+
+create index if not exists invoice_lines_invoice_id_idx on invoice_lines (invoice_id);
@@ -0,0 +1,15 @@
+alter table plans add column if not exists currency varchar(3) not null default 'USD';
+alter table users add column if not exists currency varchar(3) not null default 'USD';
+alter table subscriptions add column if not exists currency varchar(3) not null default 'USD';
+alter table invoices add column if not exists currency varchar(3) not null default 'USD';
+
+-- prices of a plan in currencies other than plans.currency
+create table if not exists plan_prices (
+    id         serial primary key,
+    plan_id    integer    not null references plans (id) on delete cascade,
+    currency   varchar(3) not null,
+    amount     integer    not null,
+    created_at timestamp  not null default now(),
+    updated_at timestamp  not null default now(),
+    unique (plan_id, currency)
+);
@@ -0,0 +1,4 @@
+alter table plans add column if not exists billing_interval varchar(10) not null default 'month';
+alter table plans add column if not exists interval_count integer not null default 1;
+
+create index if not exists subscriptions_renewal_idx on subscriptions (status, current_period_end);
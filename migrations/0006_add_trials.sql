@@ -0,0 +1,4 @@
+alter table plans add column if not exists trial_days integer not null default 0;
+
+alter table subscriptions add column if not exists trial_end timestamp;
+alter table subscriptions add column if not exists trial_reminder_sent_at timestamp;
@@ -0,0 +1,17 @@
+alter table users add column if not exists payment_customer_id varchar(255) not null default '';
+alter table users add column if not exists payment_method_id varchar(255) not null default '';
+
+create table if not exists payments (
+    id                 serial primary key,
+    user_id            integer      not null references users (id) on delete cascade,
+    invoice_id         integer      not null references invoices (id),
+    provider_charge_id varchar(255) not null default '',
+    amount             integer      not null,
+    currency           varchar(3)   not null,
+    status             varchar(20)  not null,
+    failure_message    varchar(255) not null default '',
+    created_at         timestamp    not null default now(),
+    updated_at         timestamp    not null default now()
+);
+
+create index if not exists payments_provider_charge_id_idx on payments (provider_charge_id);
@@ -0,0 +1,5 @@
+create table if not exists webhook_events (
+    id          varchar(255) primary key,
+    type        varchar(100) not null,
+    received_at timestamp    not null default now()
+);
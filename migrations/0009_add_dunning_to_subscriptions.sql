@@ -0,0 +1,6 @@
+alter table subscriptions add column if not exists past_due_since timestamp;
+alter table subscriptions add column if not exists payment_attempts integer not null default 0;
+alter table subscriptions add column if not exists next_payment_attempt_at timestamp;
+
+create index if not exists subscriptions_next_payment_attempt_idx
+    on subscriptions (next_payment_attempt_at) where status = 'past_due';
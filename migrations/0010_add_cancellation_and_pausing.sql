@@ -0,0 +1,10 @@
+alter table subscriptions add column if not exists paused_at timestamp;
+
+create table if not exists cancellation_feedback (
+    id              serial primary key,
+    user_id         integer     not null references users (id) on delete cascade,
+    subscription_id integer     not null references subscriptions (id),
+    reason          varchar(50) not null default '',
+    comment         text        not null default '',
+    created_at      timestamp   not null default now()
+);
@@ -0,0 +1,34 @@
+create table if not exists coupons (
+    id               serial primary key,
+    code             varchar(50) not null unique,
+    percent_off      integer     not null default 0,
+    amount_off       integer     not null default 0,
+    currency         varchar(3)  not null default 'USD',
+    duration         varchar(20) not null default 'once',
+    duration_periods integer     not null default 0,
+    max_redemptions  integer     not null default 0,
+    times_redeemed   integer     not null default 0,
+    expires_at       timestamp,
+    active           boolean     not null default true,
+    created_at       timestamp   not null default now(),
+    updated_at       timestamp   not null default now(),
+    check (percent_off between 0 and 100),
+    check (amount_off >= 0)
+);
+
+-- the plans a coupon is restricted to; a coupon without rows here applies to every plan
+create table if not exists coupon_plans (
+    coupon_id integer not null references coupons (id) on delete cascade,
+    plan_id   integer not null references plans (id) on delete cascade,
+    primary key (coupon_id, plan_id)
+);
+
+create table if not exists coupon_redemptions (
+    id              serial primary key,
+    coupon_id       integer   not null references coupons (id),
+    user_id         integer   not null references users (id) on delete cascade,
+    invoice_id      integer references invoices (id),
+    periods_applied integer   not null default 0,
+    created_at      timestamp not null default now(),
+    unique (coupon_id, user_id)
+);
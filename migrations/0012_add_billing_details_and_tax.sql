@@ -0,0 +1,13 @@
+alter table users add column if not exists address_line1 varchar(255) not null default '';
+alter table users add column if not exists address_line2 varchar(255) not null default '';
+alter table users add column if not exists city varchar(255) not null default '';
+alter table users add column if not exists region varchar(50) not null default '';
+alter table users add column if not exists postal_code varchar(20) not null default '';
+alter table users add column if not exists country varchar(2) not null default '';
+alter table users add column if not exists tax_id varchar(50) not null default '';
+-- set once an administrator has checked the tax ID of a user; until then tax is not
+-- reverse charged
+alter table users add column if not exists tax_id_verified boolean not null default false;
+
+-- set when the prices on the invoice include its tax
+alter table invoices add column if not exists tax_inclusive boolean not null default false;
@@ -0,0 +1 @@
+alter table plans add column if not exists archived boolean not null default false;
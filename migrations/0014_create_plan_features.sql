@@ -0,0 +1,11 @@
+-- the features each plan includes; limit_value is null for a feature without a limit
+create table if not exists plan_features (
+    id          serial primary key,
+    plan_id     integer     not null references plans (id) on delete cascade,
+    feature     varchar(50) not null,
+    limit_value integer,
+    created_at  timestamp   not null default now(),
+    updated_at  timestamp   not null default now(),
+    unique (plan_id, feature),
+    check (limit_value >= 0)
+);
@@ -0,0 +1,48 @@
+-- what plans charge per unit of usage; mode is tiered or volume
+create table if not exists metered_prices (
+    id         serial primary key,
+    plan_id    integer     not null references plans (id) on delete cascade,
+    metric     varchar(50) not null,
+    currency   varchar(3)  not null default 'USD',
+    mode       varchar(10) not null default 'tiered',
+    created_at timestamp   not null default now(),
+    updated_at timestamp   not null default now(),
+    unique (plan_id, metric, currency),
+    check (mode in ('tiered', 'volume'))
+);
+
+-- the tiers of a metered price; the last tier has no up_to and takes every unit left
+create table if not exists metered_price_tiers (
+    id               serial primary key,
+    metered_price_id integer not null references metered_prices (id) on delete cascade,
+    up_to            integer,
+    unit_amount      integer not null default 0,
+    flat_amount      integer not null default 0,
+    unique (metered_price_id, up_to),
+    check (up_to > 0),
+    check (unit_amount >= 0 and flat_amount >= 0)
+);
+
+create table if not exists usage_records (
+    id              serial primary key,
+    user_id         integer      not null references users (id) on delete cascade,
+    subscription_id integer      not null references subscriptions (id) on delete cascade,
+    metric          varchar(50)  not null,
+    quantity        integer      not null,
+    idempotency_key varchar(100) not null,
+    recorded_at     timestamp    not null,
+    created_at      timestamp    not null default now(),
+    unique (user_id, idempotency_key),
+    check (quantity > 0)
+);
+
+create index if not exists usage_records_user_id_recorded_at_idx on usage_records (user_id, recorded_at);
+
+create table if not exists api_keys (
+    id           serial primary key,
+    user_id      integer     not null unique references users (id) on delete cascade,
+    key_hash     varchar(64) not null unique,
+    hint         varchar(10) not null,
+    created_at   timestamp   not null default now(),
+    last_used_at timestamp
+);
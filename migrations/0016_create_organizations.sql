@@ -0,0 +1,37 @@
+-- plans priced per seat charge their amount once for every member of the organization
+alter table plans add column if not exists per_seat boolean not null default false;
+
+-- the number of seats a subscription is charged for; 1 unless its plan is priced per seat
+alter table subscriptions add column if not exists quantity integer not null default 1;
+
+-- organizations share the subscription of their owner among their members
+create table if not exists organizations (
+    id         serial primary key,
+    name       varchar(255) not null,
+    owner_id   integer      not null unique references users (id) on delete cascade,
+    created_at timestamp    not null default now(),
+    updated_at timestamp    not null default now()
+);
+
+-- a user belongs to one organization at most; the owner is a member with the owner role
+create table if not exists organization_members (
+    id              serial primary key,
+    organization_id integer     not null references organizations (id) on delete cascade,
+    user_id         integer     not null unique references users (id) on delete cascade,
+    role            varchar(10) not null default 'member',
+    created_at      timestamp   not null default now(),
+    check (role in ('owner', 'billing', 'member'))
+);
+
+create table if not exists organization_invitations (
+    id              serial primary key,
+    organization_id integer      not null references organizations (id) on delete cascade,
+    email           varchar(255) not null,
+    role            varchar(10)  not null default 'member',
+    invited_by      integer      not null references users (id) on delete cascade,
+    accepted_at     timestamp,
+    created_at      timestamp    not null default now(),
+    check (role in ('billing', 'member'))
+);
+
+create index if not exists organization_invitations_organization_id_idx on organization_invitations (organization_id);
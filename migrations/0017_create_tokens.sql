@@ -0,0 +1,17 @@
+-- single use tokens we email as part of links; only a hash of each token is stored
+create table if not exists tokens (
+    id          serial primary key,
+    token_hash  varchar(64)  not null unique,
+    purpose     varchar(20)  not null,
+    user_id     integer references users (id) on delete cascade,
+    email       varchar(255) not null default '',
+    subject_id  integer,
+    expires_at  timestamp    not null,
+    consumed_at timestamp,
+    revoked_at  timestamp,
+    created_at  timestamp    not null default now(),
+    check (purpose in ('activation', 'password_reset', 'email_change', 'invitation'))
+);
+
+create index if not exists tokens_user_id_purpose_idx on tokens (user_id, purpose);
+create index if not exists tokens_subject_id_purpose_idx on tokens (subject_id, purpose);
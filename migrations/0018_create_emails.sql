@@ -0,0 +1,25 @@
+-- the outbox: emails are stored rendered before they are sent, and retried until they
+-- are sent or have had too many attempts, when they are marked dead
+create table if not exists emails (
+    id              serial primary key,
+    from_address    varchar(255) not null,
+    from_name       varchar(255) not null default '',
+    to_addresses    jsonb        not null,
+    subject         varchar(255) not null,
+    plain_body      text         not null default '',
+    html_body       text         not null default '',
+    -- the base64 encoded contents of each attached file by its name, as the file may be
+    -- gone by the time the email is sent
+    attachments     jsonb        not null default '{}',
+    status          varchar(10)  not null default 'pending',
+    attempts        integer      not null default 0,
+    next_attempt_at timestamp    not null default now(),
+    last_error      text         not null default '',
+    sent_at         timestamp,
+    created_at      timestamp    not null default now(),
+    updated_at      timestamp    not null default now(),
+    check (status in ('pending', 'sending', 'sent', 'dead'))
+);
+
+-- the emails waiting to be sent, in the order they are due
+create index if not exists emails_due_idx on emails (next_attempt_at) where status in ('pending', 'sending');
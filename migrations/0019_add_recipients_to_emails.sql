@@ -0,0 +1,5 @@
+-- emails can be copied to more recipients, name where replies go and carry extra headers
+alter table emails add column if not exists cc_addresses jsonb not null default '[]';
+alter table emails add column if not exists bcc_addresses jsonb not null default '[]';
+alter table emails add column if not exists reply_to varchar(255) not null default '';
+alter table emails add column if not exists headers jsonb not null default '{}';
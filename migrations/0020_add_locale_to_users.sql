@@ -0,0 +1,2 @@
+-- the language a user reads the site and their email in; blank means their browser's
+alter table users add column if not exists locale varchar(10) not null default '';